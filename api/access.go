@@ -0,0 +1,250 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/mna/lune/types"
+	"github.com/mna/lune/vm"
+)
+
+/*
+  Access functions (stack -> Go) and push functions (Go -> stack)
+*/
+
+// Returns the type of the value at the acceptable index idx, types.TNONE if
+// there is none. See lua_type.
+func Type(s *types.State, idx int) types.ValType {
+	p := index2addr(s, idx)
+	if p == nil {
+		return types.TNONE
+	}
+	return types.TypeOf(*p)
+}
+
+// Returns the name of the type t. See lua_typename.
+func TypeName(s *types.State, t types.ValType) string {
+	return t.String()
+}
+
+// See lua_isnumber.
+func IsNumber(s *types.State, idx int) bool {
+	_, ok := ToNumber(s, idx)
+	return ok
+}
+
+// Returns true for strings and numbers, which are convertible to strings.
+// See lua_isstring.
+func IsString(s *types.State, idx int) bool {
+	t := Type(s, idx)
+	return t == types.TSTRING || t == types.TNUMBER
+}
+
+// See lua_iscfunction.
+func IsGoFunction(s *types.State, idx int) bool {
+	switch get(s, idx).(type) {
+	case *types.GoClosure:
+		return true
+	}
+	return false
+}
+
+// Returns true for full and light userdata. See lua_isuserdata.
+func IsUserdata(s *types.State, idx int) bool {
+	t := Type(s, idx)
+	return t == types.TUSERDATA || t == types.TLIGHTUSERDATA
+}
+
+// See lua_isfunction.
+func IsFunction(s *types.State, idx int) bool {
+	return Type(s, idx) == types.TFUNCTION
+}
+
+// See lua_istable.
+func IsTable(s *types.State, idx int) bool {
+	return Type(s, idx) == types.TTABLE
+}
+
+// See lua_islightuserdata.
+func IsLightUserdata(s *types.State, idx int) bool {
+	return Type(s, idx) == types.TLIGHTUSERDATA
+}
+
+// See lua_isnil.
+func IsNil(s *types.State, idx int) bool {
+	return Type(s, idx) == types.TNIL
+}
+
+// See lua_isboolean.
+func IsBoolean(s *types.State, idx int) bool {
+	return Type(s, idx) == types.TBOOL
+}
+
+// See lua_isthread.
+func IsThread(s *types.State, idx int) bool {
+	return Type(s, idx) == types.TTHREAD
+}
+
+// See lua_isnone.
+func IsNone(s *types.State, idx int) bool {
+	return Type(s, idx) == types.TNONE
+}
+
+// See lua_isnoneornil.
+func IsNoneOrNil(s *types.State, idx int) bool {
+	return get(s, idx) == nil
+}
+
+// Returns the value at index idx as a number, converting strings like Lua's
+// arithmetic. Returns false if it is not convertible. See lua_tonumberx.
+func ToNumber(s *types.State, idx int) (float64, bool) {
+	switch v := get(s, idx).(type) {
+	case float64:
+		return v, true
+	case string:
+		return types.StrToNumber(v)
+	}
+	return 0, false
+}
+
+// Like ToNumber, but truncates the number to an integer. See lua_tointegerx.
+func ToInteger(s *types.State, idx int) (int, bool) {
+	n, ok := ToNumber(s, idx)
+	return int(n), ok
+}
+
+// Returns false for nil and false, true for any other value, including none.
+// See lua_toboolean.
+func ToBoolean(s *types.State, idx int) bool {
+	v := get(s, idx)
+	return v != nil && v != false
+}
+
+// Returns the value at index idx as a string, false if it is neither a string
+// nor a number. A number is converted in place, the value in the stack is
+// then a string. See lua_tolstring.
+func ToString(s *types.State, idx int) (string, bool) {
+	switch v := get(s, idx).(type) {
+	case string:
+		return v, true
+	case float64:
+		str := types.NumberToString(v)
+		*index2addr(s, idx) = str
+		return str, true
+	}
+	return "", false
+}
+
+// Returns the Go function at index idx, nil if it is not one. For a Go
+// closure, it is the function without its upvalues. See lua_tocfunction.
+func ToGoFunction(s *types.State, idx int) types.GoFunc {
+	if f, ok := get(s, idx).(*types.GoClosure); ok {
+		return f.F
+	}
+	return nil
+}
+
+// Returns the Go value wrapped by the full or light userdata at index idx,
+// nil if it is not a userdata. See lua_touserdata.
+func ToUserdata(s *types.State, idx int) interface{} {
+	switch v := get(s, idx).(type) {
+	case *types.Userdata:
+		return v.Value
+	case types.LightUserdata:
+		return v.Value
+	}
+	return nil
+}
+
+// Returns the thread at index idx, nil if it is not one. See lua_tothread.
+func ToThread(s *types.State, idx int) *types.Thread {
+	t, _ := get(s, idx).(*types.Thread)
+	return t
+}
+
+// Returns the raw length of the value at index idx: the length of a string,
+// the border of a table, 0 for other values. See lua_rawlen.
+func RawLen(s *types.State, idx int) int {
+	switch v := get(s, idx).(type) {
+	case string:
+		return len(v)
+	case *types.Table:
+		return v.Len()
+	}
+	return 0
+}
+
+// Returns true if the values at indices i1 and i2 are primitively equal,
+// without calling metamethods. Returns false if an index has no value. See
+// lua_rawequal.
+func RawEqual(s *types.State, i1, i2 int) bool {
+	p1, p2 := index2addr(s, i1), index2addr(s, i2)
+	return p1 != nil && p2 != nil && vm.RawEqual(*p1, *p2)
+}
+
+// Pushes the Lua value v.
+func Push(s *types.State, v types.Value) {
+	push(s, v)
+}
+
+// See lua_pushnil.
+func PushNil(s *types.State) {
+	push(s, nil)
+}
+
+// See lua_pushnumber.
+func PushNumber(s *types.State, n float64) {
+	push(s, n)
+}
+
+// See lua_pushinteger.
+func PushInteger(s *types.State, n int) {
+	push(s, float64(n))
+}
+
+// See lua_pushstring.
+func PushString(s *types.State, str string) {
+	push(s, str)
+}
+
+// Pushes a formatted string, and returns it. See lua_pushfstring.
+func PushFString(s *types.State, format string, args ...interface{}) string {
+	str := fmt.Sprintf(format, args...)
+	push(s, str)
+	return str
+}
+
+// See lua_pushboolean.
+func PushBoolean(s *types.State, b bool) {
+	push(s, b)
+}
+
+// Pushes a Go closure of the function f, without upvalues. Each call pushes
+// a distinct function value. See lua_pushcfunction.
+func PushGoFunction(s *types.State, f types.GoFunc) {
+	push(s, types.NewGoClosure(f))
+}
+
+// Pops n values and pushes a Go closure of the function f with these values
+// as upvalues, the first one pushed being upvalue 1. See lua_pushcclosure.
+func PushGoClosure(s *types.State, f types.GoFunc, n int) {
+	if n < 0 || n > GetTop(s) {
+		panic("not enough elements in the stack")
+	}
+	upvals := make([]types.Value, n)
+	copy(upvals, s.Stack[s.Top-n:s.Top])
+	SetTop(s, -n-1)
+	push(s, types.NewGoClosure(f, upvals...))
+}
+
+// See lua_pushlightuserdata.
+func PushLightUserdata(s *types.State, v interface{}) {
+	push(s, types.LightUserdata{Value: v})
+}
+
+// Pushes the thread of the state s, and returns true if it is the main
+// thread. See lua_pushthread.
+func PushThread(s *types.State) bool {
+	t := s.Thread()
+	push(s, t)
+	return t == s.MainThread
+}
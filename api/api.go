@@ -0,0 +1,241 @@
+// Package api is a port of the Lua C API (lua.h) to Go, so that Go functions
+// can work on the stack of a state the way C functions do in Lua. It makes
+// porting C extension modules mostly mechanical.
+//
+// As in Lua, positive indices start at 1 for the first argument of the
+// running Go function (or the bottom of the stack when used from the host,
+// outside of any call), negative indices are relative to the top of the
+// stack, and pseudo-indices give access to the registry (REGISTRYINDEX) and
+// to the upvalues of the running Go function (UpvalueIndex).
+//
+// A Go function using this API pushes its results and returns them with
+// Return, in place of the number of results returned by a C function:
+//
+//	func add(s *types.State, _ []types.Value) []types.Value {
+//		a, _ := api.ToNumber(s, 1)
+//		b, _ := api.ToNumber(s, 2)
+//		api.PushNumber(s, a+b)
+//		return api.Return(s, 1)
+//	}
+package api
+
+import (
+	"fmt"
+
+	"github.com/mna/lune/types"
+)
+
+// Pseudo-index of the registry, see LUA_REGISTRYINDEX.
+const REGISTRYINDEX = types.LUNE_REGISTRYINDEX
+
+// Returns the pseudo-index of the upvalue i (starting at 1) of the running Go
+// function. See lua_upvalueindex.
+func UpvalueIndex(i int) int {
+	return REGISTRYINDEX - i
+}
+
+// Returns the position in the stack of index 1.
+func stackBase(s *types.State) int {
+	if s.CI == nil {
+		return 0
+	}
+	return s.CI.FuncIndex + 1
+}
+
+// Returns a pointer to the value at the acceptable index idx, or nil if there
+// is none: a positive index above the top, or a missing upvalue. Panics if
+// idx is not an acceptable index. See index2addr in lapi.c.
+func index2addr(s *types.State, idx int) *types.Value {
+	switch {
+	case idx > 0:
+		if i := stackBase(s) + idx - 1; i < s.Top {
+			return &s.Stack[i]
+		}
+		return nil
+	case idx > REGISTRYINDEX:
+		// Relative to the top
+		i := s.Top + idx
+		if idx == 0 || i < stackBase(s) {
+			panic(fmt.Sprintf("invalid stack index %d", idx))
+		}
+		return &s.Stack[i]
+	case idx == REGISTRYINDEX:
+		v := types.Value(s.Registry)
+		return &v
+	}
+	return upvalue(s, REGISTRYINDEX-idx)
+}
+
+// Returns a pointer to the upvalue n (starting at 1) of the running Go
+// function, or nil if there is none.
+func upvalue(s *types.State, n int) *types.Value {
+	if s.CI == nil {
+		return nil
+	}
+	if cl, ok := s.Stack[s.CI.FuncIndex].(*types.GoClosure); ok && n <= len(cl.UpVals) {
+		return &cl.UpVals[n-1]
+	}
+	return nil
+}
+
+// Returns the value at the acceptable index idx, nil if there is none.
+func get(s *types.State, idx int) types.Value {
+	if p := index2addr(s, idx); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// Returns the table at index idx, panics if it is not a table.
+func table(s *types.State, idx int) *types.Table {
+	t, ok := get(s, idx).(*types.Table)
+	if !ok {
+		panic(fmt.Sprintf("table expected at index %d", idx))
+	}
+	return t
+}
+
+// Pushes the value v.
+func push(s *types.State, v types.Value) {
+	s.CheckStack(1)
+	s.Stack[s.Top] = v
+	s.Top++
+}
+
+// Removes and returns the value at the top.
+func pop(s *types.State) types.Value {
+	if s.Top <= stackBase(s) {
+		panic("not enough elements in the stack")
+	}
+	s.Top--
+	v := s.Stack[s.Top]
+	s.Stack[s.Top] = nil
+	return v
+}
+
+// Returns the n values at the top of the stack as the results of the running
+// Go function: `return api.Return(s, n)` is the equivalent of `return n` in a
+// C function.
+func Return(s *types.State, n int) []types.Value {
+	if n > GetTop(s) {
+		panic("not enough elements in the stack")
+	}
+	res := make([]types.Value, n)
+	copy(res, s.Stack[s.Top-n:s.Top])
+	return res
+}
+
+/*
+  Basic stack manipulation
+*/
+
+// Returns the absolute (positive) index of the acceptable index idx. See
+// lua_absindex.
+func AbsIndex(s *types.State, idx int) int {
+	if idx > 0 || idx <= REGISTRYINDEX {
+		return idx
+	}
+	return s.Top - stackBase(s) + idx + 1
+}
+
+// Returns the index of the top element, that is the number of elements in the
+// stack. See lua_gettop.
+func GetTop(s *types.State) int {
+	return s.Top - stackBase(s)
+}
+
+// Sets the top to the acceptable index idx, filling new elements with nil or
+// removing the elements above it. See lua_settop.
+func SetTop(s *types.State, idx int) {
+	base := stackBase(s)
+	if idx >= 0 {
+		s.CheckStack(base + idx - s.Top)
+		for ; s.Top < base+idx; s.Top++ {
+			s.Stack[s.Top] = nil
+		}
+		for ; s.Top > base+idx; s.Top-- {
+			s.Stack[s.Top-1] = nil
+		}
+		return
+	}
+	if s.Top+idx+1 < base {
+		panic(fmt.Sprintf("invalid new top %d", idx))
+	}
+	for n := -idx - 1; n > 0; n-- {
+		pop(s)
+	}
+}
+
+// Pops n elements from the stack. See lua_pop.
+func Pop(s *types.State, n int) {
+	SetTop(s, -n-1)
+}
+
+// Pushes a copy of the element at index idx. See lua_pushvalue.
+func PushValue(s *types.State, idx int) {
+	push(s, get(s, idx))
+}
+
+// Removes the element at the valid index idx, shifting down the elements
+// above it. See lua_remove.
+func Remove(s *types.State, idx int) {
+	i := stackIndex(s, idx)
+	copy(s.Stack[i:], s.Stack[i+1:s.Top])
+	s.Top--
+	s.Stack[s.Top] = nil
+}
+
+// Moves the top element into the valid index idx, shifting up the elements
+// above it. See lua_insert.
+func Insert(s *types.State, idx int) {
+	i := stackIndex(s, idx)
+	v := s.Stack[s.Top-1]
+	copy(s.Stack[i+1:s.Top], s.Stack[i:s.Top-1])
+	s.Stack[i] = v
+}
+
+// Pops the top element and sets it at the index idx, without shifting. See
+// lua_replace.
+func Replace(s *types.State, idx int) {
+	Copy(s, -1, idx)
+	pop(s)
+}
+
+// Copies the element at index from to the valid index to, replacing its
+// value. See lua_copy.
+func Copy(s *types.State, from, to int) {
+	if to == REGISTRYINDEX {
+		panic("cannot replace the registry")
+	}
+	p := index2addr(s, to)
+	if p == nil {
+		panic(fmt.Sprintf("invalid index %d", to))
+	}
+	*p = get(s, from)
+}
+
+// Makes sure that the stack has room for n more elements. Returns false if it
+// can't grow that much. See lua_checkstack.
+func CheckStack(s *types.State, n int) bool {
+	if s.Top+n > types.LUNE_MAXSTACK {
+		return false
+	}
+	s.CheckStack(n)
+	if ci := s.CI; ci != nil && ci.Top < s.Top+n {
+		ci.Top = s.Top + n
+	}
+	return true
+}
+
+// Returns the position in the stack of the valid stack index idx, panics if
+// it is not one.
+func stackIndex(s *types.State, idx int) int {
+	i := s.Top + idx
+	if idx > 0 {
+		i = stackBase(s) + idx - 1
+	}
+	if idx == 0 || idx <= REGISTRYINDEX || i < stackBase(s) || i >= s.Top {
+		panic(fmt.Sprintf("invalid stack index %d", idx))
+	}
+	return i
+}
@@ -0,0 +1,271 @@
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mna/lune/compiler"
+	"github.com/mna/lune/stdlib"
+	"github.com/mna/lune/types"
+	"github.com/mna/lune/vm"
+)
+
+// Asserts the values of the stack, from index 1 to the top.
+func assertStack(t *testing.T, name string, s *types.State, exp ...types.Value) {
+	if n := GetTop(s); n != len(exp) {
+		t.Errorf("%s: expected %d values in the stack, got %d", name, len(exp), n)
+		return
+	}
+	for i, v := range exp {
+		if got := get(s, i+1); got != v {
+			t.Errorf("%s: expected value at %d to be %v, got %v", name, i+1, v, got)
+		}
+	}
+}
+
+func TestStack(t *testing.T) {
+	s := types.NewState(nil)
+
+	PushInteger(s, 1)
+	PushString(s, "b")
+	PushBoolean(s, true)
+	PushNil(s)
+	assertStack(t, "push", s, 1.0, "b", true, nil)
+	if Type(s, 4) != types.TNIL || Type(s, 5) != types.TNONE || !IsNone(s, 5) || !IsNoneOrNil(s, -1) {
+		t.Error("expected index 4 to be nil and index 5 to have no value")
+	}
+	if n := AbsIndex(s, -2); n != 3 {
+		t.Errorf("expected absolute index 3, got %d", n)
+	}
+
+	Insert(s, 2)
+	assertStack(t, "insert", s, 1.0, nil, "b", true)
+	Remove(s, 2)
+	assertStack(t, "remove", s, 1.0, "b", true)
+	PushValue(s, 1)
+	Replace(s, 3)
+	assertStack(t, "replace", s, 1.0, "b", 1.0)
+	Copy(s, 2, -1)
+	assertStack(t, "copy", s, 1.0, "b", "b")
+	SetTop(s, 5)
+	assertStack(t, "settop up", s, 1.0, "b", "b", nil, nil)
+	SetTop(s, -4)
+	assertStack(t, "settop down", s, 1.0, "b")
+
+	// Conversions
+	if str, ok := ToString(s, 1); !ok || str != "1" || !IsString(s, 1) {
+		t.Errorf("expected 1 to convert to a string, got %q", str)
+	}
+	assertStack(t, "tostring", s, "1", "b")
+	if n, ok := ToInteger(s, 1); !ok || n != 1 {
+		t.Errorf("expected \"1\" to convert to a number, got %d", n)
+	}
+	if _, ok := ToNumber(s, 2); ok || ToBoolean(s, 3) || !ToBoolean(s, 2) {
+		t.Error("unexpected conversion of \"b\"")
+	}
+	Pop(s, 2)
+	assertStack(t, "pop", s)
+
+	// Pseudo-indices
+	RawGetI(s, REGISTRYINDEX, types.LUNE_RIDX_GLOBALS)
+	if !RawEqual(s, -1, -1) || get(s, -1) != s.Globals {
+		t.Error("expected the globals table in the registry")
+	}
+	if !PushThread(s) || ToThread(s, -1) != s.MainThread {
+		t.Error("expected the main thread")
+	}
+	if !IsNone(s, UpvalueIndex(1)) {
+		t.Error("expected no upvalue")
+	}
+	Pop(s, 2)
+
+	// Tables
+	CreateTable(s, 0, 1)
+	PushNumber(s, 42)
+	SetField(s, 1, "x")
+	PushString(s, "y")
+	PushString(s, "z")
+	RawSet(s, -3)
+	GetField(s, 1, "x")
+	PushString(s, "y")
+	GetTable(s, 1)
+	RawGetI(s, 1, 1)
+	assertStack(t, "tables", s, get(s, 1), 42.0, "z", nil)
+	if RawLen(s, 1) != 0 || RawLen(s, 3) != 1 {
+		t.Error("unexpected raw lengths")
+	}
+}
+
+// Compiles and runs src with the standard libraries and the Go functions fns,
+// and returns its state.
+func runSource(t *testing.T, name, src string, fns map[string]types.GoFunc) (*types.State, error) {
+	p, err := compiler.Compile(strings.NewReader(src), "="+name)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	s := types.NewState(p)
+	stdlib.OpenLibs(s)
+	for k, f := range fns {
+		s.Globals.Set(k, types.NewGoClosure(f))
+	}
+	return s, vm.Execute(s)
+}
+
+func TestGoFunctions(t *testing.T) {
+	fns := map[string]types.GoFunc{
+		// Returns the sum and the number of its arguments
+		"sum": func(s *types.State, _ []types.Value) []types.Value {
+			n := GetTop(s)
+			var sum float64
+			for i := 1; i <= n; i++ {
+				v, ok := ToNumber(s, i)
+				if !ok {
+					PushFString(s, "bad argument #%d to 'sum' (number expected, got %s)", i, TypeName(s, Type(s, i)))
+					Error(s)
+				}
+				sum += v
+			}
+			PushNumber(s, sum)
+			PushInteger(s, n)
+			return Return(s, 2)
+		},
+		// Calls f(x) and returns the field 'v' of its result
+		"callv": func(s *types.State, _ []types.Value) []types.Value {
+			SetTop(s, 2)
+			Call(s, 1, 1)
+			GetField(s, -1, "v")
+			return Return(s, 1)
+		},
+		// Calls f in protected mode, returns its result or the error with a prefix
+		"try": func(s *types.State, _ []types.Value) []types.Value {
+			PushGoFunction(s, func(s *types.State, args []types.Value) []types.Value {
+				return []types.Value{"handled: " + args[0].(string)}
+			})
+			Insert(s, 1)
+			if err := PCall(s, GetTop(s)-2, types.LUNE_MULTRET, 1); err != nil {
+				PushBoolean(s, false)
+				Insert(s, -2)
+				return Return(s, 2)
+			}
+			return Return(s, GetTop(s)-1)
+		},
+		// Sets the global g.count, counting the calls
+		"count": func(s *types.State, _ []types.Value) []types.Value {
+			GetGlobal(s, "g")
+			GetField(s, -1, "count")
+			n, _ := ToInteger(s, -1)
+			PushInteger(s, n+1)
+			SetField(s, -3, "count")
+			return nil
+		},
+	}
+
+	cases := []struct {
+		name string
+		src  string
+		exp  map[string]types.Value
+	}{
+		{"sum", `a, b = sum(1, "2", 3) ; c, d = sum()`,
+			map[string]types.Value{"a": 6.0, "b": 3.0, "c": 0.0, "d": 0.0}},
+		{"error", `a, b = pcall(sum, 1, {})`,
+			map[string]types.Value{"a": false, "b": "bad argument #2 to 'sum' (number expected, got table)"}},
+		{"call", `
+a = callv(function(x) return {v = x * 2} end, 21)
+b = callv(function() return debug.setmetatable({}, {__index = function(t, k) return k end}) end)`,
+			map[string]types.Value{"a": 42.0, "b": "v"}},
+		{"pcall", `
+a, b = try(function(x, y) return x + y end, 1, 2)
+c, d = try(function() error("oops", 0) end)`,
+			map[string]types.Value{"a": 3.0, "b": nil, "c": false, "d": "handled: oops"}},
+		{"globals", `
+g = {count = 0}
+count() ; count()
+a = g.count`,
+			map[string]types.Value{"a": 2.0}},
+	}
+
+	for _, c := range cases {
+		s, err := runSource(t, c.name, c.src, fns)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		for k, v := range c.exp {
+			if got := s.Globals.Get(k); got != v {
+				t.Errorf("%s: expected %s to be %v, got %v", c.name, k, v, got)
+			}
+		}
+	}
+}
+
+func TestGoClosures(t *testing.T) {
+	// Returns a counter, a Go closure that increments its upvalue
+	newCounter := func(s *types.State, _ []types.Value) []types.Value {
+		SetTop(s, 1)
+		PushGoClosure(s, func(s *types.State, _ []types.Value) []types.Value {
+			n, _ := ToInteger(s, UpvalueIndex(1))
+			PushInteger(s, n+1)
+			Copy(s, -1, UpvalueIndex(1))
+			return Return(s, 1)
+		}, 1)
+		return Return(s, 1)
+	}
+	s, err := runSource(t, "closures", `
+local c1, c2 = newCounter(10), newCounter()
+c1() ; c1()
+a, b = c1(), c2()
+c = c1 ~= c2`, map[string]types.GoFunc{"newCounter": newCounter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]types.Value{"a": 13.0, "b": 1.0, "c": true} {
+		if got := s.Globals.Get(k); got != v {
+			t.Errorf("expected %s to be %v, got %v", k, v, got)
+		}
+	}
+
+	// Pushing a closure pops its upvalues
+	PushString(s, "x")
+	PushString(s, "y")
+	PushGoClosure(s, newCounter, 2)
+	if cl, ok := get(s, -1).(*types.GoClosure); !ok || GetTop(s) != 1 || len(cl.UpVals) != 2 || cl.UpVals[0] != "x" {
+		t.Errorf("unexpected closure %v", get(s, -1))
+	}
+	if !IsGoFunction(s, -1) || ToGoFunction(s, -1) == nil || Type(s, -1) != types.TFUNCTION {
+		t.Error("expected a Go function")
+	}
+}
+
+func TestRefs(t *testing.T) {
+	s := types.NewState(nil)
+	tbl := types.NewTable(0, 0)
+
+	Push(s, tbl)
+	r1 := Ref(s, REGISTRYINDEX)
+	PushString(s, "v")
+	r2 := Ref(s, REGISTRYINDEX)
+	PushNil(s)
+	if r := Ref(s, REGISTRYINDEX); r != REFNIL {
+		t.Errorf("expected REFNIL for nil, got %d", r)
+	}
+	if r1 == r2 || r1 <= types.LUNE_RIDX_GLOBALS || GetTop(s) != 0 {
+		t.Errorf("unexpected references %d and %d", r1, r2)
+	}
+	RawGetI(s, REGISTRYINDEX, r1)
+	RawGetI(s, REGISTRYINDEX, r2)
+	assertStack(t, "refs", s, tbl, "v")
+	SetTop(s, 0)
+
+	// Released references are reused
+	Unref(s, REGISTRYINDEX, r1)
+	RawGetI(s, REGISTRYINDEX, r1)
+	if IsTable(s, -1) {
+		t.Error("expected the value to be released")
+	}
+	PushBoolean(s, true)
+	if r3 := Ref(s, REGISTRYINDEX); r3 != r1 {
+		t.Errorf("expected reference %d to be reused, got %d", r1, r3)
+	}
+	Unref(s, REGISTRYINDEX, REFNIL)
+	Unref(s, REGISTRYINDEX, NOREF)
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"github.com/mna/lune/types"
+	"github.com/mna/lune/vm"
+)
+
+/*
+  Calls and errors
+*/
+
+// Pops the function to call and its nArgs arguments, pushed in order, and
+// returns them.
+func popCall(s *types.State, nArgs int) (types.Value, []types.Value) {
+	fIdx := s.Top - nArgs - 1
+	if nArgs < 0 || fIdx < stackBase(s) {
+		panic("not enough elements in the stack")
+	}
+	f := s.Stack[fIdx]
+	args := make([]types.Value, nArgs)
+	copy(args, s.Stack[fIdx+1:s.Top])
+	SetTop(s, -nArgs-2)
+	return f, args
+}
+
+// Pushes the results of a call, adjusted to nResults unless it is
+// types.LUNE_MULTRET.
+func pushResults(s *types.State, res []types.Value, nResults int) {
+	if nResults != types.LUNE_MULTRET {
+		for len(res) < nResults {
+			res = append(res, nil)
+		}
+		res = res[:nResults]
+	}
+	s.CheckStack(len(res))
+	for _, v := range res {
+		push(s, v)
+	}
+}
+
+// Calls a function: pops the function and its nArgs arguments, pushed in
+// order, and pushes nResults results, or all of them if nResults is
+// types.LUNE_MULTRET. Errors are propagated. See lua_call.
+func Call(s *types.State, nArgs, nResults int) {
+	f, args := popCall(s, nArgs)
+	pushResults(s, vm.Call(s, f, args...), nResults)
+}
+
+// Calls a function in protected mode, like Call. If it raises an error, only
+// the error value is pushed, and it is returned as a *vm.RuntimeError. If
+// msgh is not 0, it is the index of the message handler, called with the
+// error value. See lua_pcall.
+func PCall(s *types.State, nArgs, nResults, msgh int) error {
+	var h types.Value
+	if msgh != 0 {
+		h = get(s, msgh)
+	}
+	f, args := popCall(s, nArgs)
+	res, err := vm.PCall(s, f, args, h)
+	if err != nil {
+		push(s, err.(*vm.RuntimeError).Value)
+		return err
+	}
+	pushResults(s, res, nResults)
+	return nil
+}
+
+// Raises an error with the value at the top as error value. See lua_error.
+func Error(s *types.State) {
+	vm.Error(s, get(s, -1))
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"github.com/mna/lune/types"
+)
+
+/*
+  References, a port of luaL_ref and luaL_unref from lauxlib.c. Go code can
+  keep a reference to a Lua value, typically in the registry, and get it back
+  later with RawGetI.
+*/
+
+const (
+	NOREF  = -2 // Never returned by Ref, see LUA_NOREF
+	REFNIL = -1 // Reference to nil, see LUA_REFNIL
+)
+
+// Index of the free list in a table of references.
+const freeList = 0
+
+// Pops the value at the top and stores it in the table at index t, e.g.
+// REGISTRYINDEX, under a new unique integer key, which is returned. If the
+// value is nil, REFNIL is returned and nothing is stored. See luaL_ref.
+func Ref(s *types.State, t int) int {
+	tbl := table(s, t)
+	v := pop(s)
+	if v == nil {
+		return REFNIL
+	}
+	ref := 0
+	if free, ok := tbl.Get(float64(freeList)).(float64); ok && free != 0 {
+		// Reuse a released reference
+		ref = int(free)
+		tbl.Set(float64(freeList), tbl.Get(free))
+	} else {
+		ref = tbl.Len() + 1
+	}
+	tbl.Set(float64(ref), v)
+	return ref
+}
+
+// Releases the reference ref from the table at index t, so that its value can
+// be collected and the reference reused. See luaL_unref.
+func Unref(s *types.State, t, ref int) {
+	if ref < 0 {
+		return
+	}
+	tbl := table(s, t)
+	tbl.Set(float64(ref), tbl.Get(float64(freeList)))
+	tbl.Set(float64(freeList), float64(ref))
+}
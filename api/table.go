@@ -0,0 +1,149 @@
+package api
+
+import (
+	"github.com/mna/lune/types"
+	"github.com/mna/lune/vm"
+)
+
+/*
+  Get functions (Lua -> stack) and set functions (stack -> Lua)
+*/
+
+// Pushes the value of the global name. See lua_getglobal.
+func GetGlobal(s *types.State, name string) {
+	push(s, vm.GetTable(s, s.Globals, name))
+}
+
+// Pushes t[k], where t is the value at index idx and k the value at the top,
+// which is popped. May call the __index metamethod. See lua_gettable.
+func GetTable(s *types.State, idx int) {
+	t := get(s, idx)
+	s.Stack[s.Top-1] = vm.GetTable(s, t, s.Stack[s.Top-1])
+}
+
+// Pushes t[k], where t is the value at index idx. May call the __index
+// metamethod. See lua_getfield.
+func GetField(s *types.State, idx int, k string) {
+	t := get(s, idx)
+	push(s, vm.GetTable(s, t, k))
+}
+
+// Like GetTable, without calling metamethods. See lua_rawget.
+func RawGet(s *types.State, idx int) {
+	t := table(s, idx)
+	s.Stack[s.Top-1] = t.Get(s.Stack[s.Top-1])
+}
+
+// Pushes t[n], where t is the table at index idx, without calling
+// metamethods. See lua_rawgeti.
+func RawGetI(s *types.State, idx, n int) {
+	push(s, table(s, idx).Get(float64(n)))
+}
+
+// Pushes a new empty table, with room for narr array elements and nrec other
+// elements. See lua_createtable.
+func CreateTable(s *types.State, narr, nrec int) {
+	push(s, types.NewTable(narr, nrec))
+}
+
+// Pushes a new empty table. See lua_newtable.
+func NewTable(s *types.State) {
+	CreateTable(s, 0, 0)
+}
+
+// Pushes a new userdata wrapping the Go value v, and returns it. See
+// lua_newuserdata.
+func NewUserdata(s *types.State, v interface{}) *types.Userdata {
+	u := types.NewUserdata(v)
+	push(s, u)
+	return u
+}
+
+// Pushes the metatable of the value at index idx, and returns true. Returns
+// false and pushes nothing if it has no metatable. See lua_getmetatable.
+func GetMetatable(s *types.State, idx int) bool {
+	mt := s.MetaTable(get(s, idx))
+	if mt == nil {
+		return false
+	}
+	push(s, mt)
+	return true
+}
+
+// Pushes the user value of the userdata at index idx, nil if it has none. See
+// lua_getuservalue.
+func GetUservalue(s *types.State, idx int) {
+	var v types.Value
+	if u, ok := get(s, idx).(*types.Userdata); ok && u.UserValue != nil {
+		v = u.UserValue
+	}
+	push(s, v)
+}
+
+// Pops a value and sets it as the value of the global name. See
+// lua_setglobal.
+func SetGlobal(s *types.State, name string) {
+	vm.SetTable(s, s.Globals, name, s.Stack[s.Top-1])
+	pop(s)
+}
+
+// Does t[k] = v, where t is the value at index idx, v the value at the top and
+// k the value just below, and pops them. May call the __newindex metamethod.
+// See lua_settable.
+func SetTable(s *types.State, idx int) {
+	t := get(s, idx)
+	vm.SetTable(s, t, s.Stack[s.Top-2], s.Stack[s.Top-1])
+	pop(s)
+	pop(s)
+}
+
+// Does t[k] = v, where t is the value at index idx and v the value at the top,
+// and pops it. May call the __newindex metamethod. See lua_setfield.
+func SetField(s *types.State, idx int, k string) {
+	t := get(s, idx)
+	vm.SetTable(s, t, k, s.Stack[s.Top-1])
+	pop(s)
+}
+
+// Like SetTable, without calling metamethods. See lua_rawset.
+func RawSet(s *types.State, idx int) {
+	t := table(s, idx)
+	vm.RawSet(s, t, s.Stack[s.Top-2], s.Stack[s.Top-1])
+	pop(s)
+	pop(s)
+}
+
+// Does t[n] = v, where t is the table at index idx and v the value at the top,
+// and pops it, without calling metamethods. See lua_rawseti.
+func RawSetI(s *types.State, idx, n int) {
+	t := table(s, idx)
+	t.Set(float64(n), s.Stack[s.Top-1])
+	pop(s)
+}
+
+// Pops a table or nil and sets it as the metatable of the value at index idx.
+// See lua_setmetatable.
+func SetMetatable(s *types.State, idx int) {
+	v := get(s, idx)
+	mt, ok := s.Stack[s.Top-1].(*types.Table)
+	if !ok && s.Stack[s.Top-1] != nil {
+		panic("table expected")
+	}
+	s.SetMetaTable(v, mt)
+	pop(s)
+}
+
+// Pops a table or nil and sets it as the user value of the userdata at index
+// idx. See lua_setuservalue.
+func SetUservalue(s *types.State, idx int) {
+	u, ok := get(s, idx).(*types.Userdata)
+	if !ok {
+		panic("userdata expected")
+	}
+	t, ok := s.Stack[s.Top-1].(*types.Table)
+	if !ok && s.Stack[s.Top-1] != nil {
+		panic("table expected")
+	}
+	u.UserValue = t
+	pop(s)
+}
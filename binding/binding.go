@@ -0,0 +1,310 @@
+// Package binding exposes Go values to Lune code using reflection, so that
+// Go functions can be registered without writing a GoFunc by hand.
+//
+// Go values are converted to Lua values this way:
+//
+//	nil, nil pointers, slices, maps and funcs: nil
+//	bool:                                      boolean
+//	int, uint and float kinds:                 number
+//	string:                                    string
+//	slices, arrays and maps:                   new table holding converted copies
+//	funcs:                                     function, see below
+//	structs and pointers to structs:           userdata with fields and methods
+//	other values (chans, other pointers...):   userdata with methods
+//
+// Lua values (*types.Table, *types.GoClosure, *types.Userdata...) are kept as
+// is, and a types.GoFunc becomes a *types.GoClosure.
+// A struct value is copied and its userdata wraps a pointer to the copy. The
+// fields of a struct userdata can be read and assigned from Lua code by name,
+// or by the name given in a `lua:"name"` tag (`lua:"-"` hides the field).
+// Its methods, those of the pointer type, are called as methods, e.g.
+// p:Move(1, 2). Struct fields are accessed in place, so p.Pos.X = 1 changes
+// the field of the Go value.
+//
+// When a wrapped Go function is called, its arguments are converted back to
+// the Go types of its parameters, and an error is raised for an argument that
+// can't be converted. A first parameter of type *types.State receives the
+// calling state. If its last result is an error, it is not returned to the
+// Lua code: a non-nil error is raised as a Lua error instead. A Lua function
+// passed for a parameter of a func type is converted to a Go func that calls
+// it.
+package binding
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+
+	"github.com/mna/lune/types"
+)
+
+var (
+	stateType    = reflect.TypeOf((*types.State)(nil))
+	valueType    = reflect.TypeOf((*types.Value)(nil)).Elem()
+	errorType    = reflect.TypeOf((*error)(nil)).Elem()
+	stringerType = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+	goFuncType   = reflect.TypeOf(types.GoFunc(nil))
+)
+
+// Sets the Go values of vals in the table t, converted by ToLua, e.g. to
+// register them in State.Globals like stdlib.OpenLibs does for the standard
+// libraries. Functions are named after their key in error messages.
+func Register(t *types.Table, vals map[string]interface{}) {
+	for k, v := range vals {
+		rv := reflect.ValueOf(v)
+		if rv.Kind() == reflect.Func && !rv.IsNil() && !rv.Type().ConvertibleTo(goFuncType) {
+			t.Set(k, wrapFunc(rv, k))
+			continue
+		}
+		t.Set(k, toLua(rv))
+	}
+}
+
+// Converts the Go value v to a Lua value.
+func ToLua(v interface{}) types.Value {
+	return toLua(reflect.ValueOf(v))
+}
+
+// Converts the Lua value v to a Go value of type t. Userdata values give back
+// the Go value they wrap.
+func FromLua(s *types.State, v types.Value, t reflect.Type) (interface{}, error) {
+	rv, err := fromLua(s, v, t)
+	if err != nil {
+		return nil, err
+	}
+	return rv.Interface(), nil
+}
+
+func toLua(rv reflect.Value) types.Value {
+	if !rv.IsValid() {
+		return nil
+	}
+	if rv.CanInterface() {
+		switch v := rv.Interface().(type) {
+		case *types.Table, *types.Closure, *types.GoClosure, *types.Userdata, types.LightUserdata, *types.Thread:
+			if rv.IsZero() {
+				return nil
+			}
+			return v
+		}
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Interface:
+		return toLua(rv.Elem())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return nil
+		}
+		t := types.NewTable(rv.Len(), 0)
+		for i := 0; i < rv.Len(); i++ {
+			t.Set(float64(i+1), toLua(rv.Index(i)))
+		}
+		return t
+	case reflect.Map:
+		if rv.IsNil() {
+			return nil
+		}
+		t := types.NewTable(0, rv.Len())
+		for it := rv.MapRange(); it.Next(); {
+			// Keys that can't be table keys (nil or NaN) are dropped
+			if k := toLua(it.Key()); k != nil && k == k {
+				t.Set(k, toLua(it.Value()))
+			}
+		}
+		return t
+	case reflect.Func:
+		if rv.IsNil() {
+			return nil
+		}
+		if rv.Type().ConvertibleTo(goFuncType) {
+			return types.NewGoClosure(rv.Convert(goFuncType).Interface().(types.GoFunc))
+		}
+		return wrapFunc(rv, funcName(rv))
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return nil
+		}
+		return newUserdata(rv)
+	case reflect.Struct:
+		// Work on a copy, so that its fields can be set
+		p := reflect.New(rv.Type())
+		p.Elem().Set(rv)
+		return newUserdata(p)
+	case reflect.Chan, reflect.UnsafePointer:
+		if rv.IsNil() {
+			return nil
+		}
+	}
+	return newUserdata(rv)
+}
+
+// Returns the short name of the Go function fn, e.g. "strings.ToUpper".
+func funcName(fn reflect.Value) string {
+	if f := runtime.FuncForPC(fn.Pointer()); f != nil {
+		name := f.Name()
+		if i := strings.LastIndex(name, "/"); i >= 0 {
+			name = name[i+1:]
+		}
+		return name
+	}
+	return "?"
+}
+
+func fromLua(s *types.State, v types.Value, t reflect.Type) (reflect.Value, error) {
+	if t == valueType {
+		// Lua values are kept as is
+		rv := reflect.New(t).Elem()
+		if v != nil {
+			rv.Set(reflect.ValueOf(v))
+		}
+		return rv, nil
+	}
+	if u, ok := v.(*types.Userdata); ok && u.Value != nil {
+		rv := reflect.ValueOf(u.Value)
+		if rv.Type().AssignableTo(t) {
+			return rv, nil
+		}
+		if rv.Kind() == reflect.Ptr && rv.Type().Elem().AssignableTo(t) && !rv.IsNil() {
+			return rv.Elem(), nil
+		}
+	}
+	if v == nil {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map, reflect.Func, reflect.Chan, reflect.UnsafePointer:
+			return reflect.Zero(t), nil
+		}
+	} else if vt := reflect.TypeOf(v); vt.AssignableTo(t) {
+		return reflect.ValueOf(v), nil
+	}
+
+	rv := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Bool:
+		rv.SetBool(v != nil && v != false)
+		return rv, nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, ok := toNumber(v); ok {
+			if i := int64(n); !rv.OverflowInt(i) {
+				rv.SetInt(i)
+				return rv, nil
+			}
+			return rv, fmt.Errorf("number out of range for %s", t)
+		}
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n, ok := toNumber(v); ok {
+			if i := uint64(n); n >= 0 && !rv.OverflowUint(i) {
+				rv.SetUint(i)
+				return rv, nil
+			}
+			return rv, fmt.Errorf("number out of range for %s", t)
+		}
+
+	case reflect.Float32, reflect.Float64:
+		if n, ok := toNumber(v); ok {
+			rv.SetFloat(n)
+			return rv, nil
+		}
+
+	case reflect.String:
+		switch v := v.(type) {
+		case string:
+			rv.SetString(v)
+			return rv, nil
+		case float64:
+			rv.SetString(types.NumberToString(v))
+			return rv, nil
+		}
+
+	case reflect.Slice, reflect.Array:
+		if tbl, ok := v.(*types.Table); ok {
+			n := tbl.Len()
+			if t.Kind() == reflect.Slice {
+				rv.Set(reflect.MakeSlice(t, n, n))
+			} else if n > t.Len() {
+				n = t.Len()
+			}
+			for i := 0; i < n; i++ {
+				ev, err := fromLua(s, tbl.Get(float64(i+1)), t.Elem())
+				if err != nil {
+					return rv, fmt.Errorf("invalid element #%d (%s)", i+1, err)
+				}
+				rv.Index(i).Set(ev)
+			}
+			return rv, nil
+		}
+
+	case reflect.Map:
+		if tbl, ok := v.(*types.Table); ok {
+			rv.Set(reflect.MakeMap(t))
+			var err error
+			tbl.ForEach(func(k, v types.Value) {
+				if err != nil {
+					return
+				}
+				var kv, ev reflect.Value
+				if kv, err = fromLua(s, k, t.Key()); err != nil {
+					err = fmt.Errorf("invalid key %v (%s)", k, err)
+					return
+				}
+				if ev, err = fromLua(s, v, t.Elem()); err != nil {
+					err = fmt.Errorf("invalid value for key %v (%s)", k, err)
+					return
+				}
+				rv.SetMapIndex(kv, ev)
+			})
+			return rv, err
+		}
+
+	case reflect.Func:
+		switch v.(type) {
+		case *types.Closure, *types.GoClosure:
+			return luaFunc(s, v, t), nil
+		}
+	}
+	return rv, fmt.Errorf("%s expected, got %s", expectedName(t), types.TypeOf(v))
+}
+
+// Returns the value v as a number, converting strings like Lua's arithmetic.
+func toNumber(v types.Value) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		return types.StrToNumber(v)
+	}
+	return 0, false
+}
+
+// Returns the name of the Lua type that converts to the Go type t, or the
+// name of t for userdata.
+func expectedName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return "table"
+	case reflect.Func:
+		return "function"
+	}
+	return t.String()
+}
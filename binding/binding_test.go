@@ -0,0 +1,229 @@
+package binding
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mna/lune/compiler"
+	"github.com/mna/lune/stdlib"
+	"github.com/mna/lune/types"
+	"github.com/mna/lune/vm"
+)
+
+// Compiles and runs src with the standard libraries and the Go values vals,
+// and returns its state.
+func runSource(t *testing.T, name, src string, vals map[string]interface{}) (*types.State, error) {
+	p, err := compiler.Compile(strings.NewReader(src), "="+name)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	s := types.NewState(p)
+	stdlib.OpenLibs(s)
+	Register(s.Globals, vals)
+	return s, vm.Execute(s)
+}
+
+type globals map[string]types.Value
+
+func assertGlobals(t *testing.T, name string, s *types.State, exp globals) {
+	for k, v := range exp {
+		if got := s.Globals.Get(k); got != v {
+			t.Errorf("%s: expected %s to be %v, got %v", name, k, v, got)
+		}
+	}
+}
+
+type vec struct {
+	X, Y float64
+}
+
+type point struct {
+	Pos   vec
+	Name  string `lua:"name"`
+	Tags  []string
+	Score int `lua:"-"`
+	id    int
+}
+
+func (p *point) Move(dx, dy float64) {
+	p.Pos.X += dx
+	p.Pos.Y += dy
+}
+
+func (p point) String() string {
+	return fmt.Sprintf("%s(%g, %g)", p.Name, p.Pos.X, p.Pos.Y)
+}
+
+func TestFunctions(t *testing.T) {
+	vals := map[string]interface{}{
+		"add":   func(a, b int) int { return a + b },
+		"upper": strings.ToUpper,
+		"sum": func(vs ...float64) (n int, total float64) {
+			for _, v := range vs {
+				total += v
+			}
+			return len(vs), total
+		},
+		"div": func(a, b int) (int, error) {
+			if b == 0 {
+				return 0, errors.New("division by zero")
+			}
+			return a / b, nil
+		},
+		"join": func(vs []string, sep string) string { return strings.Join(vs, sep) },
+		"keys": func(m map[string]bool) (n int) {
+			for _, v := range m {
+				if v {
+					n++
+				}
+			}
+			return n
+		},
+		"split": func(s string) map[string]int {
+			m := make(map[string]int)
+			for _, w := range strings.Fields(s) {
+				m[w]++
+			}
+			return m
+		},
+		"apply": func(f func(int) int, vs []int) []int {
+			for i, v := range vs {
+				vs[i] = f(v)
+			}
+			return vs
+		},
+		"try": func(f func() error) error { return f() },
+		"top": func(s *types.State, n int) int { return s.Top + n - s.Top },
+		"pi":  3.5,
+	}
+
+	cases := []struct {
+		name string
+		src  string
+		exp  globals
+		err  string
+	}{
+		{"call", `a, b, c = add(2, 3.7), upper("abc"), add("4", 5)`,
+			globals{"a": 5.0, "b": "ABC", "c": 9.0}, ""},
+		{"variadic", `a, b = sum(1, 2, 3) ; c, d = sum()`,
+			globals{"a": 3.0, "b": 6.0, "c": 0.0, "d": 0.0}, ""},
+		{"error", `a = div(7, 2) ; b, c = pcall(div, 1, 0)`,
+			globals{"a": 3.0, "b": false, "c": "division by zero"}, ""},
+		{"uncaught", `
+a = div(1, 0)`, nil, "uncaught:2: division by zero"},
+		{"args", `
+a, b = pcall(add, 1)
+c, d = pcall(upper, {})`,
+			globals{"a": false, "b": "bad argument #2 to 'add' (number expected, got no value)",
+				"c": false, "d": "bad argument #1 to 'upper' (string expected, got table)"}, ""},
+		{"tables", `
+a = join({"x", "y", "z"}, ", ")
+b = keys({x = true, y = false, z = true})
+local t = split("a b a")
+c, d = t.a, t.b
+local u = apply(function(v) return v * 10 end, {1, 2, 3})
+e = u[1] + u[2] + u[3]`,
+			globals{"a": "x, y, z", "b": 2.0, "c": 2.0, "d": 1.0, "e": 60.0}, ""},
+		{"callback", `
+a = try(function() end)
+b = try(function() error("oops", 0) end)`,
+			globals{"a": nil, "b": nil}, "oops"},
+		{"state", `a = top(4) ; b = pi`,
+			globals{"a": 4.0, "b": 3.5}, ""},
+		{"identity", `
+a, b, c = add == upper, add == add, rawequal(sum, div)
+local t = {[add] = 1, [upper] = 2}
+d, e = t[add], t[upper]`,
+			globals{"a": false, "b": true, "c": false, "d": 1.0, "e": 2.0}, ""},
+	}
+
+	for _, c := range cases {
+		s, err := runSource(t, c.name, c.src, vals)
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("%s: expected error %q, got %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		assertGlobals(t, c.name, s, c.exp)
+	}
+}
+
+func TestStructs(t *testing.T) {
+	p := &point{Name: "p", Pos: vec{1, 2}, Score: 5}
+	vals := map[string]interface{}{
+		"p":        p,
+		"newPoint": func(name string) point { return point{Name: name} },
+		"name":     func(p point) string { return p.Name },
+	}
+	s, err := runSource(t, "structs", `
+a, b, c = p.name, p.Pos.X, p.Score
+p:Move(1, 1)
+p.Pos.Y = p.Pos.Y * 10
+p.Tags = {"x", "y"}
+local q = newPoint("q")
+q.name = "r"
+d = name(q)
+e = p == p and p ~= q
+f, g = pcall(function() p.Foo = 1 end)
+h, i = pcall(function() p.name = {} end)
+j = p.Move ~= nil and p.id == nil and p.Nothing == nil
+k = p.Move == p.Move and getmetatable(p) == getmetatable(newPoint("s"))
+l = getmetatable(p)`, vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertGlobals(t, "structs", s, globals{
+		"a": "p", "b": 1.0, "c": nil, "d": "r", "e": true,
+		"f": false, "g": "structs:10: no field 'Foo' in *binding.point",
+		"h": false, "i": "structs:11: invalid value for field 'name' (string expected, got table)",
+		"j": true, "k": true, "l": "*binding.point",
+	})
+
+	exp := &point{Name: "p", Pos: vec{2, 30}, Tags: []string{"x", "y"}, Score: 5}
+	if !reflect.DeepEqual(p, exp) {
+		t.Errorf("expected %+v, got %+v", exp, p)
+	}
+	if u1, u2 := ToLua(p).(*types.Userdata), ToLua(exp).(*types.Userdata); u1.Meta != u2.Meta {
+		t.Errorf("expected values of the same type to share their metatable")
+	}
+}
+
+func TestConversions(t *testing.T) {
+	for _, v := range []interface{}{nil, true, 1.5, "s", int8(-3), uint16(7), float32(0.5)} {
+		lv := ToLua(v)
+		if v == nil {
+			if lv != nil {
+				t.Errorf("expected nil, got %v", lv)
+			}
+			continue
+		}
+		if gv, err := FromLua(nil, lv, reflect.TypeOf(v)); err != nil {
+			t.Errorf("%v: %s", v, err)
+		} else if gv != v {
+			t.Errorf("expected %v, got %v", v, gv)
+		}
+	}
+
+	tbl := types.NewTable(0, 0)
+	if ToLua(tbl) != tbl {
+		t.Error("expected Lua values to be kept as is")
+	}
+	if _, err := FromLua(nil, 300.0, reflect.TypeOf(int8(0))); err == nil || err.Error() != "number out of range for int8" {
+		t.Errorf("expected range error, got %v", err)
+	}
+	if _, err := FromLua(nil, -1.0, reflect.TypeOf(uint(0))); err == nil {
+		t.Error("expected range error for a negative uint")
+	}
+	u := ToLua(point{Name: "x"}).(*types.Userdata)
+	if gv, err := FromLua(nil, u, reflect.TypeOf(point{})); err != nil || gv.(point).Name != "x" {
+		t.Errorf("expected the struct value, got %v (%v)", gv, err)
+	}
+}
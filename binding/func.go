@@ -0,0 +1,126 @@
+package binding
+
+import (
+	"reflect"
+
+	"github.com/mna/lune/types"
+	"github.com/mna/lune/vm"
+)
+
+// Returns a Go closure that calls the Go function fn, named name in error
+// messages. Each call returns a distinct function value.
+func wrapFunc(fn reflect.Value, name string) *types.GoClosure {
+	ft := fn.Type()
+	nIn := ft.NumIn()
+	if ft.IsVariadic() {
+		nIn--
+	}
+	withErr := ft.NumOut() > 0 && ft.Out(ft.NumOut()-1) == errorType
+
+	return types.NewGoClosure(func(s *types.State, args []types.Value) []types.Value {
+		in := make([]reflect.Value, 0, len(args)+1)
+		i := 0
+		if nIn > 0 && ft.In(0) == stateType {
+			in = append(in, reflect.ValueOf(s))
+			i++
+		}
+		n := 0 // Index of the Lua argument
+		arg := func(t reflect.Type) {
+			var v types.Value
+			if n < len(args) {
+				v = args[n]
+			}
+			n++
+			rv, err := fromLua(s, v, t)
+			if err != nil {
+				if n > len(args) {
+					vm.Errorf(s, "bad argument #%d to '%s' (%s expected, got no value)", n, name, expectedName(t))
+				}
+				vm.Errorf(s, "bad argument #%d to '%s' (%s)", n, name, err)
+			}
+			in = append(in, rv)
+		}
+		for ; i < nIn; i++ {
+			arg(ft.In(i))
+		}
+		if ft.IsVariadic() {
+			for et := ft.In(nIn).Elem(); n < len(args); {
+				arg(et)
+			}
+		}
+
+		out := fn.Call(in)
+		if withErr {
+			last := out[len(out)-1]
+			out = out[:len(out)-1]
+			if !last.IsNil() {
+				raise(s, last.Interface().(error))
+			}
+		}
+		res := make([]types.Value, len(out))
+		for i, rv := range out {
+			res[i] = toLua(rv)
+		}
+		return res
+	})
+}
+
+// Raises the error err returned by a Go function as a Lua error. The value of
+// Lua errors is raised again as is.
+func raise(s *types.State, err error) {
+	if re, ok := err.(*vm.RuntimeError); ok {
+		vm.Error(s, re.Value)
+	}
+	vm.Errorf(s, "%s", err)
+}
+
+// Returns a Go func of type t that calls the Lua function f. If the last
+// result of t is an error, f is called in protected mode and its errors are
+// returned as *vm.RuntimeError, otherwise they are propagated.
+func luaFunc(s *types.State, f types.Value, t reflect.Type) reflect.Value {
+	nOut := t.NumOut()
+	withErr := nOut > 0 && t.Out(nOut-1) == errorType
+	if withErr {
+		nOut--
+	}
+
+	return reflect.MakeFunc(t, func(in []reflect.Value) []reflect.Value {
+		args := make([]types.Value, 0, len(in))
+		for i, rv := range in {
+			if t.IsVariadic() && i == len(in)-1 {
+				for j := 0; j < rv.Len(); j++ {
+					args = append(args, toLua(rv.Index(j)))
+				}
+				continue
+			}
+			args = append(args, toLua(rv))
+		}
+
+		out := make([]reflect.Value, t.NumOut())
+		for i := range out {
+			out[i] = reflect.Zero(t.Out(i))
+		}
+		var res []types.Value
+		if withErr {
+			var err error
+			if res, err = vm.PCall(s, f, args, nil); err != nil {
+				out[nOut] = reflect.ValueOf(&err).Elem()
+				return out
+			}
+		} else {
+			res = vm.Call(s, f, args...)
+		}
+		for i := 0; i < nOut; i++ {
+			var v types.Value
+			if i < len(res) {
+				v = res[i]
+			}
+			rv, err := fromLua(s, v, t.Out(i))
+			if err != nil {
+				vm.Errorf(s, "invalid result #%d of function (%s)", i+1, err)
+			}
+			out[i] = rv
+		}
+		return out
+	})
+}
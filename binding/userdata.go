@@ -0,0 +1,160 @@
+package binding
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/mna/lune/types"
+	"github.com/mna/lune/vm"
+)
+
+// Fields, methods and metatable of a Go type wrapped in userdata, computed
+// once per type.
+type typeInfo struct {
+	fields  map[string][]int // Index sequences of the struct fields
+	methods map[string]*types.GoClosure
+	meta    *types.Table
+}
+
+var typeInfos sync.Map // reflect.Type -> *typeInfo
+
+func infoOf(t reflect.Type) *typeInfo {
+	if ti, ok := typeInfos.Load(t); ok {
+		return ti.(*typeInfo)
+	}
+
+	ti := &typeInfo{
+		fields:  make(map[string][]int),
+		methods: make(map[string]*types.GoClosure, t.NumMethod()),
+		meta:    newMetaTable(t),
+	}
+	if t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct {
+		for _, f := range reflect.VisibleFields(t.Elem()) {
+			if !f.IsExported() {
+				continue
+			}
+			name := f.Name
+			if tag, ok := f.Tag.Lookup("lua"); ok {
+				if tag == "-" {
+					continue
+				}
+				name = tag
+			}
+			// Fields of embedded structs are hidden by the shallower ones
+			if idx, ok := ti.fields[name]; !ok || len(f.Index) < len(idx) {
+				ti.fields[name] = f.Index
+			}
+		}
+	}
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		ti.methods[m.Name] = wrapFunc(m.Func, m.Name)
+	}
+	ti2, _ := typeInfos.LoadOrStore(t, ti)
+	return ti2.(*typeInfo)
+}
+
+// Returns the metatable of the userdata wrapping values of type t, giving
+// access to their fields and methods. It is shared by all the states, so it is
+// protected from changes by a __metatable field.
+func newMetaTable(t reflect.Type) *types.Table {
+	mt := types.NewTable(0, 5)
+	mt.Set("__index", types.NewGoClosure(udIndex))
+	mt.Set("__newindex", types.NewGoClosure(udNewIndex))
+	mt.Set("__eq", types.NewGoClosure(udEq))
+	if t.Implements(stringerType) || t.Implements(errorType) {
+		mt.Set("__tostring", types.NewGoClosure(udToString))
+	}
+	mt.Set("__metatable", t.String())
+	return mt
+}
+
+// Returns a userdata wrapping the Go value rv, with the metatable of its type.
+func newUserdata(rv reflect.Value) *types.Userdata {
+	u := types.NewUserdata(rv.Interface())
+	u.Meta = infoOf(rv.Type()).meta
+	return u
+}
+
+// Returns the struct field named by key of the value in u, if there is one.
+func field(u *types.Userdata, key types.Value) (reflect.Value, bool) {
+	name, ok := key.(string)
+	if !ok {
+		return reflect.Value{}, false
+	}
+	rv := reflect.ValueOf(u.Value)
+	idx, ok := infoOf(rv.Type()).fields[name]
+	if !ok {
+		return reflect.Value{}, false
+	}
+	fv, err := rv.Elem().FieldByIndexErr(idx)
+	if err != nil {
+		// Through a nil embedded pointer
+		return reflect.Value{}, false
+	}
+	return fv, true
+}
+
+// Returns the userdata receiving the metamethod event.
+func checkUserdata(s *types.State, args []types.Value, event string) *types.Userdata {
+	if len(args) > 0 {
+		if u, ok := args[0].(*types.Userdata); ok && u.Value != nil {
+			return u
+		}
+	}
+	vm.Errorf(s, "bad argument #1 to '%s' (userdata expected)", event)
+	return nil
+}
+
+// The __index metamethod, returns a field or a method.
+func udIndex(s *types.State, args []types.Value) []types.Value {
+	u := checkUserdata(s, args, "__index")
+	if len(args) < 2 {
+		return []types.Value{nil}
+	}
+	if fv, ok := field(u, args[1]); ok {
+		if fv.Kind() == reflect.Struct {
+			// Nested structs are accessed in place
+			return []types.Value{toLua(fv.Addr())}
+		}
+		return []types.Value{toLua(fv)}
+	}
+	if name, ok := args[1].(string); ok {
+		if m, ok := infoOf(reflect.TypeOf(u.Value)).methods[name]; ok {
+			return []types.Value{m}
+		}
+	}
+	return []types.Value{nil}
+}
+
+// The __newindex metamethod, sets a field.
+func udNewIndex(s *types.State, args []types.Value) []types.Value {
+	u := checkUserdata(s, args, "__newindex")
+	args = append(args, nil, nil)
+	fv, ok := field(u, args[1])
+	if !ok {
+		vm.Errorf(s, "no field '%v' in %T", args[1], u.Value)
+	}
+	rv, err := fromLua(s, args[2], fv.Type())
+	if err != nil {
+		vm.Errorf(s, "invalid value for field '%v' (%s)", args[1], err)
+	}
+	fv.Set(rv)
+	return nil
+}
+
+// The __eq metamethod, compares the wrapped Go values.
+func udEq(s *types.State, args []types.Value) []types.Value {
+	u1, ok1 := args[0].(*types.Userdata)
+	u2, ok2 := args[1].(*types.Userdata)
+	if !ok1 || !ok2 || reflect.TypeOf(u1.Value) != reflect.TypeOf(u2.Value) || !reflect.TypeOf(u1.Value).Comparable() {
+		return []types.Value{false}
+	}
+	return []types.Value{u1.Value == u2.Value}
+}
+
+// The __tostring metamethod, for values that implement fmt.Stringer or error.
+func udToString(s *types.State, args []types.Value) []types.Value {
+	return []types.Value{fmt.Sprint(checkUserdata(s, args, "__tostring").Value)}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mna/lune"
+	"github.com/mna/lune/disasm"
+	"github.com/mna/lune/types"
+	"github.com/mna/lune/vm"
+)
+
+func loadFile(fn string) (*types.Prototype, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return lune.Load(f, "@"+fn)
+}
+
+var listFlag = flag.Bool("l", false, "list the bytecode instead of running it, like luac -l -l")
+
+func main() {
+	flag.Parse()
+
+	// Check args
+	if flag.NArg() < 1 {
+		fmt.Println("Expected an argument (file name)")
+		os.Exit(1)
+	}
+
+	// Load file
+	fn := flag.Arg(0)
+	p, err := loadFile(fn)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// List file
+	if *listFlag {
+		if err := disasm.Fprint(os.Stdout, p, true); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Run file
+	rt := lune.NewRuntime()
+	if _, err := rt.Call(rt.State().Load(p)); err != nil {
+		fmt.Println(err)
+		if re, ok := err.(*vm.RuntimeError); ok {
+			fmt.Println(re.Traceback)
+		}
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,834 @@
+package compiler
+
+import (
+	"math"
+
+	"github.com/mna/lune/types"
+)
+
+/*
+  Mostly a port of lcode.{c,h} from Lua
+
+  Code generator
+*/
+
+const (
+	_NO_JUMP  = -1             // marks the end of a patch list
+	_NO_REG   = types.MAXARG_A // invalid register that fits in 8 bits
+	_MAXSTACK = 250            // maximum stack size for a function
+)
+
+// Binary operators, ORDER OPR
+type binOpr int
+
+const (
+	oprAdd binOpr = iota
+	oprSub
+	oprMul
+	oprDiv
+	oprMod
+	oprPow
+	oprConcat
+	oprEq
+	oprLt
+	oprLe
+	oprNe
+	oprGt
+	oprGe
+	oprAnd
+	oprOr
+	oprNoBinOpr
+)
+
+// Unary operators
+type unOpr int
+
+const (
+	oprMinus unOpr = iota
+	oprNot
+	oprLen
+	oprNoUnOpr
+)
+
+// Kinds of variables/expressions
+type expKind int
+
+const (
+	vVoid      expKind = iota // no value
+	vNil                      // nil constant
+	vTrue                     // true constant
+	vFalse                    // false constant
+	vK                        // info = index of constant in 'Ks'
+	vKNum                     // nval = numerical value
+	vNonReloc                 // info = result register
+	vLocal                    // info = local register
+	vUpval                    // info = index of upvalue in 'Upvalues'
+	vIndexed                  // t = table register/upvalue; idx = index R/K
+	vJmp                      // info = instruction pc
+	vRelocable                // info = instruction pc
+	vCall                     // info = instruction pc
+	vVararg                   // info = instruction pc
+)
+
+func vkIsVar(k expKind) bool {
+	return vLocal <= k && k <= vIndexed
+}
+
+func vkIsInReg(k expKind) bool {
+	return k == vNonReloc || k == vLocal
+}
+
+func hasMultRet(k expKind) bool {
+	return k == vCall || k == vVararg
+}
+
+type expDesc struct {
+	k    expKind
+	info int // for generic use
+	ind  struct {
+		idx int     // index (R/K)
+		t   int     // table (register or upvalue)
+		vt  expKind // whether 't' is register (vLocal) or upvalue (vUpval)
+	}
+	nval float64 // for vKNum
+	t    int     // patch list of 'exit when true'
+	f    int     // patch list of 'exit when false'
+}
+
+func (e *expDesc) init(k expKind, i int) {
+	e.f, e.t = _NO_JUMP, _NO_JUMP
+	e.k = k
+	e.info = i
+}
+
+func (e *expDesc) hasJumps() bool {
+	return e.t != e.f
+}
+
+func (e *expDesc) isNumeral() bool {
+	return e.k == vKNum && e.t == _NO_JUMP && e.f == _NO_JUMP
+}
+
+// Key used for constants that cannot be used as-is in the constants map
+// (zero, to tell -0 from 0, and NaN, that is never equal to itself).
+type rawNumberKey uint64
+
+// Key used for the nil constant.
+type nilKey struct{}
+
+func (fs *funcState) getCode(e *expDesc) *types.Instruction {
+	return &fs.f.Code[e.info]
+}
+
+func (fs *funcState) codeAsBx(o types.OpCode, a, sbx int) int {
+	return fs.codeABx(o, a, sbx+types.MAXARG_sBx)
+}
+
+func (fs *funcState) setMultRet(e *expDesc) {
+	fs.setReturns(e, types.LUNE_MULTRET)
+}
+
+func (fs *funcState) jumpTo(t int) {
+	fs.patchList(fs.jump(), t)
+}
+
+func (fs *funcState) nil(from, n int) {
+	l := from + n - 1 // last register to set nil
+	if fs.pc > fs.lastTarget {
+		// no jumps to current position?
+		previous := &fs.f.Code[fs.pc-1]
+		if previous.GetOpCode() == types.OP_LOADNIL {
+			pfrom := previous.GetArgA()
+			pb, _ := previous.GetArgB(false)
+			pl := pfrom + pb
+			if (pfrom <= from && from <= pl+1) || (from <= pfrom && pfrom <= l+1) {
+				// can connect both?
+				if pfrom < from {
+					from = pfrom
+				}
+				if pl > l {
+					l = pl
+				}
+				previous.SetArgA(from)
+				previous.SetArgB(l - from)
+				return
+			}
+		} // else go through
+	}
+	fs.codeABC(types.OP_LOADNIL, from, n-1, 0) // else no optimization
+}
+
+func (fs *funcState) jump() int {
+	jpc := fs.jpc // save list of jumps to here
+	fs.jpc = _NO_JUMP
+	j := fs.codeAsBx(types.OP_JMP, 0, _NO_JUMP)
+	fs.concat(&j, jpc) // keep them on hold
+	return j
+}
+
+func (fs *funcState) ret(first, nret int) {
+	fs.codeABC(types.OP_RETURN, first, nret+1, 0)
+}
+
+func (fs *funcState) condJump(op types.OpCode, a, b, c int) int {
+	fs.codeABC(op, a, b, c)
+	return fs.jump()
+}
+
+func (fs *funcState) fixJump(pc, dest int) {
+	jmp := &fs.f.Code[pc]
+	offset := dest - (pc + 1)
+	if offset > types.MAXARG_sBx || offset < -types.MAXARG_sBx {
+		fs.ls.syntaxError("control structure too long")
+	}
+	jmp.SetArgsBx(offset)
+}
+
+// Returns current 'pc' and marks it as a jump target (to avoid wrong
+// optimizations with consecutive instructions not in the same basic block).
+func (fs *funcState) getLabel() int {
+	fs.lastTarget = fs.pc
+	return fs.pc
+}
+
+func (fs *funcState) getJump(pc int) int {
+	offset := fs.f.Code[pc].GetArgsBx()
+	if offset == _NO_JUMP {
+		// point to itself represents end of list
+		return _NO_JUMP
+	}
+	return (pc + 1) + offset // turn offset into absolute position
+}
+
+func (fs *funcState) getJumpControl(pc int) *types.Instruction {
+	if pc >= 1 && fs.f.Code[pc-1].GetOpCode().GetTMode() {
+		return &fs.f.Code[pc-1]
+	}
+	return &fs.f.Code[pc]
+}
+
+// Checks whether list has any jump that does not produce a value
+// (or produces an inverted value).
+func (fs *funcState) needValue(list int) bool {
+	for ; list != _NO_JUMP; list = fs.getJump(list) {
+		i := fs.getJumpControl(list)
+		if i.GetOpCode() != types.OP_TESTSET {
+			return true
+		}
+	}
+	return false // not found
+}
+
+func (fs *funcState) patchTestReg(node, reg int) bool {
+	i := fs.getJumpControl(node)
+	if i.GetOpCode() != types.OP_TESTSET {
+		return false // cannot patch other instructions
+	}
+	b, _ := i.GetArgB(false)
+	if reg != _NO_REG && reg != b {
+		i.SetArgA(reg)
+	} else {
+		// no register to put value or register already has the value
+		c, _ := i.GetArgC(false)
+		*i = types.NewInstrABC(types.OP_TEST, b, 0, c)
+	}
+	return true
+}
+
+func (fs *funcState) removeValues(list int) {
+	for ; list != _NO_JUMP; list = fs.getJump(list) {
+		fs.patchTestReg(list, _NO_REG)
+	}
+}
+
+func (fs *funcState) patchListAux(list, vtarget, reg, dtarget int) {
+	for list != _NO_JUMP {
+		next := fs.getJump(list)
+		if fs.patchTestReg(list, reg) {
+			fs.fixJump(list, vtarget)
+		} else {
+			fs.fixJump(list, dtarget) // jump to default target
+		}
+		list = next
+	}
+}
+
+func (fs *funcState) dischargeJpc() {
+	fs.patchListAux(fs.jpc, fs.pc, _NO_REG, fs.pc)
+	fs.jpc = _NO_JUMP
+}
+
+func (fs *funcState) patchList(list, target int) {
+	if target == fs.pc {
+		fs.patchToHere(list)
+	} else {
+		fs.patchListAux(list, target, _NO_REG, target)
+	}
+}
+
+func (fs *funcState) patchClose(list, level int) {
+	level++ // argument is +1 to reserve 0 as non-op
+	for list != _NO_JUMP {
+		next := fs.getJump(list)
+		fs.f.Code[list].SetArgA(level)
+		list = next
+	}
+}
+
+func (fs *funcState) patchToHere(list int) {
+	fs.getLabel()
+	fs.concat(&fs.jpc, list)
+}
+
+func (fs *funcState) concat(l1 *int, l2 int) {
+	if l2 == _NO_JUMP {
+		return
+	} else if *l1 == _NO_JUMP {
+		*l1 = l2
+	} else {
+		list := *l1
+		for next := fs.getJump(list); next != _NO_JUMP; next = fs.getJump(list) {
+			// find last element
+			list = next
+		}
+		fs.fixJump(list, l2)
+	}
+}
+
+func (fs *funcState) code(i types.Instruction) int {
+	f := fs.f
+	fs.dischargeJpc() // 'pc' will change
+	// put new instruction in code array
+	f.Code = append(f.Code[:fs.pc], i)
+	// save corresponding line information
+	f.LineInfo = append(f.LineInfo[:fs.pc], int32(fs.ls.lastLine))
+	fs.pc++
+	return fs.pc - 1
+}
+
+func (fs *funcState) codeABC(o types.OpCode, a, b, c int) int {
+	return fs.code(types.NewInstrABC(o, a, b, c))
+}
+
+func (fs *funcState) codeABx(o types.OpCode, a, bc int) int {
+	return fs.code(types.NewInstrABx(o, a, bc))
+}
+
+func (fs *funcState) codeExtraArg(a int) int {
+	return fs.code(types.NewInstrAx(types.OP_EXTRAARG, a))
+}
+
+func (fs *funcState) codeK(reg, k int) int {
+	if k <= types.MAXARG_Bx {
+		return fs.codeABx(types.OP_LOADK, reg, k)
+	}
+	p := fs.codeABx(types.OP_LOADKx, reg, 0)
+	fs.codeExtraArg(k)
+	return p
+}
+
+func (fs *funcState) checkStack(n int) {
+	newStack := fs.freeReg + n
+	if newStack > int(fs.f.Meta.MaxStackSize) {
+		if newStack >= _MAXSTACK {
+			fs.ls.syntaxError("function or expression too complex")
+		}
+		fs.f.Meta.MaxStackSize = byte(newStack)
+	}
+}
+
+func (fs *funcState) reserveRegs(n int) {
+	fs.checkStack(n)
+	fs.freeReg += n
+}
+
+func (fs *funcState) freeRegister(reg int) {
+	if !types.IsK(reg) && reg >= fs.nActVar {
+		fs.freeReg--
+	}
+}
+
+func (fs *funcState) freeExp(e *expDesc) {
+	if e.k == vNonReloc {
+		fs.freeRegister(e.info)
+	}
+}
+
+func (fs *funcState) addK(key interface{}, v types.Value) int {
+	if idx, ok := fs.h[key]; ok {
+		return idx
+	}
+	// constant not found; create a new entry
+	k := len(fs.f.Ks)
+	if k > types.MAXARG_Ax {
+		fs.ls.syntaxError("too many constants")
+	}
+	fs.h[key] = k
+	fs.f.Ks = append(fs.f.Ks, v)
+	return k
+}
+
+func (fs *funcState) stringK(s string) int {
+	return fs.addK(s, s)
+}
+
+func (fs *funcState) numberK(r float64) int {
+	if r == 0 || math.IsNaN(r) {
+		// handle -0 and NaN: use raw representation as key to avoid numeric problems
+		return fs.addK(rawNumberKey(math.Float64bits(r)), r)
+	}
+	return fs.addK(r, r) // regular case
+}
+
+func (fs *funcState) boolK(b bool) int {
+	return fs.addK(b, b)
+}
+
+func (fs *funcState) nilK() int {
+	return fs.addK(nilKey{}, nil)
+}
+
+func (fs *funcState) setReturns(e *expDesc, nResults int) {
+	if e.k == vCall {
+		// expression is an open function call?
+		fs.getCode(e).SetArgC(nResults + 1)
+	} else if e.k == vVararg {
+		fs.getCode(e).SetArgB(nResults + 1)
+		fs.getCode(e).SetArgA(fs.freeReg)
+		fs.reserveRegs(1)
+	}
+}
+
+func (fs *funcState) setOneRet(e *expDesc) {
+	if e.k == vCall {
+		// expression is an open function call?
+		e.k = vNonReloc
+		e.info = fs.getCode(e).GetArgA()
+	} else if e.k == vVararg {
+		fs.getCode(e).SetArgB(2)
+		e.k = vRelocable // can relocate its simple result
+	}
+}
+
+func (fs *funcState) dischargeVars(e *expDesc) {
+	switch e.k {
+	case vLocal:
+		e.k = vNonReloc
+	case vUpval:
+		e.info = fs.codeABC(types.OP_GETUPVAL, 0, e.info, 0)
+		e.k = vRelocable
+	case vIndexed:
+		op := types.OP_GETTABUP // assume 't' is in an upvalue
+		fs.freeRegister(e.ind.idx)
+		if e.ind.vt == vLocal {
+			// 't' is in a register?
+			fs.freeRegister(e.ind.t)
+			op = types.OP_GETTABLE
+		}
+		e.info = fs.codeABC(op, 0, e.ind.t, e.ind.idx)
+		e.k = vRelocable
+	case vVararg, vCall:
+		fs.setOneRet(e)
+	default:
+		// there is one value available (somewhere)
+	}
+}
+
+func (fs *funcState) codeLabel(a, b, jump int) int {
+	fs.getLabel() // those instructions may be jump targets
+	return fs.codeABC(types.OP_LOADBOOL, a, b, jump)
+}
+
+func (fs *funcState) discharge2Reg(e *expDesc, reg int) {
+	fs.dischargeVars(e)
+	switch e.k {
+	case vNil:
+		fs.nil(reg, 1)
+	case vFalse, vTrue:
+		b := 0
+		if e.k == vTrue {
+			b = 1
+		}
+		fs.codeABC(types.OP_LOADBOOL, reg, b, 0)
+	case vK:
+		fs.codeK(reg, e.info)
+	case vKNum:
+		fs.codeK(reg, fs.numberK(e.nval))
+	case vRelocable:
+		fs.getCode(e).SetArgA(reg)
+	case vNonReloc:
+		if reg != e.info {
+			fs.codeABC(types.OP_MOVE, reg, e.info, 0)
+		}
+	default:
+		// vVoid or vJmp, nothing to do...
+		return
+	}
+	e.info = reg
+	e.k = vNonReloc
+}
+
+func (fs *funcState) discharge2AnyReg(e *expDesc) {
+	if e.k != vNonReloc {
+		fs.reserveRegs(1)
+		fs.discharge2Reg(e, fs.freeReg-1)
+	}
+}
+
+func (fs *funcState) exp2Reg(e *expDesc, reg int) {
+	fs.discharge2Reg(e, reg)
+	if e.k == vJmp {
+		fs.concat(&e.t, e.info) // put this jump in 't' list
+	}
+	if e.hasJumps() {
+		pf := _NO_JUMP // position of an eventual LOAD false
+		pt := _NO_JUMP // position of an eventual LOAD true
+		if fs.needValue(e.t) || fs.needValue(e.f) {
+			fj := _NO_JUMP
+			if e.k != vJmp {
+				fj = fs.jump()
+			}
+			pf = fs.codeLabel(reg, 0, 1)
+			pt = fs.codeLabel(reg, 1, 0)
+			fs.patchToHere(fj)
+		}
+		final := fs.getLabel() // position after whole expression
+		fs.patchListAux(e.f, final, reg, pf)
+		fs.patchListAux(e.t, final, reg, pt)
+	}
+	e.f, e.t = _NO_JUMP, _NO_JUMP
+	e.info = reg
+	e.k = vNonReloc
+}
+
+func (fs *funcState) exp2NextReg(e *expDesc) {
+	fs.dischargeVars(e)
+	fs.freeExp(e)
+	fs.reserveRegs(1)
+	fs.exp2Reg(e, fs.freeReg-1)
+}
+
+func (fs *funcState) exp2AnyReg(e *expDesc) int {
+	fs.dischargeVars(e)
+	if e.k == vNonReloc {
+		if !e.hasJumps() {
+			// exp is already in a register
+			return e.info
+		}
+		if e.info >= fs.nActVar {
+			// reg. is not a local? put value on it
+			fs.exp2Reg(e, e.info)
+			return e.info
+		}
+	}
+	fs.exp2NextReg(e) // default
+	return e.info
+}
+
+func (fs *funcState) exp2AnyRegUp(e *expDesc) {
+	if e.k != vUpval || e.hasJumps() {
+		fs.exp2AnyReg(e)
+	}
+}
+
+func (fs *funcState) exp2Val(e *expDesc) {
+	if e.hasJumps() {
+		fs.exp2AnyReg(e)
+	} else {
+		fs.dischargeVars(e)
+	}
+}
+
+func (fs *funcState) exp2RK(e *expDesc) int {
+	fs.exp2Val(e)
+	switch e.k {
+	case vTrue, vFalse, vNil:
+		if len(fs.f.Ks) <= types.MAXINDEXRK {
+			// constant fits in RK operand?
+			if e.k == vNil {
+				e.info = fs.nilK()
+			} else {
+				e.info = fs.boolK(e.k == vTrue)
+			}
+			e.k = vK
+			return types.RKAsK(e.info)
+		}
+	case vKNum, vK:
+		if e.k == vKNum {
+			e.info = fs.numberK(e.nval)
+			e.k = vK
+		}
+		if e.info <= types.MAXINDEXRK {
+			// constant fits in argC?
+			return types.RKAsK(e.info)
+		}
+	}
+	// not a constant in the right range: put it in a register
+	return fs.exp2AnyReg(e)
+}
+
+func (fs *funcState) storeVar(v *expDesc, ex *expDesc) {
+	switch v.k {
+	case vLocal:
+		fs.freeExp(ex)
+		fs.exp2Reg(ex, v.info)
+		return
+	case vUpval:
+		e := fs.exp2AnyReg(ex)
+		fs.codeABC(types.OP_SETUPVAL, e, v.info, 0)
+	case vIndexed:
+		op := types.OP_SETTABUP
+		if v.ind.vt == vLocal {
+			op = types.OP_SETTABLE
+		}
+		e := fs.exp2RK(ex)
+		fs.codeABC(op, v.ind.t, v.ind.idx, e)
+	default:
+		panic("invalid var kind to store")
+	}
+	fs.freeExp(ex)
+}
+
+func (fs *funcState) self(e *expDesc, key *expDesc) {
+	fs.exp2AnyReg(e)
+	ereg := e.info // register where 'e' was placed
+	fs.freeExp(e)
+	e.info = fs.freeReg // base register for OP_SELF
+	e.k = vNonReloc
+	fs.reserveRegs(2) // function and 'self' produced by OP_SELF
+	fs.codeABC(types.OP_SELF, e.info, ereg, fs.exp2RK(key))
+	fs.freeExp(key)
+}
+
+func (fs *funcState) invertJump(e *expDesc) {
+	pc := fs.getJumpControl(e.info)
+	if pc.GetArgA() == 0 {
+		pc.SetArgA(1)
+	} else {
+		pc.SetArgA(0)
+	}
+}
+
+func (fs *funcState) jumpOnCond(e *expDesc, cond int) int {
+	if e.k == vRelocable {
+		ie := *fs.getCode(e)
+		if ie.GetOpCode() == types.OP_NOT {
+			fs.pc-- // remove previous OP_NOT
+			b, _ := ie.GetArgB(false)
+			c := 0
+			if cond == 0 {
+				c = 1
+			}
+			return fs.condJump(types.OP_TEST, b, 0, c)
+		}
+		// else go through
+	}
+	fs.discharge2AnyReg(e)
+	fs.freeExp(e)
+	return fs.condJump(types.OP_TESTSET, _NO_REG, e.info, cond)
+}
+
+func (fs *funcState) goIfTrue(e *expDesc) {
+	var pc int // pc of last jump
+	fs.dischargeVars(e)
+	switch e.k {
+	case vJmp:
+		fs.invertJump(e)
+		pc = e.info
+	case vK, vKNum, vTrue:
+		pc = _NO_JUMP // always true; do nothing
+	default:
+		pc = fs.jumpOnCond(e, 0)
+	}
+	fs.concat(&e.f, pc) // insert last jump in 'f' list
+	fs.patchToHere(e.t)
+	e.t = _NO_JUMP
+}
+
+func (fs *funcState) goIfFalse(e *expDesc) {
+	var pc int // pc of last jump
+	fs.dischargeVars(e)
+	switch e.k {
+	case vJmp:
+		pc = e.info
+	case vNil, vFalse:
+		pc = _NO_JUMP // always false; do nothing
+	default:
+		pc = fs.jumpOnCond(e, 1)
+	}
+	fs.concat(&e.t, pc) // insert last jump in 't' list
+	fs.patchToHere(e.f)
+	e.f = _NO_JUMP
+}
+
+func (fs *funcState) codeNot(e *expDesc) {
+	fs.dischargeVars(e)
+	switch e.k {
+	case vNil, vFalse:
+		e.k = vTrue
+	case vK, vKNum, vTrue:
+		e.k = vFalse
+	case vJmp:
+		fs.invertJump(e)
+	case vRelocable, vNonReloc:
+		fs.discharge2AnyReg(e)
+		fs.freeExp(e)
+		e.info = fs.codeABC(types.OP_NOT, 0, e.info, 0)
+		e.k = vRelocable
+	default:
+		panic("cannot happen")
+	}
+	// interchange true and false lists
+	e.f, e.t = e.t, e.f
+	fs.removeValues(e.f)
+	fs.removeValues(e.t)
+}
+
+func (fs *funcState) indexed(t *expDesc, k *expDesc) {
+	t.ind.t = t.info
+	t.ind.idx = fs.exp2RK(k)
+	if t.k == vUpval {
+		t.ind.vt = vUpval
+	} else {
+		t.ind.vt = vLocal
+	}
+	t.k = vIndexed
+}
+
+func constFolding(op types.OpCode, e1, e2 *expDesc) bool {
+	if !e1.isNumeral() || !e2.isNumeral() {
+		return false
+	}
+	if (op == types.OP_DIV || op == types.OP_MOD) && e2.nval == 0 {
+		return false // do not attempt to divide by 0
+	}
+	e1.nval = types.Arith(op, e1.nval, e2.nval)
+	return true
+}
+
+func (fs *funcState) codeArith(op types.OpCode, e1, e2 *expDesc, line int) {
+	if constFolding(op, e1, e2) {
+		return
+	}
+	o2 := 0
+	if op != types.OP_UNM && op != types.OP_LEN {
+		o2 = fs.exp2RK(e2)
+	}
+	o1 := fs.exp2RK(e1)
+	if o1 > o2 {
+		fs.freeExp(e1)
+		fs.freeExp(e2)
+	} else {
+		fs.freeExp(e2)
+		fs.freeExp(e1)
+	}
+	e1.info = fs.codeABC(op, 0, o1, o2)
+	e1.k = vRelocable
+	fs.fixLine(line)
+}
+
+func (fs *funcState) codeComp(op types.OpCode, cond int, e1, e2 *expDesc) {
+	o1 := fs.exp2RK(e1)
+	o2 := fs.exp2RK(e2)
+	fs.freeExp(e2)
+	fs.freeExp(e1)
+	if cond == 0 && op != types.OP_EQ {
+		// exchange args to replace by '<' or '<='
+		o1, o2 = o2, o1
+		cond = 1
+	}
+	e1.info = fs.condJump(op, cond, o1, o2)
+	e1.k = vJmp
+}
+
+func (fs *funcState) prefix(op unOpr, e *expDesc, line int) {
+	var e2 expDesc
+	e2.init(vKNum, 0)
+	switch op {
+	case oprMinus:
+		if e.isNumeral() {
+			// minus constant? fold it
+			e.nval = -e.nval
+		} else {
+			fs.exp2AnyReg(e)
+			fs.codeArith(types.OP_UNM, e, &e2, line)
+		}
+	case oprNot:
+		fs.codeNot(e)
+	case oprLen:
+		fs.exp2AnyReg(e) // cannot operate on constants
+		fs.codeArith(types.OP_LEN, e, &e2, line)
+	default:
+		panic("invalid unary operator")
+	}
+}
+
+func (fs *funcState) infix(op binOpr, v *expDesc) {
+	switch op {
+	case oprAnd:
+		fs.goIfTrue(v)
+	case oprOr:
+		fs.goIfFalse(v)
+	case oprConcat:
+		fs.exp2NextReg(v) // operand must be on the 'stack'
+	case oprAdd, oprSub, oprMul, oprDiv, oprMod, oprPow:
+		if !v.isNumeral() {
+			fs.exp2RK(v)
+		}
+	default:
+		fs.exp2RK(v)
+	}
+}
+
+func (fs *funcState) posfix(op binOpr, e1, e2 *expDesc, line int) {
+	switch op {
+	case oprAnd:
+		fs.dischargeVars(e2)
+		fs.concat(&e2.f, e1.f)
+		*e1 = *e2
+	case oprOr:
+		fs.dischargeVars(e2)
+		fs.concat(&e2.t, e1.t)
+		*e1 = *e2
+	case oprConcat:
+		fs.exp2Val(e2)
+		if e2.k == vRelocable && fs.getCode(e2).GetOpCode() == types.OP_CONCAT {
+			fs.freeExp(e1)
+			fs.getCode(e2).SetArgB(e1.info)
+			e1.k = vRelocable
+			e1.info = e2.info
+		} else {
+			fs.exp2NextReg(e2) // operand must be on the 'stack'
+			fs.codeArith(types.OP_CONCAT, e1, e2, line)
+		}
+	case oprAdd, oprSub, oprMul, oprDiv, oprMod, oprPow:
+		fs.codeArith(types.OpCode(int(op-oprAdd)+int(types.OP_ADD)), e1, e2, line)
+	case oprEq, oprLt, oprLe:
+		fs.codeComp(types.OpCode(int(op-oprEq)+int(types.OP_EQ)), 1, e1, e2)
+	case oprNe, oprGt, oprGe:
+		fs.codeComp(types.OpCode(int(op-oprNe)+int(types.OP_EQ)), 0, e1, e2)
+	default:
+		panic("invalid binary operator")
+	}
+}
+
+func (fs *funcState) fixLine(line int) {
+	fs.f.LineInfo[fs.pc-1] = int32(line)
+}
+
+func (fs *funcState) setList(base, nElems, toStore int) {
+	c := (nElems-1)/types.LFIELDS_PER_FLUSH + 1
+	b := toStore
+	if toStore == types.LUNE_MULTRET {
+		b = 0
+	}
+	if c <= types.MAXARG_C {
+		fs.codeABC(types.OP_SETLIST, base, b, c)
+	} else if c <= types.MAXARG_Ax {
+		fs.codeABC(types.OP_SETLIST, base, b, 0)
+		fs.codeExtraArg(c)
+	} else {
+		fs.ls.syntaxError("constructor too long")
+	}
+	fs.freeReg = base + 1 // free registers with list values
+}
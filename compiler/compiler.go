@@ -0,0 +1,38 @@
+package compiler
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/mna/lune/types"
+)
+
+// Compiles the Lua source code read from r into a function prototype, the
+// main chunk of the program. The chunk name is used as source for debug
+// information and error messages, with the same conventions as Lua ("@file.lua"
+// for a file, "=stdin" for a literal name). A syntax error is returned as
+// a *SyntaxError.
+func Compile(r io.Reader, chunkName string) (p *types.Prototype, err error) {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like the serializer, the lexer and parser panic with a *SyntaxError as
+	// soon as an error is detected.
+	defer func() {
+		if e := recover(); e != nil {
+			if se, ok := e.(*SyntaxError); ok {
+				p, err = nil, se
+				return
+			}
+			panic(e)
+		}
+	}()
+
+	ls := newLexState(src, chunkName)
+	ls.dyd = &dynData{}
+	fs := &funcState{f: newPrototype(chunkName)}
+	ls.mainFunc(fs)
+	return fs.f, nil
+}
@@ -0,0 +1,148 @@
+package compiler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mna/lune/serializer"
+	"github.com/mna/lune/types"
+)
+
+// Compile all the Lua test files of the vm and compare the result with the
+// precompiled chunks. Line information is ignored, some sources got comments
+// added after their chunk was compiled.
+func TestCompileTestdata(t *testing.T) {
+	files, err := filepath.Glob("../vm/testdata/*.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no test file found")
+	}
+	for _, fn := range files {
+		name := strings.TrimSuffix(filepath.Base(fn), ".lua")
+		pEx, err := loadChunk(strings.TrimSuffix(fn, ".lua") + ".out")
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		pAc, err := compileFile(fn)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		assertPrototypes(t, name, pEx, pAc)
+		if err := serializer.Verify(pAc); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+}
+
+// Syntax errors are reported with the chunk name and the line.
+func TestSyntaxErrors(t *testing.T) {
+	cases := []struct {
+		src   string
+		chunk string
+		err   string
+	}{
+		{"a = ", "@t.lua", "t.lua:1: unexpected symbol near <eof>"},
+		{"local a = 1\nlocal 3", "=stdin", "stdin:2: <name> expected near '3'"},
+		{"x = 'abc\ny = 2", "@t.lua", "t.lua:1: unfinished string near ''abc'"},
+		{"for i = 1 do end", "@t.lua", "t.lua:1: ',' expected near 'do'"},
+		{"goto l", "@t.lua", "t.lua:1: no visible label 'l' for <goto> at line 1"},
+		{"return return", "a = 1", `[string "a = 1"]:1: unexpected symbol near 'return'`},
+	}
+	for _, c := range cases {
+		_, err := Compile(strings.NewReader(c.src), c.chunk)
+		if err == nil {
+			t.Errorf("%q: expected error %q, got none", c.src, c.err)
+		} else if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("%q: expected a *SyntaxError, got %T", c.src, err)
+		} else if err.Error() != c.err {
+			t.Errorf("%q: expected error %q, got %q", c.src, c.err, err)
+		}
+	}
+}
+
+func loadChunk(fn string) (*types.Prototype, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return serializer.Load(f)
+}
+
+func compileFile(fn string) (*types.Prototype, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Compile(f, "@"+filepath.Base(fn))
+}
+
+func assertPrototypes(t *testing.T, ctx string, pEx, pAc *types.Prototype) {
+	if pEx.Source != pAc.Source {
+		t.Errorf("%s: expected source %q, got %q", ctx, pEx.Source, pAc.Source)
+	}
+	mEx, mAc := pEx.Meta, pAc.Meta
+	if mEx.NumParams != mAc.NumParams || mEx.IsVarArg != mAc.IsVarArg || mEx.MaxStackSize != mAc.MaxStackSize {
+		t.Errorf("%s: expected params %d, vararg %d and stack size %d, got %d, %d and %d", ctx,
+			mEx.NumParams, mEx.IsVarArg, mEx.MaxStackSize, mAc.NumParams, mAc.IsVarArg, mAc.MaxStackSize)
+	}
+
+	if lEx, lAc := len(pEx.Code), len(pAc.Code); lEx != lAc {
+		t.Errorf("%s: expected %d instructions, got %d", ctx, lEx, lAc)
+	} else {
+		for i, iEx := range pEx.Code {
+			if iAc := pAc.Code[i]; iEx != iAc {
+				t.Errorf("%s: expected instruction %d to be %08x, got %08x", ctx, i, uint32(iEx), uint32(iAc))
+			}
+		}
+	}
+	if lEx, lAc := len(pAc.LineInfo), len(pAc.Code); lEx != lAc {
+		t.Errorf("%s: expected line info for %d instructions, got %d", ctx, lAc, lEx)
+	}
+
+	if lEx, lAc := len(pEx.Ks), len(pAc.Ks); lEx != lAc {
+		t.Errorf("%s: expected %d constants, got %d", ctx, lEx, lAc)
+	} else {
+		for i, kEx := range pEx.Ks {
+			if kAc := pAc.Ks[i]; kEx != kAc {
+				t.Errorf("%s: expected constant %d to be %v, got %v", ctx, i, kEx, kAc)
+			}
+		}
+	}
+
+	if lEx, lAc := len(pEx.Upvalues), len(pAc.Upvalues); lEx != lAc {
+		t.Errorf("%s: expected %d upvalues, got %d", ctx, lEx, lAc)
+	} else {
+		for i, uEx := range pEx.Upvalues {
+			if uAc := pAc.Upvalues[i]; *uEx != *uAc {
+				t.Errorf("%s: expected upvalue %d to be %v, got %v", ctx, i, *uEx, *uAc)
+			}
+		}
+	}
+
+	if lEx, lAc := len(pEx.LocVars), len(pAc.LocVars); lEx != lAc {
+		t.Errorf("%s: expected %d local variables, got %d", ctx, lEx, lAc)
+	} else {
+		for i, vEx := range pEx.LocVars {
+			if vAc := pAc.LocVars[i]; *vEx != *vAc {
+				t.Errorf("%s: expected local variable %d to be %v, got %v", ctx, i, *vEx, *vAc)
+			}
+		}
+	}
+
+	if lEx, lAc := len(pEx.Protos), len(pAc.Protos); lEx != lAc {
+		t.Errorf("%s: expected %d functions, got %d", ctx, lEx, lAc)
+	} else {
+		for i, sub := range pEx.Protos {
+			assertPrototypes(t, fmt.Sprintf("%s.%d", ctx, i), sub, pAc.Protos[i])
+		}
+	}
+}
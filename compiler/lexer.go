@@ -0,0 +1,564 @@
+package compiler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mna/lune/types"
+)
+
+/*
+  Mostly a port of llex.{c,h} from Lua
+
+  Lexical analyzer
+*/
+
+type token int
+
+const (
+	_EOZ = -1 // end of stream
+
+	_FIRST_RESERVED = 257
+
+	// Characters represented by the escape sequences \a, \b, \f, \n, \r, \t and \v
+	_ESCAPES = "\a\b\f\n\r\t\v"
+)
+
+const (
+	// terminal symbols denoted by reserved words
+	tkAnd token = iota + _FIRST_RESERVED
+	tkBreak
+	tkDo
+	tkElse
+	tkElseif
+	tkEnd
+	tkFalse
+	tkFor
+	tkFunction
+	tkGoto
+	tkIf
+	tkIn
+	tkLocal
+	tkNil
+	tkNot
+	tkOr
+	tkRepeat
+	tkReturn
+	tkThen
+	tkTrue
+	tkUntil
+	tkWhile
+	// other terminal symbols
+	tkConcat
+	tkDots
+	tkEq
+	tkGe
+	tkLe
+	tkNe
+	tkDbColon
+	tkEOS
+	tkNumber
+	tkName
+	tkString
+)
+
+const _NUM_RESERVED = int(tkWhile - _FIRST_RESERVED + 1)
+
+var tokenNames = [...]string{
+	"and", "break", "do", "else", "elseif",
+	"end", "false", "for", "function", "goto", "if",
+	"in", "local", "nil", "not", "or", "repeat",
+	"return", "then", "true", "until", "while",
+	"..", "...", "==", ">=", "<=", "~=", "::", "<eof>",
+	"<number>", "<name>", "<string>",
+}
+
+var reserved = make(map[string]token, _NUM_RESERVED)
+
+func init() {
+	for i := 0; i < _NUM_RESERVED; i++ {
+		reserved[tokenNames[i]] = token(i + _FIRST_RESERVED)
+	}
+}
+
+// Semantic information of a token
+type tokenInfo struct {
+	tok token
+	n   float64 // for tkNumber
+	s   string  // for tkName and tkString
+}
+
+type lexState struct {
+	src        []byte
+	pos        int // position of the next byte to read in src
+	current    int // current character
+	lineNumber int // input line counter
+	lastLine   int // line of last token 'consumed'
+	t          tokenInfo
+	lookahead  tokenInfo
+	fs         *funcState
+	dyd        *dynData
+	buf        []byte // buffer for tokens
+	source     string // current source name
+	envn       string // environment variable name
+	nCcalls    int    // number of nested "C calls" (recursive descent levels)
+}
+
+// The error raised (as a panic) by the lexer and the parser
+type SyntaxError struct {
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return e.Msg
+}
+
+func isAlpha(c int) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+}
+
+func isDigit(c int) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isAlNum(c int) bool {
+	return isAlpha(c) || isDigit(c)
+}
+
+func isXDigit(c int) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isSpace(c int) bool {
+	return c == ' ' || (c >= '\t' && c <= '\r')
+}
+
+func isPrint(c int) bool {
+	return c >= 32 && c < 127
+}
+
+func hexValue(c int) int {
+	if isDigit(c) {
+		return c - '0'
+	}
+	return (c | ('a' ^ 'A')) - 'a' + 10
+}
+
+func newLexState(src []byte, source string) *lexState {
+	ls := &lexState{
+		src:        src,
+		lookahead:  tokenInfo{tok: tkEOS},
+		lineNumber: 1,
+		lastLine:   1,
+		source:     source,
+		envn:       "_ENV",
+	}
+	ls.next()
+	return ls
+}
+
+func (ls *lexState) next() {
+	if ls.pos < len(ls.src) {
+		ls.current = int(ls.src[ls.pos])
+		ls.pos++
+	} else {
+		ls.current = _EOZ
+	}
+}
+
+func (ls *lexState) save(c int) {
+	ls.buf = append(ls.buf, byte(c))
+}
+
+func (ls *lexState) saveAndNext() {
+	ls.save(ls.current)
+	ls.next()
+}
+
+func (ls *lexState) currIsNewline() bool {
+	return ls.current == '\n' || ls.current == '\r'
+}
+
+func (ls *lexState) token2str(t token) string {
+	if t < _FIRST_RESERVED {
+		// single-byte symbols
+		if isPrint(int(t)) {
+			return fmt.Sprintf("'%c'", t)
+		}
+		return fmt.Sprintf("char(%d)", t)
+	}
+	s := tokenNames[t-_FIRST_RESERVED]
+	if t < tkEOS {
+		// fixed format (symbols and reserved words)
+		return fmt.Sprintf("'%s'", s)
+	}
+	// names, strings, and numerals
+	return s
+}
+
+func (ls *lexState) txtToken(t token) string {
+	switch t {
+	case tkName, tkString, tkNumber:
+		return fmt.Sprintf("'%s'", ls.buf)
+	default:
+		return ls.token2str(t)
+	}
+}
+
+func (ls *lexState) lexError(msg string, t token) {
+	msg = fmt.Sprintf("%s:%d: %s", types.ChunkID(ls.source), ls.lineNumber, msg)
+	if t != 0 {
+		msg = fmt.Sprintf("%s near %s", msg, ls.txtToken(t))
+	}
+	panic(&SyntaxError{msg})
+}
+
+func (ls *lexState) syntaxError(msg string) {
+	ls.lexError(msg, ls.t.tok)
+}
+
+// Increment line number and skips newline sequence (any of
+// \n, \r, \n\r, or \r\n)
+func (ls *lexState) incLineNumber() {
+	old := ls.current
+	ls.next() // skip '\n' or '\r'
+	if ls.currIsNewline() && ls.current != old {
+		ls.next() // skip '\n\r' or '\r\n'
+	}
+	if ls.lineNumber++; ls.lineNumber >= types.MAX_INT {
+		ls.syntaxError("chunk has too many lines")
+	}
+}
+
+// Checks whether current char is in set (if so, saves it and reads the next
+// char).
+func (ls *lexState) checkNext(set string) bool {
+	if ls.current == _EOZ || strings.IndexByte(set, byte(ls.current)) < 0 {
+		return false
+	}
+	ls.saveAndNext()
+	return true
+}
+
+// This function is quite liberal in what it accepts, as the actual
+// conversion validates the result.
+func (ls *lexState) readNumeral(si *tokenInfo) {
+	expo := "Ee"
+	first := ls.current
+	ls.saveAndNext()
+	if first == '0' && ls.checkNext("Xx") {
+		// hexadecimal?
+		expo = "Pp"
+	}
+	for {
+		if ls.checkNext(expo) {
+			// exponent part? optional exponent sign
+			ls.checkNext("+-")
+		}
+		if isXDigit(ls.current) || ls.current == '.' {
+			ls.saveAndNext()
+		} else {
+			break
+		}
+	}
+	n, ok := types.StrToNumber(string(ls.buf))
+	if !ok {
+		ls.lexError("malformed number", tkNumber)
+	}
+	si.n = n
+}
+
+// Skips a sequence '[=*[' or ']=*]' and returns its number of '='s, or
+// a negative value if the sequence is malformed (-1 if there is no '='
+// sign).
+func (ls *lexState) skipSep() int {
+	count := 0
+	s := ls.current
+	ls.saveAndNext()
+	for ls.current == '=' {
+		ls.saveAndNext()
+		count++
+	}
+	if ls.current == s {
+		return count
+	}
+	return (-count) - 1
+}
+
+func (ls *lexState) readLongString(si *tokenInfo, sep int) {
+	ls.saveAndNext() // skip 2nd '['
+	if ls.currIsNewline() {
+		// string starts with a newline? skip it
+		ls.incLineNumber()
+	}
+loop:
+	for {
+		switch ls.current {
+		case _EOZ:
+			if si != nil {
+				ls.lexError("unfinished long string", tkEOS)
+			} else {
+				ls.lexError("unfinished long comment", tkEOS)
+			}
+		case ']':
+			if ls.skipSep() == sep {
+				ls.saveAndNext() // skip 2nd ']'
+				break loop
+			}
+		case '\n', '\r':
+			ls.save('\n')
+			ls.incLineNumber()
+			if si == nil {
+				// avoid wasting space
+				ls.buf = ls.buf[:0]
+			}
+		default:
+			if si != nil {
+				ls.saveAndNext()
+			} else {
+				ls.next()
+			}
+		}
+	}
+	if si != nil {
+		si.s = string(ls.buf[2+sep : len(ls.buf)-(2+sep)])
+	}
+}
+
+func (ls *lexState) escError(c []int, msg string) {
+	ls.buf = ls.buf[:0] // prepare error message
+	ls.save('\\')
+	for _, ch := range c {
+		if ch == _EOZ {
+			break
+		}
+		ls.save(ch)
+	}
+	ls.lexError(msg, tkString)
+}
+
+func (ls *lexState) readHexaEsc() int {
+	var c [3]int
+	r := 0
+	c[0] = 'x' // for error message
+	for i := 1; i < 3; i++ {
+		// read two hexadecimal digits
+		ls.next()
+		c[i] = ls.current
+		if !isXDigit(c[i]) {
+			ls.escError(c[:i+1], "hexadecimal digit expected")
+		}
+		r = (r << 4) + hexValue(c[i])
+	}
+	return r
+}
+
+func (ls *lexState) readDecEsc() int {
+	var c [3]int
+	var i int
+	r := 0
+	for i = 0; i < 3 && isDigit(ls.current); i++ {
+		// read up to 3 digits
+		c[i] = ls.current
+		r = 10*r + c[i] - '0'
+		ls.next()
+	}
+	if r > 255 {
+		ls.escError(c[:i], "decimal escape too large")
+	}
+	return r
+}
+
+func (ls *lexState) readString(del int, si *tokenInfo) {
+	ls.saveAndNext() // keep delimiters for error messages
+	for ls.current != del {
+		switch ls.current {
+		case _EOZ:
+			ls.lexError("unfinished string", tkEOS)
+		case '\n', '\r':
+			ls.lexError("unfinished string", tkString)
+		case '\\':
+			// escape sequences
+			var c int
+			ls.next() // do not save the '\'
+			switch ls.current {
+			case 'a', 'b', 'f', 'n', 'r', 't', 'v':
+				c = int(_ESCAPES[strings.IndexByte("abfnrtv", byte(ls.current))])
+				ls.next()
+				ls.save(c)
+			case 'x':
+				c = ls.readHexaEsc()
+				ls.next()
+				ls.save(c)
+			case '\n', '\r':
+				ls.incLineNumber()
+				ls.save('\n')
+			case '\\', '"', '\'':
+				c = ls.current
+				ls.next()
+				ls.save(c)
+			case _EOZ:
+				// will raise an error next loop
+			case 'z':
+				// zap following span of spaces
+				ls.next() // skip the 'z'
+				for isSpace(ls.current) {
+					if ls.currIsNewline() {
+						ls.incLineNumber()
+					} else {
+						ls.next()
+					}
+				}
+			default:
+				if !isDigit(ls.current) {
+					ls.escError([]int{ls.current}, "invalid escape sequence")
+				}
+				// digital escape \ddd
+				ls.save(ls.readDecEsc())
+			}
+		default:
+			ls.saveAndNext()
+		}
+	}
+	ls.saveAndNext() // skip delimiter
+	si.s = string(ls.buf[1 : len(ls.buf)-1])
+}
+
+func (ls *lexState) lex(si *tokenInfo) token {
+	ls.buf = ls.buf[:0]
+	for {
+		switch ls.current {
+		case '\n', '\r':
+			// line breaks
+			ls.incLineNumber()
+		case ' ', '\f', '\t', '\v':
+			// spaces
+			ls.next()
+		case '-':
+			// '-' or '--' (comment)
+			ls.next()
+			if ls.current != '-' {
+				return '-'
+			}
+			// else is a comment
+			ls.next()
+			if ls.current == '[' {
+				// long comment?
+				sep := ls.skipSep()
+				ls.buf = ls.buf[:0] // 'skipSep' may dirty the buffer
+				if sep >= 0 {
+					ls.readLongString(nil, sep) // skip long comment
+					ls.buf = ls.buf[:0]         // previous call may dirty the buffer
+					break
+				}
+			}
+			// else short comment
+			for !ls.currIsNewline() && ls.current != _EOZ {
+				ls.next() // skip until end of line (or end of file)
+			}
+		case '[':
+			// long string or simply '['
+			sep := ls.skipSep()
+			if sep >= 0 {
+				ls.readLongString(si, sep)
+				return tkString
+			} else if sep == -1 {
+				return '['
+			}
+			ls.lexError("invalid long string delimiter", tkString)
+		case '=':
+			ls.next()
+			if ls.current != '=' {
+				return '='
+			}
+			ls.next()
+			return tkEq
+		case '<':
+			ls.next()
+			if ls.current != '=' {
+				return '<'
+			}
+			ls.next()
+			return tkLe
+		case '>':
+			ls.next()
+			if ls.current != '=' {
+				return '>'
+			}
+			ls.next()
+			return tkGe
+		case '~':
+			ls.next()
+			if ls.current != '=' {
+				return '~'
+			}
+			ls.next()
+			return tkNe
+		case ':':
+			ls.next()
+			if ls.current != ':' {
+				return ':'
+			}
+			ls.next()
+			return tkDbColon
+		case '"', '\'':
+			// short literal strings
+			ls.readString(ls.current, si)
+			return tkString
+		case '.':
+			// '.', '..', '...', or number
+			ls.saveAndNext()
+			if ls.checkNext(".") {
+				if ls.checkNext(".") {
+					return tkDots // '...'
+				}
+				return tkConcat // '..'
+			} else if !isDigit(ls.current) {
+				return '.'
+			}
+			ls.readNumeral(si)
+			return tkNumber
+		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+			ls.readNumeral(si)
+			return tkNumber
+		case _EOZ:
+			return tkEOS
+		default:
+			if isAlpha(ls.current) {
+				// identifier or reserved word?
+				for {
+					ls.saveAndNext()
+					if !isAlNum(ls.current) {
+						break
+					}
+				}
+				s := string(ls.buf)
+				if t, ok := reserved[s]; ok {
+					return t
+				}
+				si.s = s
+				return tkName
+			}
+			// single-char tokens (+ - / ...)
+			c := ls.current
+			ls.next()
+			return token(c)
+		}
+	}
+}
+
+func (ls *lexState) nextToken() {
+	ls.lastLine = ls.lineNumber
+	if ls.lookahead.tok != tkEOS {
+		// is there a look-ahead token? use this one
+		ls.t = ls.lookahead
+		ls.lookahead.tok = tkEOS // and discharge it
+	} else {
+		ls.t.tok = ls.lex(&ls.t)
+	}
+}
+
+func (ls *lexState) lookaheadToken() token {
+	ls.lookahead.tok = ls.lex(&ls.lookahead)
+	return ls.lookahead.tok
+}
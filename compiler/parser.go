@@ -0,0 +1,1412 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/mna/lune/types"
+)
+
+/*
+  Mostly a port of lparser.{c,h} from Lua
+
+  Lua parser
+*/
+
+const (
+	_MAXVARS        = 200 // maximum number of local variables per function
+	_MAXUPVAL       = 255 // maximum number of upvalues per function
+	_LUAI_MAXCCALLS = 200 // maximum depth for nested "C calls" (recursive descent levels)
+	_UNARY_PRIORITY = 8   // priority for unary operators
+)
+
+// Nodes for block list (list of active blocks)
+type blockCnt struct {
+	previous   *blockCnt // chain
+	firstLabel int       // index of first label in this block
+	firstGoto  int       // index of first pending goto in this block
+	nActVar    int       // number of active locals outside the block
+	upval      bool      // true if some variable in the block is an upvalue
+	isLoop     bool      // true if 'block' is a loop
+}
+
+// Description of pending goto statements and label statements
+type labelDesc struct {
+	name    string // label identifier
+	pc      int    // position in code
+	line    int    // line where it appeared
+	nActVar int    // local level where it appears in current block
+}
+
+// Dynamic structures used by the parser
+type dynData struct {
+	actVar []int // list of active local variables (indexes in LocVars)
+	gt     []labelDesc
+	label  []labelDesc
+}
+
+// State needed to generate code for a given function
+type funcState struct {
+	f          *types.Prototype
+	h          map[interface{}]int // table to find (and reuse) elements in 'Ks'
+	prev       *funcState          // enclosing function
+	ls         *lexState           // lexical state
+	bl         *blockCnt           // chain of current blocks
+	pc         int                 // next position to code (equivalent to 'ncode')
+	lastTarget int                 // 'label' of last 'jump label'
+	jpc        int                 // list of pending jumps to 'pc'
+	firstLocal int                 // index of first local var (in dynData array)
+	nActVar    int                 // number of active local variables
+	freeReg    int                 // first free register
+}
+
+// Priority of binary operators, ORDER OPR
+var priority = [...]struct {
+	left  int // left priority for each binary operator
+	right int // right priority
+}{
+	{6, 6}, {6, 6}, {7, 7}, {7, 7}, {7, 7}, // '+' '-' '*' '/' '%'
+	{10, 9}, {5, 4}, // '^', '..' (right associative)
+	{3, 3}, {3, 3}, {3, 3}, // '==', '<', '<='
+	{3, 3}, {3, 3}, {3, 3}, // '~=', '>', '>='
+	{2, 2}, {1, 1}, // 'and', 'or'
+}
+
+func (ls *lexState) semError(msg string) {
+	ls.t.tok = 0 // remove 'near to' from final message
+	ls.syntaxError(msg)
+}
+
+func (ls *lexState) errorExpected(t token) {
+	ls.syntaxError(fmt.Sprintf("%s expected", ls.token2str(t)))
+}
+
+func (fs *funcState) errorLimit(limit int, what string) {
+	var where string
+	if line := fs.f.Meta.LineDefined; line == 0 {
+		where = "main function"
+	} else {
+		where = fmt.Sprintf("function at line %d", line)
+	}
+	fs.ls.syntaxError(fmt.Sprintf("too many %s (limit is %d) in %s", what, limit, where))
+}
+
+func (fs *funcState) checkLimit(v, l int, what string) {
+	if v > l {
+		fs.errorLimit(l, what)
+	}
+}
+
+func (ls *lexState) testNext(c token) bool {
+	if ls.t.tok == c {
+		ls.nextToken()
+		return true
+	}
+	return false
+}
+
+func (ls *lexState) check(c token) {
+	if ls.t.tok != c {
+		ls.errorExpected(c)
+	}
+}
+
+func (ls *lexState) checkNextToken(c token) {
+	ls.check(c)
+	ls.nextToken()
+}
+
+func (ls *lexState) checkCondition(c bool, msg string) {
+	if !c {
+		ls.syntaxError(msg)
+	}
+}
+
+func (ls *lexState) checkMatch(what, who token, where int) {
+	if !ls.testNext(what) {
+		if where == ls.lineNumber {
+			ls.errorExpected(what)
+		} else {
+			ls.syntaxError(fmt.Sprintf("%s expected (to close %s at line %d)",
+				ls.token2str(what), ls.token2str(who), where))
+		}
+	}
+}
+
+func (ls *lexState) strCheckName() string {
+	ls.check(tkName)
+	s := ls.t.s
+	ls.nextToken()
+	return s
+}
+
+func (ls *lexState) codeString(e *expDesc, s string) {
+	e.init(vK, ls.fs.stringK(s))
+}
+
+func (ls *lexState) checkName(e *expDesc) {
+	ls.codeString(e, ls.strCheckName())
+}
+
+func (ls *lexState) registerLocalVar(varName string) int {
+	f := ls.fs.f
+	f.LocVars = append(f.LocVars, &types.LocVar{Name: varName})
+	return len(f.LocVars) - 1
+}
+
+func (ls *lexState) newLocalVar(name string) {
+	fs := ls.fs
+	reg := ls.registerLocalVar(name)
+	fs.checkLimit(len(ls.dyd.actVar)+1-fs.firstLocal, _MAXVARS, "local variables")
+	ls.dyd.actVar = append(ls.dyd.actVar, reg)
+}
+
+func (fs *funcState) getLocVar(i int) *types.LocVar {
+	idx := fs.ls.dyd.actVar[fs.firstLocal+i]
+	return fs.f.LocVars[idx]
+}
+
+func (ls *lexState) adjustLocalVars(nVars int) {
+	fs := ls.fs
+	fs.nActVar += nVars
+	for ; nVars > 0; nVars-- {
+		fs.getLocVar(fs.nActVar - nVars).Startpc = uint32(fs.pc)
+	}
+}
+
+func (fs *funcState) removeVars(toLevel int) {
+	n := len(fs.ls.dyd.actVar) - (fs.nActVar - toLevel)
+	for fs.nActVar > toLevel {
+		fs.nActVar--
+		fs.getLocVar(fs.nActVar).Endpc = uint32(fs.pc)
+	}
+	fs.ls.dyd.actVar = fs.ls.dyd.actVar[:n]
+}
+
+func (fs *funcState) searchUpvalue(name string) int {
+	for i, up := range fs.f.Upvalues {
+		if up.Name == name {
+			return i
+		}
+	}
+	return -1 // not found
+}
+
+func (fs *funcState) newUpvalue(name string, v *expDesc) int {
+	fs.checkLimit(len(fs.f.Upvalues)+1, _MAXUPVAL, "upvalues")
+	var instack byte
+	if v.k == vLocal {
+		instack = 1
+	}
+	fs.f.Upvalues = append(fs.f.Upvalues, &types.Upvalue{Name: name, Instack: instack, Idx: byte(v.info)})
+	return len(fs.f.Upvalues) - 1
+}
+
+func (fs *funcState) searchVar(n string) int {
+	for i := fs.nActVar - 1; i >= 0; i-- {
+		if n == fs.getLocVar(i).Name {
+			return i
+		}
+	}
+	return -1 // not found
+}
+
+// Mark block where variable at given level was defined (to emit close
+// instructions later).
+func (fs *funcState) markUpval(level int) {
+	bl := fs.bl
+	for bl.nActVar > level {
+		bl = bl.previous
+	}
+	bl.upval = true
+}
+
+// Find variable with given name 'n'. If it is an upvalue, add this
+// upvalue into all intermediate functions.
+func singleVarAux(fs *funcState, n string, v *expDesc, base bool) expKind {
+	if fs == nil {
+		// no more levels? default is global
+		return vVoid
+	}
+	if idx := fs.searchVar(n); idx >= 0 {
+		// found? variable is local
+		v.init(vLocal, idx)
+		if !base {
+			fs.markUpval(idx) // local will be used as an upval
+		}
+		return vLocal
+	}
+	// not found as local at current level; try upvalues
+	idx := fs.searchUpvalue(n)
+	if idx < 0 {
+		// not found? try upper levels
+		if singleVarAux(fs.prev, n, v, false) == vVoid {
+			return vVoid // not found; is a global
+		}
+		// else was LOCAL or UPVAL
+		idx = fs.newUpvalue(n, v) // will be a new upvalue
+	}
+	v.init(vUpval, idx)
+	return vUpval
+}
+
+func (ls *lexState) singleVar(v *expDesc) {
+	varName := ls.strCheckName()
+	fs := ls.fs
+	if singleVarAux(fs, varName, v, true) == vVoid {
+		// global name?
+		var key expDesc
+		singleVarAux(fs, ls.envn, v, true) // get environment variable
+		ls.codeString(&key, varName)       // key is variable name
+		fs.indexed(v, &key)                // env[varname]
+	}
+}
+
+func (ls *lexState) adjustAssign(nVars, nExps int, e *expDesc) {
+	fs := ls.fs
+	extra := nVars - nExps
+	if hasMultRet(e.k) {
+		extra++ // includes call itself
+		if extra < 0 {
+			extra = 0
+		}
+		fs.setReturns(e, extra) // last exp. provides the difference
+		if extra > 1 {
+			fs.reserveRegs(extra - 1)
+		}
+	} else {
+		if e.k != vVoid {
+			// at least one expression? close last expression
+			fs.exp2NextReg(e)
+		}
+		if extra > 0 {
+			reg := fs.freeReg
+			fs.reserveRegs(extra)
+			fs.nil(reg, extra)
+		}
+	}
+}
+
+func (ls *lexState) enterLevel() {
+	ls.nCcalls++
+	ls.fs.checkLimit(ls.nCcalls, _LUAI_MAXCCALLS, "C levels")
+}
+
+func (ls *lexState) leaveLevel() {
+	ls.nCcalls--
+}
+
+func (ls *lexState) closeGoto(g int, label *labelDesc) {
+	fs := ls.fs
+	gt := &ls.dyd.gt[g]
+	if gt.nActVar < label.nActVar {
+		vname := fs.getLocVar(gt.nActVar).Name
+		ls.semError(fmt.Sprintf("<goto %s> at line %d jumps into the scope of local '%s'",
+			gt.name, gt.line, vname))
+	}
+	fs.patchList(gt.pc, label.pc)
+	// remove goto from pending list
+	ls.dyd.gt = append(ls.dyd.gt[:g], ls.dyd.gt[g+1:]...)
+}
+
+// Try to close a goto with existing labels; this solves backward jumps.
+func (ls *lexState) findLabel(g int) bool {
+	bl := ls.fs.bl
+	dyd := ls.dyd
+	gt := &dyd.gt[g]
+	// check labels in current block for a match
+	for i := bl.firstLabel; i < len(dyd.label); i++ {
+		lb := &dyd.label[i]
+		if lb.name == gt.name {
+			// correct label?
+			if gt.nActVar > lb.nActVar && (bl.upval || len(dyd.label) > bl.firstLabel) {
+				ls.fs.patchClose(gt.pc, lb.nActVar)
+			}
+			ls.closeGoto(g, lb) // close it
+			return true
+		}
+	}
+	return false // label not found; cannot close goto
+}
+
+func (ls *lexState) newLabelEntry(l *[]labelDesc, name string, line, pc int) int {
+	*l = append(*l, labelDesc{name: name, line: line, nActVar: ls.fs.nActVar, pc: pc})
+	return len(*l) - 1
+}
+
+// Check whether new label 'lb' matches any pending gotos in current
+// block; solves forward jumps.
+func (ls *lexState) findGotos(lb *labelDesc) {
+	i := ls.fs.bl.firstGoto
+	for i < len(ls.dyd.gt) {
+		if ls.dyd.gt[i].name == lb.name {
+			ls.closeGoto(i, lb)
+		} else {
+			i++
+		}
+	}
+}
+
+// "Export" pending gotos to outer level, to check them against
+// outer labels; if the block being exited has upvalues, and
+// the goto exits the scope of any variable (which can be the
+// upvalue), close those variables being exited.
+func (fs *funcState) moveGotosOut(bl *blockCnt) {
+	i := bl.firstGoto
+	// correct pending gotos to current block and try to close it
+	// with visible labels
+	for i < len(fs.ls.dyd.gt) {
+		gt := &fs.ls.dyd.gt[i]
+		if gt.nActVar > bl.nActVar {
+			if bl.upval {
+				fs.patchClose(gt.pc, bl.nActVar)
+			}
+			gt.nActVar = bl.nActVar
+		}
+		if !fs.ls.findLabel(i) {
+			i++ // move to next one
+		}
+	}
+}
+
+func (fs *funcState) enterBlock(bl *blockCnt, isLoop bool) {
+	bl.isLoop = isLoop
+	bl.nActVar = fs.nActVar
+	bl.firstLabel = len(fs.ls.dyd.label)
+	bl.firstGoto = len(fs.ls.dyd.gt)
+	bl.upval = false
+	bl.previous = fs.bl
+	fs.bl = bl
+}
+
+// Create a label named "break" to resolve break statements.
+func (ls *lexState) breakLabel() {
+	l := ls.newLabelEntry(&ls.dyd.label, "break", 0, ls.fs.pc)
+	ls.findGotos(&ls.dyd.label[l])
+}
+
+// Generates an error for an undefined 'goto'; choose appropriate
+// message when label name is a reserved word (which can only be 'break').
+func (ls *lexState) undefGoto(gt *labelDesc) {
+	if _, ok := reserved[gt.name]; ok {
+		ls.semError(fmt.Sprintf("<%s> at line %d not inside a loop", gt.name, gt.line))
+	}
+	ls.semError(fmt.Sprintf("no visible label '%s' for <goto> at line %d", gt.name, gt.line))
+}
+
+func (fs *funcState) leaveBlock() {
+	bl := fs.bl
+	ls := fs.ls
+	if bl.previous != nil && bl.upval {
+		// create a 'jump to here' to close upvalues
+		j := fs.jump()
+		fs.patchClose(j, bl.nActVar)
+		fs.patchToHere(j)
+	}
+	if bl.isLoop {
+		ls.breakLabel() // close pending breaks
+	}
+	fs.bl = bl.previous
+	fs.removeVars(bl.nActVar)
+	fs.freeReg = fs.nActVar                     // free registers
+	ls.dyd.label = ls.dyd.label[:bl.firstLabel] // remove local labels
+	if bl.previous != nil {
+		// inner block? update pending gotos to outer block
+		fs.moveGotosOut(bl)
+	} else if bl.firstGoto < len(ls.dyd.gt) {
+		// pending gotos in outer block? error
+		ls.undefGoto(&ls.dyd.gt[bl.firstGoto])
+	}
+}
+
+// Adds a new prototype into list of prototypes.
+func (ls *lexState) addPrototype() *types.Prototype {
+	f := ls.fs.f // prototype of current function
+	if len(f.Protos) >= types.MAXARG_Bx {
+		ls.fs.errorLimit(types.MAXARG_Bx, "functions")
+	}
+	clp := newPrototype(ls.source)
+	f.Protos = append(f.Protos, clp)
+	return clp
+}
+
+func newPrototype(source string) *types.Prototype {
+	return &types.Prototype{
+		Meta:   &types.FuncMeta{},
+		Source: source,
+	}
+}
+
+// Codes instruction to create new closure in parent function.
+func (ls *lexState) codeClosure(v *expDesc) {
+	fs := ls.fs.prev
+	v.init(vRelocable, fs.codeABx(types.OP_CLOSURE, 0, len(fs.f.Protos)-1))
+	fs.exp2NextReg(v) // fix it at the last register
+}
+
+func (ls *lexState) openFunc(fs *funcState, bl *blockCnt) {
+	fs.prev = ls.fs // linked list of funcstates
+	fs.ls = ls
+	ls.fs = fs
+	fs.pc = 0
+	fs.lastTarget = 0
+	fs.jpc = _NO_JUMP
+	fs.freeReg = 0
+	fs.nActVar = 0
+	fs.firstLocal = len(ls.dyd.actVar)
+	fs.bl = nil
+	fs.f.Source = ls.source
+	fs.f.Meta.MaxStackSize = 2 // registers 0/1 are always valid
+	fs.h = make(map[interface{}]int)
+	fs.enterBlock(bl, false)
+}
+
+func (ls *lexState) closeFunc() {
+	fs := ls.fs
+	fs.ret(0, 0) // final return
+	fs.leaveBlock()
+	ls.fs = fs.prev
+}
+
+/*
+  GRAMMAR RULES
+*/
+
+// Check whether current token is in the follow set of a block.
+// 'until' closes syntactical blocks, but do not close scope,
+// so it is handled separately.
+func (ls *lexState) blockFollow(withUntil bool) bool {
+	switch ls.t.tok {
+	case tkElse, tkElseif, tkEnd, tkEOS:
+		return true
+	case tkUntil:
+		return withUntil
+	default:
+		return false
+	}
+}
+
+func (ls *lexState) statList() {
+	// statlist -> { stat [';'] }
+	for !ls.blockFollow(true) {
+		if ls.t.tok == tkReturn {
+			ls.statement()
+			return // 'return' must be last statement
+		}
+		ls.statement()
+	}
+}
+
+func (ls *lexState) fieldSel(v *expDesc) {
+	// fieldsel -> ['.' | ':'] NAME
+	fs := ls.fs
+	var key expDesc
+	fs.exp2AnyRegUp(v)
+	ls.nextToken() // skip the dot or colon
+	ls.checkName(&key)
+	fs.indexed(v, &key)
+}
+
+func (ls *lexState) yIndex(v *expDesc) {
+	// index -> '[' expr ']'
+	ls.nextToken() // skip the '['
+	ls.expr(v)
+	ls.fs.exp2Val(v)
+	ls.checkNextToken(']')
+}
+
+/*
+  Rules for Constructors
+*/
+
+type consControl struct {
+	v       expDesc  // last list item read
+	t       *expDesc // table descriptor
+	nh      int      // total number of 'record' elements
+	na      int      // total number of array elements
+	toStore int      // number of array elements pending to be stored
+}
+
+func (ls *lexState) recField(cc *consControl) {
+	// recfield -> (NAME | '['exp1']') = exp1
+	fs := ls.fs
+	reg := ls.fs.freeReg
+	var key, val expDesc
+	if ls.t.tok == tkName {
+		fs.checkLimit(cc.nh, types.MAX_INT, "items in a constructor")
+		ls.checkName(&key)
+	} else {
+		// ls.t.tok == '['
+		ls.yIndex(&key)
+	}
+	cc.nh++
+	ls.checkNextToken('=')
+	rkKey := fs.exp2RK(&key)
+	ls.expr(&val)
+	fs.codeABC(types.OP_SETTABLE, cc.t.info, rkKey, fs.exp2RK(&val))
+	fs.freeReg = reg // free registers
+}
+
+func (fs *funcState) closeListField(cc *consControl) {
+	if cc.v.k == vVoid {
+		return // there is no list item
+	}
+	fs.exp2NextReg(&cc.v)
+	cc.v.k = vVoid
+	if cc.toStore == types.LFIELDS_PER_FLUSH {
+		fs.setList(cc.t.info, cc.na, cc.toStore) // flush
+		cc.toStore = 0                           // no more items pending
+	}
+}
+
+func (fs *funcState) lastListField(cc *consControl) {
+	if cc.toStore == 0 {
+		return
+	}
+	if hasMultRet(cc.v.k) {
+		fs.setMultRet(&cc.v)
+		fs.setList(cc.t.info, cc.na, types.LUNE_MULTRET)
+		cc.na-- // do not count last expression (unknown number of elements)
+	} else {
+		if cc.v.k != vVoid {
+			fs.exp2NextReg(&cc.v)
+		}
+		fs.setList(cc.t.info, cc.na, cc.toStore)
+	}
+}
+
+func (ls *lexState) listField(cc *consControl) {
+	// listfield -> exp
+	ls.expr(&cc.v)
+	ls.fs.checkLimit(cc.na, types.MAX_INT, "items in a constructor")
+	cc.na++
+	cc.toStore++
+}
+
+func (ls *lexState) field(cc *consControl) {
+	// field -> listfield | recfield
+	switch ls.t.tok {
+	case tkName:
+		// may be 'listfield' or 'recfield'
+		if ls.lookaheadToken() != '=' {
+			// expression?
+			ls.listField(cc)
+		} else {
+			ls.recField(cc)
+		}
+	case '[':
+		ls.recField(cc)
+	default:
+		ls.listField(cc)
+	}
+}
+
+func (ls *lexState) constructor(t *expDesc) {
+	// constructor -> '{' [ field { sep field } [sep] ] '}'
+	// sep -> ',' | ';'
+	fs := ls.fs
+	line := ls.lineNumber
+	pc := fs.codeABC(types.OP_NEWTABLE, 0, 0, 0)
+	var cc consControl
+	cc.t = t
+	t.init(vRelocable, pc)
+	cc.v.init(vVoid, 0) // no value (yet)
+	fs.exp2NextReg(t)   // fix it at stack top
+	ls.checkNextToken('{')
+	for {
+		if ls.t.tok == '}' {
+			break
+		}
+		fs.closeListField(&cc)
+		ls.field(&cc)
+		if !ls.testNext(',') && !ls.testNext(';') {
+			break
+		}
+	}
+	ls.checkMatch('}', '{', line)
+	fs.lastListField(&cc)
+	fs.f.Code[pc].SetArgB(types.Int2Fb(cc.na)) // set initial array size
+	fs.f.Code[pc].SetArgC(types.Int2Fb(cc.nh)) // set initial table size
+}
+
+func (ls *lexState) parList() {
+	// parlist -> [ param { ',' param } ]
+	fs := ls.fs
+	f := fs.f
+	nParams := 0
+	f.Meta.IsVarArg = 0
+	if ls.t.tok != ')' {
+		// is 'parlist' not empty?
+		for {
+			switch ls.t.tok {
+			case tkName:
+				// param -> NAME
+				ls.newLocalVar(ls.strCheckName())
+				nParams++
+			case tkDots:
+				// param -> '...'
+				ls.nextToken()
+				f.Meta.IsVarArg = 1
+			default:
+				ls.syntaxError("<name> or '...' expected")
+			}
+			if f.Meta.IsVarArg != 0 || !ls.testNext(',') {
+				break
+			}
+		}
+	}
+	ls.adjustLocalVars(nParams)
+	f.Meta.NumParams = byte(fs.nActVar)
+	fs.reserveRegs(fs.nActVar) // reserve register for parameters
+}
+
+func (ls *lexState) body(e *expDesc, isMethod bool, line int) {
+	// body ->  '(' parlist ')' block END
+	var newFs funcState
+	var bl blockCnt
+	newFs.f = ls.addPrototype()
+	newFs.f.Meta.LineDefined = uint32(line)
+	ls.openFunc(&newFs, &bl)
+	ls.checkNextToken('(')
+	if isMethod {
+		ls.newLocalVar("self") // create 'self' parameter
+		ls.adjustLocalVars(1)
+	}
+	ls.parList()
+	ls.checkNextToken(')')
+	ls.statList()
+	newFs.f.Meta.LastLineDefined = uint32(ls.lineNumber)
+	ls.checkMatch(tkEnd, tkFunction, line)
+	ls.codeClosure(e)
+	ls.closeFunc()
+}
+
+func (ls *lexState) expList(v *expDesc) int {
+	// explist -> expr { ',' expr }
+	n := 1 // at least one expression
+	ls.expr(v)
+	for ls.testNext(',') {
+		ls.fs.exp2NextReg(v)
+		ls.expr(v)
+		n++
+	}
+	return n
+}
+
+func (ls *lexState) funcArgs(f *expDesc, line int) {
+	fs := ls.fs
+	var args expDesc
+	var nParams int
+	switch ls.t.tok {
+	case '(':
+		// funcargs -> '(' [ explist ] ')'
+		ls.nextToken()
+		if ls.t.tok == ')' {
+			// arg list is empty?
+			args.k = vVoid
+		} else {
+			ls.expList(&args)
+			fs.setMultRet(&args)
+		}
+		ls.checkMatch(')', '(', line)
+	case '{':
+		// funcargs -> constructor
+		ls.constructor(&args)
+	case tkString:
+		// funcargs -> STRING
+		ls.codeString(&args, ls.t.s)
+		ls.nextToken() // must use 'seminfo' before 'next'
+	default:
+		ls.syntaxError("function arguments expected")
+	}
+	base := f.info // base register for call
+	if hasMultRet(args.k) {
+		nParams = types.LUNE_MULTRET // open call
+	} else {
+		if args.k != vVoid {
+			fs.exp2NextReg(&args) // close last argument
+		}
+		nParams = fs.freeReg - (base + 1)
+	}
+	f.init(vCall, fs.codeABC(types.OP_CALL, base, nParams+1, 2))
+	fs.fixLine(line)
+	fs.freeReg = base + 1 // call remove function and arguments and leaves
+	// (unless changed) one result
+}
+
+/*
+  Expression parsing
+*/
+
+func (ls *lexState) primaryExp(v *expDesc) {
+	// primaryexp -> NAME | '(' expr ')'
+	switch ls.t.tok {
+	case '(':
+		line := ls.lineNumber
+		ls.nextToken()
+		ls.expr(v)
+		ls.checkMatch(')', '(', line)
+		ls.fs.dischargeVars(v)
+	case tkName:
+		ls.singleVar(v)
+	default:
+		ls.syntaxError("unexpected symbol")
+	}
+}
+
+func (ls *lexState) suffixedExp(v *expDesc) {
+	// suffixedexp ->
+	//   primaryexp { '.' NAME | '[' exp ']' | ':' NAME funcargs | funcargs }
+	fs := ls.fs
+	line := ls.lineNumber
+	ls.primaryExp(v)
+	for {
+		switch ls.t.tok {
+		case '.':
+			// fieldsel
+			ls.fieldSel(v)
+		case '[':
+			// '[' exp1 ']'
+			var key expDesc
+			fs.exp2AnyRegUp(v)
+			ls.yIndex(&key)
+			fs.indexed(v, &key)
+		case ':':
+			// ':' NAME funcargs
+			var key expDesc
+			ls.nextToken()
+			ls.checkName(&key)
+			fs.self(v, &key)
+			ls.funcArgs(v, line)
+		case '(', tkString, '{':
+			// funcargs
+			fs.exp2NextReg(v)
+			ls.funcArgs(v, line)
+		default:
+			return
+		}
+	}
+}
+
+func (ls *lexState) simpleExp(v *expDesc) {
+	// simpleexp -> NUMBER | STRING | NIL | TRUE | FALSE | ... |
+	//              constructor | FUNCTION body | suffixedexp
+	switch ls.t.tok {
+	case tkNumber:
+		v.init(vKNum, 0)
+		v.nval = ls.t.n
+	case tkString:
+		ls.codeString(v, ls.t.s)
+	case tkNil:
+		v.init(vNil, 0)
+	case tkTrue:
+		v.init(vTrue, 0)
+	case tkFalse:
+		v.init(vFalse, 0)
+	case tkDots:
+		// vararg
+		fs := ls.fs
+		ls.checkCondition(fs.f.Meta.IsVarArg != 0, "cannot use '...' outside a vararg function")
+		v.init(vVararg, fs.codeABC(types.OP_VARARG, 0, 1, 0))
+	case '{':
+		// constructor
+		ls.constructor(v)
+		return
+	case tkFunction:
+		ls.nextToken()
+		ls.body(v, false, ls.lineNumber)
+		return
+	default:
+		ls.suffixedExp(v)
+		return
+	}
+	ls.nextToken()
+}
+
+func getUnOpr(op token) unOpr {
+	switch op {
+	case tkNot:
+		return oprNot
+	case '-':
+		return oprMinus
+	case '#':
+		return oprLen
+	default:
+		return oprNoUnOpr
+	}
+}
+
+func getBinOpr(op token) binOpr {
+	switch op {
+	case '+':
+		return oprAdd
+	case '-':
+		return oprSub
+	case '*':
+		return oprMul
+	case '/':
+		return oprDiv
+	case '%':
+		return oprMod
+	case '^':
+		return oprPow
+	case tkConcat:
+		return oprConcat
+	case tkNe:
+		return oprNe
+	case tkEq:
+		return oprEq
+	case '<':
+		return oprLt
+	case tkLe:
+		return oprLe
+	case '>':
+		return oprGt
+	case tkGe:
+		return oprGe
+	case tkAnd:
+		return oprAnd
+	case tkOr:
+		return oprOr
+	default:
+		return oprNoBinOpr
+	}
+}
+
+// subexpr -> (simpleexp | unop subexpr) { binop subexpr }
+// where 'binop' is any binary operator with a priority higher than 'limit'
+func (ls *lexState) subExpr(v *expDesc, limit int) binOpr {
+	ls.enterLevel()
+	uop := getUnOpr(ls.t.tok)
+	if uop != oprNoUnOpr {
+		line := ls.lineNumber
+		ls.nextToken()
+		ls.subExpr(v, _UNARY_PRIORITY)
+		ls.fs.prefix(uop, v, line)
+	} else {
+		ls.simpleExp(v)
+	}
+	// expand while operators have priorities higher than 'limit'
+	op := getBinOpr(ls.t.tok)
+	for op != oprNoBinOpr && priority[op].left > limit {
+		var v2 expDesc
+		line := ls.lineNumber
+		ls.nextToken()
+		ls.fs.infix(op, v)
+		// read sub-expression with higher priority
+		nextOp := ls.subExpr(&v2, priority[op].right)
+		ls.fs.posfix(op, v, &v2, line)
+		op = nextOp
+	}
+	ls.leaveLevel()
+	return op // return first untreated operator
+}
+
+func (ls *lexState) expr(v *expDesc) {
+	ls.subExpr(v, 0)
+}
+
+/*
+  Rules for Statements
+*/
+
+func (ls *lexState) block() {
+	// block -> statlist
+	fs := ls.fs
+	var bl blockCnt
+	fs.enterBlock(&bl, false)
+	ls.statList()
+	fs.leaveBlock()
+}
+
+// Structure to chain all variables in the left-hand side of an
+// assignment
+type lhsAssign struct {
+	prev *lhsAssign
+	v    expDesc // variable (global, local, upvalue, or indexed)
+}
+
+// Check whether, in an assignment to an upvalue/local variable, the
+// upvalue/local variable is begin used in a previous assignment to a
+// table. If so, save original upvalue/local value in a safe place and
+// use this safe copy in the previous assignment.
+func (ls *lexState) checkConflict(lh *lhsAssign, v *expDesc) {
+	fs := ls.fs
+	extra := fs.freeReg // eventual position to save local variable
+	conflict := false
+	for ; lh != nil; lh = lh.prev {
+		// check all previous assignments
+		if lh.v.k == vIndexed {
+			// assigning to a table?
+			// table is the upvalue/local being assigned now?
+			if lh.v.ind.vt == v.k && lh.v.ind.t == v.info {
+				conflict = true
+				lh.v.ind.vt = vLocal
+				lh.v.ind.t = extra // previous assignment will use safe copy
+			}
+			// index is the local being assigned? (index cannot be upvalue)
+			if v.k == vLocal && lh.v.ind.idx == v.info {
+				conflict = true
+				lh.v.ind.idx = extra // previous assignment will use safe copy
+			}
+		}
+	}
+	if conflict {
+		// copy upvalue/local value to a temporary (in position 'extra')
+		op := types.OP_GETUPVAL
+		if v.k == vLocal {
+			op = types.OP_MOVE
+		}
+		fs.codeABC(op, extra, v.info, 0)
+		fs.reserveRegs(1)
+	}
+}
+
+func (ls *lexState) assignment(lh *lhsAssign, nVars int) {
+	var e expDesc
+	ls.checkCondition(vkIsVar(lh.v.k), "syntax error")
+	if ls.testNext(',') {
+		// assignment -> ',' suffixedexp assignment
+		var nv lhsAssign
+		nv.prev = lh
+		ls.suffixedExp(&nv.v)
+		if nv.v.k != vIndexed {
+			ls.checkConflict(lh, &nv.v)
+		}
+		ls.fs.checkLimit(nVars+ls.nCcalls, _LUAI_MAXCCALLS, "C levels")
+		ls.assignment(&nv, nVars+1)
+	} else {
+		// assignment -> '=' explist
+		ls.checkNextToken('=')
+		nExps := ls.expList(&e)
+		if nExps != nVars {
+			ls.adjustAssign(nVars, nExps, &e)
+			if nExps > nVars {
+				ls.fs.freeReg -= nExps - nVars // remove extra values
+			}
+		} else {
+			ls.fs.setOneRet(&e) // close last expression
+			ls.fs.storeVar(&lh.v, &e)
+			return // avoid default
+		}
+	}
+	e.init(vNonReloc, ls.fs.freeReg-1) // default assignment
+	ls.fs.storeVar(&lh.v, &e)
+}
+
+func (ls *lexState) cond() int {
+	// cond -> exp
+	var v expDesc
+	ls.expr(&v) // read condition
+	if v.k == vNil {
+		v.k = vFalse // 'falses' are all equal here
+	}
+	ls.fs.goIfTrue(&v)
+	return v.f
+}
+
+func (ls *lexState) gotoStat(pc int) {
+	var label string
+	line := ls.lineNumber
+	if ls.testNext(tkGoto) {
+		label = ls.strCheckName()
+	} else {
+		ls.nextToken() // skip break
+		label = "break"
+	}
+	g := ls.newLabelEntry(&ls.dyd.gt, label, line, pc)
+	ls.findLabel(g) // close it if label already defined
+}
+
+// Check for repeated labels on the same block.
+func (fs *funcState) checkRepeated(ll []labelDesc, label string) {
+	for i := fs.bl.firstLabel; i < len(ll); i++ {
+		if label == ll[i].name {
+			fs.ls.semError(fmt.Sprintf("label '%s' already defined on line %d", label, ll[i].line))
+		}
+	}
+}
+
+// Skip no-op statements.
+func (ls *lexState) skipNoOpStat() {
+	for ls.t.tok == ';' || ls.t.tok == tkDbColon {
+		ls.statement()
+	}
+}
+
+func (ls *lexState) labelStat(label string, line int) {
+	// label -> '::' NAME '::'
+	fs := ls.fs
+	fs.checkRepeated(ls.dyd.label, label) // check for repeated labels
+	ls.checkNextToken(tkDbColon)          // skip double colon
+	// create new entry for this label
+	l := ls.newLabelEntry(&ls.dyd.label, label, line, fs.pc)
+	ls.skipNoOpStat() // skip other no-op statements
+	if ls.blockFollow(false) {
+		// label is last no-op statement in the block?
+		// assume that locals are already out of scope
+		ls.dyd.label[l].nActVar = fs.bl.nActVar
+	}
+	ls.findGotos(&ls.dyd.label[l])
+}
+
+func (ls *lexState) whileStat(line int) {
+	// whilestat -> WHILE cond DO block END
+	fs := ls.fs
+	var bl blockCnt
+	ls.nextToken() // skip WHILE
+	whileInit := fs.getLabel()
+	condExit := ls.cond()
+	fs.enterBlock(&bl, true)
+	ls.checkNextToken(tkDo)
+	ls.block()
+	fs.jumpTo(whileInit)
+	ls.checkMatch(tkEnd, tkWhile, line)
+	fs.leaveBlock()
+	fs.patchToHere(condExit) // false conditions finish the loop
+}
+
+func (ls *lexState) repeatStat(line int) {
+	// repeatstat -> REPEAT block UNTIL cond
+	fs := ls.fs
+	repeatInit := fs.getLabel()
+	var bl1, bl2 blockCnt
+	fs.enterBlock(&bl1, true)  // loop block
+	fs.enterBlock(&bl2, false) // scope block
+	ls.nextToken()             // skip REPEAT
+	ls.statList()
+	ls.checkMatch(tkUntil, tkRepeat, line)
+	condExit := ls.cond() // read condition (inside scope block)
+	if bl2.upval {
+		// upvalues?
+		fs.patchClose(condExit, bl2.nActVar)
+	}
+	fs.leaveBlock()                    // finish scope
+	fs.patchList(condExit, repeatInit) // close the loop
+	fs.leaveBlock()                    // finish loop
+}
+
+func (ls *lexState) exp1() int {
+	var e expDesc
+	ls.expr(&e)
+	ls.fs.exp2NextReg(&e)
+	return e.info
+}
+
+func (ls *lexState) forBody(base, line, nVars int, isNum bool) {
+	// forbody -> DO block
+	var bl blockCnt
+	var prep, endFor int
+	fs := ls.fs
+	ls.adjustLocalVars(3) // control variables
+	ls.checkNextToken(tkDo)
+	if isNum {
+		prep = fs.codeAsBx(types.OP_FORPREP, base, _NO_JUMP)
+	} else {
+		prep = fs.jump()
+	}
+	fs.enterBlock(&bl, false) // scope for declared variables
+	ls.adjustLocalVars(nVars)
+	fs.reserveRegs(nVars)
+	ls.block()
+	fs.leaveBlock() // end of scope for declared variables
+	fs.patchToHere(prep)
+	if isNum {
+		// numeric for?
+		endFor = fs.codeAsBx(types.OP_FORLOOP, base, _NO_JUMP)
+	} else {
+		// generic for
+		fs.codeABC(types.OP_TFORCALL, base, 0, nVars)
+		fs.fixLine(line)
+		endFor = fs.codeAsBx(types.OP_TFORLOOP, base+2, _NO_JUMP)
+	}
+	fs.patchList(endFor, prep+1)
+	fs.fixLine(line)
+}
+
+func (ls *lexState) forNum(varName string, line int) {
+	// fornum -> NAME = exp1,exp1[,exp1] forbody
+	fs := ls.fs
+	base := fs.freeReg
+	ls.newLocalVar("(for index)")
+	ls.newLocalVar("(for limit)")
+	ls.newLocalVar("(for step)")
+	ls.newLocalVar(varName)
+	ls.checkNextToken('=')
+	ls.exp1() // initial value
+	ls.checkNextToken(',')
+	ls.exp1() // limit
+	if ls.testNext(',') {
+		ls.exp1() // optional step
+	} else {
+		// default step = 1
+		fs.codeK(fs.freeReg, fs.numberK(1))
+		fs.reserveRegs(1)
+	}
+	ls.forBody(base, line, 1, true)
+}
+
+func (ls *lexState) forList(indexName string) {
+	// forlist -> NAME {,NAME} IN explist forbody
+	fs := ls.fs
+	var e expDesc
+	nVars := 4 // gen, state, control, plus at least one declared var
+	base := fs.freeReg
+	// create control variables
+	ls.newLocalVar("(for generator)")
+	ls.newLocalVar("(for state)")
+	ls.newLocalVar("(for control)")
+	// create declared variables
+	ls.newLocalVar(indexName)
+	for ls.testNext(',') {
+		ls.newLocalVar(ls.strCheckName())
+		nVars++
+	}
+	ls.checkNextToken(tkIn)
+	line := ls.lineNumber
+	ls.adjustAssign(3, ls.expList(&e), &e)
+	fs.checkStack(3) // extra space to call generator
+	ls.forBody(base, line, nVars-3, false)
+}
+
+func (ls *lexState) forStat(line int) {
+	// forstat -> FOR (fornum | forlist) END
+	fs := ls.fs
+	var bl blockCnt
+	fs.enterBlock(&bl, true)     // scope for loop and control variables
+	ls.nextToken()               // skip 'for'
+	varName := ls.strCheckName() // first variable name
+	switch ls.t.tok {
+	case '=':
+		ls.forNum(varName, line)
+	case ',', tkIn:
+		ls.forList(varName)
+	default:
+		ls.syntaxError("'=' or 'in' expected")
+	}
+	ls.checkMatch(tkEnd, tkFor, line)
+	fs.leaveBlock() // loop scope ('break' jumps to this point)
+}
+
+func (ls *lexState) testThenBlock(escapeList *int) {
+	// test_then_block -> [IF | ELSEIF] cond THEN block
+	var bl blockCnt
+	var v expDesc
+	var jf int // instruction to skip 'then' code (if condition is false)
+	fs := ls.fs
+	ls.nextToken() // skip IF or ELSEIF
+	ls.expr(&v)    // read condition
+	ls.checkNextToken(tkThen)
+	if ls.t.tok == tkGoto || ls.t.tok == tkBreak {
+		fs.goIfFalse(&v)          // will jump to label if condition is true
+		fs.enterBlock(&bl, false) // must enter block before 'goto'
+		ls.gotoStat(v.t)          // handle goto/break
+		ls.skipNoOpStat()         // skip other no-op statements
+		if ls.blockFollow(false) {
+			// 'goto' is the entire block?
+			fs.leaveBlock()
+			return // and that is it
+		}
+		// must skip over 'then' part if condition is false
+		jf = fs.jump()
+	} else {
+		// regular case (not goto/break)
+		fs.goIfTrue(&v) // skip over block if condition is false
+		fs.enterBlock(&bl, false)
+		jf = v.f
+	}
+	ls.statList() // 'then' part
+	fs.leaveBlock()
+	if ls.t.tok == tkElse || ls.t.tok == tkElseif {
+		// followed by 'else'/'elseif'? must jump over it
+		fs.concat(escapeList, fs.jump())
+	}
+	fs.patchToHere(jf)
+}
+
+func (ls *lexState) ifStat(line int) {
+	// ifstat -> IF cond THEN block {ELSEIF cond THEN block} [ELSE block] END
+	escapeList := _NO_JUMP        // exit list for finished parts
+	ls.testThenBlock(&escapeList) // IF cond THEN block
+	for ls.t.tok == tkElseif {
+		ls.testThenBlock(&escapeList) // ELSEIF cond THEN block
+	}
+	if ls.testNext(tkElse) {
+		ls.block() // 'else' part
+	}
+	ls.checkMatch(tkEnd, tkIf, line)
+	ls.fs.patchToHere(escapeList) // patch escape list to 'if' end
+}
+
+func (ls *lexState) localFunc() {
+	var b expDesc
+	fs := ls.fs
+	ls.newLocalVar(ls.strCheckName()) // new local variable
+	ls.adjustLocalVars(1)             // enter its scope
+	ls.body(&b, false, ls.lineNumber) // function created in next register
+	// debug information will only see the variable after this point!
+	fs.getLocVar(b.info).Startpc = uint32(fs.pc)
+}
+
+func (ls *lexState) localStat() {
+	// stat -> LOCAL NAME {',' NAME} ['=' explist]
+	var e expDesc
+	var nExps int
+	nVars := 0
+	for {
+		ls.newLocalVar(ls.strCheckName())
+		nVars++
+		if !ls.testNext(',') {
+			break
+		}
+	}
+	if ls.testNext('=') {
+		nExps = ls.expList(&e)
+	} else {
+		e.k = vVoid
+		nExps = 0
+	}
+	ls.adjustAssign(nVars, nExps, &e)
+	ls.adjustLocalVars(nVars)
+}
+
+func (ls *lexState) funcName(v *expDesc) bool {
+	// funcname -> NAME {fieldsel} [':' NAME]
+	isMethod := false
+	ls.singleVar(v)
+	for ls.t.tok == '.' {
+		ls.fieldSel(v)
+	}
+	if ls.t.tok == ':' {
+		isMethod = true
+		ls.fieldSel(v)
+	}
+	return isMethod
+}
+
+func (ls *lexState) funcStat(line int) {
+	// funcstat -> FUNCTION funcname body
+	var v, b expDesc
+	ls.nextToken() // skip FUNCTION
+	isMethod := ls.funcName(&v)
+	ls.body(&b, isMethod, line)
+	ls.fs.storeVar(&v, &b)
+	ls.fs.fixLine(line) // definition 'happens' in the first line
+}
+
+func (ls *lexState) exprStat() {
+	// stat -> func | assignment
+	fs := ls.fs
+	var v lhsAssign
+	ls.suffixedExp(&v.v)
+	if ls.t.tok == '=' || ls.t.tok == ',' {
+		// stat -> assignment ?
+		v.prev = nil
+		ls.assignment(&v, 1)
+	} else {
+		// stat -> func
+		ls.checkCondition(v.v.k == vCall, "syntax error")
+		fs.getCode(&v.v).SetArgC(1) // call statement uses no results
+	}
+}
+
+func (ls *lexState) retStat() {
+	// stat -> RETURN [explist] [';']
+	fs := ls.fs
+	var e expDesc
+	var first, nRet int // registers with returned values
+	if ls.blockFollow(true) || ls.t.tok == ';' {
+		// return no values
+		first, nRet = 0, 0
+	} else {
+		nRet = ls.expList(&e) // optional return values
+		if hasMultRet(e.k) {
+			fs.setMultRet(&e)
+			if e.k == vCall && nRet == 1 {
+				// tail call?
+				fs.getCode(&e).SetOpCode(types.OP_TAILCALL)
+			}
+			first = fs.nActVar
+			nRet = types.LUNE_MULTRET // return all values
+		} else {
+			if nRet == 1 {
+				// only one single value?
+				first = fs.exp2AnyReg(&e)
+			} else {
+				fs.exp2NextReg(&e) // values must go to the stack
+				first = fs.nActVar // return all active values
+			}
+		}
+	}
+	fs.ret(first, nRet)
+	ls.testNext(';') // skip optional semicolon
+}
+
+func (ls *lexState) statement() {
+	line := ls.lineNumber // may be needed for error messages
+	ls.enterLevel()
+	switch ls.t.tok {
+	case ';':
+		// stat -> ';' (empty statement)
+		ls.nextToken() // skip ';'
+	case tkIf:
+		// stat -> ifstat
+		ls.ifStat(line)
+	case tkWhile:
+		// stat -> whilestat
+		ls.whileStat(line)
+	case tkDo:
+		// stat -> DO block END
+		ls.nextToken() // skip DO
+		ls.block()
+		ls.checkMatch(tkEnd, tkDo, line)
+	case tkFor:
+		// stat -> forstat
+		ls.forStat(line)
+	case tkRepeat:
+		// stat -> repeatstat
+		ls.repeatStat(line)
+	case tkFunction:
+		// stat -> funcstat
+		ls.funcStat(line)
+	case tkLocal:
+		// stat -> localstat
+		ls.nextToken() // skip LOCAL
+		if ls.testNext(tkFunction) {
+			// local function?
+			ls.localFunc()
+		} else {
+			ls.localStat()
+		}
+	case tkDbColon:
+		// stat -> label
+		ls.nextToken() // skip double colon
+		ls.labelStat(ls.strCheckName(), line)
+	case tkReturn:
+		// stat -> retstat
+		ls.nextToken() // skip RETURN
+		ls.retStat()
+	case tkBreak, tkGoto:
+		// stat -> breakstat | 'goto' NAME
+		ls.gotoStat(ls.fs.jump())
+	default:
+		// stat -> func | assignment
+		ls.exprStat()
+	}
+	ls.fs.freeReg = ls.fs.nActVar // free registers
+	ls.leaveLevel()
+}
+
+// Compiles the main function, which is a regular vararg function with an
+// upvalue named _ENV.
+func (ls *lexState) mainFunc(fs *funcState) {
+	var bl blockCnt
+	var v expDesc
+	ls.openFunc(fs, &bl)
+	fs.f.Meta.IsVarArg = 1     // main function is always vararg
+	v.init(vLocal, 0)          // create and...
+	fs.newUpvalue(ls.envn, &v) // ...set environment upvalue
+	ls.nextToken()             // read first token
+	ls.statList()              // parse main body
+	ls.check(tkEOS)
+	ls.closeFunc()
+}
@@ -0,0 +1,229 @@
+package disasm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mna/lune/types"
+)
+
+/*
+  Mostly a port of the listing functions of luac.c (print.c) from Lua
+*/
+
+// Writes the listing of the prototype p and all its nested prototypes to w,
+// in the same format as luac -l. If full is true, the constants, locals and
+// upvalues are listed too, as with luac -l -l.
+func Fprint(w io.Writer, p *types.Prototype, full bool) error {
+	bw := bufio.NewWriter(w)
+	printFunction(bw, p, full)
+	return bw.Flush()
+}
+
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
+
+func printHeader(w io.Writer, p *types.Prototype) {
+	s := p.Source
+	switch {
+	case s == "":
+		s = "=?"
+		fallthrough
+	case strings.HasPrefix(s, "@"), strings.HasPrefix(s, "="):
+		s = s[1:]
+	case strings.HasPrefix(s, "\x1b"):
+		s = "(bstring)"
+	default:
+		s = "(string)"
+	}
+	kind := "function"
+	if p.Meta.LineDefined == 0 {
+		kind = "main"
+	}
+	fmt.Fprintf(w, "\n%s <%s:%d,%d> (%d instruction%s at %p)\n", kind, s,
+		p.Meta.LineDefined, p.Meta.LastLineDefined, len(p.Code), plural(len(p.Code)), p)
+
+	vararg := ""
+	if p.Meta.IsVarArg != 0 {
+		vararg = "+"
+	}
+	np := int(p.Meta.NumParams)
+	ms := int(p.Meta.MaxStackSize)
+	fmt.Fprintf(w, "%d%s param%s, %d slot%s, %d upvalue%s, ", np, vararg, plural(np),
+		ms, plural(ms), len(p.Upvalues), plural(len(p.Upvalues)))
+	fmt.Fprintf(w, "%d local%s, %d constant%s, %d function%s\n", len(p.LocVars), plural(len(p.LocVars)),
+		len(p.Ks), plural(len(p.Ks)), len(p.Protos), plural(len(p.Protos)))
+}
+
+func printString(w io.Writer, s string) {
+	io.WriteString(w, `"`)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			io.WriteString(w, `\"`)
+		case '\\':
+			io.WriteString(w, `\\`)
+		case '\a':
+			io.WriteString(w, `\a`)
+		case '\b':
+			io.WriteString(w, `\b`)
+		case '\f':
+			io.WriteString(w, `\f`)
+		case '\n':
+			io.WriteString(w, `\n`)
+		case '\r':
+			io.WriteString(w, `\r`)
+		case '\t':
+			io.WriteString(w, `\t`)
+		case '\v':
+			io.WriteString(w, `\v`)
+		default:
+			if c >= 32 && c < 127 {
+				fmt.Fprintf(w, "%c", c)
+			} else {
+				fmt.Fprintf(w, `\%03d`, c)
+			}
+		}
+	}
+	io.WriteString(w, `"`)
+}
+
+func printConstant(w io.Writer, p *types.Prototype, i int) {
+	switch v := p.Ks[i].(type) {
+	case nil:
+		io.WriteString(w, "nil")
+	case bool:
+		fmt.Fprintf(w, "%t", v)
+	case float64:
+		io.WriteString(w, types.NumberToString(v))
+	case string:
+		printString(w, v)
+	default:
+		fmt.Fprintf(w, "? type=%T", v)
+	}
+}
+
+func upvalName(p *types.Prototype, i int) string {
+	if i < len(p.Upvalues) && p.Upvalues[i].Name != "" {
+		return p.Upvalues[i].Name
+	}
+	return "-"
+}
+
+func printCode(w io.Writer, p *types.Prototype) {
+	for pc := 0; pc < len(p.Code); pc++ {
+		i := p.Code[pc]
+		op := i.GetOpCode()
+		a := i.GetArgA()
+		b, bk := i.GetArgB(true)
+		c, ck := i.GetArgC(true)
+		bx, _ := i.GetArgBx(false)
+		sbx := i.GetArgsBx()
+
+		fmt.Fprintf(w, "\t%d\t", pc+1)
+		if pc < len(p.LineInfo) && p.LineInfo[pc] > 0 {
+			fmt.Fprintf(w, "[%d]\t", p.LineInfo[pc])
+		} else {
+			io.WriteString(w, "[-]\t")
+		}
+		io.WriteString(w, i.String())
+
+		switch op {
+		case types.OP_LOADK:
+			io.WriteString(w, "\t; ")
+			printConstant(w, p, bx)
+		case types.OP_GETUPVAL, types.OP_SETUPVAL:
+			b, _ = i.GetArgB(false)
+			fmt.Fprintf(w, "\t; %s", upvalName(p, b))
+		case types.OP_GETTABUP:
+			b, _ = i.GetArgB(false)
+			fmt.Fprintf(w, "\t; %s", upvalName(p, b))
+			if ck {
+				io.WriteString(w, " ")
+				printConstant(w, p, c)
+			}
+		case types.OP_SETTABUP:
+			fmt.Fprintf(w, "\t; %s", upvalName(p, a))
+			if bk {
+				io.WriteString(w, " ")
+				printConstant(w, p, b)
+			}
+			if ck {
+				io.WriteString(w, " ")
+				printConstant(w, p, c)
+			}
+		case types.OP_GETTABLE, types.OP_SELF:
+			if ck {
+				io.WriteString(w, "\t; ")
+				printConstant(w, p, c)
+			}
+		case types.OP_SETTABLE, types.OP_ADD, types.OP_SUB, types.OP_MUL,
+			types.OP_DIV, types.OP_POW, types.OP_EQ, types.OP_LT, types.OP_LE:
+			// OP_MOD is not listed, like in luac
+			if bk || ck {
+				io.WriteString(w, "\t; ")
+				if bk {
+					printConstant(w, p, b)
+				} else {
+					io.WriteString(w, "-")
+				}
+				io.WriteString(w, " ")
+				if ck {
+					printConstant(w, p, c)
+				} else {
+					io.WriteString(w, "-")
+				}
+			}
+		case types.OP_JMP, types.OP_FORLOOP, types.OP_FORPREP, types.OP_TFORLOOP:
+			fmt.Fprintf(w, "\t; to %d", sbx+pc+2)
+		case types.OP_CLOSURE:
+			fmt.Fprintf(w, "\t; %p", p.Protos[bx])
+		case types.OP_SETLIST:
+			c, _ = i.GetArgC(false)
+			if c == 0 {
+				pc++
+				fmt.Fprintf(w, "\t; %d", int(p.Code[pc]))
+			} else {
+				fmt.Fprintf(w, "\t; %d", c)
+			}
+		case types.OP_EXTRAARG:
+			io.WriteString(w, "\t; ")
+			printConstant(w, p, i.GetArgAx())
+		}
+		io.WriteString(w, "\n")
+	}
+}
+
+func printDebug(w io.Writer, p *types.Prototype) {
+	fmt.Fprintf(w, "constants (%d) for %p:\n", len(p.Ks), p)
+	for i := range p.Ks {
+		fmt.Fprintf(w, "\t%d\t", i+1)
+		printConstant(w, p, i)
+		io.WriteString(w, "\n")
+	}
+	fmt.Fprintf(w, "locals (%d) for %p:\n", len(p.LocVars), p)
+	for i, lv := range p.LocVars {
+		fmt.Fprintf(w, "\t%d\t%s\t%d\t%d\n", i, lv.Name, lv.Startpc+1, lv.Endpc+1)
+	}
+	fmt.Fprintf(w, "upvalues (%d) for %p:\n", len(p.Upvalues), p)
+	for i, up := range p.Upvalues {
+		fmt.Fprintf(w, "\t%d\t%s\t%d\t%d\n", i, upvalName(p, i), up.Instack, up.Idx)
+	}
+}
+
+func printFunction(w io.Writer, p *types.Prototype, full bool) {
+	printHeader(w, p)
+	printCode(w, p)
+	if full {
+		printDebug(w, p)
+	}
+	for _, sub := range p.Protos {
+		printFunction(w, sub, full)
+	}
+}
@@ -0,0 +1,82 @@
+package disasm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/mna/lune/serializer"
+)
+
+var rxPointer = regexp.MustCompile(`0x[0-9a-f]+`)
+
+// Replaces the addresses of the prototypes with their order of appearance, so
+// that listings can be compared while still checking that each function is
+// referenced by the right CLOSURE instruction.
+func normalizePointers(s string) string {
+	seen := make(map[string]string)
+	return rxPointer.ReplaceAllStringFunc(s, func(p string) string {
+		if n, ok := seen[p]; ok {
+			return n
+		}
+		n := "<" + string('a'+rune(len(seen))) + ">"
+		seen[p] = n
+		return n
+	})
+}
+
+// List all the precompiled chunks of the vm tests and compare with the
+// listing produced by luac -l -l.
+func TestListTestdata(t *testing.T) {
+	files, err := filepath.Glob("../vm/testdata/*.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no test file found")
+	}
+	for _, fn := range files {
+		name := strings.TrimSuffix(filepath.Base(fn), ".out")
+		exp, err := ioutil.ReadFile(strings.TrimSuffix(fn, ".out") + ".info")
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		f, err := os.Open(fn)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		p, err := serializer.Load(f)
+		f.Close()
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := Fprint(&buf, p, true); err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		lEx := strings.Split(normalizePointers(string(exp)), "\n")
+		lAc := strings.Split(normalizePointers(buf.String()), "\n")
+		for i := 0; i < len(lEx) || i < len(lAc); i++ {
+			var ex, ac string
+			if i < len(lEx) {
+				ex = lEx[i]
+			}
+			if i < len(lAc) {
+				ac = lAc[i]
+			}
+			if ex != ac {
+				t.Errorf("%s: line %d: expected %q, got %q", name, i+1, ex, ac)
+				break
+			}
+		}
+	}
+}
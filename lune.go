@@ -1,42 +1,106 @@
-package main
+// Package lune embeds the Lune virtual machine in a Go program. A Runtime
+// holds a single state with the standard libraries, in which any number of
+// chunks can be run and their functions called from Go.
+package lune
 
 import (
-	"fmt"
+	"bufio"
+	"io"
 	"os"
+	"strings"
 
+	"github.com/mna/lune/binding"
+	"github.com/mna/lune/compiler"
 	"github.com/mna/lune/serializer"
 	"github.com/mna/lune/stdlib"
 	"github.com/mna/lune/types"
 	"github.com/mna/lune/vm"
 )
 
-func loadFile(fn string) (*types.Prototype, error) {
-	f, err := os.Open(fn)
+// A Runtime runs Lua code in one state, so the globals set by a chunk are
+// seen by the next ones. It must not be used by multiple goroutines at the
+// same time.
+type Runtime struct {
+	s *types.State
+}
+
+// Creates a runtime with the standard libraries.
+func NewRuntime() *Runtime {
+	s := types.NewState(nil)
+	stdlib.OpenLibs(s)
+	return &Runtime{s}
+}
+
+// Returns the state of the runtime, for use with the vm package.
+func (r *Runtime) State() *types.State {
+	return r.s
+}
+
+// Loads a chunk from rd, source code or a precompiled binary chunk, and
+// returns its main function prototype. The chunk name is used in error
+// messages, e.g. "@file.lua" or "=stdin", see types.ChunkID.
+func Load(rd io.Reader, chunkName string) (*types.Prototype, error) {
+	// Precompiled chunks start with the escape char, otherwise it is source code
+	br := bufio.NewReader(rd)
+	if b, err := br.Peek(1); err == nil && b[0] == '\x1b' {
+		return serializer.LoadVerified(br)
+	}
+	return compiler.Compile(br, chunkName)
+}
+
+// Loads a chunk from rd, without running it, and returns its main function.
+func (r *Runtime) Load(rd io.Reader, chunkName string) (types.Value, error) {
+	p, err := Load(rd, chunkName)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-
-	return serializer.Load(f)
+	return r.s.Load(p), nil
 }
 
-func main() {
-	// Check args
-	if len(os.Args) < 2 {
-		fmt.Println("Expected an argument (file name)")
-		os.Exit(1)
+// Loads and runs a chunk from rd, and returns its results.
+func (r *Runtime) DoChunk(rd io.Reader, chunkName string) ([]types.Value, error) {
+	f, err := r.Load(rd, chunkName)
+	if err != nil {
+		return nil, err
 	}
+	return r.Call(f)
+}
 
-	// Load file
-	fn := os.Args[1]
-	p, err := loadFile(fn)
+// Loads and runs the file at path, and returns its results.
+func (r *Runtime) DoFile(path string) ([]types.Value, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return nil, err
 	}
+	defer f.Close()
+	return r.DoChunk(f, "@"+path)
+}
+
+// Loads and runs the source code src, and returns its results. As in Lua, the
+// source itself is the chunk name.
+func (r *Runtime) DoString(src string) ([]types.Value, error) {
+	return r.DoChunk(strings.NewReader(src), src)
+}
+
+// Calls the function fn with the arguments args, and returns its results.
+// Errors raised by fn are returned as a *vm.RuntimeError with a traceback.
+func (r *Runtime) Call(fn types.Value, args ...types.Value) ([]types.Value, error) {
+	return vm.Run(r.s, fn, args...)
+}
+
+// Returns the value of the global variable name.
+func (r *Runtime) GetGlobal(name string) types.Value {
+	return r.s.Globals.Get(name)
+}
+
+// Sets the global variable name to the value v.
+func (r *Runtime) SetGlobal(name string, v types.Value) {
+	r.s.Globals.Set(name, v)
+}
 
-	// Run file
-	s := types.NewState(p)
-	stdlib.OpenLibs(s.Globals)
-	vm.Execute(s)
+// Sets the global variable name to the Go value v converted to a Lua value.
+// Go functions other than types.GoFunc are wrapped using reflection, see the
+// binding package.
+func (r *Runtime) Register(name string, v interface{}) {
+	binding.Register(r.s.Globals, map[string]interface{}{name: v})
 }
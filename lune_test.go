@@ -0,0 +1,106 @@
+package lune
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mna/lune/types"
+	"github.com/mna/lune/vm"
+)
+
+func TestRuntime(t *testing.T) {
+	rt := NewRuntime()
+	rt.SetGlobal("base", 10.0)
+	rt.Register("double", func(n int) int { return n * 2 })
+
+	res, err := rt.DoString(`
+count = 0
+function handle(x)
+  count = count + 1
+  return base + double(x), count
+end
+return "loaded"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0] != "loaded" {
+		t.Errorf("expected the chunk to return 'loaded', got %v", res)
+	}
+
+	// The handler is called many times on the same state
+	h := rt.GetGlobal("handle")
+	for i := 1; i <= 3; i++ {
+		res, err := rt.Call(h, float64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != 2 || res[0] != 10.0+2*float64(i) || res[1] != float64(i) {
+			t.Errorf("%d: unexpected results %v", i, res)
+		}
+	}
+	if top := rt.State().Top; top != 0 {
+		t.Errorf("expected an empty stack, got top %d", top)
+	}
+
+	// Globals are shared by the chunks
+	if res, err := rt.DoChunk(strings.NewReader(`return count`), "=chunk"); err != nil || len(res) != 1 || res[0] != 3.0 {
+		t.Errorf("expected count to be 3, got %v (%v)", res, err)
+	}
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	rt := NewRuntime()
+	if _, err := rt.DoString(`x = = 1`); err == nil {
+		t.Error("expected a syntax error")
+	}
+
+	_, err := rt.DoChunk(strings.NewReader(`
+function fail(msg)
+  error(msg)
+end
+fail("boom")`), "=errors")
+	re, ok := err.(*vm.RuntimeError)
+	if !ok {
+		t.Fatalf("expected a *vm.RuntimeError, got %v", err)
+	}
+	if re.Value != "errors:3: boom" {
+		t.Errorf("unexpected error %q", re.Value)
+	}
+	if !strings.Contains(re.Traceback, "in function 'fail'") {
+		t.Errorf("unexpected traceback %q", re.Traceback)
+	}
+
+	// Go panics are returned as errors too, and the runtime is still usable
+	rt.Register("panic", types.NewGoClosure(func(s *types.State, args []types.Value) []types.Value {
+		panic("oops")
+	}))
+	if _, err := rt.Call(rt.GetGlobal("panic")); err == nil || err.Error() != "oops" {
+		t.Errorf("expected the panic as error, got %v", err)
+	}
+	if _, err := rt.Call(rt.GetGlobal("fail"), "again"); err == nil || err.Error() != "errors:3: again" {
+		t.Errorf("expected the error of fail, got %v", err)
+	}
+	if rt.State().Top != 0 || rt.State().CI != nil {
+		t.Errorf("expected the state to be reset, got top %d", rt.State().Top)
+	}
+}
+
+func TestDoFile(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "script.lua")
+	if err := os.WriteFile(fn, []byte("local a = ...\nreturn a, 42\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rt := NewRuntime()
+	res, err := rt.DoFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0] != nil || res[1] != 42.0 {
+		t.Errorf("unexpected results %v", res)
+	}
+	if _, err := rt.DoFile(fn + ".missing"); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
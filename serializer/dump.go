@@ -0,0 +1,174 @@
+package serializer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/mna/lune/types"
+)
+
+// Encodes the chunk according to the sizes and byte order described by the
+// header, the reverse of loadState.
+type dumpState struct {
+	w     io.Writer
+	strip bool
+	h     *gHeader
+	o     binary.ByteOrder
+}
+
+func (d *dumpState) write(v interface{}) {
+	if err := binary.Write(d.w, d.o, v); err != nil {
+		panic(err)
+	}
+}
+
+// Writes the unsigned integer v on sz bytes.
+func (d *dumpState) writeUint(v uint64, sz byte) {
+	switch sz {
+	case 1:
+		d.write(uint8(v))
+	case 2:
+		d.write(uint16(v))
+	case 4:
+		d.write(uint32(v))
+	case 8:
+		d.write(v)
+	default:
+		panic(fmt.Errorf("unsupported integer size: %d", sz))
+	}
+}
+
+func (d *dumpState) writeInt(n int) {
+	d.writeUint(uint64(n), d.h.IntSz)
+}
+
+func (d *dumpState) writeNumber(n float64) {
+	if d.h.IntFlag != 0 {
+		if math.Trunc(n) != n {
+			panic(fmt.Errorf("number %v is not integral", n))
+		}
+		d.writeUint(uint64(int64(n)), d.h.NumberSz)
+		return
+	}
+	switch d.h.NumberSz {
+	case 4:
+		d.write(float32(n))
+	case 8:
+		d.write(n)
+	default:
+		panic(fmt.Errorf("unsupported number size: %d", d.h.NumberSz))
+	}
+}
+
+func (d *dumpState) writeString(s string, null bool) {
+	if null {
+		d.writeUint(0, d.h.SizeTSz)
+		return
+	}
+	d.writeUint(uint64(len(s)+1), d.h.SizeTSz)
+	d.write([]byte(s))
+	d.write(byte(0))
+}
+
+func (d *dumpState) writeCode(p *types.Prototype) {
+	d.writeInt(len(p.Code))
+	for _, i := range p.Code {
+		d.writeUint(uint64(i), d.h.InstrSz)
+	}
+}
+
+func (d *dumpState) writeConstants(p *types.Prototype) {
+	d.writeInt(len(p.Ks))
+	for _, k := range p.Ks {
+		switch v := k.(type) {
+		case nil:
+			d.write(byte(types.TNIL))
+		case bool:
+			d.write(byte(types.TBOOL))
+			if v {
+				d.write(byte(1))
+			} else {
+				d.write(byte(0))
+			}
+		case float64:
+			d.write(byte(types.TNUMBER))
+			d.writeNumber(v)
+		case string:
+			d.write(byte(types.TSTRING))
+			d.writeString(v, false)
+		default:
+			panic(fmt.Errorf("unexpected constant type: %T", k))
+		}
+	}
+	d.writeInt(len(p.Protos))
+	for _, sub := range p.Protos {
+		d.writeFunction(sub)
+	}
+}
+
+func (d *dumpState) writeUpvalues(p *types.Prototype) {
+	d.writeInt(len(p.Upvalues))
+	for _, up := range p.Upvalues {
+		d.write([2]byte{up.Instack, up.Idx})
+	}
+}
+
+func (d *dumpState) writeDebug(p *types.Prototype) {
+	d.writeString(p.Source, d.strip)
+	if d.strip {
+		d.writeInt(0)
+		d.writeInt(0)
+		d.writeInt(0)
+		return
+	}
+	d.writeInt(len(p.LineInfo))
+	for _, li := range p.LineInfo {
+		d.writeInt(int(li))
+	}
+	d.writeInt(len(p.LocVars))
+	for _, lv := range p.LocVars {
+		d.writeString(lv.Name, false)
+		d.writeInt(int(lv.Startpc))
+		d.writeInt(int(lv.Endpc))
+	}
+	d.writeInt(len(p.Upvalues))
+	for _, up := range p.Upvalues {
+		d.writeString(up.Name, false)
+	}
+}
+
+func (d *dumpState) writeFunction(p *types.Prototype) {
+	d.writeInt(int(p.Meta.LineDefined))
+	d.writeInt(int(p.Meta.LastLineDefined))
+	d.write([3]byte{p.Meta.NumParams, p.Meta.IsVarArg, p.Meta.MaxStackSize})
+	d.writeCode(p)
+	d.writeConstants(p)
+	d.writeUpvalues(p)
+	d.writeDebug(p)
+}
+
+// Writes the precompiled binary chunk of the function prototype p to w, in the
+// same format as the one produced by Lua's luac. If strip is true, the debug
+// information is omitted.
+func Dump(w io.Writer, p *types.Prototype, strip bool) error {
+	return dump(w, p, strip, NewHeader())
+}
+
+// Writes the chunk for the platform described by the header h.
+func dump(w io.Writer, p *types.Prototype, strip bool, h *gHeader) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			var ok bool
+			if err, ok = e.(error); !ok {
+				panic(e)
+			}
+		}
+	}()
+
+	d := &dumpState{w, strip, h, h.byteOrder()}
+	d.write(h)
+	d.writeFunction(p)
+	return nil
+}
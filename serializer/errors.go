@@ -0,0 +1,77 @@
+package serializer
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Errors returned by Load, wrapped in a *LoadError.
+var (
+	ErrNotChunk           = errors.New("not a precompiled chunk")
+	ErrVersionMismatch    = errors.New("version mismatch")
+	ErrIncompatibleHeader = errors.New("incompatible header")
+	ErrTruncated          = errors.New("truncated chunk")
+	ErrBadConstant        = errors.New("bad constant")
+	ErrBadFormat          = errors.New("bad binary format") // Invalid counts or instructions
+)
+
+// Describes why and where a chunk could not be loaded.
+type LoadError struct {
+	Err    error  // One of the Err* errors, or the error returned by the reader
+	Msg    string // Details about the error, may be empty
+	Offset int64  // Offset in the chunk where the error was detected
+	Path   []int  // Indexes of the nested prototypes being decoded, nil for the header
+}
+
+// Returns the path of the prototype being decoded, "main" for the main
+// function, "main.0" for its first nested function, and so on. Returns
+// "header" if the error is in the header.
+func (e *LoadError) PathString() string {
+	if e.Path == nil {
+		return "header"
+	}
+	return pathString(e.Path)
+}
+
+func (e *LoadError) Error() string {
+	msg := e.Err.Error()
+	if e.Msg != "" {
+		msg += ": " + e.Msg
+	}
+	return fmt.Sprintf("%s (%s, offset %d)", msg, e.PathString(), e.Offset)
+}
+
+// Returns the underlying error, so that errors.Is can match the Err* errors.
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// Describes an invalid instruction or prototype, found by Verify.
+type VerifyError struct {
+	Msg  string
+	PC   int   // Index of the invalid instruction, -1 if the prototype itself is invalid
+	Path []int // Indexes of the nested prototypes, empty for the main function
+}
+
+// Returns the path of the invalid prototype, "main" for the main function,
+// "main.0" for its first nested function, and so on.
+func (e *VerifyError) PathString() string {
+	return pathString(e.Path)
+}
+
+func (e *VerifyError) Error() string {
+	if e.PC < 0 {
+		return fmt.Sprintf("invalid code: %s (%s)", e.Msg, e.PathString())
+	}
+	return fmt.Sprintf("invalid code: %s (%s, pc %d)", e.Msg, e.PathString(), e.PC)
+}
+
+func pathString(path []int) string {
+	parts := []string{"main"}
+	for _, i := range path {
+		parts = append(parts, strconv.Itoa(i))
+	}
+	return strings.Join(parts, ".")
+}
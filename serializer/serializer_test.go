@@ -0,0 +1,418 @@
+package serializer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mna/lune/types"
+)
+
+// Load all the precompiled chunks of the vm tests, dump them back and check
+// that the bytes are the same.
+func TestRoundTrip(t *testing.T) {
+	files, err := filepath.Glob("../vm/testdata/*.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no test file found")
+	}
+	for _, fn := range files {
+		name := filepath.Base(fn)
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		p, err := Load(bytes.NewReader(b))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := Dump(&buf, p, false); err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if !bytes.Equal(b, buf.Bytes()) {
+			t.Errorf("%s: expected dumped chunk to be the same as the loaded one", name)
+		}
+	}
+}
+
+// A stripped chunk has the same code, without the debug information.
+func TestDumpStrip(t *testing.T) {
+	b, err := ioutil.ReadFile("../vm/testdata/t22.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Load(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := Dump(&buf, p, true); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() >= len(b) {
+		t.Errorf("expected stripped chunk to be smaller than %d bytes, got %d", len(b), buf.Len())
+	}
+
+	ps, err := Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps.Source != "" || len(ps.LineInfo) != 0 || len(ps.LocVars) != 0 {
+		t.Errorf("expected no debug information, got source %q, %d lines and %d locals", ps.Source, len(ps.LineInfo), len(ps.LocVars))
+	}
+	if len(ps.Code) != len(p.Code) || len(ps.Protos) != len(p.Protos) {
+		t.Fatalf("expected %d instructions and %d functions, got %d and %d", len(p.Code), len(p.Protos), len(ps.Code), len(ps.Protos))
+	}
+	for i, instr := range p.Code {
+		if ps.Code[i] != instr {
+			t.Errorf("expected instruction %d to be %08x, got %08x", i, uint32(instr), uint32(ps.Code[i]))
+		}
+	}
+	for i, up := range ps.Upvalues {
+		if up.Name != "" {
+			t.Errorf("expected upvalue %d to have no name, got %q", i, up.Name)
+		}
+	}
+}
+
+// Errors from the writer are returned.
+func TestDumpError(t *testing.T) {
+	b, err := ioutil.ReadFile("../vm/testdata/t1.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Load(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Dump(failWriter{}, p, false); err != errWrite {
+		t.Errorf("expected error %v, got %v", errWrite, err)
+	}
+}
+
+type failWriter struct{}
+
+var errWrite = errors.New("write failed")
+
+func (failWriter) Write(b []byte) (int, error) {
+	return 0, errWrite
+}
+
+// Chunks produced on other platforms are re-encoded from the testdata and
+// must load as the same prototypes.
+func TestLoadCrossArch(t *testing.T) {
+	platforms := map[string]func(h *gHeader){
+		"big-endian": func(h *gHeader) {
+			h.Endianness = 0
+		},
+		"32-bit": func(h *gHeader) {
+			h.SizeTSz = 4
+		},
+		"32-bit big-endian": func(h *gHeader) {
+			h.Endianness, h.SizeTSz = 0, 4
+		},
+		"64-bit int and instructions": func(h *gHeader) {
+			h.IntSz, h.InstrSz = 8, 8
+		},
+		"float numbers": func(h *gHeader) {
+			h.NumberSz = 4
+		},
+		"integer numbers": func(h *gHeader) {
+			h.IntFlag = 1
+		},
+		"32-bit big-endian integer numbers": func(h *gHeader) {
+			h.Endianness, h.SizeTSz, h.NumberSz, h.IntFlag = 0, 4, 4, 1
+		},
+	}
+
+	files, err := filepath.Glob("../vm/testdata/*.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range files {
+		name := filepath.Base(fn)
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		p, err := Load(bytes.NewReader(b))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+
+		for pf, fix := range platforms {
+			h := NewHeader()
+			fix(h)
+			if h.IntFlag != 0 && !integralConstants(p) {
+				// Can't be represented on this platform
+				continue
+			}
+			var buf bytes.Buffer
+			if err := dump(&buf, p, false, h); err != nil {
+				t.Errorf("%s (%s): %s", name, pf, err)
+				continue
+			}
+			if bytes.Equal(b, buf.Bytes()) {
+				t.Errorf("%s (%s): expected a different encoding", name, pf)
+			}
+			pAc, err := Load(&buf)
+			if err != nil {
+				t.Errorf("%s (%s): %s", name, pf, err)
+				continue
+			}
+			pEx := p
+			if h.IntFlag == 0 && h.NumberSz == 4 {
+				pEx = withFloat32Constants(p)
+			}
+			if !reflect.DeepEqual(pEx, pAc) {
+				t.Errorf("%s (%s): expected the same prototype once loaded", name, pf)
+			}
+		}
+	}
+}
+
+// Headers with sizes that can't be decoded are rejected.
+func TestLoadIncompatible(t *testing.T) {
+	b, err := ioutil.ReadFile("../vm/testdata/t1.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixes := []func(h *gHeader){
+		func(h *gHeader) { h.InstrSz = 2 },
+		func(h *gHeader) { h.SizeTSz = 3 },
+		func(h *gHeader) { h.NumberSz = 16 },
+		func(h *gHeader) { h.Endianness = 2 },
+		func(h *gHeader) { h.Format = 1 },
+	}
+	for i, fix := range fixes {
+		// Replace the header of the valid chunk
+		var buf bytes.Buffer
+		h := NewHeader()
+		fix(h)
+		if err := binary.Write(&buf, binary.LittleEndian, h); err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(b[buf.Len():])
+		if _, err := Load(&buf); !errors.Is(err, ErrIncompatibleHeader) {
+			t.Errorf("%d: expected error %v, got %v", i, ErrIncompatibleHeader, err)
+		}
+	}
+}
+
+func integralConstants(p *types.Prototype) bool {
+	for _, k := range p.Ks {
+		if f, ok := k.(float64); ok && math.Trunc(f) != f {
+			return false
+		}
+	}
+	for _, sub := range p.Protos {
+		if !integralConstants(sub) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns a copy of p with the number constants rounded to float32.
+func withFloat32Constants(p *types.Prototype) *types.Prototype {
+	cp := *p
+	cp.Ks, cp.Protos = nil, nil
+	for _, k := range p.Ks {
+		if f, ok := k.(float64); ok {
+			k = float64(float32(f))
+		}
+		cp.Ks = append(cp.Ks, k)
+	}
+	for _, sub := range p.Protos {
+		cp.Protos = append(cp.Protos, withFloat32Constants(sub))
+	}
+	return &cp
+}
+
+// Every prefix of a valid chunk is reported as truncated, at the offset where
+// the data is missing.
+func TestLoadTruncated(t *testing.T) {
+	b, err := ioutil.ReadFile("../vm/testdata/t22.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(b); i++ {
+		_, err := Load(bytes.NewReader(b[:i]))
+		if !errors.Is(err, ErrTruncated) {
+			t.Errorf("%d: expected error %v, got %v", i, ErrTruncated, err)
+			continue
+		}
+		if le := err.(*LoadError); le.Offset != int64(i) {
+			t.Errorf("%d: expected error at offset %d, got %d", i, i, le.Offset)
+		}
+	}
+}
+
+func TestLoadCorrupted(t *testing.T) {
+	const marker = "MARKER"
+
+	// The marker and the boolean constant are in the nested function
+	sub := &types.Prototype{
+		Meta: &types.FuncMeta{},
+		Ks:   []types.Value{marker, true},
+	}
+	main := &types.Prototype{
+		Meta:   &types.FuncMeta{IsVarArg: 1, MaxStackSize: 2},
+		Ks:     []types.Value{1.0},
+		Protos: []*types.Prototype{sub},
+	}
+	var buf bytes.Buffer
+	if err := Dump(&buf, main, false); err != nil {
+		t.Fatal(err)
+	}
+	chunk := buf.Bytes()
+	// The string is preceded by its size_t length, and its type
+	strTypeIdx := bytes.Index(chunk, []byte(marker)) - 8 - 1
+	boolValIdx := strTypeIdx + 1 + 8 + len(marker) + 1 + 1
+
+	cases := []struct {
+		idx  int
+		val  byte
+		err  error
+		path string
+	}{
+		{0, 'X', ErrNotChunk, "header"},
+		{4, 0x51, ErrVersionMismatch, "header"},
+		{6, 2, ErrIncompatibleHeader, "header"},
+		{strTypeIdx, 9, ErrBadConstant, "main.0"},
+		{boolValIdx, 2, ErrBadConstant, "main.0"},
+	}
+	for i, c := range cases {
+		b := append([]byte{}, chunk...)
+		b[c.idx] = c.val
+		_, err := Load(bytes.NewReader(b))
+		if !errors.Is(err, c.err) {
+			t.Errorf("%d: expected error %v, got %v", i, c.err, err)
+			continue
+		}
+		if le := err.(*LoadError); le.PathString() != c.path {
+			t.Errorf("%d: expected error in %s, got %s", i, c.path, le.PathString())
+		}
+	}
+
+	// A negative count of instructions, after the header and the lines and
+	// sizes of the main function
+	b := append([]byte{}, chunk...)
+	copy(b[binary.Size(NewHeader())+4+4+3:], []byte{0xff, 0xff, 0xff, 0xff})
+	if _, err := Load(bytes.NewReader(b)); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("expected error %v, got %v", ErrBadFormat, err)
+	}
+}
+
+// Errors of the reader are returned as is, in a *LoadError.
+func TestLoadReaderError(t *testing.T) {
+	_, err := Load(failReader{})
+	if le, ok := err.(*LoadError); !ok {
+		t.Errorf("expected a *LoadError, got %T", err)
+	} else if le.Err != errRead {
+		t.Errorf("expected error %v, got %v", errRead, le.Err)
+	}
+}
+
+type failReader struct{}
+
+var errRead = errors.New("read failed")
+
+func (failReader) Read(b []byte) (int, error) {
+	return 0, errRead
+}
+
+// The chunks produced by luac are all valid.
+func TestVerifyTestdata(t *testing.T) {
+	files, err := filepath.Glob("../vm/testdata/*.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range files {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadVerified(bytes.NewReader(b)); err != nil {
+			t.Errorf("%s: %s", filepath.Base(fn), err)
+		}
+	}
+}
+
+func TestVerifyInvalid(t *testing.T) {
+	abc, abx, ax := types.NewInstrABC, types.NewInstrABx, types.NewInstrAx
+	ret := abc(types.OP_RETURN, 0, 1, 0)
+	newProto := func(code ...types.Instruction) *types.Prototype {
+		return &types.Prototype{
+			Meta:     &types.FuncMeta{MaxStackSize: 2},
+			Code:     code,
+			Ks:       []types.Value{1.0},
+			Upvalues: []*types.Upvalue{{Name: "_ENV", Instack: 1}},
+		}
+	}
+	nested := newProto(abx(types.OP_CLOSURE, 0, 0), ret)
+	nested.Protos = []*types.Prototype{newProto(ret), newProto(abc(types.OP_MOVE, 0, 2, 0), ret)}
+	badUpval := newProto(abx(types.OP_CLOSURE, 0, 0), ret)
+	badUpval.Protos = []*types.Prototype{newProto(ret)}
+	badUpval.Protos[0].Upvalues[0].Idx = 2
+
+	cases := []struct {
+		name string
+		p    *types.Prototype
+		path string
+		pc   int
+	}{
+		{"empty", newProto(), "main", -1},
+		{"no return", newProto(abc(types.OP_MOVE, 0, 1, 0)), "main", -1},
+		{"register", newProto(abc(types.OP_MOVE, 0, 2, 0), ret), "main", 0},
+		{"constant", newProto(abx(types.OP_LOADK, 0, 1), ret), "main", 0},
+		{"rk constant", newProto(abc(types.OP_ADD, 0, 0, types.RKAsK(1)), ret), "main", 0},
+		{"upvalue", newProto(abc(types.OP_GETTABUP, 0, 1, 0), ret), "main", 0},
+		{"function", newProto(abx(types.OP_CLOSURE, 0, 0), ret), "main", 0},
+		{"jump", newProto(abx(types.OP_JMP, 0, types.MAXARG_sBx+1), ret), "main", 0},
+		{"jump back", newProto(abx(types.OP_JMP, 0, types.MAXARG_sBx-2), ret), "main", 0},
+		{"loadkx", newProto(abx(types.OP_LOADKx, 0, 0), ret), "main", 0},
+		{"loadkx constant", newProto(abx(types.OP_LOADKx, 0, 0), ax(types.OP_EXTRAARG, 1), ret), "main", 0},
+		{"extraarg", newProto(ax(types.OP_EXTRAARG, 0), ret), "main", 0},
+		{"jump to extraarg", newProto(abx(types.OP_JMP, 0, types.MAXARG_sBx+1),
+			abx(types.OP_LOADKx, 0, 0), ax(types.OP_EXTRAARG, 0), ret), "main", 0},
+		{"comparison", newProto(abc(types.OP_LT, 1, 0, 1), ret), "main", 0},
+		{"tforcall", newProto(abc(types.OP_TFORCALL, 0, 0, 0), ret), "main", 0},
+		{"vararg", newProto(abc(types.OP_VARARG, 0, 2, 0), ret), "main", 0},
+		{"table size", newProto(abc(types.OP_NEWTABLE, 0, types.MAXARG_B, 0), ret), "main", 0},
+		{"list block", newProto(abc(types.OP_NEWTABLE, 0, 0, 0), abc(types.OP_SETLIST, 0, 1, 0),
+			ax(types.OP_EXTRAARG, types.MAXARG_Ax), ret), "main", 1},
+		{"opcode", newProto(abc(types.OP_EXTRAARG+1, 0, 0, 0), ret), "main", 0},
+		{"nested", nested, "main.1", 0},
+		{"capture", badUpval, "main", -1},
+	}
+	for _, c := range cases {
+		err := Verify(c.p)
+		if ve, ok := err.(*VerifyError); !ok {
+			t.Errorf("%s: expected a *VerifyError, got %v", c.name, err)
+		} else if ve.PathString() != c.path || ve.PC != c.pc {
+			t.Errorf("%s: expected error at %s pc %d, got %s pc %d (%s)", c.name, c.path, c.pc, ve.PathString(), ve.PC, ve)
+		}
+	}
+
+	// The same instructions, well-formed
+	valid := newProto(abx(types.OP_LOADKx, 0, 0), ax(types.OP_EXTRAARG, 0),
+		abc(types.OP_LT, 1, 0, types.RKAsK(0)), abx(types.OP_JMP, 0, types.MAXARG_sBx),
+		abc(types.OP_NEWTABLE, 0, types.Int2Fb(50), 1), abc(types.OP_SETLIST, 0, 1, 1), ret)
+	if err := Verify(valid); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+}
@@ -1,16 +1,16 @@
 package serializer
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"unsafe"
 
 	"github.com/mna/lune/types"
 )
 
-// TODO : Tests, and error variables much like io.EOF
-
 const (
 	LUNE_MAJOR_VERSION      = 5
 	LUNE_MINOR_VERSION      = 2
@@ -66,216 +66,322 @@ func NewHeader() *gHeader {
 	}
 }
 
-func readString(r io.Reader) string {
-	var sz uint64
-	var s string
+func (h *gHeader) byteOrder() binary.ByteOrder {
+	if h.Endianness == 0 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// Counts the bytes read, to report the offset of errors.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// Decodes the chunk according to the sizes and byte order of the platform
+// that produced it, as described by its header.
+type loadState struct {
+	r    *countingReader
+	h    *gHeader
+	o    binary.ByteOrder
+	path []int // Indexes of the nested prototypes being decoded, nil for the header
+}
 
-	if err := binary.Read(r, binary.LittleEndian, &sz); err != nil {
-		panic(err)
+// Stops the loading with a *LoadError at the current position.
+func (l *loadState) fail(err error, format string, args ...interface{}) {
+	le := &LoadError{Err: err, Msg: fmt.Sprintf(format, args...), Offset: l.r.n}
+	if l.path != nil {
+		le.Path = append([]int{}, l.path...)
 	}
-	if sz > 0 {
-		ch := make([]byte, sz)
-		if err := binary.Read(r, binary.LittleEndian, ch); err != nil {
-			panic(err)
-		}
-		// Remove 0x00
-		s = string(ch[:len(ch)-1])
+	panic(le)
+}
+
+func (l *loadState) failRead(err error) {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		l.fail(ErrTruncated, "")
 	}
-	return s
+	l.fail(err, "")
 }
 
-func readDebug(r io.Reader, p *types.Prototype) {
-	var n uint32
-	var i uint32
+func (l *loadState) read(v interface{}) {
+	if err := binary.Read(l.r, l.o, v); err != nil {
+		l.failRead(err)
+	}
+}
 
-	// Source file name
-	p.Source = readString(r)
+func (l *loadState) readByte() byte {
+	var b byte
+	l.read(&b)
+	return b
+}
 
-	// Line numbers
-	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
-		panic(err)
-	}
-	for i = 0; i < n; i++ {
-		var li int32
-		if err := binary.Read(r, binary.LittleEndian, &li); err != nil {
-			panic(err)
-		}
-		p.LineInfo = append(p.LineInfo, li)
+// Reads an unsigned integer of sz bytes.
+func (l *loadState) readUint(sz byte) uint64 {
+	switch sz {
+	case 1:
+		return uint64(l.readByte())
+	case 2:
+		var v uint16
+		l.read(&v)
+		return uint64(v)
+	case 4:
+		var v uint32
+		l.read(&v)
+		return uint64(v)
+	case 8:
+		var v uint64
+		l.read(&v)
+		return v
 	}
+	l.fail(ErrIncompatibleHeader, "unsupported integer size: %d", sz)
+	return 0
+}
 
-	// Local variables
-	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
-		panic(err)
+// Reads a C int.
+func (l *loadState) readInt() int {
+	v := l.readUint(l.h.IntSz)
+	// Sign-extend
+	sh := 64 - 8*uint(l.h.IntSz)
+	return int(int64(v<<sh) >> sh)
+}
+
+func (l *loadState) readCount() int {
+	n := l.readInt()
+	if n < 0 {
+		l.fail(ErrBadFormat, "negative count %d", n)
 	}
-	for i = 0; i < n; i++ {
-		var lv types.LocVar
-		lv.Name = readString(r)
+	return n
+}
 
-		if err := binary.Read(r, binary.LittleEndian, &lv.Startpc); err != nil {
-			panic(err)
-		}
-		if err := binary.Read(r, binary.LittleEndian, &lv.Endpc); err != nil {
-			panic(err)
-		}
-		p.LocVars = append(p.LocVars, &lv)
+func (l *loadState) readInstr() types.Instruction {
+	v := l.readUint(l.h.InstrSz)
+	if v > uint64(^types.Instruction(0)) {
+		l.fail(ErrBadFormat, "instruction %#x does not fit in %d bits", v, 8*unsafe.Sizeof(types.Instruction(0)))
 	}
+	return types.Instruction(v)
+}
 
-	// Upvalue names
-	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
-		panic(err)
+func (l *loadState) readNumber() float64 {
+	if l.h.IntFlag != 0 {
+		// Integral numbers
+		v := l.readUint(l.h.NumberSz)
+		sh := 64 - 8*uint(l.h.NumberSz)
+		return float64(int64(v<<sh) >> sh)
 	}
-	for i = 0; i < n; i++ {
-		p.Upvalues[i].Name = readString(r)
+	switch l.h.NumberSz {
+	case 4:
+		var f float32
+		l.read(&f)
+		return float64(f)
+	case 8:
+		var f float64
+		l.read(&f)
+		return f
 	}
+	l.fail(ErrIncompatibleHeader, "unsupported number size: %d", l.h.NumberSz)
+	return 0
 }
 
-func readUpvalues(r io.Reader, p *types.Prototype) {
-	var n uint32
-	var i uint32
+func (l *loadState) readString() string {
+	var buf bytes.Buffer
 
-	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
-		panic(err)
+	sz := l.readUint(l.h.SizeTSz)
+	if sz == 0 {
+		return ""
+	} else if sz > math.MaxInt64 {
+		l.fail(ErrBadFormat, "string size %d", sz)
 	}
-	for i = 0; i < n; i++ {
-		var ba [2]byte
-		if err := binary.Read(r, binary.LittleEndian, &ba); err != nil {
-			panic(err)
-		}
-		p.Upvalues = append(p.Upvalues, &types.Upvalue{"", ba[0], ba[1]})
+	// Don't trust the size to allocate the string, the chunk may be corrupted
+	if _, err := io.CopyN(&buf, l.r, int64(sz)); err != nil {
+		l.failRead(err)
 	}
+	// Remove 0x00
+	return buf.String()[:sz-1]
 }
 
-func readConstants(r io.Reader, p *types.Prototype) {
-	var n uint32
-	var i uint32
+func (l *loadState) readDebug(p *types.Prototype) {
+	// Source file name
+	p.Source = l.readString()
+
+	// Line numbers
+	n := l.readCount()
+	for i := 0; i < n; i++ {
+		p.LineInfo = append(p.LineInfo, int32(l.readInt()))
+	}
+
+	// Local variables
+	n = l.readCount()
+	for i := 0; i < n; i++ {
+		var lv types.LocVar
+		lv.Name = l.readString()
+		lv.Startpc = uint32(l.readInt())
+		lv.Endpc = uint32(l.readInt())
+		p.LocVars = append(p.LocVars, &lv)
+	}
+
+	// Upvalue names
+	n = l.readCount()
+	if n > len(p.Upvalues) {
+		l.fail(ErrBadFormat, "%d upvalue names for %d upvalues", n, len(p.Upvalues))
+	}
+	for i := 0; i < n; i++ {
+		p.Upvalues[i].Name = l.readString()
+	}
+}
 
-	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
-		panic(err)
+func (l *loadState) readUpvalues(p *types.Prototype) {
+	n := l.readCount()
+	for i := 0; i < n; i++ {
+		var ba [2]byte
+		l.read(&ba)
+		p.Upvalues = append(p.Upvalues, &types.Upvalue{Instack: ba[0], Idx: ba[1]})
 	}
+}
 
-	for i = 0; i < n; i++ {
+func (l *loadState) readConstants(p *types.Prototype) {
+	n := l.readCount()
+	for i := 0; i < n; i++ {
 		// Read the constant's type, 1 byte
-		var t byte
-		if err := binary.Read(r, binary.LittleEndian, &t); err != nil {
-			panic(err)
-		}
+		t := l.readByte()
 		switch types.ValType(t) {
 		case types.TNIL:
 			p.Ks = append(p.Ks, nil)
 		case types.TBOOL:
 			var v types.Value
-			if err := binary.Read(r, binary.LittleEndian, &t); err != nil {
-				panic(err)
-			}
-			if t == 0 {
+			if t = l.readByte(); t == 0 {
 				v = false
 			} else if t == 1 {
 				v = true
 			} else {
-				panic(fmt.Errorf("invalid value for boolean: %d", t))
+				l.fail(ErrBadConstant, "invalid value for boolean: %d", t)
 			}
 			p.Ks = append(p.Ks, v)
 		case types.TNUMBER:
-			var f float64
-			if err := binary.Read(r, binary.LittleEndian, &f); err != nil {
-				panic(err)
-			}
-			p.Ks = append(p.Ks, f)
+			p.Ks = append(p.Ks, l.readNumber())
 		case types.TSTRING:
-			p.Ks = append(p.Ks, readString(r))
+			p.Ks = append(p.Ks, l.readString())
 		default:
-			panic(fmt.Errorf("unexpected constant type: %d", t))
+			l.fail(ErrBadConstant, "unexpected constant type: %d", t)
 		}
 	}
 }
 
-func readCode(r io.Reader, p *types.Prototype) {
-	var n uint32
-	var i uint32
-
-	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
-		panic(err)
-	}
-	for i = 0; i < n; i++ {
-		var instr types.Instruction
-		if err := binary.Read(r, binary.LittleEndian, &instr); err != nil {
-			panic(err)
-		}
-		p.Code = append(p.Code, instr)
+func (l *loadState) readCode(p *types.Prototype) {
+	n := l.readCount()
+	for i := 0; i < n; i++ {
+		p.Code = append(p.Code, l.readInstr())
 	}
 }
 
-func readFunction(r io.Reader) *types.Prototype {
+func (l *loadState) readFunction() *types.Prototype {
 	var fm types.FuncMeta
 	var p types.Prototype
-	var n uint32
-	var i uint32
 
 	// Meta-data about the function
-	if err := binary.Read(r, binary.LittleEndian, &fm); err != nil {
-		panic(err)
-	}
+	fm.LineDefined = uint32(l.readInt())
+	fm.LastLineDefined = uint32(l.readInt())
+	fm.NumParams = l.readByte()
+	fm.IsVarArg = l.readByte()
+	fm.MaxStackSize = l.readByte()
 	p.Meta = &fm
 
 	// Function's instructions
-	readCode(r, &p)
+	l.readCode(&p)
 	// Function's constants
-	readConstants(r, &p)
+	l.readConstants(&p)
 	// Inner function's functions (prototypes)
-	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
-		panic(err)
-	}
-	for i = 0; i < n; i++ {
-		p.Protos = append(p.Protos, readFunction(r))
+	n := l.readCount()
+	for i := 0; i < n; i++ {
+		l.path = append(l.path, i)
+		p.Protos = append(p.Protos, l.readFunction())
+		l.path = l.path[:len(l.path)-1]
 	}
 
 	// Upvalues
-	readUpvalues(r, &p)
+	l.readUpvalues(&p)
 	// Debug
-	readDebug(r, &p)
+	l.readDebug(&p)
 
 	return &p
 }
 
-func readHeader(r io.Reader) *gHeader {
+func (l *loadState) readHeader() {
 	var h gHeader
 
-	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
-		panic(err)
+	// The header is made of bytes only, the byte order doesn't matter
+	if err := binary.Read(l.r, binary.LittleEndian, &h); err != nil {
+		l.failRead(err)
 	}
+	l.h = &h
 
 	// Validate header
 	stdH := NewHeader()
 
 	// As a whole
 	if h == *stdH {
-		return &h
+		return
 	} else if h.Signature != stdH.Signature {
-		panic(fmt.Errorf("is not a precompiled chunk"))
+		l.fail(ErrNotChunk, "")
 	} else if h.Version != stdH.Version {
-		panic(fmt.Errorf("version mismatch, got %d.%d, expected %d.%d", h.MajorVersion(), h.MinorVersion(), stdH.MajorVersion(), stdH.MinorVersion()))
+		l.fail(ErrVersionMismatch, "got %d.%d, expected %d.%d", h.MajorVersion(), h.MinorVersion(), stdH.MajorVersion(), stdH.MinorVersion())
 	}
 
-	panic(fmt.Errorf("incompatible"))
+	// Chunks produced on other platforms are supported, as long as the
+	// sizes can be decoded
+	switch {
+	case h.Format != stdH.Format:
+		l.fail(ErrIncompatibleHeader, "format %d", h.Format)
+	case h.Tail != stdH.Tail:
+		l.fail(ErrIncompatibleHeader, "corrupted tail")
+	case h.Endianness > 1:
+		l.fail(ErrIncompatibleHeader, "endianness %d", h.Endianness)
+	case !validSize(h.IntSz):
+		l.fail(ErrIncompatibleHeader, "int size %d", h.IntSz)
+	case !validSize(h.SizeTSz):
+		l.fail(ErrIncompatibleHeader, "size_t size %d", h.SizeTSz)
+	case h.InstrSz != 4 && h.InstrSz != 8:
+		l.fail(ErrIncompatibleHeader, "instruction size %d", h.InstrSz)
+	case !validSize(h.NumberSz), h.IntFlag == 0 && h.NumberSz != 4 && h.NumberSz != 8:
+		l.fail(ErrIncompatibleHeader, "number size %d", h.NumberSz)
+	}
 }
 
+func validSize(sz byte) bool {
+	return sz == 1 || sz == 2 || sz == 4 || sz == 8
+}
+
+// Loads the precompiled chunk read from r. If it can't be loaded, the error is
+// a *LoadError that wraps one of the Err* errors, or the error returned by r.
 func Load(r io.Reader) (p *types.Prototype, err error) {
 	// For simplicity's sake, to avoid multiple if err != nil, use a panic in the
 	// various readXxxx functions, and catch here, since Load() returns as soon as an
 	// error is detected (this is not a compiler).
 	defer func() {
 		if e := recover(); e != nil {
-			err = e.(error)
+			if le, ok := e.(*LoadError); ok {
+				p, err = nil, le
+				return
+			}
+			panic(e)
 		}
 	}()
 
+	l := &loadState{r: &countingReader{r: r}}
+
 	// First up, the Header (12 bytes) + LUAC_TAIL to "catch conversion errors", as described in Lua
-	readHeader(r)
-	//fmt.Printf("Header: %+v\n", h)
+	l.readHeader()
 
-	// Then, the function header (a prototype)
-	p = readFunction(r)
-	//fmt.Println(p)
+	// Then, the function header (a prototype), decoded as described by the header
+	l.o = l.h.byteOrder()
+	l.path = []int{}
+	p = l.readFunction()
 
 	return
 }
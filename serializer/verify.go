@@ -0,0 +1,317 @@
+package serializer
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/mna/lune/types"
+)
+
+type verifyState struct {
+	p     *types.Prototype
+	path  []int
+	pc    int
+	extra []bool // Instructions that are the OP_EXTRAARG argument of the previous one
+}
+
+func (v *verifyState) fail(format string, args ...interface{}) {
+	panic(&VerifyError{
+		Msg:  fmt.Sprintf(format, args...),
+		PC:   v.pc,
+		Path: append([]int{}, v.path...),
+	})
+}
+
+func (v *verifyState) checkReg(r int) {
+	if r < 0 || r >= int(v.p.Meta.MaxStackSize) {
+		v.fail("register %d out of range (stack size %d)", r, v.p.Meta.MaxStackSize)
+	}
+}
+
+func (v *verifyState) checkK(k int) {
+	if k < 0 || k >= len(v.p.Ks) {
+		v.fail("constant %d out of range (%d constants)", k, len(v.p.Ks))
+	}
+}
+
+// RK(x) is a constant if the BITRK bit is set, a register otherwise.
+func (v *verifyState) checkRK(rk int) {
+	if types.IsK(rk) {
+		v.checkK(types.IndexK(rk))
+	} else {
+		v.checkReg(rk)
+	}
+}
+
+func (v *verifyState) checkUpval(u int) {
+	if u >= len(v.p.Upvalues) {
+		v.fail("upvalue %d out of range (%d upvalues)", u, len(v.p.Upvalues))
+	}
+}
+
+// The jump target is the pc of the next instruction plus the offset.
+func (v *verifyState) checkJump(offset int) {
+	to := v.pc + 1 + offset
+	if to < 0 || to >= len(v.p.Code) {
+		v.fail("jump to %d out of code (%d instructions)", to, len(v.p.Code))
+	}
+	if v.extra[to] {
+		v.fail("jump to %d lands on an extra argument", to)
+	}
+}
+
+func (v *verifyState) checkNext(op types.OpCode) {
+	if v.pc+1 >= len(v.p.Code) {
+		v.fail("%s must be followed by %s", v.p.Code[v.pc].GetOpCode(), op)
+	}
+	if nop := v.p.Code[v.pc+1].GetOpCode(); nop != op {
+		v.fail("%s must be followed by %s, found %s", v.p.Code[v.pc].GetOpCode(), op, nop)
+	}
+}
+
+func (v *verifyState) verifyFunction() {
+	p := v.p
+	v.pc = -1
+	if int(p.Meta.NumParams) > int(p.Meta.MaxStackSize) {
+		v.fail("%d parameters for a stack size of %d", p.Meta.NumParams, p.Meta.MaxStackSize)
+	}
+	if len(p.Code) == 0 || p.Code[len(p.Code)-1].GetOpCode() != types.OP_RETURN {
+		v.fail("code does not end with %s", types.OP_RETURN)
+	}
+	if len(p.LineInfo) != 0 && len(p.LineInfo) != len(p.Code) {
+		v.fail("line info for %d instructions, expected %d", len(p.LineInfo), len(p.Code))
+	}
+
+	// Mark the OP_EXTRAARG arguments first, so that jumps can be checked against them
+	v.extra = make([]bool, len(p.Code))
+	for pc := 0; pc < len(p.Code)-1; pc++ {
+		i := p.Code[pc]
+		switch op := i.GetOpCode(); {
+		case op == types.OP_LOADKx, op == types.OP_SETLIST && getC(i) == 0:
+			v.extra[pc+1] = true
+			pc++
+		}
+	}
+
+	for v.pc = 0; v.pc < len(p.Code); v.pc++ {
+		if v.extra[v.pc] {
+			continue
+		}
+		v.verifyInstr(p.Code[v.pc])
+	}
+
+	// Nested functions capture registers or upvalues of this function
+	for i, sub := range p.Protos {
+		v.pc = -1
+		for j, u := range sub.Upvalues {
+			if u.Instack != 0 {
+				if int(u.Idx) >= int(p.Meta.MaxStackSize) {
+					v.fail("function %d upvalue %d captures register %d out of range (stack size %d)",
+						i, j, u.Idx, p.Meta.MaxStackSize)
+				}
+			} else if int(u.Idx) >= len(p.Upvalues) {
+				v.fail("function %d upvalue %d captures upvalue %d out of range (%d upvalues)",
+					i, j, u.Idx, len(p.Upvalues))
+			}
+		}
+		v.path = append(v.path, i)
+		v.p = sub
+		v.verifyFunction()
+		v.p = p
+		v.path = v.path[:len(v.path)-1]
+	}
+}
+
+func getB(i types.Instruction) int {
+	b, _ := i.GetArgB(false)
+	return b
+}
+
+func getC(i types.Instruction) int {
+	c, _ := i.GetArgC(false)
+	return c
+}
+
+func getBx(i types.Instruction) int {
+	bx, _ := i.GetArgBx(false)
+	return bx
+}
+
+func (v *verifyState) verifyInstr(i types.Instruction) {
+	op := i.GetOpCode()
+	a, b, c := i.GetArgA(), getB(i), getC(i)
+
+	switch op {
+	case types.OP_MOVE, types.OP_UNM, types.OP_NOT, types.OP_LEN:
+		v.checkReg(a)
+		v.checkReg(b)
+	case types.OP_LOADK:
+		v.checkReg(a)
+		v.checkK(getBx(i))
+	case types.OP_LOADKx:
+		v.checkReg(a)
+		v.checkNext(types.OP_EXTRAARG)
+		v.checkK(v.p.Code[v.pc+1].GetArgAx())
+	case types.OP_LOADBOOL:
+		v.checkReg(a)
+		if c != 0 {
+			v.checkJump(1)
+		}
+	case types.OP_LOADNIL:
+		v.checkReg(a)
+		v.checkReg(a + b)
+	case types.OP_GETUPVAL, types.OP_SETUPVAL:
+		v.checkReg(a)
+		v.checkUpval(b)
+	case types.OP_GETTABUP:
+		v.checkReg(a)
+		v.checkUpval(b)
+		v.checkRK(c)
+	case types.OP_GETTABLE:
+		v.checkReg(a)
+		v.checkReg(b)
+		v.checkRK(c)
+	case types.OP_SETTABUP:
+		v.checkUpval(a)
+		v.checkRK(b)
+		v.checkRK(c)
+	case types.OP_SETTABLE:
+		v.checkReg(a)
+		v.checkRK(b)
+		v.checkRK(c)
+	case types.OP_NEWTABLE:
+		v.checkReg(a)
+		// A constructor sets at most LFIELDS_PER_FLUSH array items per
+		// OP_SETLIST, and one hash item per OP_SETTABLE
+		n := len(v.p.Code)
+		if maxArr := types.Fb2Int(types.Int2Fb(n * types.LFIELDS_PER_FLUSH)); types.Fb2Int(b) > maxArr {
+			v.fail("array size %d too large for %d instructions", types.Fb2Int(b), n)
+		}
+		if maxHash := types.Fb2Int(types.Int2Fb(n)); types.Fb2Int(c) > maxHash {
+			v.fail("hash size %d too large for %d instructions", types.Fb2Int(c), n)
+		}
+	case types.OP_SELF:
+		v.checkReg(a + 1)
+		v.checkReg(b)
+		v.checkRK(c)
+	case types.OP_ADD, types.OP_SUB, types.OP_MUL, types.OP_DIV, types.OP_MOD, types.OP_POW:
+		v.checkReg(a)
+		v.checkRK(b)
+		v.checkRK(c)
+	case types.OP_CONCAT:
+		v.checkReg(a)
+		if b > c {
+			v.fail("concatenation of registers %d to %d", b, c)
+		}
+		v.checkReg(b)
+		v.checkReg(c)
+	case types.OP_JMP:
+		if a > 0 {
+			v.checkReg(a - 1)
+		}
+		v.checkJump(i.GetArgsBx())
+	case types.OP_EQ, types.OP_LT, types.OP_LE:
+		v.checkRK(b)
+		v.checkRK(c)
+		v.checkNext(types.OP_JMP)
+	case types.OP_TEST:
+		v.checkReg(a)
+		v.checkNext(types.OP_JMP)
+	case types.OP_TESTSET:
+		v.checkReg(a)
+		v.checkReg(b)
+		v.checkNext(types.OP_JMP)
+	case types.OP_CALL:
+		v.checkReg(a)
+		if b > 0 {
+			v.checkReg(a + b - 1)
+		}
+		if c > 1 {
+			v.checkReg(a + c - 2)
+		}
+	case types.OP_TAILCALL:
+		v.checkReg(a)
+		if b > 0 {
+			v.checkReg(a + b - 1)
+		}
+	case types.OP_RETURN:
+		if b == 0 {
+			v.checkReg(a)
+		} else if b > 1 {
+			v.checkReg(a + b - 2)
+		}
+	case types.OP_FORLOOP, types.OP_FORPREP:
+		v.checkReg(a + 3)
+		v.checkJump(i.GetArgsBx())
+	case types.OP_TFORCALL:
+		v.checkReg(a + 2 + c)
+		v.checkNext(types.OP_TFORLOOP)
+	case types.OP_TFORLOOP:
+		v.checkReg(a + 1)
+		v.checkJump(i.GetArgsBx())
+	case types.OP_SETLIST:
+		v.checkReg(a + b)
+		if c == 0 {
+			v.checkNext(types.OP_EXTRAARG)
+			c = v.p.Code[v.pc+1].GetArgAx()
+		}
+		// Each block of the constructor is set by its own OP_SETLIST
+		if c < 1 || c > len(v.p.Code) {
+			v.fail("list block %d out of range (%d instructions)", c, len(v.p.Code))
+		}
+	case types.OP_CLOSURE:
+		v.checkReg(a)
+		if bx := getBx(i); bx >= len(v.p.Protos) {
+			v.fail("function %d out of range (%d functions)", bx, len(v.p.Protos))
+		}
+	case types.OP_VARARG:
+		if v.p.Meta.IsVarArg == 0 {
+			v.fail("%s in a function that is not vararg", op)
+		}
+		v.checkReg(a)
+		if b > 1 {
+			v.checkReg(a + b - 2)
+		}
+	case types.OP_EXTRAARG:
+		v.fail("%s without a preceding %s or %s", op, types.OP_LOADKx, types.OP_SETLIST)
+	default:
+		v.fail("invalid opcode %d", op)
+	}
+}
+
+// Verifies that the code of p and of its nested functions can be executed
+// safely by the VM: registers, constants, upvalues and functions referenced by
+// the instructions exist, jumps stay in the code, instructions that must go in
+// pairs do, table sizes are no larger than the code can fill, and the code
+// ends with a return. If it can't, the error is a *VerifyError.
+//
+// Chunks produced by the compiler or by luac always pass, it is meant for
+// chunks that come from untrusted sources.
+func Verify(p *types.Prototype) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			if ve, ok := e.(*VerifyError); ok {
+				err = ve
+				return
+			}
+			panic(e)
+		}
+	}()
+
+	v := &verifyState{p: p, path: []int{}}
+	v.verifyFunction()
+	return nil
+}
+
+// Loads the precompiled chunk read from r, like Load, and verifies it before
+// returning it. If it is rejected by Verify, the error is a *VerifyError.
+func LoadVerified(r io.Reader) (*types.Prototype, error) {
+	p, err := Load(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := Verify(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,196 @@
+package stdlib
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/mna/lune/types"
+	"github.com/mna/lune/vm"
+)
+
+/*
+  Argument checks for the library functions, mostly a port of the relevant
+  parts of lauxlib.c from Lua
+*/
+
+// Raises an error for the argument at position n (starting at 1) of the
+// function fName. See luaL_argerror in lauxlib.c.
+func argError(s *types.State, n int, fName, msg string) {
+	vm.Errorf(s, "bad argument #%d to '%s' (%s)", n, fName, msg)
+}
+
+// Raises an error if there is no argument at position n.
+func checkAny(s *types.State, args []types.Value, n int, fName string) {
+	if len(args) < n {
+		argError(s, n, fName, "value expected")
+	}
+}
+
+// Returns the argument at position n as an integer, or def if it is absent or
+// nil. Raises an error if it is not a number.
+func optInt(s *types.State, args []types.Value, n int, fName string, def int) int {
+	if len(args) < n || args[n-1] == nil {
+		return def
+	}
+	switch v := args[n-1].(type) {
+	case float64:
+		return int(v)
+	case string:
+		if f, ok := types.StrToNumber(v); ok {
+			return int(f)
+		}
+	}
+	typeError(s, args, n, fName, "number")
+	return 0
+}
+
+// Returns the argument at position n as an integer. Raises an error if it is
+// not a number. See luaL_checkinteger.
+func checkInt(s *types.State, args []types.Value, n int, fName string) int {
+	if len(args) < n || args[n-1] == nil {
+		typeError(s, args, n, fName, "number")
+	}
+	return optInt(s, args, n, fName, 0)
+}
+
+// Returns the argument at position n as a number. Raises an error if it is
+// not a number. See luaL_checknumber.
+func checkNumber(s *types.State, args []types.Value, n int, fName string) float64 {
+	if len(args) >= n {
+		switch v := args[n-1].(type) {
+		case float64:
+			return v
+		case string:
+			if f, ok := types.StrToNumber(v); ok {
+				return f
+			}
+		}
+	}
+	typeError(s, args, n, fName, "number")
+	return 0
+}
+
+// Returns the argument at position n as a string, converting numbers. Raises
+// an error if it is neither a string nor a number. See luaL_checklstring.
+func checkString(s *types.State, args []types.Value, n int, fName string) string {
+	if len(args) >= n {
+		switch v := args[n-1].(type) {
+		case string:
+			return v
+		case float64:
+			return types.NumberToString(v)
+		}
+	}
+	typeError(s, args, n, fName, "string")
+	return ""
+}
+
+// Returns the argument at position n as a string, or def if it is absent or
+// nil. See luaL_optlstring.
+func optString(s *types.State, args []types.Value, n int, fName string, def string) string {
+	if len(args) < n || args[n-1] == nil {
+		return def
+	}
+	return checkString(s, args, n, fName)
+}
+
+// Returns the index in opts of the string argument at position n, or of def
+// if it is absent and def is not empty. Raises an error if it is not one of
+// opts. See luaL_checkoption.
+func checkOption(s *types.State, args []types.Value, n int, fName, def string, opts ...string) int {
+	var name string
+	if def != "" {
+		name = optString(s, args, n, fName, def)
+	} else {
+		name = checkString(s, args, n, fName)
+	}
+	for i, opt := range opts {
+		if opt == name {
+			return i
+		}
+	}
+	argError(s, n, fName, fmt.Sprintf("invalid option '%s'", name))
+	return 0
+}
+
+// Returns the table argument at position n.
+func checkTable(s *types.State, args []types.Value, n int, fName string) *types.Table {
+	checkType(s, args, n, fName, types.TTABLE)
+	return args[n-1].(*types.Table)
+}
+
+// Returns the value v converted to a string in a reasonable format, calling
+// its __tostring metamethod if it has one. See luaL_tolstring.
+func toString(s *types.State, v types.Value) string {
+	if tm := metaField(s, v, "__tostring"); tm != nil {
+		res := vm.Call(s, tm, v)
+		if len(res) > 0 {
+			switch r := res[0].(type) {
+			case string:
+				return r
+			case float64:
+				return types.NumberToString(r)
+			}
+		}
+		vm.Errorf(s, "'__tostring' must return a string")
+	}
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return types.NumberToString(v)
+	case string:
+		return v
+	}
+	kind := types.TypeOf(v).String()
+	if name, ok := metaField(s, v, "__name").(string); ok {
+		kind = name
+	}
+	return fmt.Sprintf("%s: 0x%x", kind, valuePointer(v))
+}
+
+// Returns the address identifying the reference value v, 0 if there is none.
+func valuePointer(v types.Value) uintptr {
+	if l, ok := v.(types.LightUserdata); ok {
+		v = l.Value
+	}
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Ptr, reflect.Func, reflect.UnsafePointer, reflect.Map, reflect.Slice, reflect.Chan:
+		return rv.Pointer()
+	}
+	return 0
+}
+
+// Returns the field event of the metatable of v, nil if there is none. See
+// luaL_getmetafield.
+func metaField(s *types.State, v types.Value, event string) types.Value {
+	if mt := s.MetaTable(v); mt != nil {
+		return mt.Get(event)
+	}
+	return nil
+}
+
+// Raises an error for the argument at position n that is not of the expected
+// type. See luaL_typerror in lauxlib.c.
+func typeError(s *types.State, args []types.Value, n int, fName, expected string) {
+	argError(s, n, fName, fmt.Sprintf("%s expected, got %s", expected, typeName(args, n)))
+}
+
+// Raises an error if the argument at position n is not of type t.
+func checkType(s *types.State, args []types.Value, n int, fName string, t types.ValType) {
+	if len(args) < n || types.TypeOf(args[n-1]) != t {
+		typeError(s, args, n, fName, t.String())
+	}
+}
+
+// Returns the type name of the argument at position n, "no value" if it is
+// absent.
+func typeName(args []types.Value, n int) string {
+	if len(args) < n {
+		return "no value"
+	}
+	return types.TypeOf(args[n-1]).String()
+}
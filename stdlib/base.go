@@ -0,0 +1,452 @@
+package stdlib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/mna/lune/compiler"
+	"github.com/mna/lune/serializer"
+	"github.com/mna/lune/types"
+	"github.com/mna/lune/vm"
+)
+
+// error (message [, level])
+func baseError(s *types.State, args []types.Value) []types.Value {
+	var msg types.Value
+	if len(args) > 0 {
+		msg = args[0]
+	}
+	level := optInt(s, args, 2, "error", 1)
+	// Add the position only to string messages
+	if str, ok := msg.(string); ok && level > 0 {
+		msg = vm.Where(s, level) + str
+	}
+	vm.Error(s, msg)
+	return nil
+}
+
+// Returns the results of a protected call, preceded by its status.
+func protectedResults(res []types.Value, err error) []types.Value {
+	if err != nil {
+		return []types.Value{false, err.(*vm.RuntimeError).Value}
+	}
+	return append([]types.Value{true}, res...)
+}
+
+// pcall (f [, arg1, ...])
+func basePCall(s *types.State, args []types.Value) []types.Value {
+	checkAny(s, args, 1, "pcall")
+	return protectedResults(vm.PCall(s, args[0], args[1:], nil))
+}
+
+// xpcall (f, msgh [, arg1, ...])
+func baseXPCall(s *types.State, args []types.Value) []types.Value {
+	checkAny(s, args, 2, "xpcall")
+	return protectedResults(vm.PCall(s, args[0], args[2:], args[1]))
+}
+
+// Registers the base library in the table t, the globals table.
+func openBase(t *types.Table) {
+	t.Set("_G", t)
+	t.Set("_VERSION", "Lua 5.2")
+	t.Set("assert", types.NewGoClosure(baseAssert))
+	t.Set("collectgarbage", types.NewGoClosure(baseCollectGarbage))
+	t.Set("dofile", types.NewGoClosure(baseDoFile))
+	t.Set("error", types.NewGoClosure(baseError))
+	t.Set("getmetatable", types.NewGoClosure(baseGetMetatable))
+	t.Set("ipairs", types.NewGoClosure(baseIPairs))
+	t.Set("load", types.NewGoClosure(baseLoad))
+	t.Set("loadfile", types.NewGoClosure(baseLoadFile))
+	t.Set("next", nextFunc)
+	t.Set("pairs", types.NewGoClosure(basePairs))
+	t.Set("pcall", types.NewGoClosure(basePCall))
+	t.Set("print", types.NewGoClosure(basePrint))
+	t.Set("rawequal", types.NewGoClosure(baseRawEqual))
+	t.Set("rawget", types.NewGoClosure(baseRawGet))
+	t.Set("rawlen", types.NewGoClosure(baseRawLen))
+	t.Set("rawset", types.NewGoClosure(baseRawSet))
+	t.Set("select", types.NewGoClosure(baseSelect))
+	t.Set("setmetatable", types.NewGoClosure(baseSetMetatable))
+	t.Set("tonumber", types.NewGoClosure(baseToNumber))
+	t.Set("tostring", types.NewGoClosure(baseToString))
+	t.Set("type", types.NewGoClosure(baseType))
+	t.Set("unpack", types.NewGoClosure(tabUnpack)) // Compatibility with Lua 5.1
+	t.Set("xpcall", types.NewGoClosure(baseXPCall))
+}
+
+// assert (v [, message])
+func baseAssert(s *types.State, args []types.Value) []types.Value {
+	checkAny(s, args, 1, "assert")
+	if args[0] == nil || args[0] == false {
+		vm.Errorf(s, "%s", optString(s, args, 2, "assert", "assertion failed!"))
+	}
+	return args
+}
+
+// collectgarbage ([opt [, arg]])
+//
+// The Go collector is shared by the whole program, so it can't be stopped or
+// tuned for a state: the options "stop", "restart", "setpause",
+// "setstepmul", "incremental" and "generational" have no effect.
+func baseCollectGarbage(s *types.State, args []types.Value) []types.Value {
+	opt := optString(s, args, 1, "collectgarbage", "collect")
+	optInt(s, args, 2, "collectgarbage", 0)
+	switch opt {
+	case "collect":
+		vm.FullGC(s)
+		return []types.Value{0.0}
+	case "step":
+		vm.FullGC(s)
+		return []types.Value{true}
+	case "count":
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		return []types.Value{float64(ms.HeapAlloc) / 1024, float64(ms.HeapAlloc % 1024)}
+	case "isrunning":
+		return []types.Value{true}
+	case "stop", "restart", "incremental", "generational":
+		return []types.Value{0.0}
+	case "setpause", "setstepmul":
+		return []types.Value{200.0}
+	}
+	argError(s, 1, "collectgarbage", fmt.Sprintf("invalid option '%s'", opt))
+	return nil
+}
+
+// dofile ([filename])
+func baseDoFile(s *types.State, args []types.Value) []types.Value {
+	f, err := loadFile(s, optString(s, args, 1, "dofile", ""), "bt")
+	if err != nil {
+		vm.Error(s, err.Error())
+	}
+	return vm.Call(s, f)
+}
+
+// getmetatable (object)
+func baseGetMetatable(s *types.State, args []types.Value) []types.Value {
+	checkAny(s, args, 1, "getmetatable")
+	mt := s.MetaTable(args[0])
+	if mt == nil {
+		return []types.Value{nil}
+	}
+	if protected := mt.Get("__metatable"); protected != nil {
+		return []types.Value{protected}
+	}
+	return []types.Value{mt}
+}
+
+// Returns the 3 values of a generic for returned by the metamethod event of
+// the first argument, or nil if it has none.
+func iterMeta(s *types.State, args []types.Value, event string) []types.Value {
+	tm := metaField(s, args[0], event)
+	if tm == nil {
+		return nil
+	}
+	res := vm.Call(s, tm, args[0])
+	for len(res) < 3 {
+		res = append(res, nil)
+	}
+	return res[:3]
+}
+
+// Iterators returned by pairs and ipairs. They are allocated once, so that
+// they are the same function value on each call, like Lua's light C functions.
+var (
+	nextFunc      = types.NewGoClosure(baseNext)
+	ipairsAuxFunc = types.NewGoClosure(ipairsAux)
+)
+
+// ipairs (t)
+func baseIPairs(s *types.State, args []types.Value) []types.Value {
+	checkAny(s, args, 1, "ipairs")
+	if res := iterMeta(s, args, "__ipairs"); res != nil {
+		return res
+	}
+	return []types.Value{ipairsAuxFunc, args[0], 0.0}
+}
+
+func ipairsAux(s *types.State, args []types.Value) []types.Value {
+	t := checkTable(s, args, 1, "ipairs")
+	i := checkInt(s, args, 2, "ipairs") + 1
+	if v := t.Get(float64(i)); v != nil {
+		return []types.Value{float64(i), v}
+	}
+	return []types.Value{nil}
+}
+
+// Loads a chunk from r, and returns its main function. The mode controls
+// whether the chunk can be text ("t"), binary ("b") or both ("bt"). See
+// luaL_loadbufferx.
+func loadChunk(s *types.State, r io.Reader, chunkName, mode string) (*types.Closure, error) {
+	br := bufio.NewReader(r)
+	var p *types.Prototype
+	var err error
+	if b, perr := br.Peek(1); perr == nil && b[0] == '\x1b' {
+		if !strings.Contains(mode, "b") {
+			return nil, fmt.Errorf("attempt to load a binary chunk (mode is '%s')", mode)
+		}
+		p, err = serializer.LoadVerified(br)
+	} else {
+		if !strings.Contains(mode, "t") {
+			return nil, fmt.Errorf("attempt to load a text chunk (mode is '%s')", mode)
+		}
+		p, err = compiler.Compile(br, chunkName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.Load(p), nil
+}
+
+// Loads the file fn, or the standard input if fn is empty.
+func loadFile(s *types.State, fn, mode string) (*types.Closure, error) {
+	if fn == "" {
+		return loadChunk(s, stdinReader(s), "=stdin", mode)
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s", fn)
+	}
+	defer f.Close()
+	return loadChunk(s, f, "@"+fn, mode)
+}
+
+// Returns the results of load and loadfile: the loaded function, with its
+// first upvalue set to the env argument at position n if it is present, or
+// nil and the error message.
+func loadResults(args []types.Value, n int, f *types.Closure, err error) []types.Value {
+	if err != nil {
+		return []types.Value{nil, err.Error()}
+	}
+	if len(args) >= n && len(f.UpVals) > 0 {
+		f.UpVals[0] = types.NewClosedUpVal(args[n-1])
+	}
+	return []types.Value{f}
+}
+
+// load (ld [, source [, mode [, env]]])
+func baseLoad(s *types.State, args []types.Value) []types.Value {
+	checkAny(s, args, 1, "load")
+	mode := optString(s, args, 3, "load", "bt")
+	var f *types.Closure
+	var err error
+	switch ld := args[0].(type) {
+	case string, float64:
+		src := checkString(s, args, 1, "load")
+		f, err = loadChunk(s, strings.NewReader(src), optString(s, args, 2, "load", src), mode)
+	default:
+		// Concatenate the pieces returned by the reader function
+		checkType(s, args, 1, "load", types.TFUNCTION)
+		var buf bytes.Buffer
+		for {
+			res := vm.Call(s, ld)
+			if len(res) == 0 || res[0] == nil || res[0] == "" {
+				break
+			}
+			piece, ok := res[0].(string)
+			if !ok {
+				return []types.Value{nil, "reader function must return a string"}
+			}
+			buf.WriteString(piece)
+		}
+		f, err = loadChunk(s, &buf, optString(s, args, 2, "load", "=(load)"), mode)
+	}
+	return loadResults(args, 4, f, err)
+}
+
+// loadfile ([filename [, mode [, env]]])
+func baseLoadFile(s *types.State, args []types.Value) []types.Value {
+	fn := optString(s, args, 1, "loadfile", "")
+	mode := optString(s, args, 2, "loadfile", "bt")
+	f, err := loadFile(s, fn, mode)
+	return loadResults(args, 3, f, err)
+}
+
+// next (table [, index])
+func baseNext(s *types.State, args []types.Value) []types.Value {
+	t := checkTable(s, args, 1, "next")
+	var k types.Value
+	if len(args) > 1 {
+		k = args[1]
+	}
+	k, v, ok := t.Next(k)
+	if !ok {
+		vm.Errorf(s, "invalid key to 'next'")
+	}
+	if k == nil {
+		return []types.Value{nil}
+	}
+	return []types.Value{k, v}
+}
+
+// pairs (t)
+func basePairs(s *types.State, args []types.Value) []types.Value {
+	checkAny(s, args, 1, "pairs")
+	if res := iterMeta(s, args, "__pairs"); res != nil {
+		return res
+	}
+	return []types.Value{nextFunc, args[0], nil}
+}
+
+// print (...)
+func basePrint(s *types.State, args []types.Value) []types.Value {
+	tostring := vm.GetTable(s, s.Globals, "tostring")
+	var buf bytes.Buffer
+	for i, v := range args {
+		var str types.Value
+		if res := vm.Call(s, tostring, v); len(res) > 0 {
+			str = res[0]
+		}
+		switch v := str.(type) {
+		case float64:
+			str = types.NumberToString(v)
+		case string:
+		default:
+			vm.Errorf(s, "'tostring' must return a string to 'print'")
+		}
+		if i > 0 {
+			buf.WriteByte('\t')
+		}
+		buf.WriteString(str.(string))
+	}
+	buf.WriteByte('\n')
+	stdoutWriter(s).Write(buf.Bytes())
+	return nil
+}
+
+// rawequal (v1, v2)
+func baseRawEqual(s *types.State, args []types.Value) []types.Value {
+	checkAny(s, args, 1, "rawequal")
+	checkAny(s, args, 2, "rawequal")
+	return []types.Value{vm.RawEqual(args[0], args[1])}
+}
+
+// rawget (table, index)
+func baseRawGet(s *types.State, args []types.Value) []types.Value {
+	t := checkTable(s, args, 1, "rawget")
+	checkAny(s, args, 2, "rawget")
+	return []types.Value{t.Get(args[1])}
+}
+
+// rawlen (v)
+func baseRawLen(s *types.State, args []types.Value) []types.Value {
+	if len(args) > 0 {
+		switch v := args[0].(type) {
+		case *types.Table:
+			return []types.Value{float64(v.Len())}
+		case string:
+			return []types.Value{float64(len(v))}
+		}
+	}
+	argError(s, 1, "rawlen", "table or string expected")
+	return nil
+}
+
+// rawset (table, index, value)
+func baseRawSet(s *types.State, args []types.Value) []types.Value {
+	t := checkTable(s, args, 1, "rawset")
+	checkAny(s, args, 2, "rawset")
+	checkAny(s, args, 3, "rawset")
+	vm.RawSet(s, t, args[1], args[2])
+	return args[:1]
+}
+
+// select (index, ...)
+func baseSelect(s *types.State, args []types.Value) []types.Value {
+	n := len(args) - 1
+	if len(args) > 0 && args[0] == "#" {
+		return []types.Value{float64(n)}
+	}
+	i := checkInt(s, args, 1, "select")
+	if i < 0 {
+		i = n + i
+	} else if i > n {
+		i = n
+	} else {
+		i--
+	}
+	if i < 0 {
+		argError(s, 1, "select", "index out of range")
+	}
+	return args[1+i:]
+}
+
+// setmetatable (table, metatable)
+func baseSetMetatable(s *types.State, args []types.Value) []types.Value {
+	checkType(s, args, 1, "setmetatable", types.TTABLE)
+	if len(args) < 2 || args[1] != nil && types.TypeOf(args[1]) != types.TTABLE {
+		typeError(s, args, 2, "setmetatable", "nil or table")
+	}
+	if metaField(s, args[0], "__metatable") != nil {
+		vm.Errorf(s, "cannot change a protected metatable")
+	}
+	mt, _ := args[1].(*types.Table)
+	s.SetMetaTable(args[0], mt)
+	return args[:1]
+}
+
+// tonumber (e [, base])
+func baseToNumber(s *types.State, args []types.Value) []types.Value {
+	if len(args) < 2 || args[1] == nil {
+		checkAny(s, args, 1, "tonumber")
+		switch v := args[0].(type) {
+		case float64:
+			return args[:1]
+		case string:
+			if n, ok := types.StrToNumber(v); ok {
+				return []types.Value{n}
+			}
+		}
+		return []types.Value{nil}
+	}
+
+	base := checkInt(s, args, 2, "tonumber")
+	str := strings.TrimSpace(checkString(s, args, 1, "tonumber"))
+	if base < 2 || base > 36 {
+		argError(s, 2, "tonumber", "base out of range")
+	}
+	neg := strings.HasPrefix(str, "-")
+	if neg {
+		str = str[1:]
+	}
+	if str == "" {
+		return []types.Value{nil}
+	}
+	var n float64
+	for _, c := range strings.ToLower(str) {
+		var d int
+		switch {
+		case c >= '0' && c <= '9':
+			d = int(c - '0')
+		case c >= 'a' && c <= 'z':
+			d = int(c-'a') + 10
+		default:
+			return []types.Value{nil}
+		}
+		if d >= base {
+			return []types.Value{nil}
+		}
+		n = n*float64(base) + float64(d)
+	}
+	if neg {
+		n = -n
+	}
+	return []types.Value{n}
+}
+
+// tostring (v)
+func baseToString(s *types.State, args []types.Value) []types.Value {
+	checkAny(s, args, 1, "tostring")
+	return []types.Value{toString(s, args[0])}
+}
+
+// type (v)
+func baseType(s *types.State, args []types.Value) []types.Value {
+	checkAny(s, args, 1, "type")
+	return []types.Value{types.TypeOf(args[0]).String()}
+}
@@ -0,0 +1,78 @@
+package stdlib
+
+import (
+	"github.com/mna/lune/types"
+	"github.com/mna/lune/vm"
+)
+
+// Returns the thread argument of the function fName.
+func checkThread(s *types.State, args []types.Value, fName string) *types.Thread {
+	if len(args) > 0 {
+		if t, ok := args[0].(*types.Thread); ok {
+			return t
+		}
+	}
+	argError(s, 1, fName, "coroutine expected")
+	return nil
+}
+
+// create (f)
+func coCreate(s *types.State, args []types.Value) []types.Value {
+	checkType(s, args, 1, "create", types.TFUNCTION)
+	return []types.Value{vm.NewThread(s, args[0])}
+}
+
+// resume (co [, val1, ...])
+func coResume(s *types.State, args []types.Value) []types.Value {
+	t := checkThread(s, args, "resume")
+	res, err := vm.Resume(s, t, args[1:]...)
+	if err != nil {
+		return []types.Value{false, err.(*vm.RuntimeError).Value}
+	}
+	return append([]types.Value{true}, res...)
+}
+
+// yield (...)
+func coYield(s *types.State, args []types.Value) []types.Value {
+	return vm.Yield(s, args...)
+}
+
+// status (co)
+func coStatus(s *types.State, args []types.Value) []types.Value {
+	t := checkThread(s, args, "status")
+	return []types.Value{t.S.Status.String()}
+}
+
+// running ()
+func coRunning(s *types.State, args []types.Value) []types.Value {
+	t := s.Thread()
+	return []types.Value{t, t == s.MainThread}
+}
+
+// wrap (f)
+//
+// The thread is an upvalue of the returned Go closure, so that it is
+// reachable from Lua and each call returns a distinct function.
+func coWrap(s *types.State, args []types.Value) []types.Value {
+	checkType(s, args, 1, "wrap", types.TFUNCTION)
+	return []types.Value{types.NewGoClosure(coAuxWrap, vm.NewThread(s, args[0]))}
+}
+
+// Resumes the thread of the function created by wrap. See auxwrap in
+// lcorolib.c.
+func coAuxWrap(s *types.State, args []types.Value) []types.Value {
+	t := s.Stack[s.CI.FuncIndex].(*types.GoClosure).UpVals[0].(*types.Thread)
+	res, err := vm.Resume(s, t, args...)
+	if err != nil {
+		// Propagate the error, with the position of the caller for a message
+		v := err.(*vm.RuntimeError).Value
+		switch msg := v.(type) {
+		case string:
+			v = vm.Where(s, 1) + msg
+		case float64:
+			v = vm.Where(s, 1) + types.NumberToString(msg)
+		}
+		vm.Error(s, v)
+	}
+	return res
+}
@@ -0,0 +1,80 @@
+package stdlib
+
+import (
+	"github.com/mna/lune/types"
+	"github.com/mna/lune/vm"
+)
+
+// traceback ([thread,] [message [, level]])
+func debugTraceback(s *types.State, args []types.Value) []types.Value {
+	ts, level := s, 1
+	if len(args) > 0 {
+		if t, ok := args[0].(*types.Thread); ok {
+			// Traceback of another thread, starting at its running function
+			ts, level = t.S, 0
+			args = args[1:]
+		}
+	}
+	var msg string
+	if len(args) > 0 {
+		switch v := args[0].(type) {
+		case nil:
+		case string:
+			msg = v
+		case float64:
+			msg = types.NumberToString(v)
+		default:
+			// Other message values are returned untouched
+			return args[:1]
+		}
+	}
+	level = optInt(s, args, 2, "traceback", level)
+	return []types.Value{vm.Traceback(ts, msg, level)}
+}
+
+// getmetatable (value)
+func debugGetMetatable(s *types.State, args []types.Value) []types.Value {
+	checkAny(s, args, 1, "getmetatable")
+	if mt := s.MetaTable(args[0]); mt != nil {
+		return []types.Value{mt}
+	}
+	return []types.Value{nil}
+}
+
+// setmetatable (value, table)
+func debugSetMetatable(s *types.State, args []types.Value) []types.Value {
+	if len(args) < 2 || args[1] != nil && types.TypeOf(args[1]) != types.TTABLE {
+		typeError(s, args, 2, "setmetatable", "nil or table")
+	}
+	mt, _ := args[1].(*types.Table)
+	s.SetMetaTable(args[0], mt)
+	return args[:1]
+}
+
+// getuservalue (u)
+func debugGetUservalue(s *types.State, args []types.Value) []types.Value {
+	if len(args) > 0 {
+		if u, ok := args[0].(*types.Userdata); ok && u.UserValue != nil {
+			return []types.Value{u.UserValue}
+		}
+	}
+	return []types.Value{nil}
+}
+
+// setuservalue (udata, value)
+func debugSetUservalue(s *types.State, args []types.Value) []types.Value {
+	if len(args) > 0 {
+		if _, ok := args[0].(types.LightUserdata); ok {
+			argError(s, 1, "setuservalue", "full userdata expected, got light userdata")
+		}
+	}
+	checkType(s, args, 1, "setuservalue", types.TUSERDATA)
+	u := args[0].(*types.Userdata)
+	if len(args) < 2 || args[1] == nil {
+		u.UserValue = nil
+	} else {
+		checkType(s, args, 2, "setuservalue", types.TTABLE)
+		u.UserValue = args[1].(*types.Table)
+	}
+	return args[:1]
+}
@@ -0,0 +1,847 @@
+package stdlib
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/mna/lune/types"
+	"github.com/mna/lune/vm"
+)
+
+/*
+  The io library, a port of liolib.c from Lua. File handles are userdata
+  wrapping a *file, with the metatable registered as "FILE*" in the registry.
+  The default input and output files are kept in the registry as in Lua, and
+  so are the standard files, so that the embedding code can redirect them
+  with SetStdin, SetStdout and SetStderr.
+*/
+
+// Registry keys of the io library.
+const (
+	fileHandle = "FILE*"
+	ioInput    = "_IO_input"
+	ioOutput   = "_IO_output"
+	ioStdin    = "_IO_stdin"
+	ioStdout   = "_IO_stdout"
+	ioStderr   = "_IO_stderr"
+)
+
+// File handle, an open file or any reader or writer.
+type file struct {
+	rd     *bufio.Reader // Nil if the file is not readable
+	base   io.Writer     // Nil if the file is not writable
+	wr     io.Writer     // base, or a buffer on base, see setvbuf
+	f      *os.File      // Nil if it is not an *os.File, then it can't seek
+	close  func() []types.Value
+	std    bool // Standard files can't be closed, see io_noclose
+	closed bool
+}
+
+// Returns a file reading from r and writing to w, either can be nil.
+// Writes are not buffered.
+func newFile(r io.Reader, w io.Writer) *file {
+	p := &file{base: w, wr: w}
+	if r != nil {
+		p.rd = bufio.NewReader(r)
+	}
+	if f, ok := r.(*os.File); ok {
+		p.f = f
+	} else if f, ok := w.(*os.File); ok {
+		p.f = f
+	}
+	return p
+}
+
+// Returns a standard file, one that can't be closed.
+func newStdFile(r io.Reader, w io.Writer) *file {
+	p := newFile(r, w)
+	p.std = true
+	return p
+}
+
+type flusher interface {
+	Flush() error
+}
+
+func (p *file) flush() error {
+	if fl, ok := p.wr.(flusher); ok {
+		return fl.Flush()
+	}
+	return nil
+}
+
+// Moves the position of the file to the position of the reader, ahead of it
+// when it buffers data.
+func (p *file) syncReader() error {
+	if p.rd == nil || p.f == nil || p.rd.Buffered() == 0 {
+		return nil
+	}
+	_, err := p.f.Seek(int64(-p.rd.Buffered()), io.SeekCurrent)
+	p.rd.Reset(p.f)
+	return err
+}
+
+func (p *file) write(b []byte) error {
+	if p.wr == nil {
+		return syscall.EBADF
+	}
+	if err := p.syncReader(); err != nil {
+		return err
+	}
+	_, err := p.wr.Write(b)
+	return err
+}
+
+func (p *file) reader() (*bufio.Reader, error) {
+	if p.rd == nil {
+		return nil, syscall.EBADF
+	}
+	return p.rd, p.flush()
+}
+
+// Writer that flushes its buffer at each newline, see setvbuf.
+type lineWriter struct {
+	*bufio.Writer
+}
+
+func (w lineWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	if err == nil && bytes.IndexByte(b, '\n') >= 0 {
+		err = w.Flush()
+	}
+	return n, err
+}
+
+// Returns a new file handle for p.
+func newFileHandle(s *types.State, p *file) *types.Userdata {
+	u := types.NewUserdata(p)
+	s.SetMetaTable(u, s.Registry.Get(fileHandle).(*types.Table))
+	return u
+}
+
+// Returns the file handle argument at position 1, nil if it is not a file
+// handle. See luaL_testudata.
+func testFile(s *types.State, args []types.Value) *file {
+	if len(args) > 0 {
+		if u, ok := args[0].(*types.Userdata); ok && u.Meta != nil && u.Meta == s.Registry.Get(fileHandle) {
+			if p, ok := u.Value.(*file); ok {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the open file handle argument at position 1. See tofile.
+func toFile(s *types.State, args []types.Value, fName string) *file {
+	p := testFile(s, args)
+	if p == nil {
+		typeError(s, args, 1, fName, fileHandle)
+	}
+	if p.closed {
+		vm.Errorf(s, "attempt to use a closed file")
+	}
+	return p
+}
+
+// Returns the results of a failed file operation: nil, the message and the
+// error number. The message is prefixed with fName if it is not empty. See
+// luaL_fileresult.
+func fileError(err error, fName string) []types.Value {
+	msg := errorString(err)
+	if fName != "" {
+		msg = fName + ": " + msg
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return []types.Value{nil, msg, float64(errno)}
+	}
+	return []types.Value{nil, msg, 0.0}
+}
+
+// Returns the message of the error err, the one of the underlying system
+// error if there is one, capitalized like C's strerror.
+func errorString(err error) string {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		msg := errno.Error()
+		if msg != "" && msg[0] >= 'a' && msg[0] <= 'z' {
+			msg = string(msg[0]-'a'+'A') + msg[1:]
+		}
+		return msg
+	}
+	return err.Error()
+}
+
+// Opens the file named fName with the C mode string mode.
+func openFile(fName, mode string) (*file, error) {
+	var flag int
+	switch strings.TrimSuffix(strings.TrimRight(mode, "b"), "+") {
+	case "r":
+		flag = os.O_RDONLY
+	case "w":
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	case "a":
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	if strings.Contains(mode, "+") {
+		flag = flag&^os.O_WRONLY | os.O_RDWR
+	}
+	f, err := os.OpenFile(fName, flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	p := &file{f: f}
+	if flag&os.O_WRONLY == 0 {
+		p.rd = bufio.NewReader(f)
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		p.base, p.wr = f, bufio.NewWriter(f)
+	}
+	p.close = func() []types.Value {
+		err := p.flush()
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fileError(err, "")
+		}
+		return []types.Value{true}
+	}
+	return p, nil
+}
+
+// Reports whether mode is a valid mode for io.open. See l_checkmode.
+func checkMode(mode string) bool {
+	if mode == "" || strings.IndexByte("rwa", mode[0]) < 0 {
+		return false
+	}
+	mode = strings.TrimPrefix(mode[1:], "+")
+	return strings.Trim(mode, "b") == ""
+}
+
+// Registers the io library in the table t, the globals table, and the file
+// handle metatable in the registry of s.
+func openIO(s *types.State, t *types.Table) {
+	methT := types.NewTable(0, 7)
+	methT.Set("close", types.NewGoClosure(ioClose))
+	methT.Set("flush", types.NewGoClosure(fFlush))
+	methT.Set("lines", types.NewGoClosure(fLines))
+	methT.Set("read", types.NewGoClosure(fRead))
+	methT.Set("seek", types.NewGoClosure(fSeek))
+	methT.Set("setvbuf", types.NewGoClosure(fSetvbuf))
+	methT.Set("write", types.NewGoClosure(fWrite))
+
+	mt := types.NewTable(0, 4)
+	mt.Set("__name", fileHandle)
+	mt.Set("__index", methT)
+	mt.Set("__gc", types.NewGoClosure(fGC))
+	mt.Set("__tostring", types.NewGoClosure(fToString))
+	s.Registry.Set(fileHandle, mt)
+
+	ioT := types.NewTable(0, 14)
+	ioT.Set("close", types.NewGoClosure(ioClose))
+	ioT.Set("flush", types.NewGoClosure(ioFlush))
+	ioT.Set("input", types.NewGoClosure(ioInputFile))
+	ioT.Set("lines", types.NewGoClosure(ioLines))
+	ioT.Set("open", types.NewGoClosure(ioOpen))
+	ioT.Set("output", types.NewGoClosure(ioOutputFile))
+	ioT.Set("popen", types.NewGoClosure(ioPopen))
+	ioT.Set("read", types.NewGoClosure(ioRead))
+	ioT.Set("tmpfile", types.NewGoClosure(ioTmpfile))
+	ioT.Set("type", types.NewGoClosure(ioType))
+	ioT.Set("write", types.NewGoClosure(ioWrite))
+
+	stdin := newFileHandle(s, newStdFile(os.Stdin, nil))
+	stdout := newFileHandle(s, newStdFile(nil, os.Stdout))
+	stderr := newFileHandle(s, newStdFile(nil, os.Stderr))
+	ioT.Set("stdin", stdin)
+	ioT.Set("stdout", stdout)
+	ioT.Set("stderr", stderr)
+	s.Registry.Set(ioStdin, stdin)
+	s.Registry.Set(ioStdout, stdout)
+	s.Registry.Set(ioStderr, stderr)
+	s.Registry.Set(ioInput, stdin)
+	s.Registry.Set(ioOutput, stdout)
+	t.Set("io", ioT)
+}
+
+// Returns the standard file of s at the registry key, nil if the io library
+// is not opened.
+func stdFile(s *types.State, key string) *file {
+	if u, ok := s.Registry.Get(key).(*types.Userdata); ok {
+		return u.Value.(*file)
+	}
+	return nil
+}
+
+// Redirects the standard input of the io library of the state s, io.stdin,
+// to r. It has no effect if the io library is not opened.
+func SetStdin(s *types.State, r io.Reader) {
+	if p := stdFile(s, ioStdin); p != nil {
+		*p = *newStdFile(r, nil)
+	}
+}
+
+// Redirects the standard output of the state s, io.stdout and the output of
+// print, to w. It has no effect if the io library is not opened.
+func SetStdout(s *types.State, w io.Writer) {
+	if p := stdFile(s, ioStdout); p != nil {
+		*p = *newStdFile(nil, w)
+	}
+}
+
+// Redirects the standard error of the io library of the state s,
+// io.stderr, to w. It has no effect if the io library is not opened.
+func SetStderr(s *types.State, w io.Writer) {
+	if p := stdFile(s, ioStderr); p != nil {
+		*p = *newStdFile(nil, w)
+	}
+}
+
+// Returns the reader of the standard input of s, os.Stdin if the io library
+// is not opened.
+func stdinReader(s *types.State) io.Reader {
+	if p := stdFile(s, ioStdin); p != nil && p.rd != nil {
+		return p.rd
+	}
+	return os.Stdin
+}
+
+// Returns the writer of the standard output of s, os.Stdout if the io
+// library is not opened.
+func stdoutWriter(s *types.State) io.Writer {
+	if p := stdFile(s, ioStdout); p != nil && p.wr != nil {
+		return p.wr
+	}
+	return os.Stdout
+}
+
+// Returns the writer of the standard error of s, os.Stderr if the io library
+// is not opened.
+func stderrWriter(s *types.State) io.Writer {
+	if p := stdFile(s, ioStderr); p != nil && p.wr != nil {
+		return p.wr
+	}
+	return os.Stderr
+}
+
+// Returns the standard input of s as the standard input of a child process,
+// if it is an *os.File. Any other reader would be read ahead by the copy to
+// the process, losing what it doesn't use, so the process has no input.
+func childStdin(s *types.State) io.Reader {
+	if p := stdFile(s, ioStdin); p != nil && p.f != nil {
+		return p.f
+	}
+	return nil
+}
+
+// Returns the standard file of s at key as an output of a child process. The
+// process writes to an *os.File directly, and to buf otherwise, so that it
+// doesn't write concurrently with the state.
+func childWriter(s *types.State, key string, buf *bytes.Buffer) io.Writer {
+	if p := stdFile(s, key); p != nil {
+		p.flush()
+		if p.f != nil {
+			return p.f
+		}
+	}
+	return buf
+}
+
+/*
+  Functions of the io table
+*/
+
+// Returns the default input or output file. See getiofile.
+func getIOFile(s *types.State, key string) *types.Userdata {
+	u := s.Registry.Get(key).(*types.Userdata)
+	if u.Value.(*file).closed {
+		vm.Errorf(s, "standard %s file is closed", strings.TrimPrefix(key, "_IO_"))
+	}
+	return u
+}
+
+// Opens the file fName, raises an error if it fails. See opencheckfile.
+func openCheckFile(s *types.State, fName, mode string) *types.Userdata {
+	p, err := openFile(fName, mode)
+	if err != nil {
+		vm.Errorf(s, "cannot open file '%s' (%s)", fName, errorString(err))
+	}
+	return newFileHandle(s, p)
+}
+
+// close ([file])
+func ioClose(s *types.State, args []types.Value) []types.Value {
+	if len(args) == 0 {
+		args = []types.Value{s.Registry.Get(ioOutput)}
+	}
+	p := toFile(s, args, "close")
+	return closeFile(p)
+}
+
+// Closes the file p, see aux_close.
+func closeFile(p *file) []types.Value {
+	if p.std {
+		return []types.Value{nil, "cannot close standard file"}
+	}
+	p.closed = true
+	return p.close()
+}
+
+// flush ()
+func ioFlush(s *types.State, args []types.Value) []types.Value {
+	return fFlush(s, []types.Value{getIOFile(s, ioOutput)})
+}
+
+// Implements io.input and io.output. See g_iofile.
+func ioFile(s *types.State, args []types.Value, key, mode, fName string) []types.Value {
+	if len(args) > 0 && args[0] != nil {
+		switch v := args[0].(type) {
+		case string, float64:
+			s.Registry.Set(key, openCheckFile(s, checkString(s, args, 1, fName), mode))
+		default:
+			toFile(s, args, fName)
+			s.Registry.Set(key, v)
+		}
+	}
+	return []types.Value{s.Registry.Get(key)}
+}
+
+// input ([file])
+func ioInputFile(s *types.State, args []types.Value) []types.Value {
+	return ioFile(s, args, ioInput, "r", "input")
+}
+
+// output ([file])
+func ioOutputFile(s *types.State, args []types.Value) []types.Value {
+	return ioFile(s, args, ioOutput, "w", "output")
+}
+
+// lines ([filename, ...])
+func ioLines(s *types.State, args []types.Value) []types.Value {
+	if len(args) == 0 || args[0] == nil {
+		// No file name, read the default input
+		u := s.Registry.Get(ioInput)
+		toFile(s, []types.Value{u}, "lines")
+		var formats []types.Value
+		if len(args) > 1 {
+			formats = args[1:]
+		}
+		return linesIter(s, u.(*types.Userdata), formats, false)
+	}
+	u := openCheckFile(s, checkString(s, args, 1, "lines"), "r")
+	return linesIter(s, u, args[1:], true)
+}
+
+// open (filename [, mode])
+func ioOpen(s *types.State, args []types.Value) []types.Value {
+	fName := checkString(s, args, 1, "open")
+	mode := optString(s, args, 2, "open", "r")
+	if !checkMode(mode) {
+		argError(s, 2, "open", "invalid mode")
+	}
+	p, err := openFile(fName, mode)
+	if err != nil {
+		return fileError(err, fName)
+	}
+	return []types.Value{newFileHandle(s, p)}
+}
+
+// popen (prog [, mode])
+func ioPopen(s *types.State, args []types.Value) []types.Value {
+	prog := checkString(s, args, 1, "popen")
+	mode := optString(s, args, 2, "popen", "r")
+	if mode != "r" && mode != "w" {
+		argError(s, 2, "popen", "invalid mode")
+	}
+	// The process uses the standard files of the state, its output to those
+	// that are not files is written once it has exited
+	var outBuf, errBuf bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", prog)
+	cmd.Stderr = childWriter(s, ioStderr, &errBuf)
+	p := &file{}
+	var pipe io.Closer
+	if mode == "r" {
+		r, err := cmd.StdoutPipe()
+		if err != nil {
+			return fileError(err, prog)
+		}
+		cmd.Stdin = childStdin(s)
+		p.rd, pipe = bufio.NewReader(r), r
+	} else {
+		w, err := cmd.StdinPipe()
+		if err != nil {
+			return fileError(err, prog)
+		}
+		cmd.Stdout = childWriter(s, ioStdout, &outBuf)
+		p.base, p.wr, pipe = w, bufio.NewWriter(w), w
+	}
+	if err := cmd.Start(); err != nil {
+		return fileError(err, prog)
+	}
+	p.close = func() []types.Value {
+		p.flush()
+		if mode == "w" {
+			pipe.Close()
+		}
+		res := execResult(cmd.Wait())
+		stdoutWriter(s).Write(outBuf.Bytes())
+		stderrWriter(s).Write(errBuf.Bytes())
+		return res
+	}
+	return []types.Value{newFileHandle(s, p)}
+}
+
+// Returns the results of a process that ended with err: true or nil, "exit"
+// or "signal", and the exit status or the signal. See luaL_execresult.
+func execResult(err error) []types.Value {
+	var exitErr *exec.ExitError
+	if err == nil {
+		return []types.Value{true, "exit", 0.0}
+	} else if !errors.As(err, &exitErr) {
+		return fileError(err, "")
+	}
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return []types.Value{nil, "signal", float64(ws.Signal())}
+	}
+	return []types.Value{nil, "exit", float64(exitErr.ExitCode())}
+}
+
+// read (...)
+func ioRead(s *types.State, args []types.Value) []types.Value {
+	p := getIOFile(s, ioInput).Value.(*file)
+	return readFile(s, p, args, 1, "read")
+}
+
+// tmpfile ()
+func ioTmpfile(s *types.State, args []types.Value) []types.Value {
+	f, err := os.CreateTemp("", "lune")
+	if err != nil {
+		return fileError(err, "")
+	}
+	// Removed right away like C's tmpfile, it stays usable until closed
+	os.Remove(f.Name())
+	p := &file{f: f, rd: bufio.NewReader(f), base: f, wr: bufio.NewWriter(f)}
+	p.close = func() []types.Value {
+		p.flush()
+		if err := f.Close(); err != nil {
+			return fileError(err, "")
+		}
+		return []types.Value{true}
+	}
+	return []types.Value{newFileHandle(s, p)}
+}
+
+// type (obj)
+func ioType(s *types.State, args []types.Value) []types.Value {
+	checkAny(s, args, 1, "type")
+	switch p := testFile(s, args); {
+	case p == nil:
+		return []types.Value{nil}
+	case p.closed:
+		return []types.Value{"closed file"}
+	}
+	return []types.Value{"file"}
+}
+
+// write (...)
+func ioWrite(s *types.State, args []types.Value) []types.Value {
+	u := getIOFile(s, ioOutput)
+	return writeFile(s, u, args, 1, "write")
+}
+
+/*
+  Methods of the file handles
+*/
+
+// file:flush ()
+func fFlush(s *types.State, args []types.Value) []types.Value {
+	if err := toFile(s, args, "flush").flush(); err != nil {
+		return fileError(err, "")
+	}
+	return []types.Value{true}
+}
+
+// __gc metamethod, closes the file if it is still open.
+func fGC(s *types.State, args []types.Value) []types.Value {
+	if p := testFile(s, args); p != nil && !p.closed {
+		closeFile(p)
+	}
+	return nil
+}
+
+// file:lines (...)
+func fLines(s *types.State, args []types.Value) []types.Value {
+	toFile(s, args, "lines")
+	return linesIter(s, args[0].(*types.Userdata), args[1:], false)
+}
+
+// Returns the iterator of lines, that reads the file handle u with the read
+// formats. If toClose is true, the file is closed at the end. See
+// aux_lines and io_readline.
+func linesIter(s *types.State, u *types.Userdata, formats []types.Value, toClose bool) []types.Value {
+	formats = append([]types.Value(nil), formats...)
+	p := u.Value.(*file)
+	iter := func(s *types.State, _ []types.Value) []types.Value {
+		if p.closed {
+			vm.Errorf(s, "file is already closed")
+		}
+		res := readFile(s, p, formats, 1, "lines")
+		if res[0] != nil {
+			return res // Read at least one value
+		}
+		if len(res) > 1 && res[1] != nil {
+			// An error, not the end of the file
+			vm.Errorf(s, "%s", res[1])
+		}
+		if toClose {
+			closeFile(p)
+		}
+		return []types.Value{nil}
+	}
+	return []types.Value{types.NewGoClosure(iter)}
+}
+
+// file:read (...)
+func fRead(s *types.State, args []types.Value) []types.Value {
+	p := toFile(s, args, "read")
+	return readFile(s, p, args[1:], 2, "read")
+}
+
+// Reads the file p according to the formats, the first of which is the
+// argument at position first. See g_read.
+func readFile(s *types.State, p *file, formats []types.Value, first int, fName string) []types.Value {
+	rd, err := p.reader()
+	if err != nil {
+		return fileError(err, "")
+	}
+	if len(formats) == 0 {
+		// Read a line by default
+		formats = []types.Value{"*l"}
+	}
+
+	res := make([]types.Value, 0, len(formats))
+	for i, f := range formats {
+		var v types.Value
+		var ok bool
+		switch f := f.(type) {
+		case float64:
+			if f < 0 {
+				argError(s, first+i, fName, "invalid count")
+			}
+			if n := int(math.Min(f, maxStringSize)); n == 0 {
+				v, ok, err = testEOF(rd)
+			} else {
+				v, ok, err = readChars(rd, n)
+			}
+		default:
+			opt, isStr := f.(string)
+			if !isStr || !strings.HasPrefix(opt, "*") {
+				argError(s, first+i, fName, "invalid option")
+			}
+			switch opt[1:min(len(opt), 2)] {
+			case "n": // Number
+				v, ok, err = readNumber(rd)
+			case "l": // Line
+				v, ok, err = readLine(rd, true)
+			case "L": // Line with end of line
+				v, ok, err = readLine(rd, false)
+			case "a": // File
+				var b []byte
+				b, err = io.ReadAll(rd)
+				v, ok = string(b), true
+			default:
+				argError(s, first+i, fName, "invalid format")
+			}
+		}
+		if err != nil {
+			return fileError(err, "")
+		}
+		if !ok {
+			return append(res, nil)
+		}
+		res = append(res, v)
+	}
+	return res
+}
+
+// Returns an empty string, and reports whether there is more to read.
+func testEOF(rd *bufio.Reader) (types.Value, bool, error) {
+	_, err := rd.Peek(1)
+	if err == io.EOF {
+		return "", false, nil
+	}
+	return "", err == nil, err
+}
+
+// Reads at most n bytes, reports whether it read any. The buffer grows with
+// what is actually read, so that a huge n doesn't allocate it all up front.
+func readChars(rd *bufio.Reader, n int) (types.Value, bool, error) {
+	var buf bytes.Buffer
+	_, err := io.CopyN(&buf, rd, int64(n))
+	if err == io.EOF {
+		err = nil
+	}
+	return buf.String(), buf.Len() > 0, err
+}
+
+// Reads a line, without the end of line if chop is true, reports whether it
+// read one.
+func readLine(rd *bufio.Reader, chop bool) (types.Value, bool, error) {
+	b, err := rd.ReadBytes('\n')
+	if err == io.EOF {
+		err = nil
+	}
+	eol := len(b) > 0 && b[len(b)-1] == '\n'
+	if chop && eol {
+		b = b[:len(b)-1]
+	}
+	return string(b), eol || len(b) > 0, err
+}
+
+// Reads a number like C's fscanf("%lf"), reports whether it read one.
+func readNumber(rd *bufio.Reader) (types.Value, bool, error) {
+	// Skip whitespace
+	c, err := rd.ReadByte()
+	for err == nil && matchClass(c, 's') {
+		c, err = rd.ReadByte()
+	}
+
+	var b []byte
+	accept := func(set string) bool {
+		if err == nil && strings.IndexByte(set, c) >= 0 {
+			b = append(b, c)
+			c, err = rd.ReadByte()
+			return true
+		}
+		return false
+	}
+	digits, exp := "0123456789", "eE"
+	accept("+-")
+	if accept("0") && accept("xX") {
+		digits, exp = "0123456789abcdefABCDEF", "pP"
+	}
+	for accept(digits) {
+	}
+	if accept(".") {
+		for accept(digits) {
+		}
+	}
+	if accept(exp) {
+		accept("+-")
+		for accept("0123456789") {
+		}
+	}
+	if err == nil {
+		rd.UnreadByte() // Not part of the number
+	} else if err != io.EOF {
+		return nil, false, err
+	}
+
+	if n, ok := types.StrToNumber(string(b)); ok {
+		return n, true, nil
+	}
+	return nil, false, nil
+}
+
+// file:seek ([whence [, offset]])
+func fSeek(s *types.State, args []types.Value) []types.Value {
+	p := toFile(s, args, "seek")
+	whence := checkOption(s, args, 2, "seek", "cur", "set", "cur", "end")
+	offset := 0.0
+	if len(args) > 2 && args[2] != nil {
+		offset = checkNumber(s, args, 3, "seek")
+	}
+	if float64(int64(offset)) != offset {
+		argError(s, 3, "seek", "not an integer in proper range")
+	}
+	if p.f == nil {
+		return fileError(syscall.ESPIPE, "")
+	}
+	if err := p.flush(); err != nil {
+		return fileError(err, "")
+	}
+	off := int64(offset)
+	if whence == io.SeekCurrent && p.rd != nil {
+		// The file is ahead of the reader by its buffered data
+		off -= int64(p.rd.Buffered())
+	}
+	pos, err := p.f.Seek(off, whence)
+	if err != nil {
+		return fileError(err, "")
+	}
+	if p.rd != nil {
+		p.rd.Reset(p.f)
+	}
+	return []types.Value{float64(pos)}
+}
+
+// file:setvbuf (mode [, size])
+func fSetvbuf(s *types.State, args []types.Value) []types.Value {
+	p := toFile(s, args, "setvbuf")
+	mode := checkOption(s, args, 2, "setvbuf", "", "no", "full", "line")
+	size := optInt(s, args, 3, "setvbuf", 4096)
+	if p.base == nil {
+		return []types.Value{true}
+	}
+	if err := p.flush(); err != nil {
+		return fileError(err, "")
+	}
+	switch mode {
+	case 0:
+		p.wr = p.base
+	case 1:
+		p.wr = bufio.NewWriterSize(p.base, size)
+	case 2:
+		p.wr = lineWriter{bufio.NewWriterSize(p.base, size)}
+	}
+	return []types.Value{true}
+}
+
+// __tostring metamethod.
+func fToString(s *types.State, args []types.Value) []types.Value {
+	p := testFile(s, args)
+	if p == nil {
+		typeError(s, args, 1, "tostring", fileHandle)
+	}
+	if p.closed {
+		return []types.Value{"file (closed)"}
+	}
+	return []types.Value{fmt.Sprintf("file (%p)", p)}
+}
+
+// file:write (...)
+func fWrite(s *types.State, args []types.Value) []types.Value {
+	toFile(s, args, "write")
+	return writeFile(s, args[0].(*types.Userdata), args[1:], 2, "write")
+}
+
+// Writes the values to the file handle u, the first of which is the
+// argument at position first. Returns the file handle. See g_write.
+func writeFile(s *types.State, u *types.Userdata, vals []types.Value, first int, fName string) []types.Value {
+	p := u.Value.(*file)
+	for i, v := range vals {
+		var str string
+		switch v := v.(type) {
+		case string:
+			str = v
+		case float64:
+			str = types.NumberToString(v)
+		default:
+			argError(s, first+i, fName, fmt.Sprintf("string expected, got %s", types.TypeOf(v)))
+		}
+		if err := p.write([]byte(str)); err != nil {
+			return fileError(err, "")
+		}
+	}
+	return []types.Value{u}
+}
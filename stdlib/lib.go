@@ -1,26 +1,35 @@
 package stdlib
 
 import (
-	"fmt"
-
 	"github.com/mna/lune/types"
 )
 
-func OpenLibs(t types.Table) {
-	var f types.GoFunc = ioWrite
+// Opens the standard libraries in the state s: registers them in its
+// globals table, sets the metatable of strings and the standard files of the
+// io library.
+func OpenLibs(s *types.State) {
+	t := s.Globals
 
-	libT := make(types.Table)
-	libT[types.Value("write")] = f
-	t[types.Value("io")] = types.Value(libT)
-}
+	openBase(t)
+	openString(s, t)
+	openTable(t)
+	openMath(t)
+	openIO(s, t)
+
+	coT := types.NewTable(0, 6)
+	coT.Set("create", types.NewGoClosure(coCreate))
+	coT.Set("resume", types.NewGoClosure(coResume))
+	coT.Set("yield", types.NewGoClosure(coYield))
+	coT.Set("status", types.NewGoClosure(coStatus))
+	coT.Set("running", types.NewGoClosure(coRunning))
+	coT.Set("wrap", types.NewGoClosure(coWrap))
+	t.Set("coroutine", coT)
 
-func ioWrite(in []types.Value) []types.Value {
-	ifs := make([]interface{}, len(in)+2)
-	ifs = append(ifs, ">>")
-	for _, v := range in {
-		ifs = append(ifs, v)
-	}
-	ifs = append(ifs, "<<")
-	fmt.Print(ifs...)
-	return nil
+	dbgT := types.NewTable(0, 5)
+	dbgT.Set("traceback", types.NewGoClosure(debugTraceback))
+	dbgT.Set("getmetatable", types.NewGoClosure(debugGetMetatable))
+	dbgT.Set("setmetatable", types.NewGoClosure(debugSetMetatable))
+	dbgT.Set("getuservalue", types.NewGoClosure(debugGetUservalue))
+	dbgT.Set("setuservalue", types.NewGoClosure(debugSetUservalue))
+	t.Set("debug", dbgT)
 }
@@ -0,0 +1,175 @@
+package stdlib
+
+import (
+	"math"
+	"math/rand/v2"
+
+	"github.com/mna/lune/types"
+	"github.com/mna/lune/vm"
+)
+
+// Registers the math library in the table t, the globals table. Each call
+// creates its own random generator, so that the states opened separately
+// don't share the sequence of math.random, and a seeded state is
+// deterministic whatever the others do.
+func openMath(t *types.Table) {
+	mathT := types.NewTable(0, 32)
+	mathT.Set("abs", mathFunc("abs", math.Abs))
+	mathT.Set("acos", mathFunc("acos", math.Acos))
+	mathT.Set("asin", mathFunc("asin", math.Asin))
+	mathT.Set("atan", mathFunc("atan", math.Atan))
+	mathT.Set("atan2", types.NewGoClosure(mathAtan2))
+	mathT.Set("ceil", mathFunc("ceil", math.Ceil))
+	mathT.Set("cos", mathFunc("cos", math.Cos))
+	mathT.Set("cosh", mathFunc("cosh", math.Cosh))
+	mathT.Set("deg", mathFunc("deg", func(x float64) float64 { return x * (180 / math.Pi) }))
+	mathT.Set("exp", mathFunc("exp", math.Exp))
+	mathT.Set("floor", mathFunc("floor", math.Floor))
+	mathT.Set("fmod", types.NewGoClosure(mathFmod))
+	mathT.Set("frexp", types.NewGoClosure(mathFrexp))
+	mathT.Set("huge", math.Inf(1))
+	mathT.Set("ldexp", types.NewGoClosure(mathLdexp))
+	mathT.Set("log", types.NewGoClosure(mathLog))
+	mathT.Set("log10", mathFunc("log10", math.Log10)) // Deprecated in Lua 5.2
+	mathT.Set("max", types.NewGoClosure(mathMax))
+	mathT.Set("min", types.NewGoClosure(mathMin))
+	mathT.Set("modf", types.NewGoClosure(mathModf))
+	mathT.Set("pi", math.Pi)
+	mathT.Set("pow", types.NewGoClosure(mathPow))
+	mathT.Set("rad", mathFunc("rad", func(x float64) float64 { return x * (math.Pi / 180) }))
+	mathT.Set("sin", mathFunc("sin", math.Sin))
+	mathT.Set("sinh", mathFunc("sinh", math.Sinh))
+	mathT.Set("sqrt", mathFunc("sqrt", math.Sqrt))
+	mathT.Set("tan", mathFunc("tan", math.Tan))
+	mathT.Set("tanh", mathFunc("tanh", math.Tanh))
+
+	r := newMathRand()
+	mathT.Set("random", types.NewGoClosure(r.random))
+	mathT.Set("randomseed", types.NewGoClosure(r.randomseed))
+	t.Set("math", mathT)
+}
+
+// Returns a library function named fName that applies f to its number
+// argument.
+func mathFunc(fName string, f func(float64) float64) *types.GoClosure {
+	return types.NewGoClosure(func(s *types.State, args []types.Value) []types.Value {
+		return []types.Value{f(checkNumber(s, args, 1, fName))}
+	})
+}
+
+// atan2 (y, x)
+func mathAtan2(s *types.State, args []types.Value) []types.Value {
+	y, x := checkNumber(s, args, 1, "atan2"), checkNumber(s, args, 2, "atan2")
+	return []types.Value{math.Atan2(y, x)}
+}
+
+// fmod (x, y)
+func mathFmod(s *types.State, args []types.Value) []types.Value {
+	x, y := checkNumber(s, args, 1, "fmod"), checkNumber(s, args, 2, "fmod")
+	return []types.Value{math.Mod(x, y)}
+}
+
+// frexp (x)
+func mathFrexp(s *types.State, args []types.Value) []types.Value {
+	m, e := math.Frexp(checkNumber(s, args, 1, "frexp"))
+	return []types.Value{m, float64(e)}
+}
+
+// ldexp (m, e)
+func mathLdexp(s *types.State, args []types.Value) []types.Value {
+	m, e := checkNumber(s, args, 1, "ldexp"), checkInt(s, args, 2, "ldexp")
+	return []types.Value{math.Ldexp(m, e)}
+}
+
+// log (x [, base])
+func mathLog(s *types.State, args []types.Value) []types.Value {
+	x := checkNumber(s, args, 1, "log")
+	if len(args) < 2 || args[1] == nil {
+		return []types.Value{math.Log(x)}
+	}
+	if base := checkNumber(s, args, 2, "log"); base != 10 {
+		return []types.Value{math.Log(x) / math.Log(base)}
+	}
+	return []types.Value{math.Log10(x)}
+}
+
+// max (x, ...)
+func mathMax(s *types.State, args []types.Value) []types.Value {
+	res := checkNumber(s, args, 1, "max")
+	for i := 2; i <= len(args); i++ {
+		if n := checkNumber(s, args, i, "max"); n > res {
+			res = n
+		}
+	}
+	return []types.Value{res}
+}
+
+// min (x, ...)
+func mathMin(s *types.State, args []types.Value) []types.Value {
+	res := checkNumber(s, args, 1, "min")
+	for i := 2; i <= len(args); i++ {
+		if n := checkNumber(s, args, i, "min"); n < res {
+			res = n
+		}
+	}
+	return []types.Value{res}
+}
+
+// modf (x)
+func mathModf(s *types.State, args []types.Value) []types.Value {
+	x := checkNumber(s, args, 1, "modf")
+	if math.IsInf(x, 0) {
+		// Go's Modf returns NaN as fractional part, C's modf returns 0
+		return []types.Value{x, 0.0}
+	}
+	ip, frac := math.Modf(x)
+	return []types.Value{ip, frac}
+}
+
+// pow (x, y)
+func mathPow(s *types.State, args []types.Value) []types.Value {
+	x, y := checkNumber(s, args, 1, "pow"), checkNumber(s, args, 2, "pow")
+	return []types.Value{math.Pow(x, y)}
+}
+
+// The random generator of a state.
+type mathRand struct {
+	src *rand.PCG
+	rnd *rand.Rand
+}
+
+// Returns a generator with a fixed seed, like C's rand before any call to
+// srand.
+func newMathRand() *mathRand {
+	src := rand.NewPCG(1, 0)
+	return &mathRand{src: src, rnd: rand.New(src)}
+}
+
+// random ([m [, n]])
+func (r *mathRand) random(s *types.State, args []types.Value) []types.Value {
+	f := r.rnd.Float64() // Between 0 (inclusive) and 1 (exclusive)
+	switch len(args) {
+	case 0:
+		return []types.Value{f}
+	case 1:
+		u := checkNumber(s, args, 1, "random")
+		if u < 1 {
+			argError(s, 1, "random", "interval is empty")
+		}
+		return []types.Value{math.Floor(f*u) + 1} // Between 1 and u
+	case 2:
+		l, u := checkNumber(s, args, 1, "random"), checkNumber(s, args, 2, "random")
+		if l > u {
+			argError(s, 2, "random", "interval is empty")
+		}
+		return []types.Value{math.Floor(f*(u-l+1)) + l} // Between l and u
+	}
+	vm.Errorf(s, "wrong number of arguments")
+	return nil
+}
+
+// randomseed (x)
+func (r *mathRand) randomseed(s *types.State, args []types.Value) []types.Value {
+	r.src.Seed(uint64(int64(checkNumber(s, args, 1, "randomseed"))), 0)
+	return nil
+}
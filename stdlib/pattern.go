@@ -0,0 +1,401 @@
+package stdlib
+
+import (
+	"strings"
+
+	"github.com/mna/lune/types"
+	"github.com/mna/lune/vm"
+)
+
+/*
+  Pattern matching, a port of the matching machinery of lstrlib.c from Lua.
+  Positions in the subject and in the pattern are byte offsets, and -1 stands
+  for the NULL pointer returned by a failed match.
+*/
+
+const (
+	maxCaptures   = 32  // See LUA_MAXCAPTURES
+	maxMatchCalls = 200 // See MAXCCALLS
+
+	capUnfinished = -1
+	capPosition   = -2
+
+	patEsc   = '%'
+	specials = "^$*+?.([%-"
+)
+
+type matchState struct {
+	s          *types.State
+	src, pat   string
+	level      int // Total number of captures (finished or unfinished)
+	matchDepth int // Control for recursive depth, to avoid overflowing the Go stack
+	capture    [maxCaptures]struct {
+		init, len int
+	}
+}
+
+func newMatchState(s *types.State, src, pat string) *matchState {
+	return &matchState{s: s, src: src, pat: pat}
+}
+
+// Resets the state before a new match attempt.
+func (ms *matchState) reprep() {
+	ms.level = 0
+	ms.matchDepth = maxMatchCalls
+}
+
+func (ms *matchState) checkCapture(l byte) int {
+	i := int(l) - '1'
+	if i < 0 || i >= ms.level || ms.capture[i].len == capUnfinished {
+		vm.Errorf(ms.s, "invalid capture index %%%d", i+1)
+	}
+	return i
+}
+
+func (ms *matchState) captureToClose() int {
+	for l := ms.level - 1; l >= 0; l-- {
+		if ms.capture[l].len == capUnfinished {
+			return l
+		}
+	}
+	vm.Errorf(ms.s, "invalid pattern capture")
+	return 0
+}
+
+// Returns the position in the pattern right after the single char class at p.
+func (ms *matchState) classEnd(p int) int {
+	c := ms.pat[p]
+	p++
+	switch c {
+	case patEsc:
+		if p >= len(ms.pat) {
+			vm.Errorf(ms.s, "malformed pattern (ends with '%%')")
+		}
+		return p + 1
+	case '[':
+		if p < len(ms.pat) && ms.pat[p] == '^' {
+			p++
+		}
+		// Look for a ']', the first char is part of the set even if it is one
+		for {
+			if p >= len(ms.pat) {
+				vm.Errorf(ms.s, "malformed pattern (missing ']')")
+			}
+			c := ms.pat[p]
+			p++
+			if c == patEsc && p < len(ms.pat) {
+				// Skip escapes (e.g. '%]')
+				p++
+			}
+			if p < len(ms.pat) && ms.pat[p] == ']' {
+				return p + 1
+			}
+		}
+	}
+	return p
+}
+
+// Reports whether c belongs to the class cl, e.g. 'a' for letters. The
+// classes are those of the C locale.
+func matchClass(c, cl byte) bool {
+	var res bool
+	switch cl | 0x20 {
+	case 'a':
+		res = isAlpha(c)
+	case 'c':
+		res = c < ' ' || c == 0x7f
+	case 'd':
+		res = isDigit(c)
+	case 'g':
+		res = c > ' ' && c < 0x7f
+	case 'l':
+		res = c >= 'a' && c <= 'z'
+	case 'p':
+		res = c > ' ' && c < 0x7f && !isAlnum(c)
+	case 's':
+		res = c == ' ' || c >= '\t' && c <= '\r'
+	case 'u':
+		res = c >= 'A' && c <= 'Z'
+	case 'w':
+		res = isAlnum(c)
+	case 'x':
+		res = isDigit(c) || c|0x20 >= 'a' && c|0x20 <= 'f'
+	case 'z': // Deprecated option
+		res = c == 0
+	default:
+		return cl == c
+	}
+	if cl >= 'A' && cl <= 'Z' {
+		return !res
+	}
+	return res
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+func isAlpha(c byte) bool { return c|0x20 >= 'a' && c|0x20 <= 'z' }
+func isAlnum(c byte) bool { return isAlpha(c) || isDigit(c) }
+
+// Reports whether c belongs to the set that starts at p (the '[') and ends at
+// ec (the ']').
+func (ms *matchState) matchBracketClass(c byte, p, ec int) bool {
+	sig := true
+	if ms.pat[p+1] == '^' {
+		sig = false
+		p++ // Skip the '^'
+	}
+	for p++; p < ec; p++ {
+		switch {
+		case ms.pat[p] == patEsc:
+			p++
+			if matchClass(c, ms.pat[p]) {
+				return sig
+			}
+		case ms.pat[p+1] == '-' && p+2 < ec:
+			p += 2
+			if ms.pat[p-2] <= c && c <= ms.pat[p] {
+				return sig
+			}
+		case ms.pat[p] == c:
+			return sig
+		}
+	}
+	return !sig
+}
+
+// Reports whether the char at position s of the subject matches the single
+// char class from p to ep.
+func (ms *matchState) singleMatch(s, p, ep int) bool {
+	if s >= len(ms.src) {
+		return false
+	}
+	c := ms.src[s]
+	switch ms.pat[p] {
+	case '.':
+		return true // Matches any char
+	case patEsc:
+		return matchClass(c, ms.pat[p+1])
+	case '[':
+		return ms.matchBracketClass(c, p, ep-1)
+	}
+	return ms.pat[p] == c
+}
+
+func (ms *matchState) matchBalance(s, p int) int {
+	if p+1 >= len(ms.pat) {
+		vm.Errorf(ms.s, "malformed pattern (missing arguments to '%%b')")
+	}
+	if s >= len(ms.src) || ms.src[s] != ms.pat[p] {
+		return -1
+	}
+	b, e := ms.pat[p], ms.pat[p+1]
+	cont := 1
+	for s++; s < len(ms.src); s++ {
+		if ms.src[s] == e {
+			if cont--; cont == 0 {
+				return s + 1
+			}
+		} else if ms.src[s] == b {
+			cont++
+		}
+	}
+	return -1
+}
+
+func (ms *matchState) maxExpand(s, p, ep int) int {
+	i := 0 // Counts maximum expand for item
+	for ms.singleMatch(s+i, p, ep) {
+		i++
+	}
+	// Keeps trying to match with the maximum repetitions
+	for ; i >= 0; i-- {
+		if res := ms.doMatch(s+i, ep+1); res != -1 {
+			return res
+		}
+	}
+	return -1
+}
+
+func (ms *matchState) minExpand(s, p, ep int) int {
+	for {
+		if res := ms.doMatch(s, ep+1); res != -1 {
+			return res
+		}
+		if !ms.singleMatch(s, p, ep) {
+			return -1
+		}
+		s++ // Try with one more repetition
+	}
+}
+
+func (ms *matchState) startCapture(s, p, what int) int {
+	if ms.level >= maxCaptures {
+		vm.Errorf(ms.s, "too many captures")
+	}
+	ms.capture[ms.level].init = s
+	ms.capture[ms.level].len = what
+	ms.level++
+	res := ms.doMatch(s, p)
+	if res == -1 {
+		ms.level-- // Undo capture
+	}
+	return res
+}
+
+func (ms *matchState) endCapture(s, p int) int {
+	l := ms.captureToClose()
+	ms.capture[l].len = s - ms.capture[l].init // Close capture
+	res := ms.doMatch(s, p)
+	if res == -1 {
+		ms.capture[l].len = capUnfinished // Undo capture
+	}
+	return res
+}
+
+func (ms *matchState) matchCapture(s int, l byte) int {
+	i := ms.checkCapture(l)
+	init, n := ms.capture[i].init, ms.capture[i].len
+	if len(ms.src)-s >= n && ms.src[init:init+n] == ms.src[s:s+n] {
+		return s + n
+	}
+	return -1
+}
+
+// Matches the pattern from position p against the subject from position s,
+// and returns the end of the match, or -1 if it doesn't match. See do_match.
+func (ms *matchState) doMatch(s, p int) int {
+	if ms.matchDepth--; ms.matchDepth == 0 {
+		vm.Errorf(ms.s, "pattern too complex")
+	}
+	defer func() { ms.matchDepth++ }()
+
+	for p < len(ms.pat) {
+		switch ms.pat[p] {
+		case '(': // Start capture
+			if p+1 < len(ms.pat) && ms.pat[p+1] == ')' {
+				return ms.startCapture(s, p+2, capPosition)
+			}
+			return ms.startCapture(s, p+1, capUnfinished)
+
+		case ')': // End capture
+			return ms.endCapture(s, p+1)
+
+		case '$':
+			if p+1 == len(ms.pat) { // Is the '$' the last char in the pattern?
+				if s == len(ms.src) {
+					return s
+				}
+				return -1
+			}
+			// Else a literal '$', handled by the default case below
+
+		case patEsc:
+			if p+1 >= len(ms.pat) {
+				break // Malformed, raised by classEnd
+			}
+			switch c := ms.pat[p+1]; {
+			case c == 'b': // Balanced string
+				if s = ms.matchBalance(s, p+2); s == -1 {
+					return -1
+				}
+				p += 4
+				continue
+
+			case c == 'f': // Frontier
+				p += 2
+				if p >= len(ms.pat) || ms.pat[p] != '[' {
+					vm.Errorf(ms.s, "missing '[' after '%%f' in pattern")
+				}
+				ep := ms.classEnd(p)
+				var prev, cur byte
+				if s > 0 {
+					prev = ms.src[s-1]
+				}
+				if s < len(ms.src) {
+					cur = ms.src[s]
+				}
+				if ms.matchBracketClass(prev, p, ep-1) || !ms.matchBracketClass(cur, p, ep-1) {
+					return -1
+				}
+				p = ep
+				continue
+
+			case isDigit(c): // Capture results (%0-%9)
+				if s = ms.matchCapture(s, c); s == -1 {
+					return -1
+				}
+				p += 2
+				continue
+			}
+		}
+
+		// Default: a single char class, optionally followed by a repetition
+		ep := ms.classEnd(p)
+		m := ms.singleMatch(s, p, ep)
+		if ep < len(ms.pat) {
+			switch ms.pat[ep] {
+			case '?': // Optional
+				if m {
+					if res := ms.doMatch(s+1, ep+1); res != -1 {
+						return res
+					}
+				}
+				p = ep + 1
+				continue
+			case '+': // 1 or more repetitions
+				if !m {
+					return -1
+				}
+				return ms.maxExpand(s+1, p, ep)
+			case '*': // 0 or more repetitions
+				return ms.maxExpand(s, p, ep)
+			case '-': // 0 or more repetitions (minimum)
+				return ms.minExpand(s, p, ep)
+			}
+		}
+		if !m {
+			return -1
+		}
+		s++
+		p = ep
+	}
+	return s // End of pattern
+}
+
+// Returns the capture i of the match from s to e. The whole match is the
+// only capture of a pattern without any.
+func (ms *matchState) getCapture(i, s, e int) types.Value {
+	if i >= ms.level {
+		if i != 0 {
+			vm.Errorf(ms.s, "invalid capture index")
+		}
+		return ms.src[s:e]
+	}
+	init, n := ms.capture[i].init, ms.capture[i].len
+	switch n {
+	case capUnfinished:
+		vm.Errorf(ms.s, "unfinished capture")
+	case capPosition:
+		return float64(init + 1)
+	}
+	return ms.src[init : init+n]
+}
+
+// Returns the captures of the match from s to e, or the whole match if the
+// pattern has no capture and s is not -1.
+func (ms *matchState) captures(s, e int) []types.Value {
+	n := ms.level
+	if n == 0 && s != -1 {
+		n = 1
+	}
+	res := make([]types.Value, n)
+	for i := range res {
+		res[i] = ms.getCapture(i, s, e)
+	}
+	return res
+}
+
+// Reports whether the pattern p has no special characters, so that it can be
+// searched as plain text.
+func noSpecials(p string) bool {
+	return !strings.ContainsAny(p, specials)
+}
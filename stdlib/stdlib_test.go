@@ -0,0 +1,994 @@
+package stdlib
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mna/lune/compiler"
+	"github.com/mna/lune/types"
+	"github.com/mna/lune/vm"
+)
+
+// Compiles and runs src with the standard libraries, and returns its state.
+func runSource(t *testing.T, name, src string) (*types.State, error) {
+	p, err := compiler.Compile(strings.NewReader(src), "="+name)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	s := types.NewState(p)
+	OpenLibs(s)
+	return s, vm.Execute(s)
+}
+
+// Expected values of global variables after running a source.
+type globals map[string]types.Value
+
+func assertGlobals(t *testing.T, name string, s *types.State, exp globals) {
+	for k, v := range exp {
+		if got := s.Globals.Get(k); got != v {
+			t.Errorf("%s: expected %s to be %v, got %v", name, k, v, got)
+		}
+	}
+}
+
+func TestPCall(t *testing.T) {
+	cases := []struct {
+		name string
+		src  string
+		exp  globals
+	}{
+		{"ok", `a, b, c = pcall(function(x, y) return x + y, x * y end, 2, 3)`,
+			globals{"a": true, "b": 5.0, "c": 6.0}},
+		{"runtime", `a, b = pcall(function(x) return x.y end)`,
+			globals{"a": false, "b": "runtime:1: attempt to index a nil value"}},
+		{"error", `
+a, b = pcall(error, "msg")
+c, d = pcall(function() error("msg") end)
+e, f = pcall(function() error("msg", 0) end)
+local function g() error("msg", 2) end
+h, i = pcall(function()
+  g()
+end)`,
+			globals{"a": false, "b": "msg", "c": false, "d": "error:3: msg",
+				"e": false, "f": "msg", "h": false, "i": "error:7: msg"}},
+		{"values", `
+local t = {}
+a, b = pcall(error, t)
+a = b == t
+c, d = pcall(error, 12)
+e, f = pcall(error)`,
+			globals{"a": true, "c": false, "d": 12.0, "e": false, "f": nil}},
+		{"nested", `
+a, b, c = pcall(pcall, error, "x")
+d, e = pcall(pcall)`,
+			globals{"a": true, "b": false, "c": "x", "d": false,
+				"e": "bad argument #1 to 'pcall' (value expected)"}},
+		{"overflow", `
+local function f() return 1 + f() end
+a, b = pcall(f)`,
+			globals{"a": false, "b": "overflow:2: stack overflow"}},
+		{"for", `
+local n = 0
+for i = 1, "2" do n = n + i end
+for i = "3", 4, "1" do n = n + i end
+a = n
+b, c = pcall(function() for i = 1, {} do end end)`,
+			globals{"a": 10.0, "b": false, "c": "for:6: 'for' limit must be a number"}},
+	}
+
+	for _, c := range cases {
+		s, err := runSource(t, c.name, c.src)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		assertGlobals(t, c.name, s, c.exp)
+	}
+}
+
+// Panics in Go functions are caught as errors, with the position of the
+// caller.
+func TestPCallGoPanic(t *testing.T) {
+	p, err := compiler.Compile(strings.NewReader(`
+a, b = pcall(crash, 1)
+c, d = xpcall(function() crash(2) end, function(m) return "handled: " .. m end)`), "=panic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := types.NewState(p)
+	OpenLibs(s)
+	s.Globals.Set("crash", types.NewGoClosure(func(s *types.State, args []types.Value) []types.Value {
+		var m map[types.Value]bool
+		m[args[0]] = true // Assignment to a nil map
+		return nil
+	}))
+	if err := vm.Execute(s); err != nil {
+		t.Fatal(err)
+	}
+	assertGlobals(t, "panic", s, globals{
+		"a": false, "b": "assignment to entry in nil map",
+		"c": false, "d": "handled: panic:3: assignment to entry in nil map",
+	})
+}
+
+func TestXPCall(t *testing.T) {
+	cases := []struct {
+		name string
+		src  string
+		exp  globals
+	}{
+		{"ok", `a, b = xpcall(function(x, y) return x + y end, error, 2, 3)`,
+			globals{"a": true, "b": 5.0}},
+		{"handler", `
+local function h(m) return "handled: " .. m end
+a, b = xpcall(function() error("msg") end, h)`,
+			globals{"a": false, "b": "handled: handler:3: msg"}},
+		// The handler runs before the stack unwinds, error levels see the failing function
+		{"stack", `
+local function h(m)
+  local ok, e = pcall(error, "failed here", 3)
+  return e
+end
+local function f() local x = nil + 1 end
+a, b = xpcall(f, h)
+c, d = xpcall(function() error("msg") end, function(m) error("again") end)`,
+			globals{"a": false, "b": "stack:6: failed here", "c": false, "d": "error in error handling"}},
+		{"noargs", `a, b = pcall(xpcall, print)`,
+			globals{"a": false, "b": "bad argument #2 to 'xpcall' (value expected)"}},
+	}
+
+	for _, c := range cases {
+		s, err := runSource(t, c.name, c.src)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		assertGlobals(t, c.name, s, c.exp)
+	}
+}
+
+// Errors that are not caught stop the execution.
+func TestUncaughtError(t *testing.T) {
+	s, err := runSource(t, "uncaught", "a = 1\nerror('stop')\na = 2")
+	if err == nil || err.Error() != "uncaught:2: stop" {
+		t.Errorf("expected error %q, got %v", "uncaught:2: stop", err)
+	}
+	assertGlobals(t, "uncaught", s, globals{"a": 1.0})
+
+	_, err = runSource(t, "table", "error({})")
+	if err == nil || err.Error() != "(error object is a table value)" {
+		t.Errorf("expected error %q, got %v", "(error object is a table value)", err)
+	}
+}
+
+func TestDebugTraceback(t *testing.T) {
+	cases := []struct {
+		name string
+		src  string
+		exp  globals
+	}{
+		{"traceback", `
+local function f()
+  return debug.traceback("msg")
+end
+a = f()
+b = debug.traceback()
+c = debug.traceback(nil, 0)
+d = debug.traceback(12, 2)`,
+			globals{
+				"a": "msg\nstack traceback:\n\ttraceback:3: in function 'f'\n\ttraceback:5: in main chunk",
+				"b": "stack traceback:\n\ttraceback:6: in main chunk",
+				"c": "stack traceback:\n\t[Go]: in function 'traceback'\n\ttraceback:7: in main chunk",
+				"d": "12\nstack traceback:",
+			}},
+		{"values", `
+local t = {}
+a = debug.traceback(t) == t
+b, c = pcall(debug.traceback, "x", {})`,
+			globals{"a": true, "b": false, "c": "bad argument #2 to 'traceback' (number expected, got table)"}},
+		{"handler", `
+local function f() error("oops") end
+a, b = xpcall(f, debug.traceback)`,
+			globals{"a": false,
+				"b": "handler:2: oops\nstack traceback:\n\t[Go]: in function 'error'\n\thandler:2: in function <handler:2>\n\t[Go]: in function 'xpcall'\n\thandler:3: in main chunk"}},
+	}
+
+	for _, c := range cases {
+		s, err := runSource(t, c.name, c.src)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		assertGlobals(t, c.name, s, c.exp)
+	}
+}
+
+// Long tracebacks keep only the first and last levels.
+func TestLongTraceback(t *testing.T) {
+	s, err := runSource(t, "long", `
+local function rec(n)
+  if n == 0 then return debug.traceback("msg") end
+  local r = rec(n - 1)
+  return r
+end
+a = rec(30)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb := s.Globals.Get("a").(string)
+	lines := strings.Split(tb, "\n")
+	// Message, header, 10 first levels, "...", 10 last levels
+	if len(lines) != 23 {
+		t.Fatalf("expected 23 lines, got %d:\n%s", len(lines), tb)
+	}
+	if lines[12] != "\t..." {
+		t.Errorf("expected line 12 to be the ellipsis, got %q", lines[12])
+	}
+	if exp := "\tlong:7: in main chunk"; lines[22] != exp {
+		t.Errorf("expected last line to be %q, got %q", exp, lines[22])
+	}
+}
+
+func TestCoroutine(t *testing.T) {
+	cases := []struct {
+		name string
+		src  string
+		exp  globals
+	}{
+		{"resume", `
+local co = coroutine.create(function(a, b)
+  local c = coroutine.yield(a + b)
+  local d, e = coroutine.yield(c * 2)
+  return d .. e
+end)
+s1 = coroutine.status(co)
+a, b = coroutine.resume(co, 1, 2)
+s2 = coroutine.status(co)
+c, d = coroutine.resume(co, 10)
+e, f = coroutine.resume(co, "x", "y")
+s3 = coroutine.status(co)
+g, h = coroutine.resume(co)`,
+			globals{"s1": "suspended", "a": true, "b": 3.0, "s2": "suspended", "c": true, "d": 20.0,
+				"e": true, "f": "xy", "s3": "dead", "g": false, "h": "cannot resume dead coroutine"}},
+		{"pcall", `
+local co = coroutine.create(function()
+  local ok, v = pcall(function()
+    local x = coroutine.yield(1)
+    error(x, 0)
+  end)
+  coroutine.yield(v)
+  error("stop")
+end)
+a, b = coroutine.resume(co)
+c, d = coroutine.resume(co, "from pcall")
+e, f = coroutine.resume(co)
+s = coroutine.status(co)`,
+			globals{"a": true, "b": 1.0, "c": true, "d": "from pcall", "e": false, "f": "pcall:8: stop", "s": "dead"}},
+		{"status", `
+local main, ismain = coroutine.running()
+a = ismain
+local co
+co = coroutine.create(function()
+  local t, m = coroutine.running()
+  b = t == co and not m
+  c = coroutine.status(co)
+  local inner = coroutine.create(function() d = coroutine.status(co) end)
+  coroutine.resume(inner)
+  e, f = coroutine.resume(co)
+  g, h = coroutine.resume(main)
+end)
+coroutine.resume(co)`,
+			globals{"a": true, "b": true, "c": "running", "d": "normal",
+				"e": false, "f": "cannot resume non-suspended coroutine",
+				"g": false, "h": "cannot resume non-suspended coroutine"}},
+		{"wrap", `
+local gen = coroutine.wrap(function(n)
+  for i = 1, n do coroutine.yield(i) end
+  return "end"
+end)
+a, b, c, d = gen(3), gen(), gen(), gen()
+e, f = pcall(gen)
+local w = coroutine.wrap(function() error("oops") end)
+g, h = pcall(function()
+  w()
+end)
+i, j = pcall(coroutine.wrap(function() error({}) end))
+k = coroutine.wrap(print) == coroutine.wrap(type) or rawequal(gen, w)
+local t = {[gen] = 1, [w] = 2}
+l, m = t[gen], t[w]`,
+			globals{"a": 1.0, "b": 2.0, "c": 3.0, "d": "end", "e": false, "f": "cannot resume dead coroutine",
+				"g": false, "h": "wrap:10: wrap:8: oops", "i": false, "k": false, "l": 1.0, "m": 2.0}},
+		{"collect", `
+local function new()
+  local co
+  co = coroutine.create(function()
+    while true do coroutine.yield(co) end
+  end)
+  coroutine.resume(co)
+  return co
+end
+local kept = new()
+local t = {new()}
+new()
+collectgarbage()
+a, b = coroutine.resume(kept)
+c, d = coroutine.resume(t[1])
+a, c = a and b == kept, c and d == t[1]`,
+			globals{"a": true, "c": true}},
+		{"errors", `
+a, b = pcall(coroutine.yield, 1)
+c, d = pcall(coroutine.create, 1)
+e, f = pcall(coroutine.resume, {})
+local function rec() return coroutine.wrap(rec)() end
+g, h = pcall(rec)`,
+			globals{"a": false, "b": "attempt to yield from outside a coroutine",
+				"c": false, "d": "bad argument #1 to 'create' (function expected, got number)",
+				"e": false, "f": "bad argument #1 to 'resume' (coroutine expected)", "g": false}},
+		{"traceback", `
+local co = coroutine.create(function()
+  local function f() coroutine.yield() end
+  f()
+end)
+coroutine.resume(co)
+a = debug.traceback(co)
+b = debug.traceback(co, "msg", 1)`,
+			globals{"a": "stack traceback:\n\t[Go]: in function 'yield'\n\ttraceback:3: in function 'f'\n\ttraceback:4: in function <traceback:2>",
+				"b": "msg\nstack traceback:\n\ttraceback:3: in function 'f'\n\ttraceback:4: in function <traceback:2>"}},
+	}
+
+	for _, c := range cases {
+		s, err := runSource(t, c.name, c.src)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		assertGlobals(t, c.name, s, c.exp)
+	}
+}
+
+func TestUserValue(t *testing.T) {
+	p, err := compiler.Compile(strings.NewReader(`
+a = debug.getuservalue(u)
+local uv = {}
+b = debug.setuservalue(u, uv) == u
+c = debug.getuservalue(u) == uv
+debug.setuservalue(u, nil)
+d = debug.getuservalue(u)
+e, f = pcall(debug.setuservalue, u, 1)
+g, h = pcall(debug.setuservalue, l, {})
+i = debug.getuservalue(l)
+local mt = {__index = function(t, k) return k .. "!" end}
+j = debug.setmetatable(u, mt) == u
+k = debug.getmetatable(u) == mt
+m = u.name`), "=uservalue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := types.NewState(p)
+	OpenLibs(s)
+	s.Globals.Set("u", types.NewUserdata(nil))
+	s.Globals.Set("l", types.LightUserdata{Value: s})
+	if err := vm.Execute(s); err != nil {
+		t.Fatal(err)
+	}
+	assertGlobals(t, "uservalue", s, globals{
+		"a": nil, "b": true, "c": true, "d": nil,
+		"e": false, "f": "bad argument #2 to 'setuservalue' (table expected, got number)",
+		"g": false, "h": "bad argument #1 to 'setuservalue' (full userdata expected, got light userdata)",
+		"i": nil, "j": true, "k": true, "m": "name!",
+	})
+}
+
+func TestBase(t *testing.T) {
+	cases := []struct {
+		name string
+		src  string
+		exp  globals
+	}{
+		{"type", `a, b, c, d, e = type(nil), type(1), type("x"), type({}), type(print)
+f, g = pcall(type)`,
+			globals{"a": "nil", "b": "number", "c": "string", "d": "table", "e": "function",
+				"f": false, "g": "bad argument #1 to 'type' (value expected)"}},
+		// Strings and numbers are converted like tonumber and tostring do
+		{"coercion", `
+a, b = "010" + 0, " 0x10 " * 1
+c, d = pcall(function() return "1_000" + 0 end)
+e, f = 1 / 3 .. "", 2^53 .. ""
+g = e == tostring(1 / 3)`,
+			globals{"a": 10.0, "b": 16.0, "c": false, "d": "coercion:3: attempt to perform arithmetic on a string value",
+				"e": "0.33333333333333", "f": "9.007199254741e+15", "g": true}},
+		{"tostring", `
+a, b, c, d = tostring(nil), tostring(true), tostring(12), tostring("s")
+local t = setmetatable({}, {__tostring = function() return "T" end})
+e = tostring(t)
+f = tostring({}) ~= tostring({})
+g = tostring(setmetatable({}, {__tostring = function() return 1 end}))
+h, i = pcall(tostring, setmetatable({}, {__tostring = function() return {} end}))`,
+			globals{"a": "nil", "b": "true", "c": "12", "d": "s", "e": "T", "f": true, "g": "1",
+				"h": false, "i": "'__tostring' must return a string"}},
+		{"tonumber", `
+a, b, c, d = tonumber("0x10"), tonumber(" 12 "), tonumber("z"), tonumber({})
+e, f, g = tonumber("ff", 16), tonumber(" -zz ", 36), tonumber("8", 8)
+h, i = pcall(tonumber, "1", 99)`,
+			globals{"a": 16.0, "b": 12.0, "c": nil, "d": nil, "e": 255.0, "f": -1295.0, "g": nil,
+				"h": false, "i": "bad argument #2 to 'tonumber' (base out of range)"}},
+		{"select", `
+a, b = select("#"), select("#", nil, nil)
+c, d = select(2, "x", "y", "z")
+e = select(-1, "x", "y", "z")
+f, g = pcall(select, -4, "x", "y", "z")`,
+			globals{"a": 0.0, "b": 2.0, "c": "y", "d": "z", "e": "z",
+				"f": false, "g": "bad argument #1 to 'select' (index out of range)"}},
+		{"pairs", `
+local t = {1, 2, 3, x = 4, y = 5}
+a, b = 0, 0
+for k, v in pairs(t) do a = a + v ; b = b + 1 end
+c = 0
+for i, v in ipairs({1, 2, nil, 4}) do c = c + i end
+-- Fields can be cleared during a traversal
+for k in pairs(t) do t[k] = nil end
+d = next(t)
+local p = setmetatable({}, {__pairs = function(t) return function(_, k) if not k then return 1, "one" end end, t, nil end})
+for k, v in pairs(p) do e = v end
+f, g = pcall(next, {}, "nokey")`,
+			globals{"a": 15.0, "b": 5.0, "c": 3.0, "d": nil, "e": "one",
+				"f": false, "g": "invalid key to 'next'"}},
+		{"raw", `
+local t = setmetatable({}, {__index = function() return "meta" end, __newindex = function() end, __len = function() return 9 end})
+rawset(t, "x", 1)
+t.y = 2
+a, b, c, d = rawget(t, "x"), rawget(t, "y"), t.y, rawlen({1, 2})
+e, f = rawlen("abc"), #t
+g, h = rawequal(t, t), rawequal("a", "b")
+i, j = pcall(rawlen, 1)
+k = rawequal(print, print) and not rawequal(print, type) and not rawequal(math.sin, math.cos)
+l = pairs({}) == next and ipairs({}) == ipairs({x = 1})`,
+			globals{"a": 1.0, "b": nil, "c": "meta", "d": 2.0, "e": 3.0, "f": 9.0, "g": true, "h": false,
+				"i": false, "j": "bad argument #1 to 'rawlen' (table or string expected)", "k": true, "l": true}},
+		{"metatable", `
+local mt = {}
+local t = setmetatable({}, mt)
+a = getmetatable(t) == mt
+mt.__metatable = "locked"
+b = getmetatable(t)
+c, d = pcall(setmetatable, t, {})
+e, f = pcall(setmetatable, 1, {})
+g = getmetatable("s").__index == string`,
+			globals{"a": true, "b": "locked", "c": false, "d": "cannot change a protected metatable",
+				"e": false, "f": "bad argument #1 to 'setmetatable' (table expected, got number)", "g": true}},
+		{"assert", `
+a, b = assert(1, "x")
+c, d = pcall(assert, false)
+e, f = pcall(assert, nil, "failed")`,
+			globals{"a": 1.0, "b": "x", "c": false, "d": "assertion failed!", "e": false, "f": "failed"}},
+		{"unpack", `
+a, b, c = unpack({1, 2, 3})
+d, e = unpack({1, 2, 3}, 2, 3)
+f = select("#", unpack({}, 1, 0))`,
+			globals{"a": 1.0, "b": 2.0, "c": 3.0, "d": 2.0, "e": 3.0, "f": 0.0}},
+		{"load", `
+a = load("return 1 + ...")(2)
+local parts, i = {"return ", "'x'"}, 0
+b = load(function() i = i + 1 ; return parts[i] end)()
+local env = {y = 3}
+c = load("return y", "chunk", "t", env)()
+d, e = load("?")
+f, g = load("return 1", "chunk", "b")`,
+			globals{"a": 3.0, "b": "x", "c": 3.0, "d": nil, "e": "[string \"?\"]:1: unexpected symbol near '?'",
+				"f": nil, "g": "attempt to load a text chunk (mode is 'b')"}},
+		{"globals", `
+a = _G == _G._G
+b = _VERSION
+c = collectgarbage("count") > 0
+d, e = pcall(collectgarbage, "nope")`,
+			globals{"a": true, "b": "Lua 5.2", "c": true,
+				"d": false, "e": "bad argument #1 to 'collectgarbage' (invalid option 'nope')"}},
+	}
+
+	for _, c := range cases {
+		s, err := runSource(t, c.name, c.src)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		assertGlobals(t, c.name, s, c.exp)
+	}
+}
+
+func TestString(t *testing.T) {
+	cases := []struct {
+		name string
+		src  string
+		exp  globals
+	}{
+		{"basic", `
+a, b, c = string.len("abc"), ("abc"):upper(), string.lower("AbC")
+d, e = string.rep("ab", 3), string.rep("x", 3, ", ")
+f, g = ("hello"):sub(2, -2), ("hello"):sub(-3)
+h, i = ("hello"):reverse(), ("x"):rep(0)
+j, k, l = string.byte("ABC", 1, -1)
+m = string.char(72, 105)
+n, o = pcall(string.char, 256)
+p = #("abc"):sub(5)`,
+			globals{"a": 3.0, "b": "ABC", "c": "abc", "d": "ababab", "e": "x, x, x",
+				"f": "ell", "g": "llo", "h": "olleh", "i": "", "j": 65.0, "k": 66.0, "l": 67.0,
+				"m": "Hi", "n": false, "o": "bad argument #1 to 'char' (value out of range)", "p": 0.0}},
+		{"find", `
+a, b = string.find("hello world", "wor")
+c, d = string.find("hello", "l+")
+e, f, g = string.find("key=val", "(%w+)=")
+h = string.find("a.b", ".", 1, true)
+i = string.find("abc", "b", -1)
+j, k = string.find("abc", "", 10), string.find("abc", "", 4)
+l, m = ("[x]"):find("[", 1, true)`,
+			globals{"a": 7.0, "b": 9.0, "c": 3.0, "d": 4.0, "e": 1.0, "f": 4.0, "g": "key",
+				"h": 2.0, "i": nil, "j": nil, "k": 4.0, "l": 1.0, "m": 1.0}},
+		{"match", `
+a = string.match("  trim  ", "^%s*(.-)%s*$")
+b, c = string.match("2024-01-15", "(%d+)-(%d+)")
+d = string.match("hello", "()ll()")
+e = string.match("f(a(b)c)d", "%b()")
+f = string.match("THE (quick) fox", "%f[%a]%a+", 5)
+g = string.match("abc", "^b")
+h = string.match("x = 'it''s'", "(['\"])(.-)%1")
+i = string.match("[[a]]", "[]]")
+j = string.match("a-b_c", "[%a_-]+$")
+k = string.match("aaab", "a-b")
+l = string.match("hello", "l?lo")
+m = string.match("$100", "%$(%d+)")
+n = string.match("end$", "d$")`,
+			globals{"a": "trim", "b": "2024", "c": "01", "d": 3.0, "e": "(a(b)c)", "f": "quick",
+				"g": nil, "h": "'", "i": "]", "j": "a-b_c", "k": "aaab", "l": "llo", "m": "100", "n": nil}},
+		{"gmatch", `
+local t = {}
+for k, v in string.gmatch("a=1, b=2", "(%w+)=(%w+)") do t[#t+1] = k .. v end
+a, b = t[1], t[2]
+c = 0
+for w in ("one two  three"):gmatch("%a+") do c = c + 1 end
+d = ""
+for x in ("abc"):gmatch("") do d = d .. "." end`,
+			globals{"a": "a1", "b": "b2", "c": 3.0, "d": "...."}},
+		{"gsub", `
+a, b = string.gsub("hello world", "o", "0")
+c = string.gsub("hello world", "(%w+)", "<%1>")
+d = string.gsub("abc", "%w", "%0%0", 2)
+e = string.gsub("$name is $age", "%$(%w+)", {name = "bob", age = 42})
+f = string.gsub("x y", "%w", function(c) if c == "x" then return "X" end end)
+g = string.gsub("abc", "", "-")
+h = string.gsub("  abc", "^%s+", "")
+i, j = pcall(string.gsub, "abc", "b", "%2")
+k, l = pcall(string.gsub, "abc", "b", "%")
+m, n = pcall(string.gsub, "abc", "b", true)
+o = ("abc"):gsub("()", "%1")`,
+			globals{"a": "hell0 w0rld", "b": 2.0, "c": "<hello> <world>", "d": "aabbc", "e": "bob is 42",
+				"f": "X y", "g": "-a-b-c-", "h": "abc", "i": false, "j": "invalid capture index",
+				"k": false, "l": "invalid use of '%' in replacement string",
+				"m": false, "n": "bad argument #3 to 'gsub' (string/function/table expected)", "o": "1a2b3c4"}},
+		{"patterns", `
+a, b = pcall(string.find, "a", "[a")
+c, d = pcall(string.find, "a", "%")
+e, f = pcall(string.match, "a", "(()")
+g, h = pcall(string.match, "a", "%1")
+i, j = pcall(string.rep, "x", 1e10)`,
+			globals{"a": false, "b": "malformed pattern (missing ']')",
+				"c": false, "d": "malformed pattern (ends with '%')",
+				"e": false, "f": "unfinished capture", "g": false, "h": "invalid capture index %1",
+				"i": false, "j": "resulting string too large"}},
+		{"format", `
+a = string.format("%d %5.2f %s %%", 42, 3.14159, "x")
+b = string.format("%5s|%-5s|%.2s", "ab", "ab", "abc")
+c = string.format("%x %X %#x %o %c", 255, 255, 255, 8, 65)
+d = string.format("%g %g %g %g", 1e20, 0.1, 100000, 1e-5)
+e = string.format("%e %.3E", 12345.678, 0.5)
+f = string.format("%q", 'a "b"\n\0c\0001')
+g = string.format("%5.1f|%-6d|%+d|%05d", 2.25, 7, 3, -42)
+h = string.format("%a %a %A", 1, 0.5, 255.5)
+i = string.format("%f %g %5.1f", 1/0, -1/0, 0/0)
+j, k = pcall(string.format, "%d", 2^63)
+l, m = pcall(string.format, "%y", 1)
+n, o = pcall(string.format, "%d")
+p = string.format("%s %s", 1, true)
+q = string.format("%u %i %d", 3.0, -3, 1.5)
+r, s = pcall(string.format, "%123d", 1)`,
+			globals{"a": "42  3.14 x %", "b": "   ab|ab   |ab", "c": "ff FF 0xff 10 A",
+				"d": "1e+20 0.1 100000 1e-05", "e": "1.234568e+04 5.000E-01",
+				"f": "\"a \\\"b\\\"\\\n\\0c\\0001\"", "g": "  2.2|7     |+3|-0042",
+				"h": "0x1p+0 0x1p-1 0X1.FFP+7", "i": "inf -inf   nan",
+				"j": false, "k": "bad argument #2 to 'format' (not a number in proper range)",
+				"l": false, "m": "invalid option '%y' to 'format'",
+				"n": false, "o": "bad argument #2 to 'format' (no value)",
+				"p": "1 true", "q": "3 -3 1", "r": false, "s": "invalid format (width or precision too long)"}},
+		{"methods", `
+local s = "hello"
+a = s:len()
+b = ("%d-%d"):format(1, 2)
+c = ("x"):rep(3):upper()
+d = #string.dump(function() return 1 end) > 0
+e, f = pcall(string.dump, print)`,
+			globals{"a": 5.0, "b": "1-2", "c": "XXX", "d": true,
+				"e": false, "f": "unable to dump given function"}},
+	}
+
+	for _, c := range cases {
+		s, err := runSource(t, c.name, c.src)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		assertGlobals(t, c.name, s, c.exp)
+	}
+}
+
+func TestTable(t *testing.T) {
+	cases := []struct {
+		name string
+		src  string
+		exp  globals
+	}{
+		{"insert", `
+local t = {1, 2, 3}
+table.insert(t, 4)
+table.insert(t, 1, 0)
+a, b = table.concat(t, ","), #t
+c, d = pcall(table.insert, t, 10, 1)
+e, f = pcall(table.insert, t, 1, 2, 3)
+g, h = pcall(table.insert, 1, 2)`,
+			globals{"a": "0,1,2,3,4", "b": 5.0,
+				"c": false, "d": "bad argument #2 to 'insert' (position out of bounds)",
+				"e": false, "f": "wrong number of arguments to 'insert'",
+				"g": false, "h": "bad argument #1 to 'insert' (table expected, got number)"}},
+		{"function keys", `
+local t = {}
+t[print], t[type], t[math.sin], t[math.cos] = 1, 2, 3, 4
+a, b, c, d = t[print], t[type], t[math.sin], t[math.cos]
+t[print] = nil
+local n = 0
+for k in pairs(t) do n = n + 1 end
+e, f = t[print], n
+t[coroutine.wrap(print)] = 5
+g = rawget(t, coroutine.wrap(print))`,
+			globals{"a": 1.0, "b": 2.0, "c": 3.0, "d": 4.0, "e": nil, "f": 3.0, "g": nil}},
+		{"remove", `
+local t = {1, 2, 3, 4}
+a = table.remove(t)
+b = table.remove(t, 1)
+c, d = table.concat(t, ","), #t
+e = table.remove({})
+f, g = pcall(table.remove, t, 5)`,
+			globals{"a": 4.0, "b": 1.0, "c": "2,3", "d": 2.0, "e": nil,
+				"f": false, "g": "bad argument #1 to 'remove' (position out of bounds)"}},
+		{"concat", `
+a = table.concat({1, "b", 3.5})
+b = table.concat({"a", "b", "c", "d"}, "-", 2, 3)
+c = table.concat({}, ",")
+d, e = pcall(table.concat, {1, {}, 3})`,
+			globals{"a": "1b3.5", "b": "b-c", "c": "",
+				"d": false, "e": "invalid value (at index 2) in table for 'concat'"}},
+		{"pack", `
+local t = table.pack(1, nil, 3)
+a, b, c = t.n, t[1], t[3]
+d, e, f = table.unpack({1, 2, 3}, 2)
+g = select("#", table.unpack(t, 1, t.n))
+h, i = pcall(table.unpack, {}, 1, 1e8)`,
+			globals{"a": 3.0, "b": 1.0, "c": 3.0, "d": 2.0, "e": 3.0, "f": nil, "g": 3.0,
+				"h": false, "i": "too many results to unpack"}},
+		{"raw", `
+local t = setmetatable({}, {__index = function() return "x" end, __newindex = function() error("newindex") end, __len = function() return 2 end})
+table.insert(t, "a")
+a, b, c = rawget(t, 3), table.concat(t, ",", 3, 3), table.unpack(t)`,
+			globals{"a": "a", "b": "a", "c": nil}},
+		{"sort", `
+local t = {5, 2, 8, 1, 9, 3, 7, 4, 6, 0}
+table.sort(t)
+a = table.concat(t, ",")
+table.sort(t, function(x, y) return x > y end)
+b = table.concat(t, ",")
+local w = {"pear", "apple", "fig", "banana"}
+table.sort(w)
+c = table.concat(w, " ")
+table.sort(w, function(x, y) return #x < #y end)
+d = w[1] .. " " .. w[4]
+local big, rev, same = {}, {}, {}
+for i = 1, 1000 do big[i], rev[i], same[i] = i, 1001 - i, 7 end
+table.sort(big) ; table.sort(rev) ; table.sort(same)
+e = big[1] == 1 and big[1000] == 1000 and rev[1] == 1 and rev[500] == 500 and same[1000] == 7
+local ok = true
+local r = {}
+for i = 1, 200 do r[i] = (i * 7919) % 211 end
+table.sort(r)
+for i = 2, #r do ok = ok and r[i-1] <= r[i] end
+f = ok`,
+			globals{"a": "0,1,2,3,4,5,6,7,8,9", "b": "9,8,7,6,5,4,3,2,1,0",
+				"c": "apple banana fig pear", "d": "fig banana", "e": true, "f": true}},
+		{"sorterrors", `
+local t = {}
+for i = 1, 20 do t[i] = 5 end
+a, b = pcall(table.sort, t, function(x, y) return x <= y end)
+c, d = pcall(table.sort, {3, 1, "x"})
+e, f = pcall(table.sort, {3, 2, 1}, function(x, y) error("cmp failed", 0) end)
+g, h = pcall(table.sort, {1, 2}, 3)`,
+			globals{"a": false, "b": "invalid order function for sorting",
+				"c": false, "d": "attempt to compare string with number",
+				"e": false, "f": "cmp failed",
+				"g": false, "h": "bad argument #2 to 'sort' (function expected, got number)"}},
+	}
+
+	for _, c := range cases {
+		s, err := runSource(t, c.name, c.src)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		assertGlobals(t, c.name, s, c.exp)
+	}
+}
+
+func TestMath(t *testing.T) {
+	cases := []struct {
+		name string
+		src  string
+		exp  globals
+	}{
+		{"basic", `
+a, b, c = math.abs(-2), math.floor(2.7), math.ceil("2.1")
+d, e = math.max(3, 9, 1), math.min(3, -9, 1)
+f, g = math.modf(3.25)
+h, i = math.modf(-1/0)
+j, k = math.frexp(8)
+l = math.ldexp(0.5, 4)
+m, n = math.fmod(7, 3), math.fmod(-7, 3)
+o, p, q = math.log(8, 2), math.log(100, 10), math.exp(0)
+r, s = math.sqrt(16), math.pow(2, 10)
+u = math.huge > 0 and -math.huge < 0
+v = math.floor(math.deg(math.pi) + 0.5)
+w, x = pcall(math.floor, "x")
+y, z = pcall(math.max)`,
+			globals{"a": 2.0, "b": 2.0, "c": 3.0, "d": 9.0, "e": -9.0, "f": 3.0, "g": 0.25,
+				"h": math.Inf(-1), "i": 0.0, "j": 0.5, "k": 4.0, "l": 8.0, "m": 1.0, "n": -1.0,
+				"o": 3.0, "p": 2.0, "q": 1.0, "r": 4.0, "s": 1024.0, "u": true, "v": 180.0,
+				"w": false, "x": "bad argument #1 to 'floor' (number expected, got string)",
+				"y": false, "z": "bad argument #1 to 'max' (number expected, got no value)"}},
+		{"random", `
+a = true
+for i = 1, 100 do
+  local x, y, z = math.random(), math.random(5), math.random(-3, 3)
+  a = a and x >= 0 and x < 1 and y >= 1 and y <= 5 and y % 1 == 0 and z >= -3 and z <= 3
+end
+math.randomseed(42)
+local s1 = {math.random(100), math.random(100), math.random(100)}
+math.randomseed(42)
+local s2 = {math.random(100), math.random(100), math.random(100)}
+b = s1[1] == s2[1] and s1[2] == s2[2] and s1[3] == s2[3]
+c, d = pcall(math.random, 0)
+e, f = pcall(math.random, 3, 1)
+g, h = pcall(math.random, 1, 2, 3)`,
+			globals{"a": true, "b": true,
+				"c": false, "d": "bad argument #1 to 'random' (interval is empty)",
+				"e": false, "f": "bad argument #2 to 'random' (interval is empty)",
+				"g": false, "h": "wrong number of arguments"}},
+	}
+
+	for _, c := range cases {
+		s, err := runSource(t, c.name, c.src)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		assertGlobals(t, c.name, s, c.exp)
+	}
+}
+
+// Each state has its own random generator.
+func TestMathRandomStates(t *testing.T) {
+	s1, err := runSource(t, "s1", `math.randomseed(7) ; a = math.random(1000000)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := runSource(t, "s2", `math.randomseed(7) ; a = math.random(1000000) ; b = math.random(1000000)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Calls in another state don't change the sequence of the first one
+	if _, err := runSource(t, "s3", `math.randomseed(7) ; for i = 1, 10 do math.random() end`); err != nil {
+		t.Fatal(err)
+	}
+	rnd := s1.Globals.Get("math").(*types.Table).Get("random")
+	res, err := vm.Run(s1, rnd, 1000000.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a1, a2 := s1.Globals.Get("a"), s2.Globals.Get("a"); a1 != a2 {
+		t.Errorf("expected the same first value with the same seed, got %v and %v", a1, a2)
+	}
+	if b := s2.Globals.Get("b"); res[0] != b {
+		t.Errorf("expected the same second value with the same seed, got %v and %v", res[0], b)
+	}
+}
+
+func TestIO(t *testing.T) {
+	dir := t.TempDir()
+	cases := []struct {
+		name string
+		src  string
+		exp  globals
+	}{
+		{"write", `
+local f = assert(io.open(path, "w"))
+a = f:write("line 1\n", 42, " 3.5\n") == f
+b = io.type(f)
+c = f:close()
+d = io.type(f)
+e, g = pcall(f.write, f, "x")
+h = tostring(f)`,
+			globals{"a": true, "b": "file", "c": true, "d": "closed file",
+				"e": false, "g": "attempt to use a closed file", "h": "file (closed)"}},
+		{"read", `
+local f = assert(io.open(path, "w"))
+f:write("line 1\n", "42 3.5\n", "0x10 end\n", "last")
+f:close()
+f = assert(io.open(path))
+a, b = f:read("*l", "*L")
+c, d, e = f:read("*n", "*n", "*n")
+f:read("*l")
+g, h = f:read(2, 0)
+i = f:read("*a")
+j, k = f:read("*l"), f:read(0)
+l = f:read("*a")
+f:close()`,
+			globals{"a": "line 1", "b": "42 3.5\n", "c": 16.0, "d": nil, "e": nil,
+				"g": "la", "h": "", "i": "st", "j": nil, "k": nil, "l": ""}},
+		{"read count", `
+local f = assert(io.open(path, "w"))
+f:write("abcdef")
+f:close()
+f = assert(io.open(path))
+a, b = pcall(f.read, f, 2^40)
+c = f:read(2^40)
+d, e = pcall(f.read, f, -1)
+f:close()`,
+			globals{"a": true, "b": "abcdef", "c": nil,
+				"d": false, "e": "bad argument #2 to 'read' (invalid count)"}},
+		{"lines", `
+local f = assert(io.open(path, "w"))
+f:write("a\nb\n\nc")
+f:close()
+a = ""
+for l in io.lines(path) do a = a .. "[" .. l .. "]" end
+f = io.open(path)
+b = 0
+for c1, c2 in f:lines(1, 1) do b = b + 1 end
+c = io.type(f)
+f:close()
+d, e = pcall(io.lines, path .. ".none")`,
+			globals{"a": "[a][b][][c]", "b": 3.0, "c": "file",
+				"d": false, "e": "cannot open file '" + filepath.Join(dir, "lines") + ".none' (No such file or directory)"}},
+		{"seek", `
+local f = assert(io.open(path, "w+"))
+f:write("hello world")
+a = f:seek("set", 6)
+b = f:read("*a")
+c = f:seek("end")
+d = f:seek("cur", -5)
+f:write("WORLD")
+f:seek("set")
+e = f:read("*a")
+g, h = pcall(f.seek, f, "nope")
+f:close()`,
+			globals{"a": 6.0, "b": "world", "c": 11.0, "d": 6.0, "e": "hello WORLD",
+				"g": false, "h": "bad argument #2 to 'seek' (invalid option 'nope')"}},
+		{"errors", `
+a, b, c = io.open(path .. "/none/x")
+d, e = pcall(io.open, path, "rw")
+g, h = io.close(io.stdout)
+i = io.type(io.stdout)
+j, k = pcall(io.read, "x")
+l, m = pcall(io.stdout.write, {})
+n = io.type(42)`,
+			globals{"a": nil, "b": filepath.Join(dir, "errors") + "/none/x: No such file or directory", "c": 2.0,
+				"d": false, "e": "bad argument #2 to 'open' (invalid mode)",
+				"g": nil, "h": "cannot close standard file", "i": "file",
+				"j": false, "k": "bad argument #1 to 'read' (invalid option)",
+				"l": false, "m": "bad argument #1 to 'write' (FILE* expected, got table)", "n": nil}},
+		{"default", `
+local out = io.output(path)
+a = io.output() == out and io.output() ~= io.stdout
+io.write("x", 1, "\n")
+io.close()
+io.output(io.stdout)
+io.input(path)
+b = io.read()
+c = io.read()
+io.input():close()
+d, e = pcall(io.read)
+io.input(io.stdin)
+g = io.type(io.tmpfile())`,
+			globals{"a": true, "b": "x1", "c": nil, "d": false, "e": "standard input file is closed", "g": "file"}},
+		{"popen", `
+local f = io.popen("echo hi")
+a = f:read("*l")
+b, c, d = f:close()
+e, g, h = io.popen("exit 3"):close()`,
+			globals{"a": "hi", "b": true, "c": "exit", "d": 0.0, "e": nil, "g": "exit", "h": 3.0}},
+	}
+
+	for _, c := range cases {
+		path := filepath.Join(dir, c.name)
+		s, err := runSource(t, c.name, fmt.Sprintf("local path = %q\n%s", path, c.src))
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		assertGlobals(t, c.name, s, c.exp)
+	}
+}
+
+// The standard files can be redirected by the host.
+func TestIORedirect(t *testing.T) {
+	p, err := compiler.Compile(strings.NewReader(`
+local l = io.read()
+local n = io.stdin:read("*n")
+print(l, n + 1)
+io.write("w\n")
+io.stderr:write("e")
+io.stdout:write(io.read("*a"))`), "=redirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := types.NewState(p)
+	OpenLibs(s)
+	var out, errOut bytes.Buffer
+	SetStdin(s, strings.NewReader("first line\n41 rest"))
+	SetStdout(s, &out)
+	SetStderr(s, &errOut)
+	if err := vm.Execute(s); err != nil {
+		t.Fatal(err)
+	}
+	if exp := "first line\t42\nw\n rest"; out.String() != exp {
+		t.Errorf("expected output %q, got %q", exp, out.String())
+	}
+	if errOut.String() != "e" {
+		t.Errorf("expected error output %q, got %q", "e", errOut.String())
+	}
+}
+
+// The processes started by io.popen use the redirected standard files.
+func TestIOPopenRedirect(t *testing.T) {
+	p, err := compiler.Compile(strings.NewReader(`
+local f = io.popen("cat ; echo e >&2", "w")
+f:write("to cat\n")
+f:close()
+f = io.popen("cat")
+io.write(f:read("*a"))
+f:close()`), "=popen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, inW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	inW.WriteString("from stdin\n")
+	inW.Close()
+
+	s := types.NewState(p)
+	OpenLibs(s)
+	var out, errOut bytes.Buffer
+	SetStdin(s, in)
+	SetStdout(s, &out)
+	SetStderr(s, &errOut)
+	if err := vm.Execute(s); err != nil {
+		t.Fatal(err)
+	}
+	if exp := "to cat\nfrom stdin\n"; out.String() != exp {
+		t.Errorf("expected output %q, got %q", exp, out.String())
+	}
+	if errOut.String() != "e\n" {
+		t.Errorf("expected error output %q, got %q", "e\n", errOut.String())
+	}
+}
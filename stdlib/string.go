@@ -0,0 +1,590 @@
+package stdlib
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/mna/lune/serializer"
+	"github.com/mna/lune/types"
+	"github.com/mna/lune/vm"
+)
+
+// Limit for the size of the strings built by rep, to fail with an error
+// rather than exhausting the memory.
+const maxStringSize = math.MaxInt32
+
+// Registers the string library in the table t, the globals table, and sets
+// the metatable of strings so that their methods can be called, e.g.
+// s:upper().
+func openString(s *types.State, t *types.Table) {
+	strT := types.NewTable(0, 16)
+	strT.Set("byte", types.NewGoClosure(strByte))
+	strT.Set("char", types.NewGoClosure(strChar))
+	strT.Set("dump", types.NewGoClosure(strDump))
+	strT.Set("find", types.NewGoClosure(strFind))
+	strT.Set("format", types.NewGoClosure(strFormat))
+	strT.Set("gmatch", types.NewGoClosure(strGMatch))
+	strT.Set("gsub", types.NewGoClosure(strGSub))
+	strT.Set("len", types.NewGoClosure(strLen))
+	strT.Set("lower", types.NewGoClosure(strLower))
+	strT.Set("match", types.NewGoClosure(strMatch))
+	strT.Set("rep", types.NewGoClosure(strRep))
+	strT.Set("reverse", types.NewGoClosure(strReverse))
+	strT.Set("sub", types.NewGoClosure(strSub))
+	strT.Set("upper", types.NewGoClosure(strUpper))
+	t.Set("string", strT)
+
+	mt := types.NewTable(0, 1)
+	mt.Set("__index", strT)
+	s.SetMetaTable("", mt)
+}
+
+// Translates a relative string position: negative means back from the end.
+// See posrelat in lstrlib.c.
+func posRelat(pos, n int) int {
+	switch {
+	case pos >= 0:
+		return pos
+	case -pos > n:
+		return 0
+	}
+	return n + pos + 1
+}
+
+// byte (s [, i [, j]])
+func strByte(s *types.State, args []types.Value) []types.Value {
+	str := checkString(s, args, 1, "byte")
+	i := posRelat(optInt(s, args, 2, "byte", 1), len(str))
+	j := posRelat(optInt(s, args, 3, "byte", i), len(str))
+	if i < 1 {
+		i = 1
+	}
+	if j > len(str) {
+		j = len(str)
+	}
+	if i > j {
+		return nil // Empty interval, return no values
+	}
+	if j-i >= types.LUNE_MAXSTACK {
+		vm.Errorf(s, "string slice too long")
+	}
+	res := make([]types.Value, 0, j-i+1)
+	for _, c := range []byte(str[i-1 : j]) {
+		res = append(res, float64(c))
+	}
+	return res
+}
+
+// char (...)
+func strChar(s *types.State, args []types.Value) []types.Value {
+	b := make([]byte, len(args))
+	for i := range args {
+		c := checkInt(s, args, i+1, "char")
+		if c < 0 || c > math.MaxUint8 {
+			argError(s, i+1, "char", "value out of range")
+		}
+		b[i] = byte(c)
+	}
+	return []types.Value{string(b)}
+}
+
+// dump (function)
+func strDump(s *types.State, args []types.Value) []types.Value {
+	checkType(s, args, 1, "dump", types.TFUNCTION)
+	cl, ok := args[0].(*types.Closure)
+	if !ok {
+		vm.Errorf(s, "unable to dump given function")
+	}
+	var buf bytes.Buffer
+	if err := serializer.Dump(&buf, cl.P, false); err != nil {
+		vm.Errorf(s, "unable to dump given function")
+	}
+	return []types.Value{buf.String()}
+}
+
+// len (s)
+func strLen(s *types.State, args []types.Value) []types.Value {
+	return []types.Value{float64(len(checkString(s, args, 1, "len")))}
+}
+
+// lower (s)
+func strLower(s *types.State, args []types.Value) []types.Value {
+	b := []byte(checkString(s, args, 1, "lower"))
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return []types.Value{string(b)}
+}
+
+// rep (s, n [, sep])
+func strRep(s *types.State, args []types.Value) []types.Value {
+	str := checkString(s, args, 1, "rep")
+	n := checkInt(s, args, 2, "rep")
+	sep := optString(s, args, 3, "rep", "")
+	if n <= 0 {
+		return []types.Value{""}
+	}
+	if l := len(str) + len(sep); l > 0 && l > maxStringSize/n {
+		vm.Errorf(s, "resulting string too large")
+	}
+	if sep == "" {
+		return []types.Value{strings.Repeat(str, n)}
+	}
+	return []types.Value{strings.Repeat(str+sep, n-1) + str}
+}
+
+// reverse (s)
+func strReverse(s *types.State, args []types.Value) []types.Value {
+	str := checkString(s, args, 1, "reverse")
+	b := make([]byte, len(str))
+	for i := range b {
+		b[i] = str[len(str)-1-i]
+	}
+	return []types.Value{string(b)}
+}
+
+// sub (s, i [, j])
+func strSub(s *types.State, args []types.Value) []types.Value {
+	str := checkString(s, args, 1, "sub")
+	i := posRelat(checkInt(s, args, 2, "sub"), len(str))
+	j := posRelat(optInt(s, args, 3, "sub", -1), len(str))
+	if i < 1 {
+		i = 1
+	}
+	if j > len(str) {
+		j = len(str)
+	}
+	if i > j {
+		return []types.Value{""}
+	}
+	return []types.Value{str[i-1 : j]}
+}
+
+// upper (s)
+func strUpper(s *types.State, args []types.Value) []types.Value {
+	b := []byte(checkString(s, args, 1, "upper"))
+	for i, c := range b {
+		if c >= 'a' && c <= 'z' {
+			b[i] = c - 'a' + 'A'
+		}
+	}
+	return []types.Value{string(b)}
+}
+
+/*
+  Pattern functions
+*/
+
+// Implements find and match. See str_find_aux.
+func findAux(s *types.State, args []types.Value, find bool, fName string) []types.Value {
+	src := checkString(s, args, 1, fName)
+	pat := checkString(s, args, 2, fName)
+	init := posRelat(optInt(s, args, 3, fName, 1), len(src))
+	if init < 1 {
+		init = 1
+	} else if init > len(src)+1 { // Start after the end?
+		return []types.Value{nil}
+	}
+
+	// Explicit request or no special characters?
+	if find && (len(args) > 3 && args[3] != nil && args[3] != false || noSpecials(pat)) {
+		if i := strings.Index(src[init-1:], pat); i >= 0 {
+			start := init + i
+			return []types.Value{float64(start), float64(start + len(pat) - 1)}
+		}
+		return []types.Value{nil}
+	}
+
+	ms := newMatchState(s, src, pat)
+	p := 0
+	anchor := strings.HasPrefix(pat, "^")
+	if anchor {
+		p++ // Skip the anchor character
+	}
+	for s1 := init - 1; ; s1++ {
+		ms.reprep()
+		if e := ms.doMatch(s1, p); e != -1 {
+			if find {
+				return append([]types.Value{float64(s1 + 1), float64(e)}, ms.captures(-1, 0)...)
+			}
+			return ms.captures(s1, e)
+		}
+		if s1 >= len(src) || anchor {
+			return []types.Value{nil}
+		}
+	}
+}
+
+// find (s, pattern [, init [, plain]])
+func strFind(s *types.State, args []types.Value) []types.Value {
+	return findAux(s, args, true, "find")
+}
+
+// match (s, pattern [, init])
+func strMatch(s *types.State, args []types.Value) []types.Value {
+	return findAux(s, args, false, "match")
+}
+
+// gmatch (s, pattern)
+func strGMatch(s *types.State, args []types.Value) []types.Value {
+	src := checkString(s, args, 1, "gmatch")
+	pat := checkString(s, args, 2, "gmatch")
+	pos := 0
+	iter := func(s *types.State, _ []types.Value) []types.Value {
+		ms := newMatchState(s, src, pat)
+		for start := pos; start <= len(src); start++ {
+			ms.reprep()
+			if e := ms.doMatch(start, 0); e != -1 {
+				pos = e
+				if e == start {
+					pos++ // Empty match, go at least one position
+				}
+				return ms.captures(start, e)
+			}
+		}
+		return nil // Not found
+	}
+	return []types.Value{types.NewGoClosure(iter)}
+}
+
+// Appends the replacement string repl of the match from s to e to b, with its
+// captures substituted. See add_s.
+func (ms *matchState) addString(b *bytes.Buffer, repl string, s, e int) {
+	for i := 0; i < len(repl); i++ {
+		c := repl[i]
+		if c != patEsc {
+			b.WriteByte(c)
+			continue
+		}
+		i++ // Skip the escape
+		switch {
+		case i < len(repl) && repl[i] == '0':
+			b.WriteString(ms.src[s:e])
+		case i < len(repl) && isDigit(repl[i]):
+			v := ms.getCapture(int(repl[i]-'1'), s, e)
+			if n, ok := v.(float64); ok {
+				v = types.NumberToString(n)
+			}
+			b.WriteString(v.(string))
+		case i < len(repl) && repl[i] == patEsc:
+			b.WriteByte(patEsc)
+		default:
+			vm.Errorf(ms.s, "invalid use of '%c' in replacement string", patEsc)
+		}
+	}
+}
+
+// Appends the replacement of the match from s to e to b. See add_value.
+func (ms *matchState) addValue(b *bytes.Buffer, repl types.Value, s, e int) {
+	var v types.Value
+	switch r := repl.(type) {
+	case string:
+		ms.addString(b, r, s, e)
+		return
+	case float64:
+		ms.addString(b, types.NumberToString(r), s, e)
+		return
+	case *types.Table:
+		v = vm.GetTable(ms.s, r, ms.getCapture(0, s, e))
+	default:
+		if res := vm.Call(ms.s, repl, ms.captures(s, e)...); len(res) > 0 {
+			v = res[0]
+		}
+	}
+	switch r := v.(type) {
+	case nil, bool:
+		if r == nil || r == false {
+			// Keep the original text
+			b.WriteString(ms.src[s:e])
+			return
+		}
+	case string:
+		b.WriteString(r)
+		return
+	case float64:
+		b.WriteString(types.NumberToString(r))
+		return
+	}
+	vm.Errorf(ms.s, "invalid replacement value (a %s)", types.TypeOf(v))
+}
+
+// gsub (s, pattern, repl [, n])
+func strGSub(s *types.State, args []types.Value) []types.Value {
+	src := checkString(s, args, 1, "gsub")
+	pat := checkString(s, args, 2, "gsub")
+	switch typeName(args, 3) {
+	case "number", "string", "table", "function":
+	default:
+		argError(s, 3, "gsub", "string/function/table expected")
+	}
+	maxN := optInt(s, args, 4, "gsub", len(src)+1)
+
+	ms := newMatchState(s, src, pat)
+	p := 0
+	anchor := strings.HasPrefix(pat, "^")
+	if anchor {
+		p++ // Skip the anchor character
+	}
+	var b bytes.Buffer
+	i, n := 0, 0
+	for n < maxN {
+		ms.reprep()
+		e := ms.doMatch(i, p)
+		if e != -1 {
+			n++
+			ms.addValue(&b, args[2], i, e)
+		}
+		if e != -1 && e > i { // Non empty match?
+			i = e // Skip it
+		} else if i < len(src) {
+			b.WriteByte(src[i])
+			i++
+		} else {
+			break
+		}
+		if anchor {
+			break
+		}
+	}
+	b.WriteString(src[i:])
+	return []types.Value{b.String(), float64(n)}
+}
+
+/*
+  format
+*/
+
+const formatFlags = "-+ #0"
+
+// format (formatstring, ...)
+func strFormat(s *types.State, args []types.Value) []types.Value {
+	f := checkString(s, args, 1, "format")
+	var b bytes.Buffer
+	arg := 1
+	for i := 0; i < len(f); i++ {
+		if f[i] != '%' {
+			b.WriteByte(f[i])
+			continue
+		}
+		if i++; i < len(f) && f[i] == '%' {
+			b.WriteByte('%') // %%
+			continue
+		}
+
+		// Format item
+		if arg++; arg > len(args) {
+			argError(s, arg, "format", "no value")
+		}
+		start := i
+		if i = scanFormat(s, f, i); i >= len(f) {
+			vm.Errorf(s, "invalid option '%%' to 'format'")
+		}
+		spec, conv := f[start:i], f[i]
+		switch conv {
+		case 'c':
+			padString(&b, spec, string([]byte{byte(checkInt(s, args, arg, "format"))}))
+		case 'd', 'i':
+			n := checkNumber(s, args, arg, "format")
+			ni := int64(n)
+			if diff := n - float64(ni); !(n >= math.MinInt64 && n < -math.MinInt64) || diff <= -1 || diff >= 1 {
+				argError(s, arg, "format", "not a number in proper range")
+			}
+			fmt.Fprintf(&b, "%"+spec+"d", ni)
+		case 'o', 'u', 'x', 'X':
+			n := checkNumber(s, args, arg, "format")
+			if !(n > -1 && n < math.MaxUint64) {
+				argError(s, arg, "format", "not a non-negative number in proper range")
+			}
+			verb := conv
+			if conv == 'u' {
+				verb = 'd'
+			}
+			fmt.Fprintf(&b, "%"+spec+string(verb), uint64(math.Max(n, 0)))
+		case 'e', 'E', 'f', 'g', 'G':
+			formatFloat(&b, spec, conv, checkNumber(s, args, arg, "format"))
+		case 'a', 'A':
+			formatHexFloat(&b, spec, conv, checkNumber(s, args, arg, "format"))
+		case 'q':
+			addQuoted(&b, checkString(s, args, arg, "format"))
+		case 's':
+			str := toString(s, args[arg-1])
+			if !strings.Contains(spec, ".") && len(str) >= 100 {
+				// No precision and string is too long to be formatted, keep it as is
+				b.WriteString(str)
+			} else {
+				padString(&b, spec, str)
+			}
+		default:
+			vm.Errorf(s, "invalid option '%%%c' to 'format'", conv)
+		}
+	}
+	return []types.Value{b.String()}
+}
+
+// Returns the position of the conversion char of the format item that starts
+// at i, right after the '%'. See scanformat.
+func scanFormat(s *types.State, f string, i int) int {
+	start := i
+	for i < len(f) && strings.IndexByte(formatFlags, f[i]) >= 0 {
+		i++
+	}
+	if i-start > len(formatFlags) {
+		vm.Errorf(s, "invalid format (repeated flags)")
+	}
+	// Width and precision have 2 digits at most
+	for n := 0; n < 2 && i < len(f) && isDigit(f[i]); n++ {
+		i++
+	}
+	if i < len(f) && f[i] == '.' {
+		i++
+		for n := 0; n < 2 && i < len(f) && isDigit(f[i]); n++ {
+			i++
+		}
+	}
+	if i < len(f) && isDigit(f[i]) {
+		vm.Errorf(s, "invalid format (width or precision too long)")
+	}
+	return i
+}
+
+// Parses the flags, width and precision of the format spec, -1 if absent.
+func parseSpec(spec string) (flags string, width, prec int) {
+	i := 0
+	for i < len(spec) && strings.IndexByte(formatFlags, spec[i]) >= 0 {
+		i++
+	}
+	flags, spec = spec[:i], spec[i:]
+	width, prec = -1, -1
+	if i = strings.IndexByte(spec, '.'); i >= 0 {
+		prec, _ = strconv.Atoi(spec[i+1:]) // An empty precision is 0
+		spec = spec[:i]
+	}
+	if spec != "" {
+		width, _ = strconv.Atoi(spec)
+	}
+	return flags, width, prec
+}
+
+// Writes str to b, truncated to the precision and padded to the width of the
+// spec. Unlike Go's fmt, lengths are in bytes.
+func padString(b *bytes.Buffer, spec, str string) {
+	flags, width, prec := parseSpec(spec)
+	if prec >= 0 && prec < len(str) {
+		str = str[:prec]
+	}
+	pad := strings.Repeat(" ", max(width-len(str), 0))
+	if strings.Contains(flags, "-") {
+		b.WriteString(str + pad)
+	} else {
+		b.WriteString(pad + str)
+	}
+}
+
+// Writes the number n in the format of the C printf conversion conv.
+func formatFloat(b *bytes.Buffer, spec string, conv byte, n float64) {
+	if math.IsInf(n, 0) || math.IsNaN(n) {
+		formatNonFinite(b, spec, conv, n)
+		return
+	}
+	if (conv == 'g' || conv == 'G') && !strings.Contains(spec, ".") {
+		// Go's default precision is the shortest representation, C's is 6
+		spec += ".6"
+	}
+	fmt.Fprintf(b, "%"+spec+string(conv), n)
+}
+
+// Writes inf or nan like C does, Go's fmt writes +Inf and NaN.
+func formatNonFinite(b *bytes.Buffer, spec string, conv byte, n float64) {
+	flags, _, _ := parseSpec(spec)
+	str := "inf"
+	switch {
+	case math.IsNaN(n):
+		str = "nan"
+	case n < 0:
+		str = "-inf"
+	}
+	if str[0] != '-' {
+		if strings.Contains(flags, "+") {
+			str = "+" + str
+		} else if strings.Contains(flags, " ") {
+			str = " " + str
+		}
+	}
+	if conv >= 'A' && conv <= 'Z' {
+		str = strings.ToUpper(str)
+	}
+	// The '0' flag doesn't apply, and there is no precision
+	padString(b, strings.Replace(flags, "0", "", -1)+specWidth(spec), str)
+}
+
+// Returns the width of the spec, or an empty string if there is none.
+func specWidth(spec string) string {
+	if _, width, _ := parseSpec(spec); width >= 0 {
+		return strconv.Itoa(width)
+	}
+	return ""
+}
+
+// Writes the number n in hexadecimal, like the C printf conversion %a.
+func formatHexFloat(b *bytes.Buffer, spec string, conv byte, n float64) {
+	if math.IsInf(n, 0) || math.IsNaN(n) {
+		formatNonFinite(b, spec, conv, n)
+		return
+	}
+	flags, width, prec := parseSpec(spec)
+	num := strconv.FormatFloat(math.Abs(n), 'x', prec, 64)
+	if strings.Contains(flags, "#") && !strings.Contains(num, ".") {
+		num = strings.Replace(num, "p", ".p", 1)
+	}
+	// C writes the exponent with as few digits as possible, Go with 2 at least
+	if i := strings.IndexByte(num, 'p'); i >= 0 && len(num) > i+3 && num[i+2] == '0' {
+		num = num[:i+2] + num[i+3:]
+	}
+	sign := ""
+	switch {
+	case math.Signbit(n):
+		sign = "-"
+	case strings.Contains(flags, "+"):
+		sign = "+"
+	case strings.Contains(flags, " "):
+		sign = " "
+	}
+	if strings.Contains(flags, "0") && !strings.Contains(flags, "-") {
+		// Zero padding goes after the 0x prefix
+		if pad := width - len(sign) - len(num); pad > 0 {
+			num = num[:2] + strings.Repeat("0", pad) + num[2:]
+		}
+	}
+	num = sign + num
+	if conv == 'A' {
+		num = strings.ToUpper(num)
+	}
+	padString(b, strings.Replace(flags, "0", "", -1)+specWidth(spec), num)
+}
+
+// Writes str to b as a string literal that can be read back by Lua. See
+// addquoted.
+func addQuoted(b *bytes.Buffer, str string) {
+	b.WriteByte('"')
+	for i := 0; i < len(str); i++ {
+		switch c := str[i]; {
+		case c == '"' || c == '\\' || c == '\n':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c == 0x7f:
+			if i+1 < len(str) && isDigit(str[i+1]) {
+				fmt.Fprintf(b, "\\%03d", c)
+			} else {
+				fmt.Fprintf(b, "\\%d", c)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+}
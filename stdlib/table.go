@@ -0,0 +1,240 @@
+package stdlib
+
+import (
+	"bytes"
+
+	"github.com/mna/lune/types"
+	"github.com/mna/lune/vm"
+)
+
+/*
+  The table library, a port of ltablib.c from Lua. As in Lua 5.2, the
+  elements are read and written with raw accesses, but the length of the
+  table honours the __len metamethod.
+*/
+
+// Registers the table library in the table t, the globals table.
+func openTable(t *types.Table) {
+	tabT := types.NewTable(0, 6)
+	tabT.Set("concat", types.NewGoClosure(tabConcat))
+	tabT.Set("insert", types.NewGoClosure(tabInsert))
+	tabT.Set("pack", types.NewGoClosure(tabPack))
+	tabT.Set("remove", types.NewGoClosure(tabRemove))
+	tabT.Set("sort", types.NewGoClosure(tabSort))
+	tabT.Set("unpack", types.NewGoClosure(tabUnpack))
+	t.Set("table", tabT)
+}
+
+// Returns the table argument at position 1 and its length. See aux_getn and
+// luaL_len.
+func checkLen(s *types.State, args []types.Value, fName string) (*types.Table, int) {
+	t := checkTable(s, args, 1, fName)
+	n, ok := vm.Len(s, t).(float64)
+	if !ok {
+		vm.Errorf(s, "object length is not a number")
+	}
+	return t, int(n)
+}
+
+// concat (list [, sep [, i [, j]]])
+func tabConcat(s *types.State, args []types.Value) []types.Value {
+	t := checkTable(s, args, 1, "concat")
+	sep := optString(s, args, 2, "concat", "")
+	i := optInt(s, args, 3, "concat", 1)
+	var last int
+	if len(args) < 4 || args[3] == nil {
+		_, last = checkLen(s, args, "concat")
+	} else {
+		last = checkInt(s, args, 4, "concat")
+	}
+
+	var b bytes.Buffer
+	for ; i <= last; i++ {
+		switch v := t.Get(float64(i)).(type) {
+		case string:
+			b.WriteString(v)
+		case float64:
+			b.WriteString(types.NumberToString(v))
+		default:
+			vm.Errorf(s, "invalid value (at index %d) in table for 'concat'", i)
+		}
+		if i < last {
+			b.WriteString(sep)
+		}
+	}
+	return []types.Value{b.String()}
+}
+
+// insert (list, [pos,] value)
+func tabInsert(s *types.State, args []types.Value) []types.Value {
+	t, n := checkLen(s, args, "insert")
+	e := n + 1 // First empty element
+	var pos int
+	switch len(args) {
+	case 2:
+		pos = e // Insert new element at the end
+	case 3:
+		pos = checkInt(s, args, 2, "insert")
+		if pos < 1 || pos > e {
+			argError(s, 2, "insert", "position out of bounds")
+		}
+		// Move up elements
+		for i := e; i > pos; i-- {
+			t.Set(float64(i), t.Get(float64(i-1)))
+		}
+	default:
+		vm.Errorf(s, "wrong number of arguments to 'insert'")
+	}
+	t.Set(float64(pos), args[len(args)-1])
+	return nil
+}
+
+// pack (...)
+func tabPack(s *types.State, args []types.Value) []types.Value {
+	t := types.NewTable(len(args), 1)
+	for i, v := range args {
+		t.Set(float64(i+1), v)
+	}
+	t.Set("n", float64(len(args)))
+	return []types.Value{t}
+}
+
+// remove (list [, pos])
+func tabRemove(s *types.State, args []types.Value) []types.Value {
+	t, n := checkLen(s, args, "remove")
+	pos := optInt(s, args, 2, "remove", n)
+	if pos != n && (pos < 1 || pos > n+1) { // Validate pos if given
+		argError(s, 1, "remove", "position out of bounds")
+	}
+	v := t.Get(float64(pos))
+	for ; pos < n; pos++ {
+		t.Set(float64(pos), t.Get(float64(pos+1)))
+	}
+	t.Set(float64(pos), nil)
+	return []types.Value{v}
+}
+
+// unpack (list [, i [, j]])
+func tabUnpack(s *types.State, args []types.Value) []types.Value {
+	t := checkTable(s, args, 1, "unpack")
+	i := optInt(s, args, 2, "unpack", 1)
+	var j int
+	if len(args) < 3 || args[2] == nil {
+		_, j = checkLen(s, args, "unpack")
+	} else {
+		j = checkInt(s, args, 3, "unpack")
+	}
+	if i > j {
+		return nil // Empty range
+	}
+	if n := j - i + 1; n <= 0 || n >= types.LUNE_MAXSTACK {
+		vm.Errorf(s, "too many results to unpack")
+	}
+	res := make([]types.Value, 0, j-i+1)
+	for ; i <= j; i++ {
+		res = append(res, t.Get(float64(i)))
+	}
+	return res
+}
+
+/*
+  sort, a quicksort with the pivot chosen as the median of 3, see auxsort
+  in ltablib.c
+*/
+
+type sorter struct {
+	s    *types.State
+	t    *types.Table
+	comp types.Value // Order function, nil to use the < operator
+}
+
+func (st *sorter) get(i int) types.Value {
+	return st.t.Get(float64(i))
+}
+
+func (st *sorter) set(i int, v types.Value) {
+	st.t.Set(float64(i), v)
+}
+
+func (st *sorter) swap(i, j int) {
+	vi, vj := st.get(i), st.get(j)
+	st.set(i, vj)
+	st.set(j, vi)
+}
+
+// Reports whether a sorts before b.
+func (st *sorter) less(a, b types.Value) bool {
+	if st.comp == nil {
+		return vm.LessThan(st.s, a, b)
+	}
+	res := vm.Call(st.s, st.comp, a, b)
+	return len(res) > 0 && res[0] != nil && res[0] != false
+}
+
+func (st *sorter) sort(l, u int) {
+	for l < u { // For tail recursion
+		// Sort elements a[l], a[(l+u)/2] and a[u]
+		if st.less(st.get(u), st.get(l)) {
+			st.swap(l, u) // a[u] < a[l]?
+		}
+		if u-l == 1 {
+			break // Only 2 elements
+		}
+		i := (l + u) / 2
+		if st.less(st.get(i), st.get(l)) { // a[i] < a[l]?
+			st.swap(i, l)
+		} else if st.less(st.get(u), st.get(i)) { // a[u] < a[i]?
+			st.swap(i, u)
+		}
+		if u-l == 2 {
+			break // Only 3 elements
+		}
+		p := st.get(i) // Pivot
+		st.swap(i, u-1)
+
+		// a[l] <= p == a[u-1] <= a[u], only need to sort from l+1 to u-2
+		i, j := l, u-1
+		for {
+			// Repeat ++i until a[i] >= p
+			for i++; st.less(st.get(i), p); i++ {
+				if i >= u {
+					vm.Errorf(st.s, "invalid order function for sorting")
+				}
+			}
+			// Repeat --j until a[j] <= p
+			for j--; st.less(p, st.get(j)); j-- {
+				if j <= l {
+					vm.Errorf(st.s, "invalid order function for sorting")
+				}
+			}
+			if j < i {
+				break
+			}
+			st.swap(i, j)
+		}
+		st.swap(u-1, i)
+
+		// a[l..i-1] <= a[i] == p <= a[i+1..u], recurse into the smaller half
+		if i-l < u-i {
+			j, i = l, i-1
+			l = i + 2
+		} else {
+			j, i = i+1, u
+			u = j - 2
+		}
+		st.sort(j, i)
+	}
+}
+
+// sort (list [, comp])
+func tabSort(s *types.State, args []types.Value) []types.Value {
+	t, n := checkLen(s, args, "sort")
+	var comp types.Value
+	if len(args) > 1 && args[1] != nil {
+		checkType(s, args, 2, "sort", types.TFUNCTION)
+		comp = args[1]
+	}
+	st := &sorter{s: s, t: t, comp: comp}
+	st.sort(1, n)
+	return nil
+}
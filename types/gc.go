@@ -0,0 +1,97 @@
+package types
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+  Finalizers (__gc metamethods). Tables and userdata are marked for
+  finalization when they get a metatable with a __gc field, as in Lua. Once
+  they become unreachable, the Go garbage collector queues them, and the VM
+  calls their __gc metamethod at its next safe point (see the vm package). The
+  Go collector does not finalize values that are part of a reference cycle, so
+  such values never get their __gc metamethod called.
+*/
+
+// Values waiting for their __gc metamethod to be called. See the 'tobefnz'
+// list in Lua.
+type FinalizerQueue struct {
+	pending atomic.Bool
+	mu      sync.Mutex
+	vals    []Value
+}
+
+func (q *FinalizerQueue) push(v Value) {
+	q.mu.Lock()
+	q.vals = append(q.vals, v)
+	q.mu.Unlock()
+	q.pending.Store(true)
+}
+
+// Returns true if values are waiting to be finalized. Safe to call on every
+// instruction.
+func (q *FinalizerQueue) Pending() bool {
+	return q.pending.Load()
+}
+
+// Returns the values waiting to be finalized, in the order they were
+// collected.
+func (q *FinalizerQueue) Values() []Value {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]Value(nil), q.vals...)
+}
+
+// Removes and returns the first value waiting to be finalized, in the order
+// they were collected. Returns false if there is none.
+func (q *FinalizerQueue) Pop() (Value, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.vals) == 0 {
+		return nil, false
+	}
+	v := q.vals[0]
+	q.vals[0] = nil
+	q.vals = q.vals[1:]
+	q.pending.Store(len(q.vals) > 0)
+	return v, true
+}
+
+// Returns the metatable of the value v, or nil if it has none. See
+// lua_getmetatable.
+func (s *State) MetaTable(v Value) *Table {
+	switch v := v.(type) {
+	case *Table:
+		return v.Meta
+	case *Userdata:
+		return v.Meta
+	}
+	return s.MetaTables[TypeOf(v)]
+}
+
+// Sets the metatable of the value v: its own metatable for a table or a
+// userdata, the metatable shared by all the values of its type otherwise. A
+// table or a userdata is marked for finalization if mt has a __gc field. See
+// lua_setmetatable.
+func (s *State) SetMetaTable(v Value, mt *Table) {
+	switch v := v.(type) {
+	case *Table:
+		v.Meta = mt
+		if !v.finalize && mt != nil && mt.Get("__gc") != nil {
+			v.finalize = true
+			q := &s.Finalizers
+			runtime.SetFinalizer(v, func(t *Table) { q.push(t) })
+		}
+	case *Userdata:
+		v.Meta = mt
+		if !v.finalize && mt != nil && mt.Get("__gc") != nil {
+			v.finalize = true
+			q := &s.Finalizers
+			runtime.SetFinalizer(v, func(u *Userdata) { q.push(u) })
+		}
+	default:
+		s.MetaTables[TypeOf(v)] = mt
+	}
+}
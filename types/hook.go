@@ -0,0 +1,59 @@
+package types
+
+// Hook events, same values as Lua's (see lua.h), except for LUNE_HOOKINSTR
+// which has no Lua equivalent.
+type HookEvent byte
+
+const (
+	LUNE_HOOKCALL HookEvent = iota
+	LUNE_HOOKRET
+	LUNE_HOOKLINE
+	LUNE_HOOKCOUNT
+	LUNE_HOOKTAILCALL
+	LUNE_HOOKINSTR // Every instruction, including those consumed by the previous one (e.g. OP_JMP after OP_EQ)
+)
+
+// Hook masks, to select the events that call the hook
+const (
+	LUNE_MASKCALL  byte = 1 << LUNE_HOOKCALL // Also selects LUNE_HOOKTAILCALL
+	LUNE_MASKRET   byte = 1 << LUNE_HOOKRET
+	LUNE_MASKLINE  byte = 1 << LUNE_HOOKLINE
+	LUNE_MASKCOUNT byte = 1 << LUNE_HOOKCOUNT
+	LUNE_MASKINSTR byte = 1 << LUNE_HOOKINSTR
+)
+
+var hookEventNames = [...]string{
+	"call", "return", "line", "count", "tail call", "instruction",
+}
+
+// Returns the event name as passed to hooks by Lua's debug.sethook.
+func (e HookEvent) String() string {
+	return hookEventNames[e]
+}
+
+// Describes the event that called a hook, see lua_Debug in Lua.
+type Debug struct {
+	Event       HookEvent
+	CurrentLine int // Line of the instruction for line and instruction events, -1 otherwise
+	PC          int // Index of the instruction for line, count and instruction events, -1 otherwise
+}
+
+// Hook function, called by the VM for the events selected by the mask given
+// to SetHook. Hooks are not called while a hook is running.
+type Hook func(s *State, ar *Debug)
+
+// Sets the hook function, see lua_sethook. The mask is a combination of the
+// LUNE_MASK* values, count is the number of instructions between two count
+// events. A nil function or a zero mask turns hooks off.
+func (s *State) SetHook(f Hook, mask byte, count int) {
+	if f == nil || mask == 0 {
+		f, mask = nil, 0
+	}
+	if count <= 0 {
+		mask &^= LUNE_MASKCOUNT
+	}
+	s.Hook = f
+	s.HookMask = mask
+	s.BaseHookCount = count
+	s.HookCount = count
+}
@@ -1,5 +1,10 @@
 package types
 
+import (
+	"bytes"
+	"fmt"
+)
+
 /*
   We assume that instructions are unsigned numbers.
   All instructions have an opcode in the first 6 bits.
@@ -80,6 +85,50 @@ func (i Instruction) GetArgsBx() int {
 	return (bx - MAXARG_sBx)
 }
 
+func setArg(i *Instruction, v int, pos, size uint) {
+	*i = (*i & mask0(size, pos)) | ((Instruction(v) << pos) & mask1(size, pos))
+}
+
+func (i *Instruction) SetOpCode(op OpCode) {
+	setArg(i, int(op), posOp, sizeOp)
+}
+
+func (i *Instruction) SetArgA(v int) {
+	setArg(i, v, posA, sizeA)
+}
+
+func (i *Instruction) SetArgB(v int) {
+	setArg(i, v, posB, sizeB)
+}
+
+func (i *Instruction) SetArgC(v int) {
+	setArg(i, v, posC, sizeC)
+}
+
+func (i *Instruction) SetArgBx(v int) {
+	setArg(i, v, posBx, sizeBx)
+}
+
+func (i *Instruction) SetArgAx(v int) {
+	setArg(i, v, posAx, sizeAx)
+}
+
+func (i *Instruction) SetArgsBx(v int) {
+	i.SetArgBx(v + MAXARG_sBx)
+}
+
+func NewInstrABC(op OpCode, a, b, c int) Instruction {
+	return Instruction(op)<<posOp | Instruction(a)<<posA | Instruction(b)<<posB | Instruction(c)<<posC
+}
+
+func NewInstrABx(op OpCode, a, bx int) Instruction {
+	return Instruction(op)<<posOp | Instruction(a)<<posA | Instruction(bx)<<posBx
+}
+
+func NewInstrAx(op OpCode, ax int) Instruction {
+	return Instruction(op)<<posOp | Instruction(ax)<<posAx
+}
+
 // test whether value is a constant
 func isK(v int) bool {
 	return (v & BITRK) != 0
@@ -90,58 +139,66 @@ func indexK(v int) int {
 	return (v & (^BITRK))
 }
 
+// code a constant index as a RK value
+func RKAsK(v int) int {
+	return (v | BITRK)
+}
+
+// exported version of isK, for the compiler
+func IsK(v int) bool {
+	return isK(v)
+}
+
+// exported version of indexK, for the compiler
+func IndexK(v int) int {
+	return indexK(v)
+}
+
 func (i Instruction) GetArgs(s *State) Args {
 	op := i.GetOpCode()
 	return opArgsFunc[op](s, i)
 }
 
-// TODO : Broken...
-/*
+// Returns the instruction as printed by luac's listing, the opcode name
+// followed by the decoded arguments. Constants are printed as negative
+// indices, starting at -1.
 func (i Instruction) String() string {
 	var buf bytes.Buffer
-	var a, b, c int
-	var bc [2]bool
 
 	op := i.GetOpCode()
-	om := op.GetOpMode()
-
-	buf.WriteString(fmt.Sprintf("%s%s", op, strings.Repeat(" ", 20-len(op.String()))))
-	if om == MODE_iAx {
-		a = i.GetArgAx()
-	} else {
-		a = i.GetArgA()
-
-		bm := op.GetBMode()
-		if bm != OpArgN {
-			bc[0] = true
-			switch om {
-			case MODE_iABC:
-				b, _ = i.GetArgB(false)
-				cm := op.GetCMode()
-				if cm != OpArgN {
-					bc[1] = true
-					c, _ = i.GetArgC(false)
-					if cm == OpArgK && isK(c) {
-						c = -1 - indexK(c)
-					}
-				}
-			case MODE_iABx:
-				b, _ = i.GetArgBx(false)
-			case MODE_iAsBx:
-				b = i.GetArgsBx()
-			}
-			if bm == OpArgK && isK(b) {
-				b = -1 - indexK(b)
-			}
+	a := i.GetArgA()
+	b, _ := i.GetArgB(false)
+	c, _ := i.GetArgC(false)
+	bx, _ := i.GetArgBx(false)
+
+	fmt.Fprintf(&buf, "%-9s\t", op)
+	switch op.GetOpMode() {
+	case MODE_iABC:
+		fmt.Fprintf(&buf, "%d", a)
+		if op.GetBMode() != OpArgN {
+			fmt.Fprintf(&buf, " %d", rkToListing(b))
 		}
-	}
-	buf.WriteString(fmt.Sprintf("%d", a))
-	if bc[0] {
-		buf.WriteString(fmt.Sprintf(" %d", b))
-	}
-	if bc[1] {
-		buf.WriteString(fmt.Sprintf(" %d", c))
+		if op.GetCMode() != OpArgN {
+			fmt.Fprintf(&buf, " %d", rkToListing(c))
+		}
+	case MODE_iABx:
+		fmt.Fprintf(&buf, "%d", a)
+		if op.GetBMode() == OpArgK {
+			fmt.Fprintf(&buf, " %d", -1-bx)
+		} else if op.GetBMode() == OpArgU {
+			fmt.Fprintf(&buf, " %d", bx)
+		}
+	case MODE_iAsBx:
+		fmt.Fprintf(&buf, "%d %d", a, i.GetArgsBx())
+	case MODE_iAx:
+		fmt.Fprintf(&buf, "%d", -1-i.GetArgAx())
 	}
 	return buf.String()
 }
-*/
+
+func rkToListing(v int) int {
+	if isK(v) {
+		return -1 - indexK(v)
+	}
+	return v
+}
@@ -41,5 +41,13 @@ const (
 
 	LUNE_MULTRET = -1
 
+	LUNE_MINSTACK  = 20      // Free stack slots guaranteed to a Go function
+	LUNE_MAXSTACK  = 1000000 // Limit for the size of the stack, see LUAI_MAXSTACK
+	LUNE_MAXCCALLS = 200     // Limit for nested calls running their own execution loop (metamethods, Go functions)
+
+	LUNE_REGISTRYINDEX   = -LUNE_MAXSTACK - 1000 // Pseudo-index of the registry, upvalues of Go functions are below
+	LUNE_RIDX_MAINTHREAD = 1                     // Index of the main thread in the registry
+	LUNE_RIDX_GLOBALS    = 2                     // Index of the globals table in the registry
+
 	LFIELDS_PER_FLUSH = 50 // Needs to be the same as Lua
 )
@@ -0,0 +1,278 @@
+package types
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+  Mostly a port of the conversion functions of lobject.{c,h} from Lua
+*/
+
+const (
+	LUA_IDSIZE = 60 // Size of the chunk id (the source description in messages)
+
+	_NUMBER_FMT = "%.14g"
+)
+
+// Performs the arithmetic operation op (OP_ADD to OP_UNM) on the numbers
+// a and b, with Lua's semantics.
+func Arith(op OpCode, a, b float64) float64 {
+	switch op {
+	case OP_ADD:
+		return a + b
+	case OP_SUB:
+		return a - b
+	case OP_MUL:
+		return a * b
+	case OP_DIV:
+		return a / b
+	case OP_MOD:
+		// Lua's modulo is defined as a - floor(a/b)*b, the result takes the
+		// sign of the divisor, unlike math.Mod.
+		return a - math.Floor(a/b)*b
+	case OP_POW:
+		return math.Pow(a, b)
+	case OP_UNM:
+		return -a
+	}
+	panic(fmt.Sprintf("%s: not an arithmetic opcode", op))
+}
+
+// Converts an integer to a "floating point byte", represented as
+// (eeeeexxx), where the real value is (1xxx) * 2^(eeeee - 1) if
+// eeeee != 0 and (xxx) otherwise.
+func Int2Fb(x int) int {
+	e := 0 // exponent
+	if x < 8 {
+		return x
+	}
+	for x >= 0x10 {
+		x = (x + 1) >> 1
+		e++
+	}
+	return ((e + 1) << 3) | (x - 8)
+}
+
+// Converts back a "floating point byte" to an integer.
+func Fb2Int(x int) int {
+	e := (x >> 3) & 0x1f
+	if e == 0 {
+		return x
+	}
+	return ((x & 7) + 8) << uint(e-1)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || (c >= '\t' && c <= '\r')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func hexValue(c byte) (int, bool) {
+	switch {
+	case isDigit(c):
+		return int(c - '0'), true
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10, true
+	case c >= 'A' && c <= 'F':
+		return int(c-'A') + 10, true
+	}
+	return 0, false
+}
+
+// Reads an optional sign, returns true if it is a minus sign.
+func readSign(s string, i int) (int, bool) {
+	if i < len(s) {
+		if s[i] == '-' {
+			return i + 1, true
+		} else if s[i] == '+' {
+			return i + 1, false
+		}
+	}
+	return i, false
+}
+
+// Converts a hexadecimal numeric string, with an optional fraction and binary
+// exponent. Returns the number and the index where the conversion ended, or
+// 0 if nothing was recognized.
+func strx2number(s string) (float64, int) {
+	var r float64
+	var e, nd int
+
+	i := 0
+	for i < len(s) && isSpace(s[i]) {
+		i++
+	}
+	i, neg := readSign(s, i)
+	if !(i+1 < len(s) && s[i] == '0' && (s[i+1] == 'x' || s[i+1] == 'X')) {
+		return 0, 0
+	}
+	for i += 2; i < len(s); i++ {
+		v, ok := hexValue(s[i])
+		if !ok {
+			break
+		}
+		r = r*16 + float64(v)
+		nd++
+	}
+	if i < len(s) && s[i] == '.' {
+		for i++; i < len(s); i++ {
+			v, ok := hexValue(s[i])
+			if !ok {
+				break
+			}
+			r = r*16 + float64(v)
+			e--
+		}
+	}
+	if nd == 0 && e == 0 {
+		return 0, 0
+	}
+	e *= 4 // each digit multiplies/divides value by 2^4
+	end := i
+	if i < len(s) && (s[i] == 'p' || s[i] == 'P') {
+		var exp int
+		i, neg1 := readSign(s, i+1)
+		if i < len(s) && isDigit(s[i]) {
+			for ; i < len(s) && isDigit(s[i]); i++ {
+				exp = exp*10 + int(s[i]-'0')
+			}
+			if neg1 {
+				exp = -exp
+			}
+			e += exp
+			end = i
+		}
+	}
+	if neg {
+		r = -r
+	}
+	return math.Ldexp(r, e), end
+}
+
+// Converts a decimal numeric string the way C's strtod does. Returns the
+// number and the index where the conversion ended, or 0 if nothing was
+// recognized.
+func str2number(s string) (float64, int) {
+	i := 0
+	for i < len(s) && isSpace(s[i]) {
+		i++
+	}
+	start := i
+	i, _ = readSign(s, i)
+	nd := 0
+	for ; i < len(s) && isDigit(s[i]); i++ {
+		nd++
+	}
+	if i < len(s) && s[i] == '.' {
+		for i++; i < len(s) && isDigit(s[i]); i++ {
+			nd++
+		}
+	}
+	if nd == 0 {
+		return 0, 0
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j, _ := readSign(s, i+1)
+		if j < len(s) && isDigit(s[j]) {
+			for i = j; i < len(s) && isDigit(s[i]); i++ {
+			}
+		}
+	}
+	f, err := strconv.ParseFloat(s[start:i], 64)
+	if err != nil {
+		// Out of range values are still valid, they are +/- HUGE_VAL
+		if ne, ok := err.(*strconv.NumError); !ok || ne.Err != strconv.ErrRange {
+			return 0, 0
+		}
+	}
+	return f, i
+}
+
+// Converts a string to a number, following the Lua lexical conventions
+// for numerals, with optional leading and trailing whitespace. Returns
+// false if the string is not a valid number.
+func StrToNumber(s string) (float64, bool) {
+	var n float64
+	var end int
+
+	if strings.ContainsAny(s, "nN") {
+		// reject 'inf' and 'nan'
+		return 0, false
+	} else if strings.ContainsAny(s, "xX") {
+		n, end = strx2number(s)
+	} else {
+		n, end = str2number(s)
+	}
+	if end == 0 {
+		// nothing recognized
+		return 0, false
+	}
+	for end < len(s) && isSpace(s[end]) {
+		end++
+	}
+	return n, end == len(s)
+}
+
+// Converts a number to its string representation, as Lua does.
+func NumberToString(n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	case math.IsNaN(n):
+		if math.Signbit(n) {
+			return "-nan"
+		}
+		return "nan"
+	}
+	return fmt.Sprintf(_NUMBER_FMT, n)
+}
+
+// Returns the printable description of a chunk's source name, as used in
+// error messages: "=stdin" is printed as "stdin", "@file.lua" as "file.lua"
+// and other sources as [string "source"].
+func ChunkID(source string) string {
+	const (
+		rets = "..."
+		pre  = "[string \""
+		pos  = "\"]"
+	)
+	bufflen := LUA_IDSIZE
+
+	if strings.HasPrefix(source, "=") {
+		// 'literal' source
+		if len(source) <= bufflen {
+			return source[1:]
+		}
+		return source[1:bufflen]
+	} else if strings.HasPrefix(source, "@") {
+		// file name
+		if len(source) <= bufflen {
+			return source[1:]
+		}
+		// add '...' before rest of name
+		bufflen -= len(rets)
+		return rets + source[len(source)-bufflen+1:]
+	}
+	// string; format as [string "source"]
+	nl := strings.IndexByte(source, '\n')
+	bufflen -= len(pre) + len(rets) + len(pos) + 1
+	if len(source) < bufflen && nl < 0 {
+		return pre + source + pos
+	}
+	l := len(source)
+	if nl >= 0 {
+		l = nl
+	}
+	if l > bufflen {
+		l = bufflen
+	}
+	return pre + source[:l] + rets + pos
+}
@@ -2,6 +2,7 @@ package types
 
 import (
 	"fmt"
+	"weak"
 )
 
 // Holds pointers to values (pointer to empty interface - yes, I know, but it is 
@@ -9,46 +10,92 @@ import (
 // http://play.golang.org/p/e2Ptu8puSZ
 
 const (
-	_INITIAL_STACK_CAP  = 10
-	_INITIAL_UPVALS_CAP = 5
+	_INITIAL_STACK_CAP = 10
 )
 
+// State shared by the main thread and all the threads created from it, see
+// global_State in Lua.
+type GlobalState struct {
+	Globals    *Table
+	Registry   *Table           // Table reserved to Go code, see LUNE_REGISTRYINDEX
+	MetaTables [NUMTYPES]*Table // Metatables shared by all values of a type (except tables and userdata)
+	MainThread *Thread
+	Finalizers FinalizerQueue        // Tables and userdata waiting for their __gc metamethod
+	Threads    []weak.Pointer[State] // Threads that may have a goroutine waiting to be resumed
+}
+
 type State struct {
-	Stack       []Value
-	Top         int // index of the first free slot in the stack
-	Globals     Table
-	CI          *CallInfo
-	OpenUpVals  []int    // TODO : index into the stack or struct?
-	OpCodeDebug []OpCode // TODO : Very temporary, find a better solution for testing... hooks?
+	*GlobalState
+	Stack      []Value
+	Top        int // index of the first free slot in the stack
+	CI         *CallInfo
+	OpenUpVals *UpVal // List of open upvalues, highest stack index first
+	ErrFunc    Value  // Message handler of the running protected call, nil if none
+	NCcalls    int    // Number of nested execution loops
+
+	// Debug hooks, see SetHook
+	Hook          Hook
+	HookMask      byte
+	BaseHookCount int
+	HookCount     int  // Instructions left before the next count event
+	AllowHook     bool // False while a hook is running
+	OldPC         int  // Last traced instruction, to detect new lines
+
+	// Threads, see NewThread
+	Status    ThreadStatus
+	ResumeCh  chan []Value // Arguments of resume, received by the thread's goroutine. Nil for the main thread
+	YieldCh   chan []Value // Values yielded or returned by the thread, sent to the resumer
+	ThreadErr error        // Error that killed the thread
+	Stop      func()       // Closes ResumeCh to stop the thread's goroutine, at most once
+	thread    weak.Pointer[Thread]
 }
 
+// Creates a state with its main function entryPoint at position 0 in the
+// stack, ready to run with vm.Execute. If entryPoint is nil, the stack is
+// empty and chunks are loaded with Load.
 func NewState(entryPoint *Prototype) *State {
 	s := &State{
-		Stack:      make([]Value, _INITIAL_STACK_CAP),
-		Globals:    NewTable(),
-		OpenUpVals: make([]int, _INITIAL_UPVALS_CAP),
+		GlobalState: &GlobalState{Globals: NewTable(0, 0)},
+		Stack:       make([]Value, _INITIAL_STACK_CAP),
+		AllowHook:   true,
+		Status:      THREAD_RUNNING,
 	}
-
-	cl := NewClosure(entryPoint)
-	if l := len(entryPoint.Upvalues); l == 1 {
-		// 1 upvalue = globals table as upvalue
-		v := Value(s.Globals)
-		cl.UpVals[0] = v
-	} else if l > 1 {
-		panic(fmt.Sprintf("too many upvalues expected for entry point: %d", l))
+	s.MainThread = &Thread{S: s}
+	s.thread = weak.Make(s.MainThread)
+	s.Registry = NewTable(LUNE_RIDX_GLOBALS, 0)
+	s.Registry.Set(float64(LUNE_RIDX_MAINTHREAD), s.MainThread)
+	s.Registry.Set(float64(LUNE_RIDX_GLOBALS), s.Globals)
+	if entryPoint == nil {
+		return s
 	}
 
 	// Push the closure on the stack
-	s.CheckStack(cl.P.Meta.MaxStackSize + 1) // +1 for the closure itself
+	cl := s.Load(entryPoint)
+	s.CheckStack(int(cl.P.Meta.MaxStackSize) + 1) // +1 for the closure itself
 	s.Stack[s.Top] = cl
 	s.Top++
 	return s
 }
 
-func (s *State) CheckStack(needed byte) {
+// Returns a closure of the main function p of a chunk. Its upvalues are nil,
+// except if it has a single one, which is then the globals table (_ENV). See
+// lua_load.
+func (s *State) Load(p *Prototype) *Closure {
+	cl := NewClosure(p)
+	for i := range cl.UpVals {
+		cl.UpVals[i] = NewClosedUpVal(nil)
+	}
+	if len(cl.UpVals) == 1 {
+		cl.UpVals[0] = NewClosedUpVal(s.Globals)
+	}
+	return cl
+}
+
+// Makes sure that the stack has at least needed free slots above Top.
+func (s *State) CheckStack(needed int) {
 	oriAdr := &s.Stack[0]
 
-	missing := (s.Top + int(needed)) - cap(s.Stack)
+	missing := (s.Top + needed) - len(s.Stack)
 	for i := 0; i < missing; i++ {
 		s.Stack = append(s.Stack, nil)
 	}
@@ -58,53 +105,35 @@ func (s *State) CheckStack(needed byte) {
 		for ci := s.CI; ci != nil; ci = ci.Prev {
 			ci.captureFrame(s)
 		}
-	}
-}
-
-// TODO : Very very temporary...
-func (s *State) Dump() {
-	fmt.Print(">>")
-	for i, v := range s.Stack {
-		if i == s.Top {
-			fmt.Print("\u01AE")
-		}
-		if i == s.CI.FuncIndex {
-			fmt.Print("\u0192")
-		}
-		if i == s.CI.Base {
-			fmt.Print("\u0251")
-		}
-		fmt.Printf("%v, ", v)
-	}
-	for j := len(s.Stack); j <= s.Top; j++ {
-		if j == s.Top {
-			fmt.Print("\u01AE")
-		}
-		if j == s.CI.FuncIndex {
-			fmt.Print("\u0192")
-		}
-		if j == s.CI.Base {
-			fmt.Print("\u0251")
+		// Same thing for open upvalues, they point into the stack
+		for uv := s.OpenUpVals; uv != nil; uv = uv.Next {
+			uv.V = &s.Stack[uv.Idx]
 		}
-		fmt.Println(", ", j)
 	}
-	fmt.Print("<<\n")
 }
 
+// Bits in CallInfo.CallStatus, same values as Lua's (see lstate.h)
+const (
+	CIST_REENTRY byte = 1 << 2 // Call is running on the same Execute loop as its caller
+	CIST_TAIL    byte = 1 << 6 // Call was tail called
+)
+
 type CallInfo struct {
 	Frame      []Value
-	Cl         *Closure
+	Cl         *Closure // Nil for a Go function
 	FuncIndex  int
 	NumResults int
 	CallStatus byte
 	PC         int
 	Base       int
+	Top        int // Index of the first slot above the frame
 	Prev       *CallInfo
 }
 
 func (s *State) NewCallInfo(cl *Closure, idx int, nRets int) {
-	// Make sure the stack has enough slots
-	s.CheckStack(cl.P.Meta.MaxStackSize)
+	// Make sure the stack has enough slots, the fixed parameters of a vararg
+	// function are copied above the arguments
+	s.CheckStack(int(cl.P.Meta.MaxStackSize) + int(cl.P.Meta.NumParams))
 
 	// Complete the arguments
 	n := s.Top - idx - 1
@@ -137,15 +166,63 @@ func (s *State) NewCallInfo(cl *Closure, idx int, nRets int) {
 	ci.PC = 0
 	ci.Base = base
 	ci.Prev = s.CI
-	s.Top = base + int(cl.P.Meta.MaxStackSize)
+	ci.Top = base + int(cl.P.Meta.MaxStackSize)
+	s.Top = ci.Top
 	ci.captureFrame(s)
 
 	s.CI = ci
 }
 
+// Creates the CallInfo for a call to the Go function at idx in the stack. Its
+// arguments are above it, up to the top of the stack.
+func (s *State) NewGoCallInfo(idx int, nRets int) {
+	s.CheckStack(LUNE_MINSTACK)
+	s.CI = &CallInfo{
+		FuncIndex:  idx,
+		NumResults: nRets,
+		Base:       idx + 1,
+		Top:        s.Top + LUNE_MINSTACK,
+		Prev:       s.CI,
+	}
+}
+
+// Returns true if the CallInfo is for a Lune function, false for a Go function.
+func (ci *CallInfo) IsLua() bool {
+	return ci.Cl != nil
+}
+
+// Moves the frame of the function just called (the current CallInfo) in place
+// of the frame of its caller, for a tail call. The caller's CallInfo is reused
+// for the called function, so that the stack and the CallInfo chain don't grow.
+func (s *State) TailCallInfo() {
+	nci := s.CI     // Called frame
+	oci := nci.Prev // Caller frame
+	nFunc, oFunc := nci.FuncIndex, oci.FuncIndex
+	// Last stack slot filled by NewCallInfo
+	lim := nci.Base + int(nci.Cl.P.Meta.NumParams)
+
+	// Move the called function and its arguments down to the caller's slot
+	for aux := 0; nFunc+aux < lim; aux++ {
+		s.Stack[oFunc+aux] = s.Stack[nFunc+aux]
+	}
+	oci.Cl = nci.Cl
+	oci.Base = oFunc + (nci.Base - nFunc)
+	oci.PC = nci.PC
+	oci.CallStatus |= CIST_TAIL
+	s.Top = oFunc + (s.Top - nFunc)
+	oci.Top = s.Top
+	oci.captureFrame(s)
+
+	s.CI = oci
+}
+
 // Because checkStack() can reallocate a new array for the stack, the frame
 // may become invalid. This gets called when required to make sure that the
 // frame slice always points to the stack array.
 func (ci *CallInfo) captureFrame(s *State) {
+	if ci.Cl == nil {
+		// Go functions have no frame
+		return
+	}
 	ci.Frame = s.Stack[ci.Base:(ci.Base + int(ci.Cl.P.Meta.MaxStackSize))]
 }
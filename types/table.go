@@ -0,0 +1,305 @@
+package types
+
+import (
+	"math"
+)
+
+/*
+  Mostly a port of ltable.{c,h} from Lua
+
+  Tables keep their elements in two parts: an array part for the integer keys
+  from 1 to n, and a hash part for all other keys. Unlike Lua, the array part
+  is not resized by counting the integer keys on rehash, it grows when keys
+  are appended right after its end (or when explicitly resized, e.g. by
+  OP_NEWTABLE and OP_SETLIST). Numbers with an integral value are normalized,
+  so that the int 1 and the float64 1.0 are the same key. The other keys are
+  the Go map keys of the hash part, the reference values (tables, functions,
+  userdata and threads) are all pointers, compared by identity.
+
+  The hash part keeps its nodes in insertion order, so that it can be
+  traversed by Next. A key set to nil keeps its node until a new key is
+  added, so that fields can be cleared during a traversal, as in Lua.
+*/
+
+type Table struct {
+	Meta     *Table // The metatable, nil if there is none
+	arr      []Value
+	hash     map[Value]int // Index of the keys in nodes
+	nodes    []node        // Hash part, in insertion order
+	dead     int           // Number of nodes with a nil value
+	finalize bool          // Marked for finalization, see SetMetaTable
+}
+
+type node struct {
+	key, val Value
+}
+
+// Limit for the sizes allocated up front by NewTable and ResizeArray. They
+// are only hints, and may come from an untrusted chunk (OP_NEWTABLE and
+// OP_SETLIST), so a table still grows past it as keys are added.
+const maxSizeHint = 1 << 20
+
+// Creates a new table with room for nArr elements in the array part and
+// nHash elements in the hash part, up to maxSizeHint.
+func NewTable(nArr, nHash int) *Table {
+	t := &Table{}
+	nArr, nHash = min(nArr, maxSizeHint), min(nHash, maxSizeHint)
+	if nArr > 0 {
+		t.arr = make([]Value, nArr)
+	}
+	if nHash > 0 {
+		t.hash = make(map[Value]int, nHash)
+		t.nodes = make([]node, 0, nHash)
+	}
+	return t
+}
+
+// Returns the integer value of the key k, if it is a number with an
+// integral value.
+func arrayIndex(k Value) (int, bool) {
+	switch n := k.(type) {
+	case float64:
+		if i := int(n); float64(i) == n {
+			return i, true
+		}
+	case int:
+		return n, true
+	}
+	return 0, false
+}
+
+// Gets the value at key k, without invoking metamethods.
+func (t *Table) Get(k Value) Value {
+	if i, ok := arrayIndex(k); ok {
+		if i >= 1 && i <= len(t.arr) {
+			return t.arr[i-1]
+		}
+		k = float64(i)
+	}
+	return t.hashGet(k)
+}
+
+// Sets the value v at key k, without invoking metamethods. Setting a nil
+// value removes the key.
+func (t *Table) Set(k Value, v Value) {
+	if i, ok := arrayIndex(k); ok {
+		if i >= 1 && i <= len(t.arr) {
+			t.arr[i-1] = v
+			return
+		}
+		if i == len(t.arr)+1 && v != nil {
+			// Append to the array part
+			t.arr = append(t.arr, v)
+			t.migrate()
+			return
+		}
+		k = float64(i)
+	}
+	t.hashSet(k, v)
+}
+
+func (t *Table) hashGet(k Value) Value {
+	if i, ok := t.hash[k]; ok {
+		return t.nodes[i].val
+	}
+	return nil
+}
+
+func (t *Table) hashSet(k Value, v Value) {
+	if i, ok := t.hash[k]; ok {
+		switch old := t.nodes[i].val; {
+		case old == nil && v != nil:
+			t.dead--
+		case old != nil && v == nil:
+			t.dead++
+		}
+		t.nodes[i].val = v
+		return
+	}
+	if v == nil {
+		return
+	}
+	if t.hash == nil {
+		t.hash = make(map[Value]int)
+	}
+	if t.dead > len(t.nodes)/2 {
+		t.compact()
+	}
+	t.hash[k] = len(t.nodes)
+	t.nodes = append(t.nodes, node{k, v})
+}
+
+// Removes the key k from the hash part, and returns its value.
+func (t *Table) hashRemove(k Value) (Value, bool) {
+	i, ok := t.hash[k]
+	if !ok {
+		return nil, false
+	}
+	v := t.nodes[i].val
+	if v != nil {
+		t.dead++
+	}
+	delete(t.hash, k)
+	t.nodes[i] = node{}
+	return v, v != nil
+}
+
+// Returns the number of keys in the hash part.
+func (t *Table) hashLen() int {
+	return len(t.nodes) - t.dead
+}
+
+// Removes the nodes with a nil value from the hash part.
+func (t *Table) compact() {
+	j := 0
+	for _, n := range t.nodes {
+		if n.val != nil {
+			t.nodes[j] = n
+			t.hash[n.key] = j
+			j++
+		} else if n.key != nil {
+			delete(t.hash, n.key)
+		}
+	}
+	for i := j; i < len(t.nodes); i++ {
+		t.nodes[i] = node{}
+	}
+	t.nodes = t.nodes[:j]
+	t.dead = 0
+}
+
+// Grows the array part so that it holds at least the keys from 1 to n, or
+// to maxSizeHint.
+func (t *Table) ResizeArray(n int) {
+	if n = min(n, maxSizeHint); n <= len(t.arr) {
+		return
+	}
+	old := len(t.arr)
+	if n <= cap(t.arr) {
+		t.arr = t.arr[:n]
+	} else {
+		arr := make([]Value, n)
+		copy(arr, t.arr)
+		t.arr = arr
+	}
+	// Move the keys now in the array range out of the hash part
+	for i := old + 1; i <= n && t.hashLen() > 0; i++ {
+		if v, ok := t.hashRemove(float64(i)); ok {
+			t.arr[i-1] = v
+		}
+	}
+	t.migrate()
+}
+
+// Moves the keys following the array part from the hash part to the array
+// part, as long as there is no gap.
+func (t *Table) migrate() {
+	for len(t.hash) > 0 {
+		k := float64(len(t.arr) + 1)
+		v, ok := t.hashRemove(k)
+		if !ok {
+			return
+		}
+		t.arr = append(t.arr, v)
+	}
+}
+
+// Returns a border of the table, that is any integer n such that t[n] is not
+// nil and t[n+1] is nil (or 0 if t[1] is nil). See luaH_getn in ltable.c.
+func (t *Table) Len() int {
+	j := len(t.arr)
+	if j > 0 && t.arr[j-1] == nil {
+		// There is a border in the array part, binary search for it
+		i := 0
+		for j-i > 1 {
+			m := (i + j) / 2
+			if t.arr[m-1] == nil {
+				j = m
+			} else {
+				i = m
+			}
+		}
+		return i
+	}
+	if t.hashLen() == 0 {
+		return j
+	}
+	return t.unboundSearch(j)
+}
+
+func (t *Table) unboundSearch(j int) int {
+	i := j // i is zero or a present index
+	j++
+	// Find 'i' and 'j' such that i is present and j is not
+	for t.Get(j) != nil {
+		i = j
+		if j > math.MaxInt32/2 {
+			// Overflow? Resort to a linear search
+			i = 1
+			for t.Get(i) != nil {
+				i++
+			}
+			return i - 1
+		}
+		j *= 2
+	}
+	// Now do a binary search between them
+	for j-i > 1 {
+		m := (i + j) / 2
+		if t.Get(m) == nil {
+			j = m
+		} else {
+			i = m
+		}
+	}
+	return i
+}
+
+// Calls f for each key-value pair in the table, the array part first, in
+// order, then the hash part in insertion order.
+func (t *Table) ForEach(f func(k, v Value)) {
+	for i, v := range t.arr {
+		if v != nil {
+			f(float64(i+1), v)
+		}
+	}
+	for _, n := range t.nodes {
+		if n.val != nil {
+			f(n.key, n.val)
+		}
+	}
+}
+
+// Returns the key-value pair that follows the key k in a traversal of the
+// table, the first one if k is nil, with the same order as ForEach. At the end
+// of the traversal, the returned key is nil. Returns false if k is not a key
+// of the table. See luaH_next in ltable.c.
+func (t *Table) Next(k Value) (Value, Value, bool) {
+	i := 0 // Position of the next key, in the array part then in the hash part
+	if k != nil {
+		n, isInt := arrayIndex(k)
+		if isInt && n >= 1 && n <= len(t.arr) {
+			i = n
+		} else {
+			if isInt {
+				k = float64(n)
+			}
+			p, ok := t.hash[k]
+			if !ok {
+				return nil, nil, false
+			}
+			i = len(t.arr) + p + 1
+		}
+	}
+	for ; i < len(t.arr); i++ {
+		if v := t.arr[i]; v != nil {
+			return float64(i + 1), v, true
+		}
+	}
+	for p := i - len(t.arr); p < len(t.nodes); p++ {
+		if n := t.nodes[p]; n.val != nil {
+			return n.key, n.val, true
+		}
+	}
+	return nil, nil, true
+}
@@ -0,0 +1,54 @@
+package types
+
+import (
+	"weak"
+)
+
+// Status of a thread, as reported by coroutine.status.
+type ThreadStatus byte
+
+const (
+	THREAD_SUSPENDED ThreadStatus = iota // Not started or yielded, can be resumed
+	THREAD_RUNNING
+	THREAD_NORMAL // Active, but waiting for a thread it resumed
+	THREAD_DEAD   // Returned or stopped by an error
+)
+
+var threadStatusNames = [...]string{
+	"suspended", "running", "normal", "dead",
+}
+
+func (st ThreadStatus) String() string {
+	return threadStatusNames[st]
+}
+
+// Thread (coroutine) value. Its State has its own stack and CallInfo chain,
+// and shares the globals and metatables of the State that created it.
+type Thread struct {
+	S *State
+}
+
+// Creates a thread that shares the global state and the hooks of s. See
+// lua_newthread. The vm package's NewThread creates a thread ready to be
+// resumed.
+func (s *State) NewThread() *Thread {
+	ns := &State{
+		GlobalState:   s.GlobalState,
+		Stack:         make([]Value, _INITIAL_STACK_CAP),
+		AllowHook:     true,
+		Hook:          s.Hook,
+		HookMask:      s.HookMask,
+		BaseHookCount: s.BaseHookCount,
+		HookCount:     s.BaseHookCount,
+		Status:        THREAD_SUSPENDED,
+	}
+	t := &Thread{S: ns}
+	// Weak, so that the thread can be collected while its goroutine is blocked
+	ns.thread = weak.Make(t)
+	return t
+}
+
+// Returns the thread value of s. See lua_pushthread.
+func (s *State) Thread() *Thread {
+	return s.thread.Value()
+}
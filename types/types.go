@@ -10,17 +10,74 @@ const (
 	// Value types constants, must match with Lua's, see lua.h grep "basic types"
 	TNIL ValType = iota
 	TBOOL
-	_ // TLIGHTUSERDATA, not implemented yet
+	TLIGHTUSERDATA
 	TNUMBER
 	TSTRING
 	TTABLE
 	TFUNCTION
-	_ // TUSERDATA, not implemented yet
-	_ // TTHREAD, not implemented yet
+	TUSERDATA
+	TTHREAD
+
+	NUMTYPES // Number of value types
+
+	TNONE ValType = 0xFF // Type of an acceptable index without a value, see LUA_TNONE
 )
 
-// Go function type
-type GoFunc func([]Value) []Value
+var typeNames = [...]string{
+	"nil", "boolean", "userdata", "number", "string", "table", "function", "userdata", "thread",
+}
+
+// Returns the type name as reported by Lua's type().
+func (t ValType) String() string {
+	if t == TNONE {
+		return "no value"
+	}
+	return typeNames[t]
+}
+
+// Returns the type of the value v.
+func TypeOf(v Value) ValType {
+	switch v.(type) {
+	case nil:
+		return TNIL
+	case bool:
+		return TBOOL
+	case float64:
+		return TNUMBER
+	case string:
+		return TSTRING
+	case *Table:
+		return TTABLE
+	case *Closure, *GoClosure:
+		return TFUNCTION
+	case *Userdata:
+		return TUSERDATA
+	case LightUserdata:
+		return TLIGHTUSERDATA
+	case *Thread:
+		return TTHREAD
+	}
+	panic(fmt.Sprintf("unexpected value type: %T", v))
+}
+
+// Go function type. It receives the calling State and the arguments, and
+// returns its results. Errors are raised with the vm package's Error. Go
+// functions are Lua values as Go closures, see NewGoClosure.
+type GoFunc func(s *State, args []Value) []Value
+
+// Go function value, with its upvalues if any, see lua_pushcclosure. The
+// function accesses its upvalues with the upvalue pseudo-indices of the api
+// package.
+type GoClosure struct {
+	F      GoFunc
+	UpVals []Value
+}
+
+// Creates a Go closure of the function f, with the given upvalues. Each Go
+// closure is a distinct function value, compared by identity.
+func NewGoClosure(f GoFunc, upvals ...Value) *GoClosure {
+	return &GoClosure{F: f, UpVals: upvals}
+}
 
 /*
   Values are represented this way:
@@ -28,8 +85,8 @@ type GoFunc func([]Value) []Value
   bool:     value is bool
   number:   value is float64 (TODO: or float32 based on GOARCH?)
   string:   value is string
-  function: value is *Closure (lune) or GoFunc (Go)
-  table:    value is Table
+  function: value is *Closure (lune) or *GoClosure (Go)
+  table:    value is *Table
   thread:   ..
   userdata: ..
 */
@@ -37,36 +94,41 @@ type Value interface{}
 
 type Closure struct {
 	P      *Prototype
-	UpVals []Value
+	UpVals []*UpVal
 }
 
 func NewClosure(p *Prototype) *Closure {
-	return &Closure{p, make([]Value, len(p.Upvalues))}
+	return &Closure{p, make([]*UpVal, len(p.Upvalues))}
 }
 
 func (cl *Closure) String() string {
 	return cl.P.String()
 }
 
-// Naive implementation for now: always a map, no array optimization
-type Table map[Value]Value
-
-func NewTable() Table {
-	return make(Table)
-}
-
-func (t Table) Set(k Value, v Value) {
-	t[k] = v
+// An upvalue as seen by closures. While the variable is still alive in its
+// declaring frame, the upvalue is open and V points to the stack slot. Once
+// the frame is left, the upvalue is closed and V points to its own Value.
+// All closures capturing the same variable share the same *UpVal.
+type UpVal struct {
+	V     *Value
+	Value Value
+	Idx   int    // Index in the stack while open
+	Next  *UpVal // Next open upvalue, ordered by decreasing stack index
 }
 
-func (t Table) Get(k Value) Value {
-	return t[k]
+// Creates an already closed upvalue holding v.
+func NewClosedUpVal(v Value) *UpVal {
+	uv := &UpVal{Value: v, Idx: -1}
+	uv.V = &uv.Value
+	return uv
 }
 
-func (t Table) Len() int {
-	// TODO : This is not how the # (length operator) works in Lua, see
-	// http://www.lua.org/manual/5.2/manual.html#3.4.6
-	return len(t)
+// Migrates the value off the stack, into the upvalue itself.
+func (uv *UpVal) Close() {
+	uv.Value = *uv.V
+	uv.V = &uv.Value
+	uv.Idx = -1
+	uv.Next = nil
 }
 
 type Prototype struct {
@@ -0,0 +1,22 @@
+package types
+
+// Userdata value, wrapping an arbitrary Go value. Unlike the other values that
+// are not tables, each userdata has its own metatable. See Udata in Lua.
+type Userdata struct {
+	Value     interface{}
+	Meta      *Table // The metatable, nil if there is none
+	UserValue *Table // See lua_setuservalue, nil if there is none
+	finalize  bool   // Marked for finalization, see SetMetaTable
+}
+
+// Creates a userdata wrapping the Go value v, without metatable.
+func NewUserdata(v interface{}) *Userdata {
+	return &Userdata{Value: v}
+}
+
+// Light userdata value, a Go value without metatable of its own, compared by
+// value. The wrapped value must be comparable, typically a pointer. See
+// lua_pushlightuserdata.
+type LightUserdata struct {
+	Value interface{}
+}
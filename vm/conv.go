@@ -2,10 +2,6 @@ package vm
 
 import (
 	"bytes"
-	"fmt"
-	"math"
-	"strconv"
-	"strings"
 
 	"github.com/mna/lune/types"
 )
@@ -29,131 +25,150 @@ func isFalse(v types.Value) bool {
 	return false
 }
 
-func computeBinaryOp(op byte, b, c float64) float64 {
-	switch op {
-	case '+':
-		return b + c
-	case '-':
-		return b - c
-	case '*':
-		return b * c
-	case '/':
-		return b / c
-	case '%':
-		return math.Mod(b, c)
-	case '^':
-		return math.Pow(b, c)
-	}
-	panic("unreachable")
-}
-
-func coerceAndComputeUnaryOp(op byte, b types.Value) types.Value {
-	bf, bok := coerceToNumber(b)
-	if bok {
-		switch op {
-		case '-':
-			return -bf
-		}
-	} else {
-		// TODO : Metamethods
-		panic("metamethods not implemented")
-	}
-	return nil
-}
-
-func coerceAndComputeBinaryOp(op byte, b, c types.Value) types.Value {
+// Computes the arithmetic operation op, or calls the corresponding metamethod
+// if the operands are not numbers. For the unary minus, c is the same as b, as
+// in Lua (see luaV_arith in lvm.c).
+func coerceAndComputeBinaryOp(s *types.State, op types.OpCode, b, c types.Value) types.Value {
 	bf, bok := coerceToNumber(b)
 	cf, cok := coerceToNumber(c)
 	if bok && cok {
 		// Both are numbers (or could be coerced to numbers)
-		return computeBinaryOp(op, bf, cf)
-	} else {
-		// TODO : Metamethods
-		panic("metamethods not implemented")
+		return types.Arith(op, bf, cf)
+	}
+	if res, ok := callBinTM(s, b, c, _ARITH_TMS[op]); ok {
+		return res
 	}
+	// Report the operand that is not a number
+	if bok {
+		b = c
+	}
+	typeError(s, b, "perform arithmetic on")
 	return nil
 }
 
+// Converts a number or a string to a number, following the Lua lexical
+// conventions for numerals. See luaV_tonumber in lvm.c.
 func coerceToNumber(v types.Value) (float64, bool) {
 	switch bv := v.(type) {
 	case float64:
 		return bv, true
 	case string:
-		// Remove whitespace
-		bv = strings.Trim(bv, " ")
-		// First try to parse as an int
-		if vi, err := strconv.ParseInt(bv, 0, 64); err == nil { // TODO : Int64 fits in float64?
-			return float64(vi), true
-		} else if vf, err := strconv.ParseFloat(bv, 64); err == nil { // TODO : Float64 for floats?
-			return vf, true
-		} else {
-			return 0, false
-		}
-	default:
-		return 0, false
+		return types.StrToNumber(bv)
 	}
-	panic("unreachable")
+	return 0, false
 }
 
+// Converts a string or a number to a string, numbers are formatted like
+// tostring does. See luaV_tostring in lvm.c.
 func coerceToString(v types.Value) (string, bool) {
 	switch bv := v.(type) {
 	case string:
 		return bv, true
 	case float64:
-		// First try as an int
-		vi := int64(bv)
-		if float64(vi) == bv {
-			return fmt.Sprintf("%d", vi), true
-		} else {
-			return fmt.Sprintf("%g", bv), true
-		}
-	default:
-		return "", false
+		return types.NumberToString(bv), true
 	}
-	panic("unreachable")
+	return "", false
 }
 
-func coerceAndConcatenate(src []types.Value) types.Value {
-	var buf bytes.Buffer
-
-	// Stop at i < len - 1 because the loop
-	// uses i and i+1
-	for i := 0; i < len(src); i++ {
-		s, ok := coerceToString(src[i])
-		if ok {
-			buf.WriteString(s)
-		} else {
-			// TODO : Metamethods
-			panic("metamethods not implemented")
+// Concatenates the values, from right to left, calling the __concat
+// metamethod when two consecutive values can't be coerced to strings. See
+// luaV_concat in lvm.c.
+func coerceAndConcatenate(s *types.State, src []types.Value) types.Value {
+	// Work on a copy, metamethods may change the stack
+	vals := append([]types.Value(nil), src...)
+
+	for n := len(vals); n > 1; n = len(vals) {
+		_, ok1 := coerceToString(vals[n-2])
+		_, ok2 := coerceToString(vals[n-1])
+		if !ok1 || !ok2 {
+			res, ok := callBinTM(s, vals[n-2], vals[n-1], TM_CONCAT)
+			if !ok {
+				culprit := vals[n-2]
+				if ok1 {
+					culprit = vals[n-1]
+				}
+				typeError(s, culprit, "concatenate")
+			}
+			vals = append(vals[:n-2], res)
+			continue
+		}
+
+		// At least two string values, get as many as possible
+		i := n - 2
+		for i > 0 {
+			if _, ok := coerceToString(vals[i-1]); !ok {
+				break
+			}
+			i--
 		}
+		var buf bytes.Buffer
+		for _, v := range vals[i:] {
+			str, _ := coerceToString(v)
+			buf.WriteString(str)
+		}
+		vals = append(vals[:i], buf.String())
 	}
-	return buf.String()
+	return vals[0]
 }
 
-func computeLength(v types.Value) float64 {
+// Returns the length of v, calling the __len metamethod if required. See
+// luaV_objlen in lvm.c.
+func Len(s *types.State, v types.Value) types.Value {
+	var tm types.Value
+
 	switch bv := v.(type) {
-	case types.Table:
-		return float64(bv.Len())
+	case *types.Table:
+		if tm = getTM(bv.Meta, TM_LEN); tm == nil {
+			return float64(bv.Len())
+		}
 	case string:
 		return float64(len(bv))
 	default:
-		// TODO : Metamethod
-		panic("metamethods not implemented")
+		if tm = getTMByObj(s, v, TM_LEN); tm == nil {
+			typeError(s, v, "get length of")
+		}
 	}
-	panic("unreachable")
+	return callTM(s, tm, v, v, nil, true)
 }
 
-func areEqual(v1, v2 types.Value) bool {
+// Compares v1 and v2 without calling metamethods.
+func RawEqual(v1, v2 types.Value) bool {
 	if t, ok := areSameType(v1, v2); !ok {
 		return false
 	} else if t == types.TNIL {
 		return true
 	}
-	// TODO : Metamethods? No?
 	return v1 == v2
 }
 
-func isLessEqual(l, r types.Value) bool {
+// Compares v1 and v2, calling the __eq metamethod for two different tables
+// or userdata. See luaV_equalobj in lvm.c.
+func areEqual(s *types.State, v1, v2 types.Value) bool {
+	var mt1, mt2 *types.Table
+	switch o1 := v1.(type) {
+	case *types.Table:
+		o2, ok := v2.(*types.Table)
+		if !ok || o1 == o2 {
+			return RawEqual(v1, v2)
+		}
+		mt1, mt2 = o1.Meta, o2.Meta
+	case *types.Userdata:
+		o2, ok := v2.(*types.Userdata)
+		if !ok || o1 == o2 {
+			return RawEqual(v1, v2)
+		}
+		mt1, mt2 = o1.Meta, o2.Meta
+	default:
+		return RawEqual(v1, v2)
+	}
+	tm := getEqualTM(mt1, mt2)
+	if tm == nil {
+		return false
+	}
+	return !isFalse(callTM(s, tm, v1, v2, nil, true))
+}
+
+func isLessEqual(s *types.State, l, r types.Value) bool {
 	if t, ok := areSameType(l, r); ok {
 		switch t {
 		case types.TNUMBER:
@@ -164,12 +179,21 @@ func isLessEqual(l, r types.Value) bool {
 			return ls <= rs
 		}
 	}
-	// Not same type or not two numbers/strings
-	// TODO : Metamethods, subtlety compared to LessThan, see lvm.c#luaV_lessequal
+	// Not same type or not two numbers/strings, try __le first
+	if res, ok := callOrderTM(s, l, r, TM_LE); ok {
+		return res
+	}
+	// Else try 'not (r < l)'
+	if res, ok := callOrderTM(s, r, l, TM_LT); ok {
+		return !res
+	}
+	orderError(s, l, r)
 	return false
 }
 
-func isLessThan(l, r types.Value) bool {
+// Reports whether l < r, calling the __lt metamethod if required. See
+// luaV_lessthan in lvm.c.
+func LessThan(s *types.State, l, r types.Value) bool {
 	if t, ok := areSameType(l, r); ok {
 		switch t {
 		case types.TNUMBER:
@@ -181,29 +205,22 @@ func isLessThan(l, r types.Value) bool {
 		}
 	}
 	// Not same type or not two numbers/strings
-	// TODO : Metamethods
+	if res, ok := callOrderTM(s, l, r, TM_LT); ok {
+		return res
+	}
+	orderError(s, l, r)
 	return false
 }
 
-func areSameType(v1, v2 types.Value) (types.ValType, bool) {
-	var valTypes [2]types.ValType
-	var vals = [2]types.Value{v1, v2}
-
-	for i := 0; i < 2; i++ {
-		switch vals[i].(type) {
-		case nil:
-			valTypes[i] = types.TNIL
-		case bool:
-			valTypes[i] = types.TBOOL
-		case float64:
-			valTypes[i] = types.TNUMBER
-		case string:
-			valTypes[i] = types.TSTRING
-		case *types.Closure:
-			valTypes[i] = types.TFUNCTION
-		case *types.Table:
-			valTypes[i] = types.TTABLE
-		}
+func orderError(s *types.State, l, r types.Value) {
+	t1, t2 := types.TypeOf(l), types.TypeOf(r)
+	if t1 == t2 {
+		runError(s, "attempt to compare two %s values", t1)
 	}
-	return valTypes[0], valTypes[0] == valTypes[1]
+	runError(s, "attempt to compare %s with %s", t1, t2)
+}
+
+func areSameType(v1, v2 types.Value) (types.ValType, bool) {
+	t1, t2 := types.TypeOf(v1), types.TypeOf(v2)
+	return t1, t1 == t2
 }
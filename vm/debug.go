@@ -0,0 +1,256 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/mna/lune/types"
+)
+
+/*
+  Mostly a port of the function naming and traceback parts of ldebug.c and
+  lauxlib.c from Lua
+*/
+
+const (
+	_LEVELS1 = 12 // Size of the first part of a long traceback
+	_LEVELS2 = 10 // Size of the last part of a long traceback
+)
+
+// Returns the name of the n-th (starting at 1) local variable active at pc,
+// or an empty string if there is none. See luaF_getlocalname in lfunc.c.
+func getLocalName(p *types.Prototype, n, pc int) string {
+	for _, lv := range p.LocVars {
+		if int(lv.Startpc) > pc {
+			break
+		}
+		if pc < int(lv.Endpc) {
+			// Variable is active
+			if n--; n == 0 {
+				return lv.Name
+			}
+		}
+	}
+	return ""
+}
+
+func upvalName(p *types.Prototype, uv int) string {
+	if uv < len(p.Upvalues) && p.Upvalues[uv].Name != "" {
+		return p.Upvalues[uv].Name
+	}
+	return "?"
+}
+
+// Returns the index of the last instruction before lastPC that changed the
+// register reg, or -1 if it can't be known because of a jump.
+func findSetReg(p *types.Prototype, lastPC, reg int) int {
+	setReg := -1
+	jmpTarget := 0 // Any code before this address is conditional
+	filter := func(pc int) int {
+		if pc < jmpTarget {
+			return -1
+		}
+		return pc
+	}
+	for pc := 0; pc < lastPC; pc++ {
+		i := p.Code[pc]
+		op := i.GetOpCode()
+		a := i.GetArgA()
+		switch op {
+		case types.OP_LOADNIL:
+			if b, _ := i.GetArgB(false); a <= reg && reg <= a+b {
+				setReg = filter(pc)
+			}
+		case types.OP_TFORCALL:
+			// Affects all registers above its base
+			if reg >= a+2 {
+				setReg = filter(pc)
+			}
+		case types.OP_CALL, types.OP_TAILCALL:
+			// Affects all registers above the function
+			if reg >= a {
+				setReg = filter(pc)
+			}
+		case types.OP_JMP:
+			// Forward jumps that don't skip lastPC make the code up to the target conditional
+			if dest := pc + 1 + i.GetArgsBx(); pc < dest && dest <= lastPC && dest > jmpTarget {
+				jmpTarget = dest
+			}
+		case types.OP_TEST:
+			// The jumped code can change A
+			if reg == a {
+				setReg = filter(pc)
+			}
+		default:
+			if op.GetAMode() && reg == a {
+				setReg = filter(pc)
+			}
+		}
+	}
+	return setReg
+}
+
+// Returns the name of the constant or register c used as a key, "?" if it
+// has no reasonable name.
+func kName(p *types.Prototype, pc, c int) string {
+	if types.IsK(c) {
+		if s, ok := p.Ks[types.IndexK(c)].(string); ok {
+			return s
+		}
+	} else if what, name := getObjName(p, pc, c); what == "constant" {
+		return name
+	}
+	return "?"
+}
+
+// Returns the kind of name ("local", "global", "field", "upvalue", "constant"
+// or "method") and the name of the value in register reg at pc, found by
+// symbolic execution of the code. Returns empty strings if there is none.
+func getObjName(p *types.Prototype, lastPC, reg int) (what, name string) {
+	if name = getLocalName(p, reg+1, lastPC); name != "" {
+		return "local", name
+	}
+
+	pc := findSetReg(p, lastPC, reg)
+	if pc == -1 {
+		return "", ""
+	}
+	i := p.Code[pc]
+	switch op := i.GetOpCode(); op {
+	case types.OP_MOVE:
+		// Move from B to A
+		if b, _ := i.GetArgB(false); b < i.GetArgA() {
+			return getObjName(p, pc, b)
+		}
+	case types.OP_GETTABUP, types.OP_GETTABLE:
+		t, _ := i.GetArgB(false)
+		k, _ := i.GetArgC(false)
+		var vn string // Name of the indexed variable
+		if op == types.OP_GETTABLE {
+			vn = getLocalName(p, t+1, pc)
+		} else {
+			vn = upvalName(p, t)
+		}
+		if vn == "_ENV" {
+			return "global", kName(p, pc, k)
+		}
+		return "field", kName(p, pc, k)
+	case types.OP_GETUPVAL:
+		b, _ := i.GetArgB(false)
+		return "upvalue", upvalName(p, b)
+	case types.OP_LOADK, types.OP_LOADKx:
+		b, _ := i.GetArgBx(false)
+		if op == types.OP_LOADKx {
+			b = p.Code[pc+1].GetArgAx()
+		}
+		if s, ok := p.Ks[b].(string); ok {
+			return "constant", s
+		}
+	case types.OP_SELF:
+		k, _ := i.GetArgC(false)
+		return "method", kName(p, pc, k)
+	}
+	return "", ""
+}
+
+// Metamethod events of the instructions that can call a function only
+// through a metamethod.
+var opTMs = map[types.OpCode]tmEvent{
+	types.OP_SELF:     TM_INDEX,
+	types.OP_GETTABUP: TM_INDEX,
+	types.OP_GETTABLE: TM_INDEX,
+	types.OP_SETTABUP: TM_NEWINDEX,
+	types.OP_SETTABLE: TM_NEWINDEX,
+	types.OP_EQ:       TM_EQ,
+	types.OP_ADD:      TM_ADD,
+	types.OP_SUB:      TM_SUB,
+	types.OP_MUL:      TM_MUL,
+	types.OP_DIV:      TM_DIV,
+	types.OP_MOD:      TM_MOD,
+	types.OP_POW:      TM_POW,
+	types.OP_UNM:      TM_UNM,
+	types.OP_LEN:      TM_LEN,
+	types.OP_LT:       TM_LT,
+	types.OP_LE:       TM_LE,
+	types.OP_CONCAT:   TM_CONCAT,
+}
+
+// Returns the kind of name and the name of the function running in ci, as
+// found from the instruction that called it. Returns empty strings if it
+// can't be known, e.g. for tail calls or calls from Go functions. See
+// getfuncname in ldebug.c.
+func getFuncName(ci *types.CallInfo) (what, name string) {
+	prev := ci.Prev
+	if ci.CallStatus&types.CIST_TAIL != 0 || prev == nil || !prev.IsLua() {
+		return "", ""
+	}
+	p := prev.Cl.P
+	pc := prev.PC - 1 // Calling instruction
+	i := p.Code[pc]
+	switch op := i.GetOpCode(); op {
+	case types.OP_CALL, types.OP_TAILCALL:
+		return getObjName(p, pc, i.GetArgA())
+	case types.OP_TFORCALL:
+		return "for iterator", "for iterator"
+	default:
+		if tm, ok := opTMs[op]; ok {
+			return "metamethod", tm.String()
+		}
+	}
+	return "", ""
+}
+
+// Returns the description of the function running in ci for a traceback. See
+// pushfuncname in lauxlib.c.
+func funcDescription(ci *types.CallInfo) string {
+	if what, name := getFuncName(ci); what != "" {
+		return fmt.Sprintf("function '%s'", name)
+	}
+	if !ci.IsLua() {
+		return "?"
+	}
+	if p := ci.Cl.P; p.Meta.LineDefined != 0 {
+		return fmt.Sprintf("function <%s:%d>", chunkID(p), p.Meta.LineDefined)
+	}
+	return "main chunk"
+}
+
+// Returns a traceback of the call stack, starting at the given level, where
+// level 0 is the running function and level 1 the one that called it. If msg
+// is not empty, it is added before the traceback. Long tracebacks only keep
+// the first and last levels. See luaL_traceback in lauxlib.c.
+func Traceback(s *types.State, msg string, level int) string {
+	var levels []*types.CallInfo
+	for ci := s.CI; ci != nil; ci = ci.Prev {
+		levels = append(levels, ci)
+	}
+
+	var buf bytes.Buffer
+	if msg != "" {
+		buf.WriteString(msg + "\n")
+	}
+	buf.WriteString("stack traceback:")
+	long := len(levels) > _LEVELS1+_LEVELS2
+	for ; level < len(levels); level++ {
+		if long && level == _LEVELS1-1 {
+			// Too many levels, skip to the last ones
+			buf.WriteString("\n\t...")
+			level = len(levels) - _LEVELS2 - 1
+			continue
+		}
+		ci := levels[level]
+		if ci.IsLua() {
+			buf.WriteString("\n\t" + chunkID(ci.Cl.P) + ":")
+			if line := currentLine(ci); line > 0 {
+				fmt.Fprintf(&buf, "%d:", line)
+			}
+		} else {
+			buf.WriteString("\n\t[Go]:")
+		}
+		buf.WriteString(" in " + funcDescription(ci))
+		if ci.CallStatus&types.CIST_TAIL != 0 {
+			buf.WriteString("\n\t(...tail calls...)")
+		}
+	}
+	return buf.String()
+}
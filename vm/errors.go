@@ -0,0 +1,211 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/mna/lune/types"
+)
+
+// A Lua error, raised by the VM or by Error. Value is the error object, which
+// can be any Lua value. Errors raised by the VM are strings prefixed with the
+// position of the faulty instruction ("chunk:line: ").
+type RuntimeError struct {
+	Value     types.Value
+	Traceback string // Stack traceback where the error was raised, set by Execute
+}
+
+func (e *RuntimeError) Error() string {
+	switch v := e.Value.(type) {
+	case string:
+		return v
+	case float64:
+		return types.NumberToString(v)
+	}
+	return fmt.Sprintf("(error object is a %s value)", types.TypeOf(e.Value))
+}
+
+// Returns the line of the instruction being executed by the Lune function of
+// ci, or -1 if it has no line information.
+func currentLine(ci *types.CallInfo) int {
+	return getFuncLine(ci.Cl.P, ci.PC-1)
+}
+
+func chunkID(p *types.Prototype) string {
+	if p.Source == "" {
+		return "?"
+	}
+	return types.ChunkID(p.Source)
+}
+
+// Returns the position ("chunk:line: ") of the function at the given level of
+// the call stack, where level 0 is the running function and level 1 the one
+// that called it. Returns an empty string if it is a Go function or if there
+// is no line information. See luaL_where in lauxlib.c.
+func Where(s *types.State, level int) string {
+	ci := s.CI
+	for ; level > 0 && ci != nil; level-- {
+		ci = ci.Prev
+	}
+	if ci != nil && ci.IsLua() {
+		if line := currentLine(ci); line > 0 {
+			return fmt.Sprintf("%s:%d: ", chunkID(ci.Cl.P), line)
+		}
+	}
+	return ""
+}
+
+// Raises an error with the value v, see lua_error. If the running protected
+// call has a message handler, it is called first with v, while the stack is
+// still the one of the failing function, and its result becomes the error
+// value.
+func Error(s *types.State, v types.Value) {
+	panic(&RuntimeError{Value: handleError(s, v)})
+}
+
+// Calls the message handler of the running protected call with the error value
+// v, if there is one, and returns the resulting error value.
+func handleError(s *types.State, v types.Value) types.Value {
+	if h := s.ErrFunc; h != nil {
+		// Errors in the handler are not handled again
+		s.ErrFunc = nil
+		raiseTop(s)
+		fIdx := s.Top
+		s.CheckStack(2)
+		s.Stack[fIdx] = h
+		s.Stack[fIdx+1] = v
+		s.Top += 2
+		if err := protectedCall(s, fIdx, 1, nil); err != nil {
+			v = "error in error handling"
+		} else {
+			v = s.Stack[fIdx]
+		}
+		s.Top = fIdx
+	}
+	return v
+}
+
+// Converts the value e recovered from a panic to a Lua error. A Go panic that
+// is not a Lua error, e.g. a runtime error in a Go function, is raised as an
+// error message with the position of the running Lune function, or of the
+// caller of the running Go function, and goes through the message handler.
+func recoverError(s *types.State, e interface{}) *RuntimeError {
+	switch e := e.(type) {
+	case *RuntimeError:
+		return e
+	case threadClosed:
+		// Not an error, the goroutine of the thread is stopped
+		panic(e)
+	}
+	level := 0
+	if ci := s.CI; ci != nil && !ci.IsLua() {
+		level = 1
+	}
+	return &RuntimeError{Value: handleError(s, Where(s, level)+fmt.Sprint(e))}
+}
+
+// Raises an error with a formatted message, prefixed with the position of the
+// caller of the running Go function. See luaL_error in lauxlib.c.
+func Errorf(s *types.State, format string, args ...interface{}) {
+	Error(s, Where(s, 1)+fmt.Sprintf(format, args...))
+}
+
+// Raises an error with a formatted message, prefixed with the position of the
+// running instruction. See luaG_runerror in ldebug.c.
+func runError(s *types.State, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if ci := s.CI; ci != nil && ci.IsLua() {
+		msg = fmt.Sprintf("%s:%d: %s", chunkID(ci.Cl.P), currentLine(ci), msg)
+	}
+	Error(s, msg)
+}
+
+// Calls the function at funcIdx in the stack, catching the errors it raises.
+// On error, the stack and the CallInfo chain are restored to their state
+// before the call, and the error value is stored in place of the function.
+// See luaD_pcall in ldo.c.
+func protectedCall(s *types.State, funcIdx, nRets int, errFunc types.Value) (err *RuntimeError) {
+	oldCI, oldAllowHook, oldErrFunc, oldNCcalls := s.CI, s.AllowHook, s.ErrFunc, s.NCcalls
+	s.ErrFunc = errFunc
+	defer func() {
+		if e := recover(); e != nil {
+			// Converted while the message handler is still set, it may call it
+			err = recoverError(s, e)
+			closeUpvalues(s, funcIdx)
+			s.CI = oldCI
+			s.AllowHook = oldAllowHook
+			s.NCcalls = oldNCcalls
+			s.Stack[funcIdx] = err.Value
+			s.Top = funcIdx + 1
+		}
+		s.ErrFunc = oldErrFunc
+	}()
+	call(s, funcIdx, nRets)
+	return nil
+}
+
+// Calls the function at funcIdx in protected mode, where nothing else can
+// recover its errors: from the host or as the main function of a thread. The
+// error is returned with the stack traceback where it was raised. Panics that
+// are not Lua errors, e.g. from a Go function, are returned as errors too.
+func tracedCall(s *types.State, funcIdx, nRets int) (err *RuntimeError) {
+	defer func() {
+		if e := recover(); e != nil {
+			if _, ok := e.(threadClosed); ok {
+				panic(e)
+			}
+			// The stack is still the one of the failing function
+			err = &RuntimeError{Value: fmt.Sprint(e), Traceback: Traceback(s, "", 0)}
+		}
+	}()
+
+	// Record the traceback from a message handler, before the stack unwinds
+	var tb string
+	handler := types.NewGoClosure(func(s *types.State, args []types.Value) []types.Value {
+		tb = Traceback(s, "", 1)
+		return args[:1]
+	})
+	if err := protectedCall(s, funcIdx, nRets, handler); err != nil {
+		err.Traceback = tb
+		return err
+	}
+	return nil
+}
+
+// Pushes the function f and its arguments, and returns the index of f.
+func pushCall(s *types.State, f types.Value, args []types.Value) int {
+	raiseTop(s)
+	fIdx := s.Top
+	s.CheckStack(len(args) + 1)
+	s.Stack[fIdx] = f
+	copy(s.Stack[fIdx+1:], args)
+	s.Top += len(args) + 1
+	return fIdx
+}
+
+// Returns the results of a call at fIdx, and pops them.
+func popResults(s *types.State, fIdx int) []types.Value {
+	res := make([]types.Value, s.Top-fIdx)
+	copy(res, s.Stack[fIdx:s.Top])
+	s.Top = fIdx
+	return res
+}
+
+// Calls f with the arguments args, and returns all its results. Errors are
+// propagated to the caller, like lua_call.
+func Call(s *types.State, f types.Value, args ...types.Value) []types.Value {
+	fIdx := pushCall(s, f, args)
+	call(s, fIdx, types.LUNE_MULTRET)
+	return popResults(s, fIdx)
+}
+
+// Calls f with the arguments args in protected mode, like lua_pcall. If f
+// raises an error, it is returned as a *RuntimeError, after the message
+// handler has been called with the error value, if handler is not nil.
+func PCall(s *types.State, f types.Value, args []types.Value, handler types.Value) ([]types.Value, error) {
+	fIdx := pushCall(s, f, args)
+	if err := protectedCall(s, fIdx, types.LUNE_MULTRET, handler); err != nil {
+		s.Top = fIdx
+		return nil, err
+	}
+	return popResults(s, fIdx), nil
+}
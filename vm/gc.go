@@ -0,0 +1,176 @@
+package vm
+
+import (
+	"runtime"
+
+	"github.com/mna/lune/types"
+)
+
+// Calls the __gc metamethods of the values collected by the Go garbage
+// collector, if any. Called at the points where Lua runs its own collector,
+// see luaC_checkGC in lgc.h.
+func checkGC(s *types.State) {
+	if s.Finalizers.Pending() {
+		runFinalizers(s)
+	}
+}
+
+// Calls the __gc metamethod of each value waiting to be finalized. An error
+// in a metamethod is propagated, the values still waiting are finalized at the
+// next check. See GCTM in lgc.c.
+func runFinalizers(s *types.State) {
+	for v, ok := s.Finalizers.Pop(); ok; v, ok = s.Finalizers.Pop() {
+		tm := getTMByObj(s, v, TM_GC)
+		if !isFunction(tm) {
+			continue
+		}
+		raiseTop(s)
+		fIdx := s.Top
+		s.CheckStack(2)
+		s.Stack[fIdx] = tm
+		s.Stack[fIdx+1] = v
+		s.Top += 2
+
+		// Hooks are not called during finalizers
+		oldAllowHook := s.AllowHook
+		s.AllowHook = false
+		err := protectedCall(s, fIdx, 0, nil)
+		s.AllowHook = oldAllowHook
+		s.Top = fIdx
+		if err != nil {
+			msg, ok := err.Value.(string)
+			if !ok {
+				msg = "no message"
+			}
+			Error(s, "error in __gc metamethod ("+msg+")")
+		}
+	}
+}
+
+// Runs a full garbage collection. See luaC_fullgc in lgc.c.
+//
+// The goroutine of a suspended thread is a root for the Go collector, so a
+// thread that can be reached from its own stack (e.g. through an upvalue of
+// its function) would never be collected. Before running the Go collector,
+// the suspended threads that can't be reached from the Lua values of the
+// state are stopped. As in Lua, references held by Go code don't count: a
+// thread used only from Go must be anchored, e.g. in the registry.
+func FullGC(s *types.State) {
+	stopUnreachableThreads(s)
+	runtime.GC()
+}
+
+// Stops the goroutines of the suspended threads that are not reachable from
+// the roots of the state: the registry, the globals, the metatables of the
+// types, the values waiting to be finalized and the threads that are not
+// suspended. Only the threads that are still alive are kept in the list of
+// threads of the state.
+func stopUnreachableThreads(s *types.State) {
+	m := &marker{seen: make(map[types.Value]bool)}
+	m.mark(s.MainThread)
+	m.mark(s.Registry)
+	m.mark(s.Globals)
+	for _, mt := range s.MetaTables {
+		m.mark(mt)
+	}
+	for _, v := range s.Finalizers.Values() {
+		m.mark(v)
+	}
+	for _, wp := range s.Threads {
+		if ts := wp.Value(); ts != nil && ts.Status != types.THREAD_SUSPENDED {
+			m.markState(ts)
+		}
+	}
+	m.propagate()
+
+	live := s.Threads[:0]
+	for _, wp := range s.Threads {
+		ts := wp.Value()
+		switch {
+		case ts == nil || ts.Status == types.THREAD_DEAD:
+			// The goroutine is done
+		case ts.Status == types.THREAD_SUSPENDED && !m.states[ts]:
+			ts.Status = types.THREAD_DEAD
+			ts.Stop()
+		default:
+			live = append(live, wp)
+		}
+	}
+	clear(s.Threads[len(live):])
+	s.Threads = live
+}
+
+// Marks the Lua values reachable from the roots, see the mark phase of lgc.c.
+// Reachable values are first marked as seen, then traversed by propagate.
+type marker struct {
+	seen   map[types.Value]bool
+	states map[*types.State]bool
+	gray   []types.Value // Values seen but not traversed yet
+}
+
+func (m *marker) mark(v types.Value) {
+	switch v := v.(type) {
+	case *types.Table:
+		if v == nil {
+			return
+		}
+	case *types.Closure, *types.GoClosure, *types.Userdata, *types.Thread:
+	default:
+		// Values that can't reference other values
+		return
+	}
+	if !m.seen[v] {
+		m.seen[v] = true
+		m.gray = append(m.gray, v)
+	}
+}
+
+// Marks the values of the stack of the thread s.
+func (m *marker) markState(s *types.State) {
+	if m.states == nil {
+		m.states = make(map[*types.State]bool)
+	}
+	if m.states[s] {
+		return
+	}
+	m.states[s] = true
+	for _, v := range s.Stack {
+		m.mark(v)
+	}
+	m.mark(s.ErrFunc)
+	if re, ok := s.ThreadErr.(*RuntimeError); ok {
+		m.mark(re.Value)
+	}
+}
+
+// Traverses the values marked as seen, until all the reachable values are
+// marked. See propagatemark in lgc.c.
+func (m *marker) propagate() {
+	for len(m.gray) > 0 {
+		v := m.gray[len(m.gray)-1]
+		m.gray = m.gray[:len(m.gray)-1]
+		switch v := v.(type) {
+		case *types.Table:
+			m.mark(v.Meta)
+			v.ForEach(func(k, v types.Value) {
+				m.mark(k)
+				m.mark(v)
+			})
+		case *types.Closure:
+			for _, uv := range v.UpVals {
+				if uv != nil {
+					m.mark(*uv.V)
+				}
+			}
+		case *types.GoClosure:
+			for _, uv := range v.UpVals {
+				m.mark(uv)
+			}
+		case *types.Userdata:
+			m.mark(v.Meta)
+			m.mark(v.UserValue)
+		case *types.Thread:
+			m.markState(v.S)
+		}
+	}
+}
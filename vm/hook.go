@@ -0,0 +1,111 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/mna/lune/types"
+)
+
+// Returns the line of the instruction at pc, or -1 if the prototype has no line
+// information.
+func getFuncLine(p *types.Prototype, pc int) int {
+	if pc < len(p.LineInfo) {
+		return int(p.LineInfo[pc])
+	}
+	return -1
+}
+
+// Calls the hook for the event, if hooks are allowed. The top of the stack is
+// restored afterwards. See luaD_hook in ldo.c.
+func callHook(s *types.State, ev types.HookEvent, line, pc int) {
+	if s.Hook == nil || !s.AllowHook {
+		return
+	}
+	top := s.Top
+	s.AllowHook = false // Cannot call hooks inside a hook
+	defer func() {
+		s.AllowHook = true
+		s.Top = top
+	}()
+	s.Hook(s, &types.Debug{Event: ev, CurrentLine: line, PC: pc})
+}
+
+// Calls the instruction hook for the instruction at pc of the running function.
+// Used for the instructions that are consumed by the previous one, the others
+// go through traceExec.
+func hookInstr(s *types.State, pc int) {
+	if s.HookMask&types.LUNE_MASKINSTR != 0 {
+		callHook(s, types.LUNE_HOOKINSTR, getFuncLine(s.CI.Cl.P, pc), pc)
+	}
+}
+
+// Calls the hooks before the instruction at pc of the running function is
+// executed. See traceexec in lvm.c.
+func traceExec(s *types.State, pc int) {
+	mask := s.HookMask
+	p := s.CI.Cl.P
+	hookInstr(s, pc)
+	if mask&types.LUNE_MASKCOUNT != 0 {
+		if s.HookCount--; s.HookCount == 0 {
+			s.HookCount = s.BaseHookCount
+			callHook(s, types.LUNE_HOOKCOUNT, -1, pc)
+		}
+	}
+	if mask&types.LUNE_MASKLINE != 0 {
+		// Call the line hook when entering a new function, when jumping back (loop)
+		// or when entering a new line
+		newLine := getFuncLine(p, pc)
+		if pc == 0 || pc <= s.OldPC || newLine != getFuncLine(p, s.OldPC) {
+			callHook(s, types.LUNE_HOOKLINE, newLine, pc)
+		}
+	}
+	s.OldPC = pc
+}
+
+// Calls the call hook for the Lune function that was just called (the current
+// CallInfo). See callhook in ldo.c.
+func hookCall(s *types.State) {
+	ev := types.LUNE_HOOKCALL
+	if prev := s.CI.Prev; prev != nil && prev.IsLua() && prev.PC > 0 {
+		if prev.Cl.P.Code[prev.PC-1].GetOpCode() == types.OP_TAILCALL {
+			ev = types.LUNE_HOOKTAILCALL
+		}
+	}
+	callHook(s, ev, -1, -1)
+}
+
+// Calls the return hook for the function that is returning, and makes sure
+// that the line hook is called for the caller's line. See luaD_poscall in ldo.c.
+func hookReturn(s *types.State) {
+	if s.HookMask&types.LUNE_MASKRET != 0 {
+		callHook(s, types.LUNE_HOOKRET, -1, -1)
+	}
+	if prev := s.CI.Prev; prev != nil {
+		s.OldPC = prev.PC - 1
+	}
+}
+
+// Returns a hook that prints each executed instruction and the stack of the
+// running function to w. Set it with the LUNE_MASKINSTR mask.
+func NewTraceHook(w io.Writer) types.Hook {
+	return func(s *types.State, ar *types.Debug) {
+		ci := s.CI
+		if ar.PC < 0 {
+			fmt.Fprintf(w, "%s\n", ar.Event)
+			return
+		}
+		fmt.Fprintf(w, "%s\t%d\t[%d]\t%s\n", ar.Event, ar.PC+1, ar.CurrentLine, ci.Cl.P.Code[ar.PC])
+		io.WriteString(w, "\t")
+		for i := ci.FuncIndex; i < s.Top && i < len(s.Stack); i++ {
+			switch {
+			case i == ci.FuncIndex:
+				io.WriteString(w, "ƒ ")
+			case i == ci.Base:
+				io.WriteString(w, "ɑ ")
+			}
+			fmt.Fprintf(w, "%v, ", s.Stack[i])
+		}
+		io.WriteString(w, "\n")
+	}
+}
@@ -0,0 +1,15 @@
+-- Test GETUPVAL, SETUPVAL with independent counter closures
+function counter()
+  local n = 0
+  return function()
+    n = n + 1
+    return n
+  end
+end
+
+local c1 = counter()
+local c2 = counter()
+c1()
+c1()
+a = c1()
+b = c2()
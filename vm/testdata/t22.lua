@@ -0,0 +1,20 @@
+-- Test upvalues shared by sibling closures, while open and once closed
+function make()
+  local v = 1
+  local function get() return v end
+  local function set(x) v = x end
+  return get, set
+end
+
+function open()
+  local v = 1
+  local function inc() v = v + 1 end
+  inc()
+  inc()
+  return v
+end
+
+local get, set = make()
+set(42)
+a = get()
+b = open()
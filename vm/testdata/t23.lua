@@ -0,0 +1,9 @@
+-- Test fresh upvalues captured in a loop body, closed by JMP
+local fns = {}
+for i = 1, 3 do
+  local j = i * 10
+  fns[i] = function() return i + j end
+end
+a = fns[1]()
+b = fns[2]()
+c = fns[3]()
@@ -0,0 +1,20 @@
+-- Test TAILCALL with unbounded tail recursion, the stack must not grow
+function countdown(n, acc)
+  if n == 0 then
+    return acc
+  end
+  return countdown(n - 1, acc + 1)
+end
+
+function isEven(n)
+  if n == 0 then return true end
+  return isOdd(n - 1)
+end
+
+function isOdd(n)
+  if n == 0 then return false end
+  return isEven(n - 1)
+end
+
+a = countdown(1000000, 0)
+b = isEven(1000001)
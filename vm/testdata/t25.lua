@@ -0,0 +1,11 @@
+-- Test TAILCALL of Go functions, all results are returned
+function f(x)
+  return double(x)
+end
+
+function g()
+  return pair()
+end
+
+a = f(21)
+b, c = g()
@@ -0,0 +1,42 @@
+-- Test arithmetic, concat, length, unary minus and call metamethods
+local mt = {}
+local function new(v)
+  return setmetatable({v = v}, mt)
+end
+
+mt.__add = function(x, y)
+  if type(x) == "number" then
+    return new(x + y.v)
+  elseif type(y) == "number" then
+    return new(x.v + y)
+  end
+  return new(x.v + y.v)
+end
+mt.__sub = function(x, y) return new(x.v - y.v) end
+mt.__mul = function(x, y) return new(x.v * y) end
+mt.__div = function(x, y) return new(x.v / y.v) end
+mt.__mod = function(x, y) return new(x.v % y.v) end
+mt.__pow = function(x, y) return new(x.v ^ y) end
+mt.__unm = function(x) return new(-x.v) end
+mt.__len = function(x) return x.v * 10 end
+mt.__concat = function(x, y)
+  if type(x) == "string" then
+    return x .. y.v
+  end
+  return x.v .. y
+end
+mt.__call = function(self, a, b) return self.v + a + b end
+
+local x, y = new(6), new(4)
+a = (x + y).v
+b = (x - y).v
+c = (x * 3).v
+d = (x / y).v
+e = (x % y).v
+f = (y ^ 2).v
+g = (-x).v
+h = #x
+i = "v=" .. x
+j = x .. "!" .. "?"
+k = (1 + x + 2).v
+l = x(2, 3)
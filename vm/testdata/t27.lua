@@ -0,0 +1,26 @@
+-- Test comparison metamethods
+local mt = {}
+mt.__eq = function(x, y) return x.v == y.v end
+mt.__lt = function(x, y) return x.v < y.v end
+local mtle = {}
+mtle.__le = function(x, y) return x.v <= y.v end
+
+local x = setmetatable({v = 1}, mt)
+local y = setmetatable({v = 1}, mt)
+local z = setmetatable({v = 2}, mt)
+local w = {v = 1}
+
+a = x == y
+b = x ~= z
+c = x == w
+d = x < z
+e = z > x
+-- __le falls back to not __lt
+f = x <= y
+g = z <= x
+
+local p = setmetatable({v = 5}, mtle)
+local q = setmetatable({v = 7}, mtle)
+h = p <= q
+i = q >= p
+j = q <= p
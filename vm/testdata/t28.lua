@@ -0,0 +1,43 @@
+-- Test index and newindex metamethods, including chains
+local Base = {}
+Base.__index = Base
+function Base.new(name)
+  return setmetatable({name = name}, Base)
+end
+function Base:hello()
+  return "hello " .. self.name
+end
+function Base:kind()
+  return "base"
+end
+
+local Derived = setmetatable({}, {__index = Base})
+Derived.__index = Derived
+function Derived.new(name)
+  return setmetatable(Base.new(name), Derived)
+end
+function Derived:kind()
+  return "derived"
+end
+
+local o = Derived.new("lune")
+a = o:hello()
+b = o:kind()
+c = Base.new("x"):kind()
+
+-- __index and __newindex as functions
+local log = {}
+local prox = setmetatable({}, {
+  __index = function(t, k) return k .. "?" end,
+  __newindex = function(t, k, v) log[k] = v end,
+})
+d = prox.foo
+prox.bar = 12
+e = log.bar
+
+-- __newindex as a table
+local store = {}
+local redir = setmetatable({}, {__newindex = store})
+redir.x = 3
+g = store.x
+h = redir.x
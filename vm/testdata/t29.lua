@@ -0,0 +1,4 @@
+-- Test the metatable shared by all strings
+local s = "lune"
+a = s:len()
+b = ("abc"):upper()
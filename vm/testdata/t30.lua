@@ -0,0 +1,29 @@
+-- Test the array part of tables and the length operator
+local t = {10, 20, 30}
+a = #t
+t[4] = 40
+t[6] = 60
+b = #t
+t[5] = 50
+c = #t
+t[6] = nil
+d = #t
+
+local u = {}
+for i = 1, 100 do
+  u[i] = i * 2
+end
+e = #u
+f = u[50.0]
+
+local v = {n = 1, [1] = "x", [2] = "y"}
+g = #v
+h = v[1.0] .. v[2]
+
+local w = {}
+w[3] = 3
+i = #w
+
+local big = {1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34, 35, 36, 37, 38, 39, 40, 41, 42, 43, 44, 45, 46, 47, 48, 49, 50, 51, 52, 53, 54, 55, 56, 57, 58, 59, 60, }
+j = #big
+k = big[55]
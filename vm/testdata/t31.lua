@@ -0,0 +1,28 @@
+-- Test variable arguments
+local function count(...)
+  return select('#', ...)
+end
+a = count()
+b = count(1, nil, 3)
+c = count(nil, nil)
+
+local function second(...)
+  local _, x = ...
+  return x
+end
+d = second(1, 2, 3)
+e = second(1)
+
+local function pack(...)
+  return {...}
+end
+local t = pack(4, 5, 6)
+f = #t
+g = t[3]
+
+local function fixed(x, ...)
+  local y, z = ...
+  return x + y + z
+end
+h = fixed(1, 2, 3, 4)
+i = count(fixed(1, 2, 3), fixed(4, 5, 6))
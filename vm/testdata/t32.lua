@@ -0,0 +1,23 @@
+-- Test multiple results, forwarded to calls, returns and table constructors
+local function three()
+  return 1, 2, 3
+end
+local function forward(...)
+  return ...
+end
+local function tail()
+  return three()
+end
+
+a, b, c = forward(three())
+d = select('#', tail())
+local t = {three(), three()}
+e = #t
+f = t[2]
+local x, y = three()
+g = x + y
+h = select('#', forward())
+i = select(2, three())
+j = select('#', select(1, three()))
+k = select('#', forward(nil, three()))
+l = #{forward(5, three())}
@@ -0,0 +1,14 @@
+-- Test many variable arguments, more than the frame of any function
+local function grow(n, ...)
+  if n == 0 then
+    return ...
+  end
+  return grow(n - 1, n, ...)
+end
+
+a = select('#', grow(300))
+local t = {grow(300)}
+b = #t
+c = t[1]
+d = t[300]
+e = select(300, grow(300))
@@ -0,0 +1,12 @@
+-- Test debug hooks
+local function add(a, b)
+  return a + b
+end
+local function inc(n)
+  return add(n, 1)
+end
+local x = 0
+for i = 1, 2 do
+  x = add(x, i)
+end
+a = inc(x)
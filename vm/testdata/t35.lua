@@ -0,0 +1,11 @@
+-- Test runtime errors
+local t = {}
+function f(n)
+  return t.x.y + n
+end
+function g(a, b)
+  return a + b, a * b
+end
+a = g(2, 3)
+f(2)
+b = 1
@@ -0,0 +1,17 @@
+-- Test tracebacks
+local t = {}
+function t.check(v)
+  if not v then
+    local x = v.field
+  end
+  return v
+end
+local function run(f, v)
+  local r = f(v)
+  return r
+end
+function main()
+  local r = apply(run, t.check, false)
+  return r
+end
+main()
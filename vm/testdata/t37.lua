@@ -0,0 +1,9 @@
+-- Test threads resumed from Go
+function worker(name, n)
+  local total = 0
+  for i = 1, n do
+    local ok, v = pcall(wait, name, i)
+    total = total + v
+  end
+  return name, total
+end
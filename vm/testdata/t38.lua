@@ -0,0 +1,13 @@
+-- Test userdata
+a = p1.x + p2.x
+p1.x = 10
+b = p1.x
+c = p1 + p2
+d = p1 == p3
+e = p1 ~= p2
+f = p2 < p1
+g = #p1
+h = p1 .. "!"
+i = p1(5)
+j = l1 == l2
+k = l1 == l3
@@ -0,0 +1,131 @@
+package vm
+
+import (
+	"runtime"
+	"slices"
+	"sync"
+	"weak"
+
+	"github.com/mna/lune/types"
+)
+
+/*
+  Threads (coroutines). Each thread runs in its own goroutine, but only one
+  goroutine runs at a time: resuming a thread hands the execution over to its
+  goroutine and waits until it yields, returns or raises an error. Since the
+  Go stack of the thread is kept while it is suspended, it can yield from
+  anywhere, including from protected calls, metamethods and Go functions.
+*/
+
+// Panic value that stops the goroutine of a thread that can no longer be
+// resumed.
+type threadClosed struct{}
+
+// Creates a thread that runs the function f when first resumed, with the
+// arguments of resume. See lua_newthread.
+//
+// When the list of threads of the state is full, the threads that are dead or
+// unreachable are removed from it first, as FullGC does, so that it doesn't
+// grow with the threads created over time. A thread resumed from Go must then
+// be anchored too, e.g. in the registry.
+func NewThread(s *types.State, f types.Value) *types.Thread {
+	if len(s.Threads) == cap(s.Threads) {
+		stopUnreachableThreads(s)
+		// Make room for as many threads as are left, so that a list of live
+		// threads is not checked again at each new thread
+		s.Threads = slices.Grow(s.Threads, len(s.Threads))
+	}
+
+	t := s.NewThread()
+	ts := t.S
+	ts.Stack[0] = f
+	ts.Top = 1
+	resumeCh := make(chan []types.Value)
+	ts.ResumeCh = resumeCh
+	ts.YieldCh = make(chan []types.Value)
+	// Doesn't refer to the state, so that it can be the argument of the cleanup
+	ts.Stop = sync.OnceFunc(func() { close(resumeCh) })
+	go runThread(ts)
+
+	// Once the thread is unreachable, it can't be resumed anymore, stop its
+	// goroutine. A thread that is reachable from its own stack is kept alive by
+	// its goroutine, it is stopped by FullGC instead.
+	runtime.AddCleanup(t, func(stop func()) { stop() }, ts.Stop)
+	s.Threads = append(s.Threads, weak.Make(ts))
+	return t
+}
+
+// Runs the function of the thread s in its goroutine, once resumed.
+func runThread(s *types.State) {
+	defer func() {
+		// Stopped while suspended, see Yield
+		if e := recover(); e != nil {
+			if _, ok := e.(threadClosed); !ok {
+				panic(e)
+			}
+		}
+	}()
+
+	args, ok := <-s.ResumeCh
+	if !ok {
+		return
+	}
+	s.CheckStack(len(args))
+	copy(s.Stack[1:], args)
+	s.Top += len(args)
+
+	// Errors, including the panics of Go functions, can't be recovered by the
+	// host on this goroutine, they are returned to the resumer
+	var res []types.Value
+	if err := tracedCall(s, 0, types.LUNE_MULTRET); err != nil {
+		s.ThreadErr = err
+	} else {
+		res = popResults(s, 0)
+	}
+	s.Status = types.THREAD_DEAD
+	s.YieldCh <- res
+}
+
+// Resumes the thread t from the thread s, passing it args, and waits until it
+// yields, returns or raises an error. Returns the values it yielded or
+// returned, its status is then suspended or dead. If it raised an error, it is
+// dead and the error is returned as a *RuntimeError. See lua_resume.
+func Resume(s *types.State, t *types.Thread, args ...types.Value) ([]types.Value, error) {
+	ts := t.S
+	switch {
+	case ts.Status == types.THREAD_DEAD:
+		return nil, &RuntimeError{Value: "cannot resume dead coroutine"}
+	case ts.Status != types.THREAD_SUSPENDED || ts.ResumeCh == nil:
+		return nil, &RuntimeError{Value: "cannot resume non-suspended coroutine"}
+	case s.NCcalls >= types.LUNE_MAXCCALLS:
+		return nil, &RuntimeError{Value: "C stack overflow"}
+	}
+	if ts.CI == nil {
+		// Not started, nested resumes count as nested calls
+		ts.NCcalls = s.NCcalls + 1
+	}
+
+	s.Status, ts.Status = types.THREAD_NORMAL, types.THREAD_RUNNING
+	ts.ResumeCh <- args
+	res := <-ts.YieldCh
+	s.Status = types.THREAD_RUNNING
+	if ts.ThreadErr != nil {
+		return nil, ts.ThreadErr
+	}
+	return res, nil
+}
+
+// Suspends the running thread s, passing vals to the function that resumed
+// it, and returns the arguments of the next resume. See lua_yield.
+func Yield(s *types.State, vals ...types.Value) []types.Value {
+	if s.ResumeCh == nil {
+		runError(s, "attempt to yield from outside a coroutine")
+	}
+	s.Status = types.THREAD_SUSPENDED
+	s.YieldCh <- vals
+	args, ok := <-s.ResumeCh
+	if !ok {
+		panic(threadClosed{})
+	}
+	return args
+}
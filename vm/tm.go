@@ -0,0 +1,186 @@
+package vm
+
+import (
+	"github.com/mna/lune/types"
+)
+
+/*
+  Mostly a port of ltm.{c,h} from Lua
+
+  Tag methods (metamethods)
+*/
+
+type tmEvent byte
+
+// ORDER TM
+const (
+	TM_INDEX tmEvent = iota
+	TM_NEWINDEX
+	TM_GC
+	TM_MODE
+	TM_LEN
+	TM_EQ // last tag method with 'fast' access
+	TM_ADD
+	TM_SUB
+	TM_MUL
+	TM_DIV
+	TM_MOD
+	TM_POW
+	TM_UNM
+	TM_LT
+	TM_LE
+	TM_CONCAT
+	TM_CALL
+	TM_N // number of elements in the enum
+)
+
+const (
+	_MAXTAGLOOP = 100 // Limit for table tag-method chains (to avoid loops)
+)
+
+var (
+	tmNames = [...]string{
+		TM_INDEX:    "__index",
+		TM_NEWINDEX: "__newindex",
+		TM_GC:       "__gc",
+		TM_MODE:     "__mode",
+		TM_LEN:      "__len",
+		TM_EQ:       "__eq",
+		TM_ADD:      "__add",
+		TM_SUB:      "__sub",
+		TM_MUL:      "__mul",
+		TM_DIV:      "__div",
+		TM_MOD:      "__mod",
+		TM_POW:      "__pow",
+		TM_UNM:      "__unm",
+		TM_LT:       "__lt",
+		TM_LE:       "__le",
+		TM_CONCAT:   "__concat",
+		TM_CALL:     "__call",
+	}
+
+	// Arithmetic opcodes and their corresponding event, in the same order.
+	_ARITH_TMS = [...]tmEvent{
+		types.OP_ADD: TM_ADD,
+		types.OP_SUB: TM_SUB,
+		types.OP_MUL: TM_MUL,
+		types.OP_DIV: TM_DIV,
+		types.OP_MOD: TM_MOD,
+		types.OP_POW: TM_POW,
+		types.OP_UNM: TM_UNM,
+	}
+)
+
+func (e tmEvent) String() string {
+	return tmNames[e]
+}
+
+// Returns the metatable of the value v, or nil if it has none.
+func getMetaTable(s *types.State, v types.Value) *types.Table {
+	return s.MetaTable(v)
+}
+
+// Returns the metamethod for the event in the metatable mt, or nil if
+// there is no metatable or no such metamethod.
+func getTM(mt *types.Table, event tmEvent) types.Value {
+	if mt == nil {
+		return nil
+	}
+	return mt.Get(tmNames[event])
+}
+
+// Returns the metamethod for the event of the value v, or nil.
+func getTMByObj(s *types.State, v types.Value, event tmEvent) types.Value {
+	return getTM(getMetaTable(s, v), event)
+}
+
+func isFunction(v types.Value) bool {
+	switch v.(type) {
+	case *types.Closure, *types.GoClosure:
+		return true
+	}
+	return false
+}
+
+// Calls the metamethod f with arguments p1, p2 and, if it doesn't return a
+// result, p3. Returns the first result if hasRes is true.
+func callTM(s *types.State, f, p1, p2, p3 types.Value, hasRes bool) types.Value {
+	// Push above the registers of the running function
+	raiseTop(s)
+	fIdx := s.Top
+	s.CheckStack(4)
+	s.Stack[s.Top] = f // push function
+	s.Stack[s.Top+1] = p1
+	s.Stack[s.Top+2] = p2
+	s.Top += 3
+	if !hasRes {
+		// no result? 'p3' is third argument
+		s.Stack[s.Top] = p3
+		s.Top++
+		call(s, fIdx, 0)
+		return nil
+	}
+	call(s, fIdx, 1)
+	s.Top--
+	return s.Stack[s.Top]
+}
+
+// Calls the binary metamethod for the event, looking first in p1's metatable
+// and then in p2's. Returns false if there is no such metamethod.
+func callBinTM(s *types.State, p1, p2 types.Value, event tmEvent) (types.Value, bool) {
+	tm := getTMByObj(s, p1, event) // try first operand
+	if tm == nil {
+		tm = getTMByObj(s, p2, event) // try second operand
+	}
+	if tm == nil {
+		return nil, false
+	}
+	return callTM(s, tm, p1, p2, nil, true), true
+}
+
+// Calls the order metamethod (__lt or __le) for p1 and p2. Returns the
+// result, and false if there is no such metamethod.
+func callOrderTM(s *types.State, p1, p2 types.Value, event tmEvent) (bool, bool) {
+	res, ok := callBinTM(s, p1, p2, event)
+	if !ok {
+		return false, false
+	}
+	return !isFalse(res), true
+}
+
+// Returns the __eq metamethod to use to compare two values with metatables
+// mt1 and mt2, or nil if they don't share the same metamethod.
+func getEqualTM(mt1, mt2 *types.Table) types.Value {
+	tm1 := getTM(mt1, TM_EQ)
+	if tm1 == nil {
+		return nil // no metamethod
+	}
+	if mt1 == mt2 {
+		return tm1 // same metatables => same metamethods
+	}
+	tm2 := getTM(mt2, TM_EQ)
+	if tm2 == nil {
+		return nil // no metamethod
+	}
+	if RawEqual(tm1, tm2) {
+		return tm1 // same metamethods?
+	}
+	return nil
+}
+
+// Returns the value to call for the value f, which is f itself if it is a
+// function, or its __call metamethod.
+func tryFuncTM(s *types.State, f types.Value) types.Value {
+	if isFunction(f) {
+		return f
+	}
+	tm := getTMByObj(s, f, TM_CALL)
+	if !isFunction(tm) {
+		typeError(s, f, "call")
+	}
+	return tm
+}
+
+func typeError(s *types.State, v types.Value, op string) {
+	runError(s, "attempt to %s a %s value", op, types.TypeOf(v))
+}
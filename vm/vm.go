@@ -2,27 +2,11 @@ package vm
 
 import (
 	"fmt"
+	"math"
 
 	"github.com/mna/lune/types"
 )
 
-var (
-	_BINOPS = [...]byte{
-		types.OP_ADD: '+',
-		types.OP_SUB: '-',
-		types.OP_MUL: '*',
-		types.OP_DIV: '/',
-		types.OP_MOD: '%',
-		types.OP_POW: '^',
-	}
-
-	_CMPOPS = [...]func(types.Value, types.Value) bool{
-		types.OP_EQ: areEqual,
-		types.OP_LT: isLessThan,
-		types.OP_LE: isLessEqual,
-	}
-)
-
 func doJump(s *types.State, args types.Args, e int) {
 	if asBool(args.Ax) {
 		closeUpvalues(s, s.CI.Base+args.Ax-1)
@@ -30,22 +14,138 @@ func doJump(s *types.State, args types.Args, e int) {
 	s.CI.PC += args.Bx + e
 }
 
-func preCall(s *types.State, args types.Args, nRets int) bool {
-	switch f := (*args.A).(type) {
-	case types.GoFunc:
+// Prepares the call of the function at funcIdx in the stack. Go functions are
+// called right away and true is returned. For Lune functions, a new CallInfo
+// is created and false is returned, the caller must execute it. A value that
+// is not a function is called via its __call metamethod. See luaD_precall in
+// ldo.c.
+func preCall(s *types.State, funcIdx int, nRets int) bool {
+	if !isFunction(s.Stack[funcIdx]) {
+		// Insert the __call metamethod before the called value, which becomes
+		// its first argument
+		tm := tryFuncTM(s, s.Stack[funcIdx])
+		s.CheckStack(1)
+		copy(s.Stack[funcIdx+1:s.Top+1], s.Stack[funcIdx:s.Top])
+		s.Top++
+		s.Stack[funcIdx] = tm
+	}
+
+	switch f := s.Stack[funcIdx].(type) {
+	case *types.GoClosure:
 		// Go function call
-		callGoFunc(s, f, s.CI.Base+args.Ax+1, nRets)
+		callGoFunc(s, f.F, funcIdx, nRets)
 		return true
 	case *types.Closure:
 		// Lune function call
-		s.NewCallInfo(f, s.CI.Base+args.Ax, nRets)
-		// TODO : Metamethods
+		if s.Top+int(f.P.Meta.MaxStackSize)+int(f.P.Meta.NumParams) > types.LUNE_MAXSTACK {
+			runError(s, "stack overflow")
+		}
+		s.NewCallInfo(f, funcIdx, nRets)
+		if s.HookMask&types.LUNE_MASKCALL != 0 {
+			hookCall(s)
+		}
 	}
 	return false
 }
 
+// Calls the function at funcIdx in the stack, running a new execution loop
+// if it is a Lune function. Used to call metamethods from within the VM.
+// See luaD_call in ldo.c.
+func call(s *types.State, funcIdx int, nRets int) {
+	// Leave some room to the message handler of a C stack overflow
+	if s.NCcalls++; s.NCcalls >= types.LUNE_MAXCCALLS {
+		if s.NCcalls == types.LUNE_MAXCCALLS {
+			runError(s, "C stack overflow")
+		} else if s.NCcalls >= types.LUNE_MAXCCALLS+types.LUNE_MAXCCALLS>>3 {
+			// Error while handling the overflow
+			panic(&RuntimeError{Value: "error in error handling"})
+		}
+	}
+	if !preCall(s, funcIdx, nRets) {
+		execute(s)
+	}
+	s.NCcalls--
+}
+
+// Moves the top of the stack above the registers of the running Lune function,
+// so that values can be pushed without overwriting them.
+func raiseTop(s *types.State) {
+	if ci := s.CI; ci != nil && ci.IsLua() && s.Top < ci.Top {
+		s.Top = ci.Top
+	}
+}
+
+// Returns the value of t[key], following the __index metamethods. See
+// luaV_gettable in lvm.c.
+func GetTable(s *types.State, t, key types.Value) types.Value {
+	for loop := 0; loop < _MAXTAGLOOP; loop++ {
+		var tm types.Value
+		if h, ok := t.(*types.Table); ok {
+			if res := h.Get(key); res != nil {
+				return res
+			}
+			if tm = getTM(h.Meta, TM_INDEX); tm == nil {
+				return nil
+			}
+		} else if tm = getTMByObj(s, t, TM_INDEX); tm == nil {
+			typeError(s, t, "index")
+		}
+		if isFunction(tm) {
+			return callTM(s, tm, t, key, nil, true)
+		}
+		// Else repeat with the metamethod
+		t = tm
+	}
+	runError(s, "loop in gettable")
+	return nil
+}
+
+// Sets t[key] = val, following the __newindex metamethods. See
+// luaV_settable in lvm.c.
+func SetTable(s *types.State, t, key, val types.Value) {
+	for loop := 0; loop < _MAXTAGLOOP; loop++ {
+		var tm types.Value
+		if h, ok := t.(*types.Table); ok {
+			// The metamethod is only used if the key is not already present
+			if h.Get(key) != nil {
+				RawSet(s, h, key, val)
+				return
+			}
+			if tm = getTM(h.Meta, TM_NEWINDEX); tm == nil {
+				RawSet(s, h, key, val)
+				return
+			}
+		} else if tm = getTMByObj(s, t, TM_NEWINDEX); tm == nil {
+			typeError(s, t, "index")
+		}
+		if isFunction(tm) {
+			callTM(s, tm, t, key, val, false)
+			return
+		}
+		// Else repeat with the metamethod
+		t = tm
+	}
+	runError(s, "loop in settable")
+}
+
+// Sets t[key] = val without calling metamethods, raising an error if key is
+// nil or NaN. See luaH_set in ltable.c.
+func RawSet(s *types.State, t *types.Table, key, val types.Value) {
+	if key == nil {
+		runError(s, "table index is nil")
+	} else if f, ok := key.(float64); ok && math.IsNaN(f) {
+		runError(s, "table index is NaN")
+	}
+	t.Set(key, val)
+}
+
+// Moves the results of the function that returns (the current CallInfo) in
+// place of the called function, as many as it expected. Returns 0 if it
+// expected multiple results. See luaD_poscall in ldo.c.
 func posCall(s *types.State, firstResult int) int {
-	// TODO : See luaD_poscall in ldo.c, the hook debugging is not implemented for now
+	if s.HookMask&(types.LUNE_MASKRET|types.LUNE_MASKLINE) != 0 {
+		hookReturn(s)
+	}
 	res := s.CI.FuncIndex
 	wanted := s.CI.NumResults
 	s.CI = s.CI.Prev
@@ -64,21 +164,37 @@ func posCall(s *types.State, firstResult int) int {
 	return wanted - types.LUNE_MULTRET
 }
 
-func closeUpvalues(s *types.State, funcIdx int) {
-	for _, stkIdx := range s.OpenUpVals {
-		// TODO : Could be optimized if openupvals are in order (greatest first)
-		if stkIdx >= funcIdx {
-			// Garbage collect stuff omitted...
-			// Should use a linked list instead...
-			// TODO : Still not clear how upvalues work once closed, where do they live?
-			// will wait for better understanding of closure calls and upvalue lookup...
-		}
+// Closes all open upvalues pointing to stack slots at or above level. The
+// values are moved into the upvalues, so that closures still sharing them see
+// the same variable once the frame is gone.
+func closeUpvalues(s *types.State, level int) {
+	for uv := s.OpenUpVals; uv != nil && uv.Idx >= level; uv = s.OpenUpVals {
+		s.OpenUpVals = uv.Next
+		uv.Close()
 	}
 }
 
-func findUpval() types.Value {
-	// TODO : Implement...
-	return nil
+// Returns the open upvalue for the stack slot at idx, creating it if it does
+// not exist yet. See luaF_findupval in lfunc.c.
+func findUpval(s *types.State, idx int) *types.UpVal {
+	var prev *types.UpVal
+
+	uv := s.OpenUpVals
+	for uv != nil && uv.Idx >= idx {
+		if uv.Idx == idx {
+			// Found a corresponding upvalue, share it
+			return uv
+		}
+		prev, uv = uv, uv.Next
+	}
+	// Not found, create a new one and insert it in the sorted list
+	nuv := &types.UpVal{V: &s.Stack[idx], Idx: idx, Next: uv}
+	if prev == nil {
+		s.OpenUpVals = nuv
+	} else {
+		prev.Next = nuv
+	}
+	return nuv
 }
 
 func pushClosure(s *types.State, p *types.Prototype, ra *types.Value) {
@@ -90,8 +206,8 @@ func pushClosure(s *types.State, p *types.Prototype, ra *types.Value) {
 	// Assign upvalues
 	for i, uv := range p.Upvalues {
 		if asBool(int(uv.Instack)) {
-			// Upval is a local variable
-			cl.UpVals[i] = findUpval()
+			// Upval is a local variable of the enclosing function
+			cl.UpVals[i] = findUpval(s, s.CI.Base+int(uv.Idx))
 		} else {
 			// Get upval from enclosing function's upvalues
 			cl.UpVals[i] = parentCl.UpVals[uv.Idx]
@@ -99,30 +215,90 @@ func pushClosure(s *types.State, p *types.Prototype, ra *types.Value) {
 	}
 }
 
-func callGoFunc(s *types.State, f types.GoFunc, base, nRets int) {
-	var in []types.Value
-	for i := base; i < s.Top; i++ {
-		in = append(in, s.Stack[i])
+// Replaces the frame of the caller with the frame of the Lune function it
+// just called, so that tail calls don't grow the stack. See OP_TAILCALL in
+// luaV_execute (lvm.c).
+func tailCall(s *types.State) {
+	// Close all upvalues of the caller before its frame gets overwritten
+	if len(s.CI.Prev.Cl.P.Protos) > 0 {
+		closeUpvalues(s, s.CI.Prev.Base)
 	}
-	out := f(in)
-	// Out values replace the stack values starting at the Go Func index (base - 1)
-	// nRets values are expected, stop at this count, and fill with nils if necessary
-	s.Top = base - 1
-	for i := 0; i < nRets; i++ {
-		if i < len(out) {
-			s.Stack[s.Top] = out[i]
-			s.Top++
-		} else {
-			s.Stack[s.Top] = nil
-			s.Top++
-		}
+	s.TailCallInfo()
+}
+
+// Calls the Go function f at funcIdx in the stack with the arguments above it,
+// and moves its results in place of the function, like posCall does for a Lune
+// function. See the C function case of luaD_precall in ldo.c.
+func callGoFunc(s *types.State, f types.GoFunc, funcIdx, nRets int) {
+	s.NewGoCallInfo(funcIdx, nRets)
+	if s.HookMask&types.LUNE_MASKCALL != 0 {
+		callHook(s, types.LUNE_HOOKCALL, -1, -1)
 	}
+	in := make([]types.Value, s.Top-funcIdx-1)
+	copy(in, s.Stack[funcIdx+1:s.Top])
+	out := f(s, in)
+
+	// Push the results above the arguments
+	firstResult := s.Top
+	s.CheckStack(len(out))
+	copy(s.Stack[firstResult:], out)
+	s.Top += len(out)
+	posCall(s, firstResult)
 }
 
-func Execute(s *types.State) {
+func compare(s *types.State, op types.OpCode, b, c types.Value) bool {
+	switch op {
+	case types.OP_EQ:
+		return areEqual(s, b, c)
+	case types.OP_LT:
+		return LessThan(s, b, c)
+	case types.OP_LE:
+		return isLessEqual(s, b, c)
+	}
+	panic(fmt.Sprintf("%s: not a comparison opcode", op))
+}
+
+// Runs the main function, at position 0 in the stack. Errors raised while it
+// runs are returned as a *RuntimeError, as are the panics of Go functions,
+// with the traceback of the stack where they happened. The state is then reset
+// so that it can run again.
+func Execute(s *types.State) error {
 	// Start with entry point (position 0)
-	s.NewCallInfo(s.Stack[0].(*types.Closure), 0, 0)
+	main := s.Stack[0]
+	if err := hostCall(s, 0, 0); err != nil {
+		s.Stack[0] = main
+		return err
+	}
+	return nil
+}
+
+// Calls f with the arguments args from the host, outside of any running
+// function, and returns all its results. Errors are returned like Execute
+// does, and the state can be used again.
+func Run(s *types.State, f types.Value, args ...types.Value) ([]types.Value, error) {
+	fIdx := pushCall(s, f, args)
+	if err := hostCall(s, fIdx, types.LUNE_MULTRET); err != nil {
+		return nil, err
+	}
+	return popResults(s, fIdx), nil
+}
+
+// Calls the function at fIdx in protected mode, also recovering the panics of
+// Go functions. On error, the state is restored to what it was before the
+// call, with the stack up to fIdx.
+func hostCall(s *types.State, fIdx, nRets int) error {
+	oldCI, oldNCcalls, oldErrFunc, oldAllowHook := s.CI, s.NCcalls, s.ErrFunc, s.AllowHook
+	if err := tracedCall(s, fIdx, nRets); err != nil {
+		closeUpvalues(s, fIdx)
+		s.CI, s.Top, s.NCcalls, s.ErrFunc, s.AllowHook = oldCI, fIdx, oldNCcalls, oldErrFunc, oldAllowHook
+		return err
+	}
+	return nil
+}
 
+// Runs the current CallInfo until it returns. Lune functions called from it
+// run on the same loop, see luaV_execute in lvm.c.
+func execute(s *types.State) {
 newFrame:
 	var i types.Instruction
 	var op types.OpCode
@@ -132,12 +308,11 @@ newFrame:
 		i = s.CI.Cl.P.Code[s.CI.PC]
 		op = i.GetOpCode()
 		s.CI.PC++
-		s.Dump()
-		s.OpCodeDebug = append(s.OpCodeDebug, op)
+		if s.HookMask != 0 {
+			traceExec(s, s.CI.PC-1)
+		}
 		args = i.GetArgs(s)
 
-		fmt.Printf("ax: %d, bx: %d, cx: %d\n", args.Ax, args.Bx, args.Cx)
-
 		switch op {
 		case types.OP_MOVE, types.OP_LOADK, types.OP_GETUPVAL:
 			// A B | R(A) := R(B)
@@ -145,26 +320,20 @@ newFrame:
 			// A B | R(A) := UpValue[B]
 			// Status: done
 			*args.A = *args.B
-			if op == types.OP_MOVE {
-				fmt.Printf("%-10sR(A)=%v R(B)=%v\n", op, *args.A, *args.B)
-			} else if op == types.OP_LOADK {
-				fmt.Printf("%-10sR(A)=%v Kst(Bx)=%v\n", op, *args.A, *args.B)
-			} else {
-				fmt.Printf("%-10sR(A)=%v U(B)=%v\n", op, *args.A, *args.B)
-			}
 
 		case types.OP_LOADKx:
 			// A | R(A) := Kst(extra arg)
 			// Special instruction: must always be followed by OP_EXTRAARG
 			// Status: untested
 			if i2 := s.CI.Cl.P.Code[s.CI.PC]; i2.GetOpCode() != types.OP_EXTRAARG {
-				panic(fmt.Sprintf("%s: expected OP_EXTRAARG as next instruction, found %s", op, i2.GetOpCode()))
+				runError(s, "%s: expected OP_EXTRAARG as next instruction, found %s", op, i2.GetOpCode())
 			} else {
 				s.CI.PC++
-				s.OpCodeDebug = append(s.OpCodeDebug, i2.GetOpCode())
+				if s.HookMask != 0 {
+					hookInstr(s, s.CI.PC-1)
+				}
 				ax := i2.GetArgAx()
 				*args.A = s.CI.Cl.P.Ks[ax]
-				fmt.Printf("%-10sR(A)=%v EXTRAARG=%v\n", op, *args.A, ax)
 			}
 
 		case types.OP_LOADBOOL:
@@ -176,7 +345,6 @@ newFrame:
 			if asBool(args.Cx) {
 				s.CI.PC++
 			}
-			fmt.Printf("%-10sR(A)=%v B=%v C=%v\n", op, *args.A, args.Bx, args.Cx)
 
 		case types.OP_LOADNIL:
 			// A B | R(A) := ... := R(B) := nil
@@ -184,110 +352,98 @@ newFrame:
 			for j := 0; j <= args.Bx; j++ {
 				s.CI.Frame[args.Ax+j] = nil
 			}
-			fmt.Printf("%-10sA=%v B=%v\n", op, args.Ax, args.Bx)
 
 		case types.OP_GETTABUP, types.OP_GETTABLE:
 			// A B C | R(A) := UpValue[B][RK(C)]
 			// A B C | R(A) := R(B)[RK(C)]
 			// Status: done
-			t := (*args.B).(types.Table)
-			*args.A = t.Get(*args.C)
-			if op == types.OP_GETTABUP {
-				fmt.Printf("%-10sR(A)=%v U(B)=%v RK(C)=%v\n", op, *args.A, t, *args.C)
-			} else {
-				fmt.Printf("%-10sR(A)=%v R(B)=%v RK(C)=%v\n", op, *args.A, t, *args.C)
-			}
+			// The stack may be reallocated by a metamethod call, don't use args.A
+			t, k := *args.B, *args.C
+			s.CI.Frame[args.Ax] = GetTable(s, t, k)
 
 		case types.OP_SETTABUP, types.OP_SETTABLE:
 			// A B C | UpValue[A][RK(B)] := RK(C)
 			// A B C | R(A)[RK(B)] := RK(C)
 			// Status: done
-			t := (*args.A).(types.Table)
-			t.Set(*args.B, *args.C)
-			if op == types.OP_SETTABUP {
-				fmt.Printf("%-10sU(A)=%v RK(B)=%v RK(C)=%v\n", op, t, *args.B, *args.C)
-			} else {
-				fmt.Printf("%-10sR(A)=%v RK(B)=%v RK(C)=%v\n", op, t, *args.B, *args.C)
-			}
+			t, k, v := *args.A, *args.B, *args.C
+			SetTable(s, t, k, v)
 
 		case types.OP_SETUPVAL:
 			// A B | UpValue[B] := R(A)
-			// Status: untested
+			// Status: done
 			*args.B = *args.A
-			fmt.Printf("%-10sR(A)=%v U(B)=%v\n", op, *args.A, *args.B)
 
 		case types.OP_NEWTABLE:
 			// A B C | R(A) := {} (size = B,C)
-			// Status: incomplete, missing array and hash sizes
-			t := types.NewTable()
-			// TODO : Encoded array and hash sizes (B and C) are ignored at the moment
+			// B and C are the array and hash sizes, encoded as "floating point bytes"
+			// Status: done
+			t := types.NewTable(types.Fb2Int(args.Bx), types.Fb2Int(args.Cx))
 			*args.A = t
-			fmt.Printf("%-10sR(A)=%v B=%v C=%v\n", op, t, args.Bx, args.Cx)
+			checkGC(s)
 
 		case types.OP_SELF:
 			// A B C | R(A+1) := R(B); R(A) := R(B)[RK(C)]
 			// Status: done
-			s.CI.Frame[args.Ax+1] = *args.B
-			t := (*args.B).(types.Table)
-			s.CI.Frame[args.Ax] = t.Get(*args.C)
-			fmt.Printf("%-10sA=%v R(B)=%v RK(C)=%v\n", op, args.Ax, t, *args.C)
+			t, k := *args.B, *args.C
+			s.CI.Frame[args.Ax+1] = t
+			s.CI.Frame[args.Ax] = GetTable(s, t, k)
 
 		case types.OP_ADD, types.OP_SUB, types.OP_MUL, types.OP_DIV,
 			types.OP_MOD, types.OP_POW:
 			// A B C | R(A) := RK(B) + RK(C)
 			// A B C | R(A) := RK(B) - RK(C)
-			// Status: incomplete, missing metamethods
 			// A B C | R(A) := RK(B) * RK(C)
 			// A B C | R(A) := RK(B) ÷ RK(C)
 			// A B C | R(A) := RK(B) % RK(C)
 			// A B C | R(A) := RK(B) ^ RK(C)
-			*args.A = coerceAndComputeBinaryOp(_BINOPS[op], *args.B, *args.C)
-			fmt.Printf("%-10sR(A)=%v RK(B)=%v RK(C)=%v\n", op, *args.A, *args.B, *args.C)
+			// Status: done
+			b, c := *args.B, *args.C
+			s.CI.Frame[args.Ax] = coerceAndComputeBinaryOp(s, op, b, c)
 
 		case types.OP_UNM:
 			// A B | R(A) := -R(B)
-			// Status: incomplete, missing metamethods
-			*args.A = coerceAndComputeUnaryOp('-', *args.B)
-			fmt.Printf("%-10sR(A)=%v R(B)=%v\n", op, *args.A, *args.B)
+			// Status: done
+			b := *args.B
+			s.CI.Frame[args.Ax] = coerceAndComputeBinaryOp(s, op, b, b)
 
 		case types.OP_NOT:
 			// A B | R(A) := not R(B)
 			*args.A = isFalse(*args.B)
-			fmt.Printf("%-10sR(A)=%v R(B)=%v\n", op, *args.A, *args.B)
 
 		case types.OP_LEN:
 			// A B | R(A) := length of R(B)
-			*args.A = computeLength(*args.B)
-			fmt.Printf("%-10sR(A)=%v R(B)=%v\n", op, *args.A, *args.B)
+			b := *args.B
+			s.CI.Frame[args.Ax] = Len(s, b)
 
 		case types.OP_CONCAT:
 			// A B C | R(A) := R(B).. ... ..R(C)
 			src := s.CI.Frame[args.Bx : args.Cx+1]
-			*args.A = coerceAndConcatenate(src)
-			fmt.Printf("%-10sR(A)=%v B=%v C=%v\n", op, *args.A, args.Bx, args.Cx)
+			s.CI.Frame[args.Ax] = coerceAndConcatenate(s, src)
+			checkGC(s)
 
 		case types.OP_JMP:
 			// A sBx | pc+=sBx; if (A) close all upvalues >= R(A) + 1
 			doJump(s, args, 0)
-			fmt.Printf("%-10sA=%v sBx=%v\n", op, args.Ax, args.Bx)
 
 		case types.OP_EQ, types.OP_LT, types.OP_LE:
 			// A B C | if ((RK(B) == RK(C)) ~= A) then pc++
 			// A B C | if ((RK(B) <  RK(C)) ~= A) then pc++
 			// A B C | if ((RK(B) <= RK(C)) ~= A) then pc++
-			if _CMPOPS[op](*args.B, *args.C) != asBool(args.Ax) {
+			b, c := *args.B, *args.C
+			if compare(s, op, b, c) != asBool(args.Ax) {
 				s.CI.PC++
 			} else {
 				// For the fall-through case, a JMP is always expected, in order to optimize
 				// execution in the virtual machine.
 				if i2 := s.CI.Cl.P.Code[s.CI.PC]; i2.GetOpCode() != types.OP_JMP {
-					panic(fmt.Sprintf("%s: expected OP_JMP as next instruction, found %s", op, i2.GetOpCode()))
+					runError(s, "%s: expected OP_JMP as next instruction, found %s", op, i2.GetOpCode())
 				} else {
-					s.OpCodeDebug = append(s.OpCodeDebug, i2.GetOpCode())
+					if s.HookMask != 0 {
+						hookInstr(s, s.CI.PC)
+					}
 					doJump(s, i2.GetArgs(s), 1)
 				}
 			}
-			fmt.Printf("%-10sA=%v RK(B)=%v RK(C)=%v\n", op, args.Ax, *args.B, *args.C)
 
 		case types.OP_TEST:
 			// A C | if not (R(A) <=> C) then pc++
@@ -295,13 +451,14 @@ newFrame:
 				s.CI.PC++
 			} else {
 				if i2 := s.CI.Cl.P.Code[s.CI.PC]; i2.GetOpCode() != types.OP_JMP {
-					panic(fmt.Sprintf("%s: expected OP_JMP as next instruction, found %s", op, i2.GetOpCode()))
+					runError(s, "%s: expected OP_JMP as next instruction, found %s", op, i2.GetOpCode())
 				} else {
-					s.OpCodeDebug = append(s.OpCodeDebug, i2.GetOpCode())
+					if s.HookMask != 0 {
+						hookInstr(s, s.CI.PC)
+					}
 					doJump(s, i2.GetArgs(s), 1)
 				}
 			}
-			fmt.Printf("%-10sR(A)=%v C=%v\n", op, *args.A, args.Cx)
 
 		case types.OP_TESTSET:
 			// A B C | if (R(B) <=> C) then R(A) := R(B) else pc++
@@ -310,13 +467,14 @@ newFrame:
 			} else {
 				*args.A = *args.B
 				if i2 := s.CI.Cl.P.Code[s.CI.PC]; i2.GetOpCode() != types.OP_JMP {
-					panic(fmt.Sprintf("%s: expected OP_JMP as next instruction, found %s", op, i2.GetOpCode()))
+					runError(s, "%s: expected OP_JMP as next instruction, found %s", op, i2.GetOpCode())
 				} else {
-					s.OpCodeDebug = append(s.OpCodeDebug, i2.GetOpCode())
+					if s.HookMask != 0 {
+						hookInstr(s, s.CI.PC)
+					}
 					doJump(s, i2.GetArgs(s), 1)
 				}
 			}
-			fmt.Printf("%-10sR(A)=%v R(B)=%v C=%v\n", op, *args.A, *args.B, args.Cx)
 
 		case types.OP_CALL:
 			// A B C | R(A), ... ,R(A+C-2) := R(A)(R(A+1), ... ,R(A+B-1))
@@ -330,39 +488,55 @@ newFrame:
 			}
 			// Else, it is because last param to this call was a func call with unknown
 			// number of results, so this call actually set the Top to whatever it had to be.
-			if preCall(s, args, nRets) {
-				// TODO : What to do if Go Func call?
+			if preCall(s, s.CI.Base+args.Ax, nRets) {
+				// Go function, its results are on the stack. Unless all results are
+				// kept for the next instruction, restore the top of the frame.
+				if nRets >= 0 {
+					s.Top = s.CI.Top
+				}
 			} else {
-				fmt.Printf("%-10sR(A)=%v B=%v C=%v\n", op, *args.A, args.Bx, args.Cx)
+				// The called function runs on this same loop
+				s.CI.CallStatus |= types.CIST_REENTRY
 				goto newFrame
 			}
 
 		case types.OP_TAILCALL:
-			panic("TAILCALL: not implemented")
+			// A B C | return R(A)(R(A+1), ... ,R(A+B-1))
+			// C is always 0, all results of the called function are returned. The
+			// called Lune function replaces the current frame instead of using a new one.
+			if asBool(args.Bx) {
+				s.Top = s.CI.Base + args.Ax + args.Bx
+			}
+			// For a Go function, the results are on the stack, ready for the RETURN
+			// that follows.
+			if !preCall(s, s.CI.Base+args.Ax, types.LUNE_MULTRET) {
+				tailCall(s)
+				goto newFrame
+			}
 
 		case types.OP_RETURN:
 			// A B | return R(A), ... ,R(A+B-2)
-			// TODO : Test coroutines!
 			if asBool(args.Bx) {
 				s.Top = s.CI.Base + args.Ax + args.Bx - 1
 			}
 			if len(s.CI.Cl.P.Protos) > 0 {
-				closeUpvalues(s, s.CI.Base+args.Ax)
+				closeUpvalues(s, s.CI.Base)
 			}
+			ci := s.CI
 			args.Bx = posCall(s, s.CI.Base+args.Ax)
 
-			if s.CI == nil {
-				// TODO : Is this equivalent to Lua's check of CIST_REENTRY?
-				fmt.Printf("%s\n", op)
+			if ci.CallStatus&types.CIST_REENTRY == 0 {
+				// Not called from this loop (entry point or metamethod), return
+				// to the caller of execute
 				return
 			} else {
 				if asBool(args.Bx) {
-					// TODO : Set Top back to CI.Top? I don't have a CI.Top! Do I need a CI.Top? Probably!
+					// A fixed number of results was expected, restore the top of the frame
+					s.Top = s.CI.Top
 				}
 				if prevOp := s.CI.Cl.P.Code[s.CI.PC-1].GetOpCode(); prevOp != types.OP_CALL {
-					panic(fmt.Sprintf("expected CALL to be previous instruction in RETURNed frame, got %s", prevOp))
+					runError(s, "expected CALL to be previous instruction in RETURNed frame, got %s", prevOp)
 				}
-				fmt.Printf("%-10sR(A)=%v B=%v\n", op, *args.A, args.Bx)
 				goto newFrame
 			}
 
@@ -377,25 +551,26 @@ newFrame:
 				*args.A = idx
 				s.CI.Frame[args.Ax+3] = idx
 			}
-			fmt.Printf("%-10sR(A)=%v sBx=%v\n", op, *args.A, args.Bx)
 
 		case types.OP_FORPREP:
 			// A sBx | R(A)-=R(A+2); pc+=sBx
 			init, ok := coerceToNumber(*args.A)
 			if !ok {
-				panic(fmt.Sprintf("%s: initial value must be a number", op))
+				runError(s, "'for' initial value must be a number")
 			}
-			_, ok = coerceToNumber(s.CI.Frame[args.Ax+1])
+			limit, ok := coerceToNumber(s.CI.Frame[args.Ax+1])
 			if !ok {
-				panic(fmt.Sprintf("%s: limit must be a number", op))
+				runError(s, "'for' limit must be a number")
 			}
 			step, ok := coerceToNumber(s.CI.Frame[args.Ax+2])
 			if !ok {
-				panic(fmt.Sprintf("%s: step must be a number", op))
+				runError(s, "'for' step must be a number")
 			}
+			// OP_FORLOOP expects numbers, store the converted strings
+			s.CI.Frame[args.Ax+1] = limit
+			s.CI.Frame[args.Ax+2] = step
 			*args.A = init - step
 			s.CI.PC += args.Bx
-			fmt.Printf("%-10sR(A)=%v sBx=%v\n", op, *args.A, args.Bx)
 
 		case types.OP_TFORCALL:
 			// A C | R(A+3), ... ,R(A+2+C) := R(A)(R(A+1), R(A+2));
@@ -404,20 +579,21 @@ newFrame:
 			s.CI.Frame[callBase+1] = s.CI.Frame[args.Ax+1]
 			s.CI.Frame[callBase] = s.CI.Frame[args.Ax]
 			s.Top = s.CI.Base + callBase + 3 // Func + 2 args (state and index)
-			// TODO : luaD_call(s, cb, args.Cx, 1)
-			// TODO: s.Top = s.CI.Top
+			call(s, s.CI.Base+callBase, args.Cx)
+			s.Top = s.CI.Top
 
 			// Fallthrough to the TFORLOOP, which must always follow a TFORCALL
 			i = s.CI.Cl.P.Code[s.CI.PC]
 			op = i.GetOpCode()
-			s.OpCodeDebug = append(s.OpCodeDebug, op)
+			if s.HookMask != 0 {
+				hookInstr(s, s.CI.PC)
+			}
 			if op != types.OP_TFORLOOP {
-				panic(fmt.Sprintf("OP_TFORCALL: expected OP_TFORLOOP as next instruction, found %s", op))
+				runError(s, "OP_TFORCALL: expected OP_TFORLOOP as next instruction, found %s", op)
 			}
 			// Consume instruction
 			s.CI.PC++
 			args = i.GetArgs(s)
-			fmt.Printf("%-10sA=%v C=%v\n", op, args.Ax, args.Cx)
 			fallthrough // *** explicit FALLTHROUGH
 
 		case types.OP_TFORLOOP:
@@ -426,7 +602,6 @@ newFrame:
 				*args.A = s.CI.Frame[args.Ax+1]
 				s.CI.PC += args.Bx
 			}
-			fmt.Printf("%-10sR(A)=%v sBx=%v\n", op, *args.A, args.Bx)
 
 		case types.OP_SETLIST:
 			// A B C | R(A)[(C-1)*FPF+i] := R(A+i), 1 <= i <= B
@@ -435,7 +610,7 @@ newFrame:
 			// size is denoted by FPF. FPF is “fields per flush”, with a value of 50.
 			// For example, for array locations 1 to 20, C will be 1 and B will be 20.
 			var c, n int
-			var t types.Table
+			var t *types.Table
 			var ok bool
 
 			if n = args.Bx; n == 0 {
@@ -445,58 +620,61 @@ newFrame:
 			if c = args.Cx; c == 0 {
 				// Use the following EXTRAARG instruction to get the value
 				if i2 := s.CI.Cl.P.Code[s.CI.PC]; i2.GetOpCode() != types.OP_EXTRAARG {
-					panic(fmt.Sprintf("%s: expected OP_EXTRAARG as next instruction, found %s", op, i2.GetOpCode()))
+					runError(s, "%s: expected OP_EXTRAARG as next instruction, found %s", op, i2.GetOpCode())
 				} else {
 					s.CI.PC++
-					s.OpCodeDebug = append(s.OpCodeDebug, i2.GetOpCode())
+					if s.HookMask != 0 {
+						hookInstr(s, s.CI.PC-1)
+					}
 					c = i2.GetArgAx()
 				}
 			}
-			if t, ok = (*args.A).(types.Table); !ok {
-				panic(fmt.Sprintf("%s: expected R(A) to be a Table", op))
+			if t, ok = (*args.A).(*types.Table); !ok {
+				runError(s, "%s: expected R(A) to be a Table", op)
 			}
 			last := ((c - 1) * types.LFIELDS_PER_FLUSH) + n
-			// TODO : Can optimize Table's array allocation here
-			/*
-				if last > t.ArraySize() {
-				}
-			*/
-			// Array portion of Lua's tables are 1-indexed, NOT 0!
+			// Pre-allocate the array part
+			t.ResizeArray(last)
+			// Array portion of Lua's tables are 1-indexed, NOT 0! The values may
+			// go past the frame if they come from a multiple results call.
+			ra := s.CI.Base + args.Ax
 			for ; n > 0; n-- {
-				t.Set(last, s.CI.Frame[args.Ax+n])
+				t.Set(last, s.Stack[ra+n])
 				last--
 			}
-			// TODO : Damn CI.Top...
-			//s.Top = s.CI.Top
-			fmt.Printf("%-10sR(A)=%v B=%v C=%v\n", op, *args.A, args.Bx, args.Cx)
+			s.Top = s.CI.Top
 
 		case types.OP_CLOSURE:
 			// A Bx | R(A) := closure(KPROTO[Bx])
 			p := s.CI.Cl.P.Protos[args.Bx]
 			// TODO : Optimize by caching closures, see getcached() in lvm.c
 			pushClosure(s, p, args.A)
-			fmt.Printf("%-10sR(A)=%v Bx=%v\n", op, *args.A, args.Bx)
+			checkGC(s)
 
 		case types.OP_VARARG:
 			// A B | R(A), R(A+1), ..., R(A+B-2) = vararg
+			// The extra arguments are stored below the base, after the function and
+			// before the copied fixed parameters. B=0 means all of them, up to the new
+			// top of the stack, possibly past the frame.
 			b := args.Bx - 1
 			n := s.CI.Base - s.CI.FuncIndex - int(s.CI.Cl.P.Meta.NumParams) - 1
+			ra := s.CI.Base + args.Ax
 			if b < 0 {
 				b = n
-				s.CheckStack(byte(n))
-				s.Top = s.CI.Base + args.Ax + n
+				s.Top = ra
+				s.CheckStack(n)
+				s.Top = ra + n
 			}
 			for j := 0; j < b; j++ {
 				if j < n {
-					s.CI.Frame[args.Ax+j] = s.CI.Frame[s.CI.Base-n+j]
+					s.Stack[ra+j] = s.Stack[s.CI.Base-n+j]
 				} else {
-					s.CI.Frame[args.Ax+j] = nil
+					s.Stack[ra+j] = nil
 				}
 			}
-			fmt.Printf("%-10sA=%v B=%v\n", op, args.Ax, args.Bx)
 
 		default:
-			panic(fmt.Sprintf("%s: unexpected opcode", op))
+			runError(s, "%s: unexpected opcode", op)
 		}
 	}
 }
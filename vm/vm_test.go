@@ -1,22 +1,31 @@
 package vm
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
+	"weak"
 
+	"github.com/mna/lune/compiler"
 	"github.com/mna/lune/serializer"
 	"github.com/mna/lune/types"
 )
 
+// Expected content of a table, compared key by key with the actual *types.Table
+type tbl map[types.Value]types.Value
+
 // Definition of an end to end test case
 type end2endTest struct {
 	name    string
 	context string
 	opcodes []types.OpCode
 	stack   []types.Value
-	globals types.Table
+	globals tbl
 	top     int
 }
 
@@ -27,7 +36,7 @@ var (
 			"",
 			[]types.OpCode{types.OP_SETTABUP, types.OP_RETURN},
 			[]types.Value{nil},
-			types.Table{"a": 6.0},
+			tbl{"a": 6.0},
 			0,
 		},
 		end2endTest{
@@ -35,7 +44,7 @@ var (
 			"",
 			[]types.OpCode{types.OP_LOADK, types.OP_MUL, types.OP_SETTABUP, types.OP_RETURN},
 			[]types.Value{nil, 10.5, 21.0},
-			types.Table{"b": 21.0},
+			tbl{"b": 21.0},
 			0,
 		},
 		end2endTest{
@@ -43,7 +52,7 @@ var (
 			"",
 			[]types.OpCode{types.OP_LOADK, types.OP_DIV, types.OP_TESTSET, types.OP_SUB, types.OP_RETURN},
 			[]types.Value{nil, 7.0, 3.5, 3.5},
-			types.Table{},
+			tbl{},
 			0,
 		},
 		end2endTest{
@@ -60,7 +69,7 @@ var (
 				types.OP_RETURN,
 			},
 			[]types.Value{nil, false, nil},
-			types.Table{
+			tbl{
 				"a": true,
 				"b": false,
 			},
@@ -81,8 +90,8 @@ var (
 				types.OP_RETURN,
 			},
 			[]types.Value{nil, 12.0},
-			types.Table{
-				"a": types.Table{"test": 6.0},
+			tbl{
+				"a": tbl{"test": 6.0},
 				"b": 12.0,
 			},
 			0,
@@ -96,7 +105,7 @@ var (
 				types.OP_RETURN,
 			},
 			[]types.Value{nil, "I come from down in the valley", 30.0},
-			types.Table{},
+			tbl{},
 			0,
 		},
 		end2endTest{
@@ -114,8 +123,8 @@ var (
 				types.OP_SETTABUP,
 				types.OP_RETURN,
 			},
-			[]types.Value{nil, -1.0, 10.0, -1.0},
-			types.Table{"hello": someClosure, "b": -1.0},
+			[]types.Value{nil, 2.0, 10.0, 2.0}, // -10 % 3 is 2 in Lua, the sign of the divisor
+			tbl{"hello": someClosure, "b": 2.0},
 			0,
 		},
 		end2endTest{
@@ -191,7 +200,7 @@ var (
 				types.OP_RETURN,
 			},
 			[]types.Value{nil, 3.0},
-			types.Table{"fib": someClosure, "a": 3.0},
+			tbl{"fib": someClosure, "a": 3.0},
 			0,
 		},
 		end2endTest{
@@ -211,7 +220,7 @@ var (
 				types.OP_RETURN,
 			},
 			[]types.Value{nil, 0.0, 0.0},
-			types.Table{"fib": someClosure, "a": 0.0},
+			tbl{"fib": someClosure, "a": 0.0},
 			0,
 		},
 		end2endTest{
@@ -245,7 +254,7 @@ var (
 				types.OP_RETURN,
 			},
 			[]types.Value{nil, 1.0, 2.0, 1.0, 0.0},
-			types.Table{"fib": someClosure, "a": 1.0},
+			tbl{"fib": someClosure, "a": 1.0},
 			0,
 		},
 		end2endTest{
@@ -293,7 +302,7 @@ var (
 				types.OP_RETURN,
 			},
 			[]types.Value{nil, 2.0},
-			types.Table{"fib": someClosure, "a": 2.0},
+			tbl{"fib": someClosure, "a": 2.0},
 			0,
 		},
 		end2endTest{
@@ -306,7 +315,7 @@ var (
 				types.OP_RETURN,
 			},
 			[]types.Value{nil, 10.0, "12", 22.0},
-			types.Table{},
+			tbl{},
 			0,
 		},
 		end2endTest{
@@ -322,7 +331,7 @@ var (
 				types.OP_RETURN,
 			},
 			[]types.Value{nil, "test", "some", "testsome", "test", "some"},
-			types.Table{},
+			tbl{},
 			0,
 		},
 		end2endTest{
@@ -339,7 +348,7 @@ var (
 				types.OP_RETURN,
 			},
 			[]types.Value{nil, "test", "some", "testsome14", "test", "some", 14.0},
-			types.Table{},
+			tbl{},
 			0,
 		},
 		end2endTest{
@@ -358,7 +367,7 @@ var (
 				types.OP_RETURN,
 			},
 			[]types.Value{nil, "test", "some", "testsomeugly123.4514", "test", "some", "ugly", 123.45, 14.0},
-			types.Table{},
+			tbl{},
 			0,
 		},
 		end2endTest{
@@ -374,7 +383,7 @@ var (
 				types.OP_RETURN,
 			},
 			[]types.Value{nil, 12.0, false, true},
-			types.Table{},
+			tbl{},
 			0,
 		},
 		end2endTest{
@@ -385,7 +394,7 @@ var (
 				types.OP_RETURN,
 			},
 			[]types.Value{nil, nil, nil, nil},
-			types.Table{},
+			tbl{},
 			0,
 		},
 		end2endTest{
@@ -406,8 +415,8 @@ var (
 				types.OP_SETTABUP,
 				types.OP_RETURN,
 			},
-			[]types.Value{nil, 6.0, types.Table{"add": someClosure}, 5.0, 6.0},
-			types.Table{"o": types.Table{"add": someClosure}, "a": 6.0},
+			[]types.Value{nil, 6.0, tbl{"add": someClosure}, 5.0, 6.0},
+			tbl{"o": tbl{"add": someClosure}, "a": 6.0},
 			0,
 		},
 		end2endTest{
@@ -425,7 +434,7 @@ var (
 				types.OP_RETURN,
 			},
 			[]types.Value{nil, 11.0, -17.0},
-			types.Table{"a": 17.0, "b": 11.0},
+			tbl{"a": 17.0, "b": 11.0},
 			0,
 		},
 		end2endTest{
@@ -443,7 +452,195 @@ var (
 				types.OP_RETURN,
 			},
 			[]types.Value{nil, 4.0, -4.0},
-			types.Table{"a": " 4  ", "b": 4.0},
+			tbl{"a": " 4  ", "b": 4.0},
+			0,
+		},
+		end2endTest{
+			"t21",
+			"",
+			[]types.OpCode{
+				types.OP_CLOSURE,
+				types.OP_SETTABUP,
+				types.OP_GETTABUP,
+				types.OP_CALL,
+				types.OP_LOADK, // c1, n=0
+				types.OP_CLOSURE,
+				types.OP_RETURN,
+				types.OP_GETTABUP,
+				types.OP_CALL,
+				types.OP_LOADK, // c2, n=0
+				types.OP_CLOSURE,
+				types.OP_RETURN,
+				types.OP_MOVE,
+				types.OP_CALL,
+				types.OP_GETUPVAL, // c1, n=0
+				types.OP_ADD,
+				types.OP_SETUPVAL, // c1, n=1
+				types.OP_GETUPVAL,
+				types.OP_RETURN,
+				types.OP_MOVE,
+				types.OP_CALL,
+				types.OP_GETUPVAL, // c1, n=1
+				types.OP_ADD,
+				types.OP_SETUPVAL, // c1, n=2
+				types.OP_GETUPVAL,
+				types.OP_RETURN,
+				types.OP_MOVE,
+				types.OP_CALL,
+				types.OP_GETUPVAL, // c1, n=2
+				types.OP_ADD,
+				types.OP_SETUPVAL, // c1, n=3
+				types.OP_GETUPVAL,
+				types.OP_RETURN,
+				types.OP_SETTABUP,
+				types.OP_MOVE,
+				types.OP_CALL,
+				types.OP_GETUPVAL, // c2, n=0
+				types.OP_ADD,
+				types.OP_SETUPVAL, // c2, n=1
+				types.OP_GETUPVAL,
+				types.OP_RETURN,
+				types.OP_SETTABUP,
+				types.OP_RETURN,
+			},
+			[]types.Value{nil, someClosure, someClosure, 1.0},
+			tbl{"counter": someClosure, "a": 3.0, "b": 1.0},
+			0,
+		},
+		end2endTest{
+			"t22",
+			"",
+			[]types.OpCode{
+				types.OP_CLOSURE,
+				types.OP_SETTABUP,
+				types.OP_CLOSURE,
+				types.OP_SETTABUP,
+				types.OP_GETTABUP,
+				types.OP_CALL,
+				types.OP_LOADK,   // make, v=1
+				types.OP_CLOSURE, // get
+				types.OP_CLOSURE, // set, shares v with get
+				types.OP_MOVE,
+				types.OP_MOVE,
+				types.OP_RETURN, // v is closed
+				types.OP_MOVE,
+				types.OP_LOADK,
+				types.OP_CALL,
+				types.OP_SETUPVAL, // set, v=42
+				types.OP_RETURN,
+				types.OP_MOVE,
+				types.OP_CALL,
+				types.OP_GETUPVAL, // get, v=42
+				types.OP_RETURN,
+				types.OP_SETTABUP,
+				types.OP_GETTABUP,
+				types.OP_CALL,
+				types.OP_LOADK,   // open, v=1
+				types.OP_CLOSURE, // inc
+				types.OP_MOVE,
+				types.OP_CALL,
+				types.OP_GETUPVAL, // inc, v=1, still open
+				types.OP_ADD,
+				types.OP_SETUPVAL, // inc, v=2
+				types.OP_RETURN,
+				types.OP_MOVE,
+				types.OP_CALL,
+				types.OP_GETUPVAL, // inc, v=2
+				types.OP_ADD,
+				types.OP_SETUPVAL, // inc, v=3
+				types.OP_RETURN,
+				types.OP_RETURN, // open, returns the local v=3
+				types.OP_SETTABUP,
+				types.OP_RETURN,
+			},
+			[]types.Value{nil, someClosure, someClosure, 3.0},
+			tbl{"make": someClosure, "open": someClosure, "a": 42.0, "b": 3.0},
+			0,
+		},
+		end2endTest{
+			"t23",
+			"",
+			[]types.OpCode{
+				types.OP_NEWTABLE,
+				types.OP_LOADK,
+				types.OP_LOADK,
+				types.OP_LOADK,
+				types.OP_FORPREP,
+				types.OP_FORLOOP, // i=1
+				types.OP_MUL,
+				types.OP_CLOSURE,
+				types.OP_SETTABLE,
+				types.OP_JMP,     // close i and j
+				types.OP_FORLOOP, // i=2
+				types.OP_MUL,
+				types.OP_CLOSURE,
+				types.OP_SETTABLE,
+				types.OP_JMP,
+				types.OP_FORLOOP, // i=3
+				types.OP_MUL,
+				types.OP_CLOSURE,
+				types.OP_SETTABLE,
+				types.OP_JMP,
+				types.OP_FORLOOP,
+				types.OP_GETTABLE,
+				types.OP_CALL,
+				types.OP_GETUPVAL, // i=1
+				types.OP_GETUPVAL, // j=10
+				types.OP_ADD,
+				types.OP_RETURN,
+				types.OP_SETTABUP,
+				types.OP_GETTABLE,
+				types.OP_CALL,
+				types.OP_GETUPVAL, // i=2
+				types.OP_GETUPVAL, // j=20
+				types.OP_ADD,
+				types.OP_RETURN,
+				types.OP_SETTABUP,
+				types.OP_GETTABLE,
+				types.OP_CALL,
+				types.OP_GETUPVAL, // i=3
+				types.OP_GETUPVAL, // j=30
+				types.OP_ADD,
+				types.OP_RETURN,
+				types.OP_SETTABUP,
+				types.OP_RETURN,
+			},
+			[]types.Value{nil, tbl{1.0: someClosure, 2.0: someClosure, 3.0: someClosure}, 33.0},
+			tbl{"a": 11.0, "b": 22.0, "c": 33.0},
+			0,
+		},
+		end2endTest{
+			"t24",
+			"",
+			nil, // Too many to list, a million tail calls
+			[]types.Value{nil},
+			tbl{
+				"countdown": someClosure,
+				"isEven":    someClosure,
+				"isOdd":     someClosure,
+				"a":         1000000.0,
+				"b":         false,
+			},
+			0,
+		},
+		end2endTest{
+			"t30",
+			"",
+			nil,
+			[]types.Value{nil},
+			tbl{
+				"a": 3.0,
+				"b": 4.0,
+				"c": 6.0,
+				"d": 5.0,
+				"e": 100.0,
+				"f": 100.0,
+				"g": 2.0,
+				"h": "xy",
+				"i": 0.0,
+				"j": 60.0,
+				"k": 55.0,
+			},
 			0,
 		},
 	}
@@ -459,6 +656,19 @@ func TestEnd2End(t *testing.T) {
 	}
 }
 
+// Run all end to end test cases, compiled from their Lua source
+func TestEnd2EndSource(t *testing.T) {
+	for _, tc := range end2endCases {
+		s, err := compileTestCase(tc)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+		} else {
+			ops := executeTestCase(t, tc, s)
+			assertTestCase(t, tc, s, ops)
+		}
+	}
+}
+
 // Test a single end to end test case
 func testEnd2EndCase(t *testing.T, tc end2endTest) {
 	/*defer func() {
@@ -471,14 +681,750 @@ func testEnd2EndCase(t *testing.T, tc end2endTest) {
 	if err != nil {
 		t.Errorf("%s: %s", tc.name, err)
 	} else {
-		Execute(s)
-		assertTestCase(t, tc, s)
+		ops := executeTestCase(t, tc, s)
+		assertTestCase(t, tc, s, ops)
+	}
+}
+
+// Execute a test case, recording the executed opcodes with an instruction hook
+// for the cases that check them.
+func executeTestCase(t *testing.T, tc end2endTest, s *types.State) []types.OpCode {
+	var ops []types.OpCode
+	if tc.opcodes != nil {
+		s.SetHook(func(s *types.State, ar *types.Debug) {
+			ops = append(ops, s.CI.Cl.P.Code[ar.PC].GetOpCode())
+		}, types.LUNE_MASKINSTR, 0)
+	}
+	if err := Execute(s); err != nil {
+		t.Errorf("%s: %s", tc.name, err)
+	}
+	return ops
+}
+
+// Tail calls must reuse the caller's frame, the stack must not grow.
+func TestTailCallStack(t *testing.T) {
+	var tc end2endTest
+	for _, tc = range end2endCases {
+		if tc.name == "t24" {
+			break
+		}
+	}
+	s, err := loadTestCase(tc)
+	if err != nil {
+		t.Fatalf("%s: %s", tc.name, err)
+	}
+	executeTestCase(t, tc, s)
+	if l := len(s.Stack); l > 20 {
+		t.Errorf("%s: expected stack to stay small, got %d slots", tc.name, l)
+	}
+	assertGlobals(t, tc, s)
+}
+
+// Tail calls to Go functions return all their results.
+func TestTailCallGoFunc(t *testing.T) {
+	double := types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+		return []types.Value{in[0].(float64) * 2}
+	})
+	pair := types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+		return []types.Value{"x", "y"}
+	})
+	tc := end2endTest{
+		"t25",
+		"",
+		[]types.OpCode{
+			types.OP_CLOSURE,
+			types.OP_SETTABUP,
+			types.OP_CLOSURE,
+			types.OP_SETTABUP,
+			types.OP_GETTABUP,
+			types.OP_LOADK,
+			types.OP_CALL,
+			types.OP_GETTABUP, // f
+			types.OP_MOVE,
+			types.OP_TAILCALL, // double
+			types.OP_RETURN,
+			types.OP_SETTABUP,
+			types.OP_GETTABUP,
+			types.OP_CALL,
+			types.OP_GETTABUP, // g
+			types.OP_TAILCALL, // pair
+			types.OP_RETURN,
+			types.OP_SETTABUP,
+			types.OP_SETTABUP,
+			types.OP_RETURN,
+		},
+		nil,
+		tbl{
+			"f":      someClosure,
+			"g":      someClosure,
+			"double": double,
+			"pair":   pair,
+			"a":      42.0,
+			"b":      "x",
+			"c":      "y",
+		},
+		0,
+	}
+	s, err := loadTestCase(tc)
+	if err != nil {
+		t.Fatalf("%s: %s", tc.name, err)
+	}
+	s.Globals.Set("double", double)
+	s.Globals.Set("pair", pair)
+	ops := executeTestCase(t, tc, s)
+	assertTestCase(t, tc, s, ops)
+}
+
+// The table sizes of OP_NEWTABLE and OP_SETLIST are only hints, the huge
+// ones of a crafted chunk are not allocated up front.
+func TestTableSizeHints(t *testing.T) {
+	p := &types.Prototype{
+		Meta: &types.FuncMeta{MaxStackSize: 2},
+		Code: []types.Instruction{
+			types.NewInstrABC(types.OP_NEWTABLE, 0, types.MAXARG_B, types.MAXARG_C),
+			types.NewInstrABx(types.OP_LOADK, 1, 0),
+			types.NewInstrABC(types.OP_SETLIST, 0, 1, 0),
+			types.NewInstrAx(types.OP_EXTRAARG, types.MAXARG_Ax),
+			types.NewInstrABC(types.OP_RETURN, 0, 2, 0),
+		},
+		Ks:       []types.Value{"x"},
+		Upvalues: []*types.Upvalue{{Name: "_ENV", Instack: 1}},
+	}
+	s := types.NewState(p)
+	res, err := Run(s, s.Stack[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := float64((types.MAXARG_Ax-1)*types.LFIELDS_PER_FLUSH + 1)
+	if v := res[0].(*types.Table).Get(last); v != "x" {
+		t.Errorf("expected t[%.0f] to be %q, got %v", last, "x", v)
+	}
+}
+
+// Go functions required by the metamethods test cases.
+var (
+	setMetaTable = types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+		t := in[0].(*types.Table)
+		t.Meta, _ = in[1].(*types.Table)
+		return []types.Value{t}
+	})
+	typeName = types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+		return []types.Value{types.TypeOf(in[0]).String()}
+	})
+	strLen = types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+		return []types.Value{float64(len(in[0].(string)))}
+	})
+	strUpper = types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+		return []types.Value{strings.ToUpper(in[0].(string))}
+	})
+)
+
+// Metamethods are called for tables with a metatable, and for all strings
+// with the metatable set for the string type.
+func TestMetamethods(t *testing.T) {
+	cases := []end2endTest{
+		end2endTest{
+			"t26",
+			"",
+			nil,
+			nil,
+			tbl{
+				"setmetatable": setMetaTable,
+				"type":         typeName,
+				"a":            10.0,
+				"b":            2.0,
+				"c":            18.0,
+				"d":            1.5,
+				"e":            2.0,
+				"f":            16.0,
+				"g":            -6.0,
+				"h":            60.0,
+				"i":            "v=6",
+				"j":            "6!?",
+				"k":            9.0,
+				"l":            11.0,
+			},
+			0,
+		},
+		end2endTest{
+			"t27",
+			"",
+			nil,
+			nil,
+			tbl{
+				"setmetatable": setMetaTable,
+				"type":         typeName,
+				"a":            true,
+				"b":            true,
+				"c":            false,
+				"d":            true,
+				"e":            true,
+				"f":            true,
+				"g":            false,
+				"h":            true,
+				"i":            true,
+				"j":            false,
+			},
+			0,
+		},
+		end2endTest{
+			"t28",
+			"",
+			nil,
+			nil,
+			tbl{
+				"setmetatable": setMetaTable,
+				"type":         typeName,
+				"a":            "hello lune",
+				"b":            "derived",
+				"c":            "base",
+				"d":            "foo?",
+				"e":            12.0,
+				"g":            3.0,
+			},
+			0,
+		},
+		end2endTest{
+			"t29",
+			"",
+			nil,
+			nil,
+			tbl{
+				"setmetatable": setMetaTable,
+				"type":         typeName,
+				"a":            4.0,
+				"b":            "ABC",
+			},
+			0,
+		},
+	}
+
+	strMeta := types.NewTable(0, 0)
+	strIndex := types.NewTable(0, 0)
+	strIndex.Set("len", strLen)
+	strIndex.Set("upper", strUpper)
+	strMeta.Set("__index", strIndex)
+
+	for _, tc := range cases {
+		s, err := loadTestCase(tc)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		s.Globals.Set("setmetatable", setMetaTable)
+		s.Globals.Set("type", typeName)
+		s.MetaTables[types.TSTRING] = strMeta
+		ops := executeTestCase(t, tc, s)
+		assertTestCase(t, tc, s, ops)
+	}
+}
+
+// Go function for the variable arguments test cases, a minimal select.
+var selectArgs = types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+	if in[0] == "#" {
+		return []types.Value{float64(len(in) - 1)}
+	}
+	return in[int(in[0].(float64)):]
+})
+
+// Variable arguments and multiple results are passed along by calls, returns
+// and table constructors.
+func TestVarargs(t *testing.T) {
+	cases := []end2endTest{
+		end2endTest{
+			"t31",
+			"",
+			nil,
+			nil,
+			tbl{
+				"select": selectArgs,
+				"a":      0.0,
+				"b":      3.0,
+				"c":      2.0,
+				"d":      2.0,
+				"f":      3.0,
+				"g":      6.0,
+				"h":      6.0,
+				"i":      2.0,
+			},
+			0,
+		},
+		end2endTest{
+			"t32",
+			"",
+			nil,
+			nil,
+			tbl{
+				"select": selectArgs,
+				"a":      1.0,
+				"b":      2.0,
+				"c":      3.0,
+				"d":      3.0,
+				"e":      4.0,
+				"f":      1.0,
+				"g":      3.0,
+				"h":      0.0,
+				"i":      2.0,
+				"j":      3.0,
+				"k":      4.0,
+				"l":      4.0,
+			},
+			0,
+		},
+		end2endTest{
+			"t33",
+			"",
+			nil,
+			nil,
+			tbl{
+				"select": selectArgs,
+				"a":      300.0,
+				"b":      300.0,
+				"c":      1.0,
+				"d":      300.0,
+				"e":      300.0,
+			},
+			0,
+		},
+	}
+
+	for _, tc := range cases {
+		for _, load := range []func(end2endTest) (*types.State, error){loadTestCase, compileTestCase} {
+			s, err := load(tc)
+			if err != nil {
+				t.Errorf("%s: %s", tc.name, err)
+				continue
+			}
+			s.Globals.Set("select", selectArgs)
+			ops := executeTestCase(t, tc, s)
+			assertTestCase(t, tc, s, ops)
+		}
+	}
+}
+
+// Hooks are called for function calls and returns, new lines and every count
+// instructions.
+func TestHooks(t *testing.T) {
+	tc := end2endTest{"t34", "", nil, nil, tbl{"a": 4.0}, 0}
+	s, err := loadTestCase(tc)
+	if err != nil {
+		t.Fatalf("%s: %s", tc.name, err)
+	}
+	var events []string
+	s.SetHook(func(s *types.State, ar *types.Debug) {
+		if ar.Event == types.LUNE_HOOKLINE {
+			events = append(events, fmt.Sprintf("%s %d", ar.Event, ar.CurrentLine))
+		} else {
+			events = append(events, ar.Event.String())
+		}
+	}, types.LUNE_MASKCALL|types.LUNE_MASKRET|types.LUNE_MASKLINE, 0)
+	executeTestCase(t, tc, s)
+	assertGlobals(t, tc, s)
+
+	expected := []string{
+		"call", "line 4", "line 7", "line 8", "line 9",
+		"line 10", "call", "line 3", "return",
+		"line 9", "line 10", "call", "line 3", "return",
+		"line 9", "line 12", "call", "line 6", "tail call", "line 3", "return",
+		"return",
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d: %v", len(expected), len(events), events)
+	}
+	for i, ev := range expected {
+		if events[i] != ev {
+			t.Errorf("expected event %d to be %q, got %q", i, ev, events[i])
+		}
+	}
+
+	// Count events, and the instructions as printed by the trace hook
+	var count int
+	s, _ = loadTestCase(tc)
+	s.SetHook(func(s *types.State, ar *types.Debug) { count++ }, types.LUNE_MASKCOUNT, 5)
+	executeTestCase(t, tc, s)
+	// 25 instructions in the main function, 4 in inc and 2 for each call of add
+	const nInstr = 25 + 4 + 3*2
+	if count != nInstr/5 {
+		t.Errorf("expected %d count events, got %d", nInstr/5, count)
+	}
+
+	var buf bytes.Buffer
+	s, _ = loadTestCase(tc)
+	s.SetHook(NewTraceHook(&buf), types.LUNE_MASKINSTR, 0)
+	executeTestCase(t, tc, s)
+	if l := strings.Count(buf.String(), "instruction\t"); l != nInstr {
+		t.Errorf("expected %d traced instructions, got %d", nInstr, l)
+	}
+}
+
+// Runtime errors stop the execution and are returned by Execute, with the
+// position of the failing instruction. Functions can then be called from Go.
+func TestRuntimeErrors(t *testing.T) {
+	tc := end2endTest{"t35", "", nil, nil, tbl{"f": someClosure, "g": someClosure, "a": 5.0}, 0}
+	for _, load := range []func(end2endTest) (*types.State, error){loadTestCase, compileTestCase} {
+		s, err := load(tc)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		const msg = "t35.lua:4: attempt to index a nil value"
+		err = Execute(s)
+		if re, ok := err.(*RuntimeError); !ok || re.Value != msg {
+			t.Errorf("%s: expected runtime error %q, got %v", tc.name, msg, err)
+		}
+		if s.CI != nil || s.Top != 0 {
+			t.Errorf("%s: expected state to be reset, got top %d", tc.name, s.Top)
+		}
+		assertGlobals(t, tc, s)
+
+		// The message handler runs on the stack of the failing function
+		var where string
+		handler := types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+			where = Where(s, 1)
+			return []types.Value{"handled: " + in[0].(string)}
+		})
+		if _, err := PCall(s, s.Globals.Get("f"), []types.Value{1.0}, handler); err == nil {
+			t.Errorf("%s: expected an error from f", tc.name)
+		} else if err.Error() != "handled: "+msg {
+			t.Errorf("%s: expected the handler's message, got %q", tc.name, err)
+		}
+		if where != "t35.lua:4: " {
+			t.Errorf("%s: expected handler to see the failing function, got %q", tc.name, where)
+		}
+
+		res := Call(s, s.Globals.Get("g"), 4.0, 5.0)
+		if len(res) != 2 || res[0] != 9.0 || res[1] != 20.0 {
+			t.Errorf("%s: expected g to return 9, 20, got %v", tc.name, res)
+		}
+		if s.Top != 0 {
+			t.Errorf("%s: expected the results to be popped, got top %d", tc.name, s.Top)
+		}
+	}
+}
+
+// Errors returned by Execute have the traceback of the stack where they were
+// raised, with the names of the functions found from the calling instructions.
+func TestTraceback(t *testing.T) {
+	apply := types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+		return Call(s, in[0], in[1:]...)
+	})
+	tc := end2endTest{"t36", "", nil, nil, tbl{"main": someClosure, "apply": apply}, 0}
+	const msg = "t36.lua:5: attempt to index a boolean value"
+	const tb = `stack traceback:
+	t36.lua:5: in function 'f'
+	t36.lua:10: in function <t36.lua:9>
+	[Go]: in function 'apply'
+	t36.lua:14: in function 'main'
+	t36.lua:17: in main chunk`
+
+	for _, load := range []func(end2endTest) (*types.State, error){loadTestCase, compileTestCase} {
+		s, err := load(tc)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		s.Globals.Set("apply", apply)
+		err = Execute(s)
+		re, ok := err.(*RuntimeError)
+		if !ok || re.Value != msg {
+			t.Fatalf("%s: expected runtime error %q, got %v", tc.name, msg, err)
+		}
+		if re.Traceback != tb {
+			t.Errorf("%s: expected traceback\n%s\ngot\n%s", tc.name, tb, re.Traceback)
+		}
+		assertGlobals(t, tc, s)
+	}
+}
+
+// Threads can be resumed step by step from Go, and can yield from a Go
+// function called in a protected call.
+func TestThreads(t *testing.T) {
+	wait := types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+		return Yield(s, in...)
+	})
+	protect := types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+		res, err := PCall(s, in[0], in[1:], nil)
+		if err != nil {
+			return []types.Value{false, err.(*RuntimeError).Value}
+		}
+		return append([]types.Value{true}, res...)
+	})
+	tc := end2endTest{"t37", "", nil, nil, tbl{"worker": someClosure, "wait": wait, "pcall": protect}, 0}
+
+	for _, load := range []func(end2endTest) (*types.State, error){loadTestCase, compileTestCase} {
+		s, err := load(tc)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		s.Globals.Set("wait", wait)
+		s.Globals.Set("pcall", protect)
+		executeTestCase(t, tc, s)
+		assertGlobals(t, tc, s)
+
+		th := NewThread(s, s.Globals.Get("worker"))
+		args := []types.Value{"w", 3.0}
+		for i := 1; i <= 3; i++ {
+			res, err := Resume(s, th, args...)
+			if err != nil {
+				t.Fatalf("%s: resume %d: %s", tc.name, i, err)
+			}
+			if len(res) != 2 || res[0] != "w" || res[1] != float64(i) {
+				t.Errorf("%s: resume %d: expected w, %d to be yielded, got %v", tc.name, i, i, res)
+			}
+			if st := th.S.Status; st != types.THREAD_SUSPENDED {
+				t.Errorf("%s: resume %d: expected thread to be suspended, got %s", tc.name, i, st)
+			}
+			args = []types.Value{float64(i) * 10}
+		}
+		res, err := Resume(s, th, args...)
+		if err != nil || len(res) != 2 || res[0] != "w" || res[1] != 60.0 {
+			t.Errorf("%s: expected w, 60 to be returned, got %v, %v", tc.name, res, err)
+		}
+		if st := th.S.Status; st != types.THREAD_DEAD {
+			t.Errorf("%s: expected thread to be dead, got %s", tc.name, st)
+		}
+		if _, err := Resume(s, th); err == nil || err.Error() != "cannot resume dead coroutine" {
+			t.Errorf("%s: expected error for a dead thread, got %v", tc.name, err)
+		}
+
+		// Errors kill the thread and are returned by Resume
+		th = NewThread(s, s.Globals.Get("worker"))
+		Resume(s, th, "e", 2.0)
+		_, err = Resume(s, th, "x")
+		const msg = "t37.lua:6: attempt to perform arithmetic on a string value"
+		const tb = "stack traceback:\n\tt37.lua:6: in function <t37.lua:2>"
+		if re, ok := err.(*RuntimeError); !ok || re.Value != msg || re.Traceback != tb {
+			t.Errorf("%s: expected error %q with traceback %q, got %#v", tc.name, msg, tb, err)
+		}
+		if st := th.S.Status; st != types.THREAD_DEAD {
+			t.Errorf("%s: expected thread to be dead after an error, got %s", tc.name, st)
+		}
+	}
+}
+
+// The goroutine of a suspended thread stops once the thread is unreachable.
+func TestThreadCleanup(t *testing.T) {
+	wait := types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+		return Yield(s, in...)
+	})
+	s := types.NewState(&types.Prototype{Meta: &types.FuncMeta{}})
+	th := NewThread(s, wait)
+	if _, err := Resume(s, th); err != nil {
+		t.Fatal(err)
+	}
+	ch := th.S.ResumeCh
+	th = nil
+
+	// The goroutine is stopped by closing the channel it waits on
+	var closed bool
+	for i := 0; i < 100 && !closed; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+		select {
+		case _, ok := <-ch:
+			closed = !ok
+		default:
+		}
+	}
+	if !closed {
+		t.Errorf("expected the thread to be stopped once collected")
+	}
+}
+
+// The goroutine of a suspended thread that refers to itself stops once the
+// thread is unreachable from the state, after a full collection.
+func TestThreadCycleCleanup(t *testing.T) {
+	wait := func(s *types.State, in []types.Value) []types.Value {
+		return Yield(s, in...)
+	}
+	s := types.NewState(&types.Prototype{Meta: &types.FuncMeta{}})
+	newThread := func() *types.Thread {
+		f := types.NewGoClosure(wait, nil)
+		th := NewThread(s, f)
+		f.UpVals[0] = th // The thread is reachable from its own stack
+		if _, err := Resume(s, th); err != nil {
+			t.Fatal(err)
+		}
+		return th
+	}
+	s.Globals.Set("kept", newThread())
+	dropped := weak.Make(newThread().S)
+
+	// The state of the thread is collected once its goroutine has exited
+	FullGC(s)
+	var exited bool
+	for i := 0; i < 100 && !exited; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+		exited = dropped.Value() == nil
+	}
+	if !exited {
+		t.Errorf("expected the goroutine of the unreachable thread to exit")
+	}
+	if _, err := Resume(s, s.Globals.Get("kept").(*types.Thread)); err != nil {
+		t.Errorf("expected the reachable thread to be resumed, got %s", err)
+	}
+}
+
+// The list of threads of a state doesn't grow with the threads that are
+// dead or unreachable, and their goroutines stop without a full collection.
+func TestThreadList(t *testing.T) {
+	wait := func(s *types.State, in []types.Value) []types.Value {
+		return Yield(s, in...)
+	}
+	s := types.NewState(&types.Prototype{Meta: &types.FuncMeta{}})
+	newThread := func(f types.Value) *types.Thread {
+		th := NewThread(s, f)
+		if _, err := Resume(s, th); err != nil {
+			t.Fatal(err)
+		}
+		return th
+	}
+	kept := newThread(types.NewGoClosure(wait))
+	s.Globals.Set("kept", kept)
+	first := types.NewGoClosure(wait, nil)
+	first.UpVals[0] = newThread(first)
+	dropped := weak.Make(first.UpVals[0].(*types.Thread).S)
+	first = nil
+
+	for i := 0; i < 1000; i++ {
+		if i%2 == 0 {
+			// Dead once resumed
+			newThread(types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+				return nil
+			}))
+		} else {
+			// Suspended, reachable from its own stack
+			f := types.NewGoClosure(wait, nil)
+			f.UpVals[0] = newThread(f)
+		}
+		if l := len(s.Threads); l > 16 {
+			t.Fatalf("expected the list of threads to stay small, got %d threads", l)
+		}
+	}
+
+	var exited bool
+	for i := 0; i < 100 && !exited; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+		exited = dropped.Value() == nil
+	}
+	if !exited {
+		t.Errorf("expected the goroutine of the unreachable thread to exit")
+	}
+	if _, err := Resume(s, kept); err != nil {
+		t.Errorf("expected the reachable thread to be resumed, got %s", err)
+	}
+}
+
+// Go value wrapped in userdata by the userdata test cases.
+type point struct {
+	x float64
+}
+
+// Userdata dispatch their metamethods like tables, using their own metatable.
+func TestUserdata(t *testing.T) {
+	x := func(v types.Value) float64 {
+		return v.(*types.Userdata).Value.(*point).x
+	}
+	mt := types.NewTable(0, 0)
+	mt.Set("__index", types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+		return []types.Value{x(in[0])}
+	}))
+	mt.Set("__newindex", types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+		in[0].(*types.Userdata).Value.(*point).x = in[2].(float64)
+		return nil
+	}))
+	mt.Set("__add", types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+		return []types.Value{x(in[0]) + x(in[1])}
+	}))
+	mt.Set("__eq", types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+		return []types.Value{x(in[0]) == x(in[1])}
+	}))
+	mt.Set("__lt", types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+		return []types.Value{x(in[0]) < x(in[1])}
+	}))
+	mt.Set("__len", types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+		return []types.Value{42.0}
+	}))
+	mt.Set("__concat", types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+		return []types.Value{fmt.Sprintf("p(%g)%s", x(in[0]), in[1])}
+	}))
+	mt.Set("__call", types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+		return []types.Value{x(in[0]) * in[1].(float64)}
+	}))
+
+	var p1 int
+	l1, l2, l3 := types.LightUserdata{Value: &p1}, types.LightUserdata{Value: &p1}, types.LightUserdata{Value: new(int)}
+	tc := end2endTest{"t38", "", nil, nil, tbl{
+		"a": 3.0, "b": 10.0, "c": 12.0, "d": true, "e": true, "f": true,
+		"g": 42.0, "h": "p(10)!", "i": 50.0, "j": true, "k": false,
+		"l1": l1, "l2": l2, "l3": l3,
+	}, 0}
+
+	for _, load := range []func(end2endTest) (*types.State, error){loadTestCase, compileTestCase} {
+		s, err := load(tc)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		for i, x := range []float64{1, 2, 10} {
+			u := types.NewUserdata(&point{x})
+			s.SetMetaTable(u, mt)
+			s.Globals.Set(fmt.Sprintf("p%d", i+1), u)
+			if s.MetaTable(u) != mt || types.TypeOf(u) != types.TUSERDATA {
+				t.Errorf("%s: expected userdata p%d with its metatable", tc.name, i+1)
+			}
+		}
+		s.Globals.Set("l1", l1)
+		s.Globals.Set("l2", l2)
+		s.Globals.Set("l3", l3)
+		executeTestCase(t, tc, s)
+
+		// Remove the userdata before comparing the globals
+		for _, k := range []string{"p1", "p2", "p3"} {
+			s.Globals.Set(k, nil)
+		}
+		assertGlobals(t, tc, s)
+	}
+}
+
+// The __gc metamethod of a collected userdata is called by the VM.
+func TestUserdataGC(t *testing.T) {
+	p, err := compiler.Compile(strings.NewReader("local t = {}"), "=gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := types.NewState(p)
+	var collected []types.Value
+	mt := types.NewTable(0, 0)
+	mt.Set("__gc", types.NewGoClosure(func(s *types.State, in []types.Value) []types.Value {
+		collected = append(collected, in[0].(*types.Userdata).Value)
+		return nil
+	}))
+	func() {
+		s.SetMetaTable(types.NewUserdata("a"), mt)
+		// Not marked for finalization, __gc is added after the metatable is set
+		u := types.NewUserdata("b")
+		s.SetMetaTable(u, types.NewTable(0, 0))
+		s.MetaTable(u).Set("__gc", mt.Get("__gc"))
+	}()
+
+	for i := 0; i < 100 && !s.Finalizers.Pending(); i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(collected) != 0 {
+		t.Fatalf("expected finalizers to wait for the VM, got %v", collected)
+	}
+	if err := Execute(s); err != nil {
+		t.Fatal(err)
+	}
+	if len(collected) != 1 || collected[0] != "a" {
+		t.Errorf("expected userdata a to be finalized, got %v", collected)
 	}
 }
 
 // Assert the expected results for a test case
-func assertTestCase(t *testing.T, tc end2endTest, s *types.State) {
-	assertOpcodes(t, tc, s)
+func assertTestCase(t *testing.T, tc end2endTest, s *types.State, ops []types.OpCode) {
+	assertOpcodes(t, tc, ops)
 	assertStack(t, tc, s)
 	assertGlobals(t, tc, s)
 }
@@ -514,32 +1460,44 @@ func assertGlobals(t *testing.T, tc end2endTest, s *types.State) {
 }
 
 func assertValues(t *testing.T, tc end2endTest, vEx types.Value, vAc types.Value) {
+	if tEx, ok := vEx.(tbl); ok {
+		// Tables are compared by content
+		if tAc, ok := vAc.(*types.Table); !ok {
+			t.Errorf("%s: expected %s value to be a table, got type %T", tc.name, tc.context, vAc)
+		} else {
+			assertTables(t, tc, tEx, tAc)
+		}
+		return
+	}
 	typeEx, typeAc := reflect.TypeOf(vEx), reflect.TypeOf(vAc)
 	// From reflect package's doc for String(): To test for equality, compare the Types directly.
 	if typeEx != typeAc {
 		t.Errorf("%s: expected %s value to be of type %s, got type %s", tc.name, tc.context, typeEx, typeAc)
 	} else {
 		// Same type, compare value
-		if typeEx != nil && typeEx.Kind() == reflect.Map {
-			// Maps are uncomparable, must use assertTables
-			assertTables(t, tc, vEx.(types.Table), vAc.(types.Table))
-		} else if vEx == someClosure {
+		if vEx == someClosure {
 			// Special case for closures, no deep compare, just the fact
 			// that both are closures is ok.
+		} else if typeEx != nil && typeEx.Kind() == reflect.Func {
+			// Go functions are uncomparable, same type is ok.
 		} else if vEx != vAc {
 			t.Errorf("%s: expected %s value to be %v, got %v", tc.name, tc.context, vEx, vAc)
 		}
 	}
 }
 
-func assertTables(t *testing.T, tc end2endTest, tEx types.Table, tAc types.Table) {
-	if lEx, lAc := tEx.Len(), tAc.Len(); lEx != lAc {
+func assertTables(t *testing.T, tc end2endTest, tEx tbl, tAc *types.Table) {
+	lAc := 0
+	tAc.ForEach(func(_, _ types.Value) {
+		lAc++
+	})
+	if lEx := len(tEx); lEx != lAc {
 		t.Errorf("%s: expected %s table size to be %d, got %d", tc.name, tc.context, lEx, lAc)
 	} else {
 		ori := tc.context
 		for kEx, vEx := range tEx {
-			vAc, ok := tAc[kEx]
-			if !ok {
+			vAc := tAc.Get(kEx)
+			if vAc == nil {
 				t.Errorf("%s: expected %s key %v to exist in table", tc.name, tc.context, kEx)
 			} else {
 				tc.context = fmt.Sprintf("%s.%v", ori, kEx)
@@ -548,22 +1506,26 @@ func assertTables(t *testing.T, tc end2endTest, tEx types.Table, tAc types.Table
 		}
 
 		// Now look for unexpected keys in actual table
-		for kAc, _ := range tAc {
+		tAc.ForEach(func(kAc, _ types.Value) {
 			if _, ok := tEx[kAc]; !ok {
 				t.Errorf("%s: unexpected %s key %v in table", tc.name, tc.context, kAc)
 			}
-		}
+		})
 	}
 }
 
 // Assert the executed opcodes
-func assertOpcodes(t *testing.T, tc end2endTest, s *types.State) {
-	if lEx, lAc := len(tc.opcodes), len(s.OpCodeDebug); lEx != lAc {
+func assertOpcodes(t *testing.T, tc end2endTest, ops []types.OpCode) {
+	if tc.opcodes == nil {
+		// Not checked for this test case
+		return
+	}
+	if lEx, lAc := len(tc.opcodes), len(ops); lEx != lAc {
 		t.Errorf("%s: expected %d opcodes executed, got %d", tc.name, lEx, lAc)
 	} else {
 		// Same size, check values
 		for i, opEx := range tc.opcodes {
-			opAc := s.OpCodeDebug[i]
+			opAc := ops[i]
 			if opEx != opAc {
 				t.Errorf("%s: expected opcode %s at position %d, got %s", tc.name, opEx, i, opAc)
 			}
@@ -585,3 +1547,18 @@ func loadTestCase(tc end2endTest) (*types.State, error) {
 	}
 	return types.NewState(p), nil
 }
+
+// Compile a test case from its Lua source
+func compileTestCase(tc end2endTest) (*types.State, error) {
+	f, err := os.Open(fmt.Sprintf("./testdata/%s.lua", tc.name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p, err := compiler.Compile(f, fmt.Sprintf("@%s.lua", tc.name))
+	if err != nil {
+		return nil, err
+	}
+	return types.NewState(p), nil
+}